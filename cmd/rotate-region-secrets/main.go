@@ -0,0 +1,81 @@
+// Command rotate-region-secrets re-encrypts the database secrets of every region with a new data
+// key under the current key. Keys of earlier rotations are passed with -previous-keys so the
+// stored secrets can still be decrypted.
+//
+//	rotate-region-secrets -db-server cluster0.example.net -db-user platform -db-name zaps-platform \
+//		-key-file /etc/zaps/keys/k2.key -previous-keys /etc/zaps/keys/k1.key
+//
+// The platform database secret is read from PLATFORM_DB_SECRET.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/zapscloud/golib-dbutils/db_common"
+	"github.com/zapscloud/golib-platform-service/platform_service"
+	"github.com/zapscloud/golib-utils/utils"
+)
+
+func main() {
+
+	dbServer := flag.String("db-server", "", "Platform database server")
+	dbUser := flag.String("db-user", "", "Platform database user")
+	dbName := flag.String("db-name", "", "Platform database name")
+	keyFile := flag.String("key-file", "", "File with the key to encrypt with")
+	previousKeys := flag.String("previous-keys", "", "Comma separated files with earlier keys")
+	flag.Parse()
+
+	if *dbServer == "" || *dbName == "" || *keyFile == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	currentKey, err := platform_service.NewKeyFileProvider(*keyFile)
+	if err != nil {
+		log.Fatalln("Key file error ", err)
+	}
+	previous := []platform_service.SettingKeyProvider{}
+	for _, previousFile := range strings.Split(*previousKeys, ",") {
+		if strings.TrimSpace(previousFile) == "" {
+			continue
+		}
+		previousKey, err := platform_service.NewKeyFileProvider(strings.TrimSpace(previousFile))
+		if err != nil {
+			log.Fatalln("Key file error ", err)
+		}
+		previous = append(previous, previousKey)
+	}
+	keyRing := platform_service.NewKeyRingProvider(currentKey, previous...)
+	platform_service.SetRegionKeyProvider(platform_service.NewLocalRegionKeyProvider(keyRing))
+
+	props := utils.Map{
+		db_common.DB_TYPE:   db_common.DATABASE_TYPE_MONGODB,
+		db_common.DB_SERVER: *dbServer,
+		db_common.DB_USER:   *dbUser,
+		db_common.DB_SECRET: os.Getenv("PLATFORM_DB_SECRET"),
+		db_common.DB_NAME:   *dbName,
+	}
+
+	regionService, err := platform_service.NewRegionService(props)
+	if err != nil {
+		log.Fatalln("Platform database error ", err)
+	}
+	defer regionService.EndService()
+
+	result, err := regionService.RotateSecrets()
+	if err != nil {
+		log.Fatalln("Rotation failed ", err)
+	}
+
+	output, _ := json.MarshalIndent(result, "", "  ")
+	log.Println("Rotation result ", string(output))
+
+	if failed, _ := result[platform_service.FLD_REGION_FAILED].([]utils.Map); len(failed) > 0 {
+		regionService.EndService()
+		os.Exit(1)
+	}
+}
@@ -3,15 +3,22 @@ module github.com/zapscloud/golib-platform-service
 go 1.20
 
 require (
+	github.com/go-sql-driver/mysql v1.6.0
 	github.com/rs/xid v1.5.0
 	github.com/zapscloud/golib-dbutils v1.1.1-0.20240411045611-812596eed546
 	github.com/zapscloud/golib-utils v1.0.1-0.20231226111345-99b9295b391e
+	go.mongodb.org/mongo-driver v1.16.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
+// HOLD: this service needs a golib-platform-repository release which is not published yet.
+// The pinned version lacks SysAccessRequestDao, AccessReviewDao (with its item methods), SiteDao,
+// DepartmentDao, SysSettingOverrideDao, SysSettingVersionDao, FeatureFlagDao,
+// AppRoleDao/SysRoleDao RemoveCredentials, RemoveUsers and ListUsers, and BusinessDao.UserList.
+// Bump the version below to the first release providing them before tagging this module.
 require github.com/zapscloud/golib-platform-repository v0.0.0-20240706073001-a4098576c15a
 
 require (
-	github.com/go-sql-driver/mysql v1.6.0 // indirect
 	github.com/golang/snappy v0.0.4 // indirect
 	github.com/jmoiron/sqlx v1.3.4 // indirect
 	github.com/klauspost/compress v1.16.3 // indirect
@@ -21,7 +28,6 @@ require (
 	github.com/xdg-go/stringprep v1.0.4 // indirect
 	github.com/youmark/pkcs8 v0.0.0-20201027041543-1326539a0a0a // indirect
 	github.com/zapscloud/golib v1.0.4 // indirect
-	go.mongodb.org/mongo-driver v1.16.0 // indirect
 	golang.org/x/crypto v0.22.0 // indirect
 	golang.org/x/sync v0.7.0 // indirect
 	golang.org/x/text v0.14.0 // indirect
@@ -0,0 +1,678 @@
+package platform_service
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/zapscloud/golib-dbutils/db_common"
+	"github.com/zapscloud/golib-dbutils/db_utils"
+	"github.com/zapscloud/golib-platform-repository/platform_common"
+	"github.com/zapscloud/golib-platform-repository/platform_repository"
+	"github.com/zapscloud/golib-utils/utils"
+)
+
+// Access review campaign fields
+const (
+	FLD_ACCESS_REVIEW_ID      = "access_review_id"
+	FLD_REVIEW_NAME           = "review_name"
+	FLD_REVIEW_SCOPE          = "review_scope"
+	FLD_REVIEW_ROLE_TYPE      = "role_type"
+	FLD_REVIEW_ROLE_ID        = "role_id"
+	FLD_REVIEW_REVIEWER_IDS   = "reviewer_ids"
+	FLD_REVIEW_DUE_AT         = "due_at"
+	FLD_REVIEW_AUTO_REVOKE    = "is_auto_revoke"
+	FLD_REVIEW_STATUS         = "review_status"
+	FLD_REVIEW_CREATED_BY     = "created_by"
+	FLD_REVIEW_CLOSED_BY      = "closed_by"
+	FLD_REVIEW_CLOSED_AT      = "closed_at"
+	FLD_REVIEW_SUMMARY        = "summary"
+	FLD_REVIEW_ITEMS          = "items"
+	FLD_REVIEW_ITEM_ID        = "review_item_id"
+	FLD_REVIEW_ITEM_TYPE      = "item_type"
+	FLD_REVIEW_USER_ID        = "user_id"
+	FLD_REVIEW_DECISION       = "decision"
+	FLD_REVIEW_REVIEWER_ID    = "reviewer_id"
+	FLD_REVIEW_REVIEWED_AT    = "reviewed_at"
+	FLD_REVIEW_COMMENT        = "comment"
+	FLD_REVIEW_IS_AUTO_ACTION = "is_auto_action"
+	FLD_REVIEW_REVOKE_ERROR   = "revoke_error"
+
+	REVIEW_SCOPE_BUSINESS = "business"
+	REVIEW_SCOPE_ROLE     = "role"
+
+	REVIEW_STATUS_OPEN   = "open"
+	REVIEW_STATUS_CLOSED = "closed"
+
+	REVIEW_ITEM_SYS_ACCESS = "sys_access"
+	REVIEW_ITEM_APP_ROLE   = "app_role"
+
+	REVIEW_DECISION_PENDING   = "pending"
+	REVIEW_DECISION_CONFIRMED = "confirmed"
+	REVIEW_DECISION_REVOKED   = "revoked"
+
+	REVIEW_REPORT_FORMAT_JSON = "json"
+	REVIEW_REPORT_FORMAT_CSV  = "csv"
+)
+
+// AccessReviewService - Periodic review campaigns over access grants and app role assignments
+type AccessReviewService interface {
+	// Campaigns
+	CreateCampaign(indata utils.Map) (utils.Map, error)
+	GetCampaign(review_id string) (utils.Map, error)
+	ListCampaigns(filter string, sort string, skip int64, limit int64) (utils.Map, error)
+	CloseCampaign(review_id string, closed_by string) (utils.Map, error)
+	// Close the open campaigns whose due date has passed
+	CloseDueCampaigns() (utils.Map, error)
+
+	// Items of a campaign
+	ListItems(review_id string, filter string, sort string, skip int64, limit int64) (utils.Map, error)
+	ReviewItem(review_id string, item_id string, reviewer_id string, decision string, comment string) (utils.Map, error)
+
+	// Report of a closed campaign as json or csv
+	ExportReport(review_id string, format string) ([]byte, error)
+
+	BeginTransaction()
+	CommitTransaction()
+	RollbackTransaction()
+
+	EndService()
+}
+
+type accessReviewBaseService struct {
+	db_utils.DatabaseService
+	daoReview    platform_repository.AccessReviewDao
+	daoSysAccess platform_repository.SysAccessDao
+	daoSysRole   platform_repository.SysRoleDao
+	daoAppRole   platform_repository.AppRoleDao
+	daoBusiness  platform_repository.BusinessDao
+	child        AccessReviewService
+	businessID   string
+}
+
+func init() {
+	log.SetFlags(log.Lshortfile | log.LstdFlags | log.Lmicroseconds)
+}
+
+func NewAccessReviewService(props utils.Map) (AccessReviewService, error) {
+	funcode := platform_common.GetServiceModuleCode() + "M" + "01"
+
+	p := accessReviewBaseService{}
+
+	// Open Database Service
+	err := p.OpenDatabaseService(props)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Verify whether the business id data passed
+	businessId, err := utils.GetMemberDataStr(props, platform_common.FLD_BUSINESS_ID)
+	if err != nil {
+		p.CloseDatabaseService()
+		return nil, err
+	}
+
+	// Assign the BusinessId
+	p.businessID = businessId
+	log.Printf("AccessReviewMongoService ")
+
+	p.daoReview = platform_repository.NewAccessReviewDao(p.GetClient(), p.businessID)
+	p.daoSysAccess = platform_repository.NewSysAccessDao(p.GetClient(), p.businessID)
+	p.daoSysRole = platform_repository.NewSysRoleDao(p.GetClient())
+	p.daoAppRole = platform_repository.NewAppRoleDao(p.GetClient())
+	p.daoBusiness = platform_repository.NewBusinessDao(p.GetClient())
+
+	_, err = p.daoBusiness.Get(businessId)
+	if err != nil {
+		err := &utils.AppError{ErrorCode: funcode + "01", ErrorMsg: "Invalid sys_business_id", ErrorDetail: "Given sys_business_id is not exist"}
+		return nil, err
+	}
+
+	p.child = &p
+
+	return &p, err
+}
+
+// EndService - Close all the services
+func (p *accessReviewBaseService) EndService() {
+	log.Printf("EndAccessReviewService ")
+	p.CloseDatabaseService()
+}
+
+func (p *accessReviewBaseService) getServiceModuleCode() string {
+	return platform_common.GetServiceModuleCode() + "09"
+}
+
+// CreateCampaign - Create a campaign and snapshot the entries to review. A business campaign covers
+// every access grant of the business and the app role assignments of its users, a role campaign
+// covers the grants or assignments of one sys role or app role.
+func (p *accessReviewBaseService) CreateCampaign(indata utils.Map) (utils.Map, error) {
+
+	funcode := p.getServiceModuleCode() + "01"
+
+	log.Println("AccessReviewService::CreateCampaign - Begin", indata)
+
+	reviewName, err := utils.GetMemberDataStr(indata, FLD_REVIEW_NAME)
+	if err != nil {
+		return indata, err
+	}
+
+	scope, _ := utils.GetMemberDataStr(indata, FLD_REVIEW_SCOPE)
+	if scope == "" {
+		scope = REVIEW_SCOPE_BUSINESS
+	}
+
+	roleType, roleId := "", ""
+	switch scope {
+	case REVIEW_SCOPE_BUSINESS:
+	case REVIEW_SCOPE_ROLE:
+		roleType, _ = utils.GetMemberDataStr(indata, FLD_REVIEW_ROLE_TYPE)
+		roleId, _ = utils.GetMemberDataStr(indata, FLD_REVIEW_ROLE_ID)
+		if roleId == "" || (roleType != ROLE_TYPE_SYS && roleType != ROLE_TYPE_APP) {
+			err := &utils.AppError{ErrorCode: funcode + "01", ErrorMsg: "Missing role", ErrorDetail: "Role campaigns need " + FLD_REVIEW_ROLE_ID + " and " + FLD_REVIEW_ROLE_TYPE + " as " + ROLE_TYPE_SYS + " or " + ROLE_TYPE_APP}
+			return indata, err
+		}
+	default:
+		err := &utils.AppError{ErrorCode: funcode + "02", ErrorMsg: "Invalid scope", ErrorDetail: FLD_REVIEW_SCOPE + " should be " + REVIEW_SCOPE_BUSINESS + " or " + REVIEW_SCOPE_ROLE}
+		return indata, err
+	}
+
+	dueAt, err := getMemberDataTime(indata, FLD_REVIEW_DUE_AT)
+	if err != nil || !dueAt.After(time.Now()) {
+		err := &utils.AppError{ErrorCode: funcode + "03", ErrorMsg: "Invalid due date", ErrorDetail: FLD_REVIEW_DUE_AT + " should be a future RFC3339 date time"}
+		return indata, err
+	}
+
+	items, err := p.collectReviewItems(roleType, roleId)
+	if err != nil {
+		return indata, err
+	}
+
+	reviewerIds := getStringList(indata[FLD_REVIEW_REVIEWER_IDS])
+	if len(reviewerIds) == 0 {
+		err := &utils.AppError{ErrorCode: funcode + "04", ErrorMsg: "Missing reviewers", ErrorDetail: "Campaigns need at least one of " + FLD_REVIEW_REVIEWER_IDS}
+		return indata, err
+	}
+
+	autoRevoke, _ := utils.GetMemberDataBool(indata, FLD_REVIEW_AUTO_REVOKE)
+	createdBy, _ := utils.GetMemberDataStr(indata, FLD_REVIEW_CREATED_BY)
+
+	reviewId := utils.GenerateUniqueId("arvw")
+	dataReview := utils.Map{
+		FLD_ACCESS_REVIEW_ID:            reviewId,
+		platform_common.FLD_BUSINESS_ID: p.businessID,
+		FLD_REVIEW_NAME:                 reviewName,
+		FLD_REVIEW_SCOPE:                scope,
+		FLD_REVIEW_ROLE_TYPE:            roleType,
+		FLD_REVIEW_ROLE_ID:              roleId,
+		FLD_REVIEW_REVIEWER_IDS:         reviewerIds,
+		FLD_REVIEW_DUE_AT:               dueAt,
+		FLD_REVIEW_AUTO_REVOKE:          autoRevoke,
+		FLD_REVIEW_CREATED_BY:           createdBy,
+		FLD_REVIEW_STATUS:               REVIEW_STATUS_OPEN,
+	}
+
+	err = runInTransaction(&p.DatabaseService, func() error {
+		var err error
+		dataReview, err = p.daoReview.Create(dataReview)
+		if err != nil {
+			return err
+		}
+		if len(items) > 0 {
+			_, err = p.daoReview.CreateItems(reviewId, items)
+		}
+		return err
+	})
+	if err != nil {
+		return indata, err
+	}
+	dataReview[FLD_REVIEW_SUMMARY] = summarizeReviewItems(items)
+
+	log.Println("AccessReviewService::CreateCampaign - End ", reviewId, len(items))
+	return dataReview, nil
+}
+
+// GetCampaign - Get the campaign with the count of items per decision
+func (p *accessReviewBaseService) GetCampaign(review_id string) (utils.Map, error) {
+	log.Println("AccessReviewService::GetCampaign - Begin", review_id)
+
+	dataReview, err := p.daoReview.Get(review_id)
+	if err != nil {
+		return nil, err
+	}
+
+	dataItems, err := p.daoReview.ListItems(review_id, "", "", 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	dataReview[FLD_REVIEW_SUMMARY] = summarizeReviewItems(getListResult(dataItems))
+
+	log.Println("AccessReviewService::GetCampaign - End ")
+	return dataReview, nil
+}
+
+// ListCampaigns - List the campaigns of this business
+func (p *accessReviewBaseService) ListCampaigns(filter string, sort string, skip int64, limit int64) (utils.Map, error) {
+	log.Println("AccessReviewService::ListCampaigns - Begin")
+
+	data, err := p.daoReview.List(filter, sort, skip, limit)
+
+	log.Println("AccessReviewService::ListCampaigns - End ", err)
+	return data, err
+}
+
+// ListItems - List the entries of the campaign
+func (p *accessReviewBaseService) ListItems(review_id string, filter string, sort string, skip int64, limit int64) (utils.Map, error) {
+	log.Println("AccessReviewService::ListItems - Begin", review_id)
+
+	data, err := p.daoReview.ListItems(review_id, filter, sort, skip, limit)
+
+	log.Println("AccessReviewService::ListItems - End ", err)
+	return data, err
+}
+
+// ReviewItem - Confirm or revoke an entry of an open campaign. Revoking removes the access right away.
+func (p *accessReviewBaseService) ReviewItem(review_id string, item_id string, reviewer_id string, decision string, comment string) (utils.Map, error) {
+
+	funcode := p.getServiceModuleCode() + "02"
+
+	log.Println("AccessReviewService::ReviewItem - Begin", review_id, item_id, reviewer_id, decision)
+
+	if decision != REVIEW_DECISION_CONFIRMED && decision != REVIEW_DECISION_REVOKED {
+		err := &utils.AppError{ErrorCode: funcode + "01", ErrorMsg: "Invalid decision", ErrorDetail: "Decision should be " + REVIEW_DECISION_CONFIRMED + " or " + REVIEW_DECISION_REVOKED}
+		return nil, err
+	}
+
+	dataReview, err := p.getOpenCampaign(review_id, funcode)
+	if err != nil {
+		return nil, err
+	}
+
+	// Campaigns without reviewers cannot be reviewed by anyone
+	reviewerIds := getStringList(dataReview[FLD_REVIEW_REVIEWER_IDS])
+	isReviewer := false
+	for _, reviewerId := range reviewerIds {
+		isReviewer = isReviewer || reviewerId == reviewer_id
+	}
+	if !isReviewer {
+		err := &utils.AppError{ErrorCode: funcode + "02", ErrorMsg: "Invalid reviewer", ErrorDetail: "Given reviewer is not assigned to the campaign"}
+		return nil, err
+	}
+
+	dataItem, err := p.daoReview.GetItem(review_id, item_id)
+	if err != nil {
+		return nil, err
+	}
+
+	if userId, _ := utils.GetMemberDataStr(dataItem, FLD_REVIEW_USER_ID); userId == reviewer_id {
+		err := &utils.AppError{ErrorCode: funcode + "03", ErrorMsg: "Invalid reviewer", ErrorDetail: "Reviewers cannot review their own access"}
+		return nil, err
+	}
+
+	if itemDecision, _ := utils.GetMemberDataStr(dataItem, FLD_REVIEW_DECISION); itemDecision != REVIEW_DECISION_PENDING {
+		err := &utils.AppError{ErrorCode: funcode + "04", ErrorMsg: "Already reviewed", ErrorDetail: "Review item is already " + itemDecision}
+		return nil, err
+	}
+
+	var dataRes utils.Map
+	err = runInTransaction(&p.DatabaseService, func() error {
+		var err error
+		dataRes, err = p.decideReviewItem(review_id, dataItem, decision, reviewer_id, comment, false)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Println("AccessReviewService::ReviewItem - End ")
+	return dataRes, nil
+}
+
+// CloseCampaign - Close the campaign. Unreviewed entries are revoked when the campaign has
+// auto revoke enabled, otherwise they stay pending in the report. An entry which cannot be
+// revoked stays pending with the error recorded, so it does not keep the campaign open.
+func (p *accessReviewBaseService) CloseCampaign(review_id string, closed_by string) (utils.Map, error) {
+
+	funcode := p.getServiceModuleCode() + "03"
+
+	log.Println("AccessReviewService::CloseCampaign - Begin", review_id, closed_by)
+
+	dataReview, err := p.getOpenCampaign(review_id, funcode)
+	if err != nil {
+		return nil, err
+	}
+
+	autoRevoke, _ := utils.GetMemberDataBool(dataReview, FLD_REVIEW_AUTO_REVOKE)
+
+	var dataRes utils.Map
+	err = runInTransaction(&p.DatabaseService, func() error {
+		if autoRevoke {
+			filter := buildFilter(utils.Map{FLD_REVIEW_DECISION: REVIEW_DECISION_PENDING})
+			dataItems, err := p.daoReview.ListItems(review_id, filter, "", 0, 0)
+			if err != nil {
+				return err
+			}
+			for _, dataItem := range getListResult(dataItems) {
+				_, errRevoke := p.decideReviewItem(review_id, dataItem, REVIEW_DECISION_REVOKED, closed_by, "Not reviewed before the campaign closed", true)
+				if errRevoke == nil {
+					continue
+				}
+				log.Println("CloseCampaign:: Unable to revoke review item ", dataItem[FLD_REVIEW_ITEM_ID], errRevoke)
+				itemId, _ := utils.GetMemberDataStr(dataItem, FLD_REVIEW_ITEM_ID)
+				dataUpdate := utils.Map{
+					FLD_REVIEW_REVOKE_ERROR:   errRevoke.Error(),
+					FLD_REVIEW_IS_AUTO_ACTION: true,
+				}
+				if _, err := p.daoReview.UpdateItem(review_id, itemId, dataUpdate); err != nil {
+					return err
+				}
+			}
+		}
+
+		dataItems, err := p.daoReview.ListItems(review_id, "", "", 0, 0)
+		if err != nil {
+			return err
+		}
+
+		dataUpdate := utils.Map{
+			FLD_REVIEW_STATUS:    REVIEW_STATUS_CLOSED,
+			FLD_REVIEW_CLOSED_BY: closed_by,
+			FLD_REVIEW_CLOSED_AT: time.Now(),
+			FLD_REVIEW_SUMMARY:   summarizeReviewItems(getListResult(dataItems)),
+		}
+		dataRes, err = p.daoReview.Update(review_id, dataUpdate)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Println("AccessReviewService::CloseCampaign - End ")
+	return dataRes, nil
+}
+
+// CloseDueCampaigns - Close the open campaigns past their due date. Meant to be called periodically,
+// returns the campaigns that were closed.
+func (p *accessReviewBaseService) CloseDueCampaigns() (utils.Map, error) {
+
+	log.Println("AccessReviewService::CloseDueCampaigns - Begin")
+
+	filter := buildFilter(utils.Map{FLD_REVIEW_STATUS: REVIEW_STATUS_OPEN})
+	dataReviews, err := p.daoReview.List(filter, "", 0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	curTime := time.Now()
+	closedIds := []string{}
+	for _, dataReview := range getListResult(dataReviews) {
+		dueAt, err := getMemberDataTime(dataReview, FLD_REVIEW_DUE_AT)
+		if err != nil || curTime.Before(dueAt) {
+			continue
+		}
+		reviewId, _ := utils.GetMemberDataStr(dataReview, FLD_ACCESS_REVIEW_ID)
+		if _, err := p.CloseCampaign(reviewId, ACCESS_REQUEST_SYSTEM_USER); err != nil {
+			log.Println("CloseDueCampaigns:: Unable to close campaign ", reviewId, err)
+			continue
+		}
+		closedIds = append(closedIds, reviewId)
+	}
+
+	response := utils.Map{
+		db_common.LIST_RESULTSIZE: len(closedIds),
+		db_common.LIST_RESULT:     closedIds,
+	}
+
+	log.Println("AccessReviewService::CloseDueCampaigns - End ", closedIds)
+	return response, nil
+}
+
+// ExportReport - Export the campaign, its summary and every decision as evidence for auditors
+func (p *accessReviewBaseService) ExportReport(review_id string, format string) ([]byte, error) {
+
+	funcode := p.getServiceModuleCode() + "04"
+
+	log.Println("AccessReviewService::ExportReport - Begin", review_id, format)
+
+	dataReview, err := p.daoReview.Get(review_id)
+	if err != nil {
+		return nil, err
+	}
+
+	if status, _ := utils.GetMemberDataStr(dataReview, FLD_REVIEW_STATUS); status != REVIEW_STATUS_CLOSED {
+		err := &utils.AppError{ErrorCode: funcode + "01", ErrorMsg: "Campaign not closed", ErrorDetail: "Only closed campaigns can be exported"}
+		return nil, err
+	}
+
+	dataItems, err := p.daoReview.ListItems(review_id, "", "", 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	items := getListResult(dataItems)
+
+	var report []byte
+	switch strings.ToLower(format) {
+	case REVIEW_REPORT_FORMAT_JSON, "":
+		dataReview[FLD_REVIEW_ITEMS] = items
+		report, err = json.MarshalIndent(dataReview, "", "  ")
+	case REVIEW_REPORT_FORMAT_CSV:
+		report, err = buildReviewReportCsv(items)
+	default:
+		err = &utils.AppError{ErrorCode: funcode + "02", ErrorMsg: "Invalid format", ErrorDetail: "Report format should be " + REVIEW_REPORT_FORMAT_JSON + " or " + REVIEW_REPORT_FORMAT_CSV}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	log.Println("AccessReviewService::ExportReport - End ", len(items))
+	return report, nil
+}
+
+func (p *accessReviewBaseService) getOpenCampaign(review_id string, funcode string) (utils.Map, error) {
+
+	dataReview, err := p.daoReview.Get(review_id)
+	if err != nil {
+		return nil, err
+	}
+
+	if status, _ := utils.GetMemberDataStr(dataReview, FLD_REVIEW_STATUS); status != REVIEW_STATUS_OPEN {
+		err := &utils.AppError{ErrorCode: funcode + "09", ErrorMsg: "Campaign closed", ErrorDetail: "Access review campaign is already " + status}
+		return nil, err
+	}
+	return dataReview, nil
+}
+
+// decideReviewItem - Record the decision and remove the access when it is revoked
+func (p *accessReviewBaseService) decideReviewItem(review_id string, dataItem utils.Map, decision string, reviewer_id string, comment string, isAuto bool) (utils.Map, error) {
+
+	if decision == REVIEW_DECISION_REVOKED {
+		if err := p.revokeReviewItem(dataItem); err != nil {
+			return nil, err
+		}
+	}
+
+	itemId, _ := utils.GetMemberDataStr(dataItem, FLD_REVIEW_ITEM_ID)
+	dataUpdate := utils.Map{
+		FLD_REVIEW_DECISION:       decision,
+		FLD_REVIEW_REVIEWER_ID:    reviewer_id,
+		FLD_REVIEW_REVIEWED_AT:    time.Now(),
+		FLD_REVIEW_COMMENT:        comment,
+		FLD_REVIEW_IS_AUTO_ACTION: isAuto,
+	}
+	return p.daoReview.UpdateItem(review_id, itemId, dataUpdate)
+}
+
+func (p *accessReviewBaseService) revokeReviewItem(dataItem utils.Map) error {
+
+	itemType, _ := utils.GetMemberDataStr(dataItem, FLD_REVIEW_ITEM_TYPE)
+	switch itemType {
+	case REVIEW_ITEM_SYS_ACCESS:
+		accessId, _ := utils.GetMemberDataStr(dataItem, platform_common.FLD_SYS_ACCESS_ID)
+		_, err := p.daoSysAccess.RevokePermission(accessId)
+		return err
+
+	case REVIEW_ITEM_APP_ROLE:
+		// App roles are shared between businesses, only the assignment of a user of this business
+		// is removed. Others have to be removed from the app role itself.
+		roleId, _ := utils.GetMemberDataStr(dataItem, platform_common.FLD_APP_ROLE_ID)
+		userId, _ := utils.GetMemberDataStr(dataItem, FLD_REVIEW_USER_ID)
+		userIds, err := p.getBusinessUserIds()
+		if err != nil {
+			return err
+		}
+		for _, businessUserId := range userIds {
+			if businessUserId == userId {
+				_, err := p.daoAppRole.RemoveUsers(roleId, []string{userId})
+				return err
+			}
+		}
+		err = &utils.AppError{ErrorStatus: 400, ErrorMsg: "Not a business user", ErrorDetail: "User " + userId + " of app role " + roleId + " is not a user of this business"}
+		return err
+	}
+
+	err := &utils.AppError{ErrorStatus: 400, ErrorMsg: "Invalid item", ErrorDetail: "Unknown review item type " + itemType}
+	return err
+}
+
+// collectReviewItems - Snapshot the grants and assignments covered by the campaign
+func (p *accessReviewBaseService) collectReviewItems(roleType string, roleId string) ([]utils.Map, error) {
+
+	items := []utils.Map{}
+
+	if roleType == "" || roleType == ROLE_TYPE_SYS {
+		filter := ""
+		if roleId != "" {
+			if _, err := p.daoSysRole.Get(roleId); err != nil {
+				return nil, err
+			}
+			filter = buildFilter(utils.Map{platform_common.FLD_SYS_ROLE_ID: roleId})
+		}
+		dataGrants, err := p.daoSysAccess.List(filter, "", 0, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, grant := range getListResult(dataGrants) {
+			if isDeleted, _ := utils.GetMemberDataBool(grant, db_common.FLD_IS_DELETED); isDeleted {
+				continue
+			}
+			items = append(items, utils.Map{
+				FLD_REVIEW_ITEM_ID:                utils.GenerateUniqueId("arvi"),
+				FLD_REVIEW_ITEM_TYPE:              REVIEW_ITEM_SYS_ACCESS,
+				platform_common.FLD_SYS_ACCESS_ID: grant[platform_common.FLD_SYS_ACCESS_ID],
+				platform_common.FLD_SYS_ROLE_ID:   grant[platform_common.FLD_SYS_ROLE_ID],
+				FLD_REVIEW_USER_ID:                grant[platform_common.FLD_SYS_USER_ID],
+				FLD_APP_SITE_ID:                   grant[FLD_APP_SITE_ID],
+				FLD_APP_DEPT_ID:                   grant[FLD_APP_DEPT_ID],
+				FLD_SYS_ACCESS_EXPIRES_AT:         grant[FLD_SYS_ACCESS_EXPIRES_AT],
+				FLD_REVIEW_DECISION:               REVIEW_DECISION_PENDING,
+			})
+		}
+	}
+
+	if roleType == "" || roleType == ROLE_TYPE_APP {
+		// App roles are shared, so limit the business campaign to the users of the business
+		userIds, err := p.getBusinessUserIds()
+		if err != nil {
+			return nil, err
+		}
+		filter := utils.Map{platform_common.FLD_APP_USER_ID: utils.Map{"$in": userIds}}
+		if roleId != "" {
+			if _, err := p.daoAppRole.Get(roleId); err != nil {
+				return nil, err
+			}
+			filter[platform_common.FLD_APP_ROLE_ID] = roleId
+		}
+		dataUsers, err := p.daoAppRole.ListUsers(buildFilter(filter), "", 0, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, assignment := range getListResult(dataUsers) {
+			items = append(items, utils.Map{
+				FLD_REVIEW_ITEM_ID:              utils.GenerateUniqueId("arvi"),
+				FLD_REVIEW_ITEM_TYPE:            REVIEW_ITEM_APP_ROLE,
+				platform_common.FLD_APP_ROLE_ID: assignment[platform_common.FLD_APP_ROLE_ID],
+				FLD_REVIEW_USER_ID:              assignment[platform_common.FLD_APP_USER_ID],
+				platform_common.FLD_BUSINESS_ID: assignment[platform_common.FLD_BUSINESS_ID],
+				FLD_ROLE_USER_VALID_FROM:        assignment[FLD_ROLE_USER_VALID_FROM],
+				FLD_ROLE_USER_VALID_UNTIL:       assignment[FLD_ROLE_USER_VALID_UNTIL],
+				FLD_REVIEW_DECISION:             REVIEW_DECISION_PENDING,
+			})
+		}
+	}
+
+	return items, nil
+}
+
+func (p *accessReviewBaseService) getBusinessUserIds() ([]string, error) {
+
+	dataUsers, err := p.daoBusiness.UserList(p.businessID, "", "", 0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	userIds := []string{}
+	for _, dataUser := range getListResult(dataUsers) {
+		if userId, err := utils.GetMemberDataStr(dataUser, platform_common.FLD_APP_USER_ID); err == nil {
+			userIds = append(userIds, userId)
+		}
+	}
+	return userIds, nil
+}
+
+// summarizeReviewItems - Count the items per decision
+func summarizeReviewItems(items []utils.Map) utils.Map {
+	summary := utils.Map{
+		db_common.LIST_RESULTSIZE: len(items),
+		REVIEW_DECISION_PENDING:   0,
+		REVIEW_DECISION_CONFIRMED: 0,
+		REVIEW_DECISION_REVOKED:   0,
+	}
+	for _, item := range items {
+		decision, _ := utils.GetMemberDataStr(item, FLD_REVIEW_DECISION)
+		if count, ok := summary[decision].(int); ok {
+			summary[decision] = count + 1
+		}
+	}
+	return summary
+}
+
+func buildReviewReportCsv(items []utils.Map) ([]byte, error) {
+
+	columns := []string{
+		FLD_REVIEW_ITEM_ID, FLD_REVIEW_ITEM_TYPE, FLD_REVIEW_USER_ID,
+		platform_common.FLD_SYS_ROLE_ID, platform_common.FLD_APP_ROLE_ID, platform_common.FLD_SYS_ACCESS_ID,
+		FLD_APP_SITE_ID, FLD_APP_DEPT_ID, FLD_REVIEW_DECISION, FLD_REVIEW_REVIEWER_ID,
+		FLD_REVIEW_REVIEWED_AT, FLD_REVIEW_IS_AUTO_ACTION, FLD_REVIEW_COMMENT, FLD_REVIEW_REVOKE_ERROR,
+	}
+
+	var buffer bytes.Buffer
+	writer := csv.NewWriter(&buffer)
+	if err := writer.Write(columns); err != nil {
+		return nil, err
+	}
+
+	for _, item := range items {
+		record := make([]string, len(columns))
+		for idx, column := range columns {
+			switch value := item[column].(type) {
+			case nil:
+			case time.Time:
+				record[idx] = value.Format(time.RFC3339)
+			case interface{ Time() time.Time }:
+				record[idx] = value.Time().Format(time.RFC3339)
+			default:
+				record[idx] = fmt.Sprint(value)
+			}
+		}
+		if err := writer.Write(record); err != nil {
+			return nil, err
+		}
+	}
+
+	writer.Flush()
+	return buffer.Bytes(), writer.Error()
+}
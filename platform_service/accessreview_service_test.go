@@ -0,0 +1,91 @@
+package platform_service
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/zapscloud/golib-platform-repository/platform_common"
+	"github.com/zapscloud/golib-platform-repository/platform_repository"
+	"github.com/zapscloud/golib-utils/utils"
+)
+
+// fakeAppRoleDao - App role calls of the review answered by a fakeRoleDao
+type fakeAppRoleDao struct {
+	platform_repository.AppRoleDao
+	roleDao *fakeRoleDao
+}
+
+func (d *fakeAppRoleDao) Get(role_id string) (utils.Map, error) {
+	return d.roleDao.Get(role_id)
+}
+
+func (d *fakeAppRoleDao) ListUsers(filter string, sort string, skip int64, limit int64) (utils.Map, error) {
+	return d.roleDao.ListUsers(filter, sort, skip, limit)
+}
+
+func (d *fakeAppRoleDao) RemoveUsers(role_id string, user_ids []string) (int64, error) {
+	return d.roleDao.RemoveUsers(role_id, user_ids)
+}
+
+// newFakeReview - App role r1 assigned to a user of biz_1 and to a user of another business
+func newFakeReview() (*accessReviewBaseService, *fakeRoleDao) {
+
+	assignment := func(userId string) utils.Map {
+		return utils.Map{platform_common.FLD_APP_ROLE_ID: "r1", platform_common.FLD_APP_USER_ID: userId}
+	}
+	daoAppRole := &fakeRoleDao{
+		roles: map[string]utils.Map{"r1": {platform_common.FLD_APP_ROLE_ID: "r1"}},
+		users: map[string][]utils.Map{"r1": {assignment("u_own"), assignment("u_other")}},
+	}
+	daoBusiness := &fakeBusinessDao{users: []utils.Map{
+		{platform_common.FLD_BUSINESS_ID: "biz_1", platform_common.FLD_APP_USER_ID: "u_own"},
+		{platform_common.FLD_BUSINESS_ID: "biz_2", platform_common.FLD_APP_USER_ID: "u_other"},
+	}}
+	return &accessReviewBaseService{daoAppRole: &fakeAppRoleDao{roleDao: daoAppRole}, daoBusiness: daoBusiness, businessID: "biz_1"}, daoAppRole
+}
+
+func TestCollectReviewItems(t *testing.T) {
+
+	for _, roleId := range []string{"", "r1"} {
+		t.Run(fmt.Sprintf("role %q", roleId), func(t *testing.T) {
+			p, _ := newFakeReview()
+			items, err := p.collectReviewItems(ROLE_TYPE_APP, roleId)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(items) != 1 || items[0][FLD_REVIEW_USER_ID] != "u_own" {
+				t.Errorf("collectReviewItems() = %v, want only the assignment of u_own", items)
+			}
+		})
+	}
+}
+
+func TestRevokeReviewItem(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		userId    string
+		wantErr   bool
+		wantUsers int
+	}{
+		{"user of the business", "u_own", false, 1},
+		{"user of another business", "u_other", true, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, daoAppRole := newFakeReview()
+			dataItem := utils.Map{
+				FLD_REVIEW_ITEM_TYPE:            REVIEW_ITEM_APP_ROLE,
+				platform_common.FLD_APP_ROLE_ID: "r1",
+				FLD_REVIEW_USER_ID:              tt.userId,
+			}
+			if err := p.revokeReviewItem(dataItem); (err != nil) != tt.wantErr {
+				t.Fatalf("revokeReviewItem() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(daoAppRole.users["r1"]) != tt.wantUsers {
+				t.Errorf("app role r1 has %d users after the revoke, want %d", len(daoAppRole.users["r1"]), tt.wantUsers)
+			}
+		})
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"strings"
+	"time"
 
 	"github.com/rs/xid"
 	"github.com/zapscloud/golib-dbutils/db_utils"
@@ -19,15 +20,26 @@ type AppRoleService interface {
 	Find(filter string) (utils.Map, error)
 	Create(indata utils.Map) (utils.Map, error)
 	Update(role_id string, indata utils.Map) (utils.Map, error)
-	Delete(role_id string) error
+	Delete(role_id string, cascade bool) (utils.Map, error)
 
 	AddCredentials(role_id string, indata utils.Map) (utils.Map, error)
 	GetCredentials(role_id string) (utils.Map, error)
+	// Credentials of the role together with those inherited from its parent roles
+	GetEffectiveCredentials(role_id string) (utils.Map, error)
 	FindCredential(filter string) (utils.Map, error)
+	CheckCredential(role_id string, credential string, attributes utils.Map) (utils.Map, error)
+	RemoveCredentials(role_id string, credentials []string) (int64, error)
+	ReplaceCredentials(role_id string, credentials []utils.Map) (utils.Map, error)
 
 	AddUsers(role_id string, indata utils.Map) (utils.Map, error)
 	FindUser(filter string) (utils.Map, error)
 	GetUsers(rold_id string) (utils.Map, error)
+	RemoveUsers(role_id string, user_ids []string) (int64, error)
+	GetExpiringUsers(within time.Duration) (utils.Map, error)
+	CheckUserCredential(user_id string, credential string, attributes utils.Map) (utils.Map, error)
+
+	ExportPolicy(role_ids []string, with_users bool, format string) ([]byte, error)
+	ImportPolicy(document []byte, format string, confirm bool) (utils.Map, error)
 
 	BeginTransaction()
 	CommitTransaction()
@@ -66,6 +78,10 @@ func (p *appRoleBaseService) EndService() {
 	p.CloseDatabaseService()
 }
 
+func (p *appRoleBaseService) getServiceModuleCode() string {
+	return platform_common.GetServiceModuleCode() + "07"
+}
+
 // List - List All records
 func (p *appRoleBaseService) List(filter string, sort string, skip int64, limit int64) (utils.Map, error) {
 
@@ -118,6 +134,12 @@ func (p *appRoleBaseService) Create(indata utils.Map) (utils.Map, error) {
 	// Update the new Id
 	indata[platform_common.FLD_APP_ROLE_ID] = roleId
 
+	// Validate the parent roles if any given
+	err := p.validateParents(roleId, indata)
+	if err != nil {
+		return indata, err
+	}
+
 	dataCreated, err := p.daoAppRole.Create(indata)
 	if err != nil {
 		return indata, err
@@ -134,24 +156,33 @@ func (p *appRoleBaseService) Update(role_id string, indata utils.Map) (utils.Map
 	// Delete the Key fields
 	delete(indata, platform_common.FLD_APP_ROLE_ID)
 
+	// Validate the parent roles if they are changed
+	err := p.validateParents(role_id, indata)
+	if err != nil {
+		return indata, err
+	}
+
 	data, err := p.daoAppRole.Update(role_id, indata)
 
 	log.Println("UserService::Update - End ")
 	return data, err
 }
 
-// Delete - Delete Service
-func (p *appRoleBaseService) Delete(role_id string) error {
+// Delete - Delete Service. Refused while the role is still in use unless cascade is set,
+// the returned summary lists what was removed along with the role.
+func (p *appRoleBaseService) Delete(role_id string, cascade bool) (utils.Map, error) {
+
+	log.Println("UserService::Delete - Begin", role_id, cascade)
 
-	log.Println("UserService::Delete - Begin", role_id)
+	funcode := p.getServiceModuleCode() + "02"
 
-	result, err := p.daoAppRole.Delete(role_id)
+	result, err := deleteRole(&p.DatabaseService, p.daoAppRole, nil, appRoleFields, role_id, cascade, funcode)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	log.Printf("UserService::Delete - End %v", result)
-	return nil
+	return result, nil
 }
 
 // Create - Create Service
@@ -161,6 +192,11 @@ func (p *appRoleBaseService) AddCredentials(role_id string, indata utils.Map) (u
 
 	log.Println("Provided Role ID:", role_id, indata)
 
+	err := normalizeRoleCredential(indata, appRoleFields)
+	if err != nil {
+		return indata, err
+	}
+
 	dataRes, err := p.daoAppRole.AddCredentials(role_id, indata)
 	if err != nil {
 		return indata, err
@@ -169,14 +205,15 @@ func (p *appRoleBaseService) AddCredentials(role_id string, indata utils.Map) (u
 	return dataRes, nil
 }
 
-// Check Credentails - Get Credentail by given role and credentail
+// FindCredential - Get the credential of the role which grants the credential given in the filter,
+// matched over the inherited credentials. A conditional grant or a deny means it is not found.
 func (p *appRoleBaseService) FindCredential(filter string) (utils.Map, error) {
 
 	log.Println("AddCredentials::Add - Begin")
 
 	log.Println("Provided Role ID:", filter)
 
-	dataRes, err := p.daoAppRole.FindCredential(filter)
+	dataRes, err := findRoleCredential(p.daoAppRole, appRoleFields, filter)
 	if err != nil {
 		return nil, err
 	}
@@ -199,6 +236,111 @@ func (p *appRoleBaseService) GetCredentials(rold_id string) (utils.Map, error) {
 	return dataCreds, nil
 }
 
+// GetEffectiveCredentials - Get the credentials of the role and the ones inherited from its parent roles,
+// each tagged with the role it came from
+func (p *appRoleBaseService) GetEffectiveCredentials(role_id string) (utils.Map, error) {
+
+	log.Println("GetEffectiveCredentials::Get - Begin")
+
+	log.Println("Provided Role ID:", role_id)
+
+	dataCreds, err := getEffectiveCredentials(p.daoAppRole, appRoleFields, role_id)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("GetEffectiveCredentials::Get - End ")
+	return dataCreds, nil
+}
+
+// CheckCredential - Check whether the role grants the credential, honouring wildcards,
+// explicit denies, inherited credentials and credential conditions on the request attributes
+func (p *appRoleBaseService) CheckCredential(role_id string, credential string, attributes utils.Map) (utils.Map, error) {
+
+	log.Println("CheckCredential::Check - Begin")
+
+	log.Println("Provided Role ID:", role_id, credential, attributes)
+
+	dataRes, err := checkRoleCredential(p.daoAppRole, appRoleFields, role_id, credential, attributes)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("CheckCredential::Check - End ", dataRes)
+	return dataRes, nil
+}
+
+// RemoveCredentials - Remove the given credentials from the role
+func (p *appRoleBaseService) RemoveCredentials(role_id string, credentials []string) (int64, error) {
+
+	log.Println("RemoveCredentials::Remove - Begin")
+
+	log.Println("Provided Role ID:", role_id, credentials)
+
+	_, err := p.daoAppRole.Get(role_id)
+	if err != nil {
+		return 0, err
+	}
+
+	for idx, credential := range credentials {
+		credentials[idx] = NormalizeCredential(credential)
+	}
+
+	result, err := p.daoAppRole.RemoveCredentials(role_id, credentials)
+	if err != nil {
+		return result, err
+	}
+	log.Println("RemoveCredentials::Remove - End ", result)
+	return result, nil
+}
+
+// ReplaceCredentials - Set the full list of credentials of the role in one transaction
+func (p *appRoleBaseService) ReplaceCredentials(role_id string, credentials []utils.Map) (utils.Map, error) {
+
+	log.Println("ReplaceCredentials::Replace - Begin")
+
+	log.Println("Provided Role ID:", role_id, credentials)
+
+	_, err := p.daoAppRole.Get(role_id)
+	if err != nil {
+		return nil, err
+	}
+
+	// Every credential should carry a valid name
+	for _, cred := range credentials {
+		if err := normalizeRoleCredential(cred, appRoleFields); err != nil {
+			return nil, err
+		}
+	}
+
+	err = runInTransaction(&p.DatabaseService, func() error {
+		dataCreds, err := p.daoAppRole.GetCredentials(role_id)
+		if err != nil {
+			log.Println("ReplaceCredentials:: No existing credentials ", err)
+		}
+
+		credsAdd, credsRemove := diffRoleCredentials(getListResult(dataCreds), credentials, appRoleFields)
+		if len(credsRemove) > 0 {
+			_, err = p.daoAppRole.RemoveCredentials(role_id, credsRemove)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, cred := range credsAdd {
+			_, err = p.daoAppRole.AddCredentials(role_id, cred)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Println("ReplaceCredentials::Replace - End ")
+	return p.daoAppRole.GetCredentials(role_id)
+}
+
 // Create - Create Service
 func (p *appRoleBaseService) AddUsers(role_id string, indata utils.Map) (utils.Map, error) {
 
@@ -206,6 +348,12 @@ func (p *appRoleBaseService) AddUsers(role_id string, indata utils.Map) (utils.M
 
 	log.Println("Provided Role ID:", role_id, indata)
 
+	// Validate the optional valid_from and valid_until of the assignment
+	err := normalizeRoleAssignment(indata)
+	if err != nil {
+		return indata, err
+	}
+
 	dataRes, err := p.daoAppRole.AddUsers(role_id, indata)
 	if err != nil {
 		return indata, err
@@ -214,14 +362,15 @@ func (p *appRoleBaseService) AddUsers(role_id string, indata utils.Map) (utils.M
 	return dataRes, nil
 }
 
-// Check Credentails - Get Credentail by given role and credentail
+// FindUser - Find the role assignment matching the filter, expired or not yet valid
+// assignments are not found
 func (p *appRoleBaseService) FindUser(filter string) (utils.Map, error) {
 
 	log.Println("FindUser::Add - Begin")
 
 	log.Println("Provided Role ID:", filter)
 
-	dataRes, err := p.daoAppRole.FindUser(filter)
+	dataRes, err := findRoleAssignment(p.daoAppRole, filter)
 	if err != nil {
 		return nil, err
 	}
@@ -241,5 +390,102 @@ func (p *appRoleBaseService) GetUsers(rold_id string) (utils.Map, error) {
 		return nil, err
 	}
 	log.Println("GetUsers::Get - End ")
+	return markRoleAssignments(dataRes), nil
+}
+
+// RemoveUsers - Unassign the given users from the role
+func (p *appRoleBaseService) RemoveUsers(role_id string, user_ids []string) (int64, error) {
+
+	log.Println("RemoveUsers::Remove - Begin")
+
+	log.Println("Provided Role ID:", role_id, user_ids)
+
+	_, err := p.daoAppRole.Get(role_id)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := p.daoAppRole.RemoveUsers(role_id, user_ids)
+	if err != nil {
+		return result, err
+	}
+	log.Println("RemoveUsers::Remove - End ", result)
+	return result, nil
+}
+
+// GetExpiringUsers - List the role assignments which expire within the given duration
+func (p *appRoleBaseService) GetExpiringUsers(within time.Duration) (utils.Map, error) {
+
+	log.Println("GetExpiringUsers::Get - Begin", within)
+
+	dataRes, err := getExpiringRoleAssignments(p.daoAppRole, within)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("GetExpiringUsers::Get - End ")
+	return dataRes, nil
+}
+
+// CheckUserCredential - Check the credential against the roles currently assigned to the user,
+// ignoring assignments which are expired or not yet active. Conditions are evaluated on attributes.
+func (p *appRoleBaseService) CheckUserCredential(user_id string, credential string, attributes utils.Map) (utils.Map, error) {
+
+	log.Println("CheckUserCredential::Check - Begin")
+
+	log.Println("Provided User ID:", user_id, credential, attributes)
+
+	dataRes, err := checkUserCredential(p.daoAppRole, appRoleFields, user_id, credential, attributes)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("CheckUserCredential::Check - End ", dataRes)
 	return dataRes, nil
 }
+
+// ExportPolicy - Export the roles with their credentials, and optionally their users, as a
+// versioned json or yaml document. All roles are exported when role_ids is empty.
+func (p *appRoleBaseService) ExportPolicy(role_ids []string, with_users bool, format string) ([]byte, error) {
+
+	log.Println("ExportPolicy::Export - Begin", role_ids, with_users, format)
+
+	document, err := exportRolePolicy(p.daoAppRole, appRoleFields, role_ids, with_users, format)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("ExportPolicy::Export - End ")
+	return document, nil
+}
+
+// ImportPolicy - Compare the policy document with the stored roles and return the difference.
+// The difference is applied in one transaction only when confirm is set.
+func (p *appRoleBaseService) ImportPolicy(document []byte, format string, confirm bool) (utils.Map, error) {
+
+	log.Println("ImportPolicy::Import - Begin", format, confirm)
+
+	funcode := p.getServiceModuleCode() + "03"
+
+	dataRes, err := importRolePolicy(&p.DatabaseService, p.daoAppRole, appRoleFields, document, format, confirm, funcode)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("ImportPolicy::Import - End ", dataRes)
+	return dataRes, nil
+}
+
+// validateParents - Normalize the parent role ids in indata and check them for cycles
+func (p *appRoleBaseService) validateParents(role_id string, indata utils.Map) error {
+	funcode := p.getServiceModuleCode() + "01"
+
+	dataVal, dataOk := indata[appRoleFields.ParentIds]
+	if !dataOk {
+		return nil
+	}
+
+	parentIds := []string{}
+	for _, parentId := range getStringList(dataVal) {
+		parentIds = append(parentIds, strings.ToLower(parentId))
+	}
+	indata[appRoleFields.ParentIds] = parentIds
+
+	return validateRoleParents(p.daoAppRole, appRoleFields, role_id, parentIds, funcode)
+}
@@ -29,6 +29,9 @@ type BusinessService interface {
 	// Create New Business
 	Create(indata utils.Map) (utils.Map, error)
 
+	// Choose the region for a new business
+	PlaceRegion(indata utils.Map) (utils.Map, error)
+
 	// Update Business Details
 	Update(businessId string, indata utils.Map) (utils.Map, error)
 
@@ -156,18 +159,33 @@ func (p *businessBaseService) Create(indata utils.Map) (utils.Map, error) {
 		return indata, err
 	}
 
+	// Use the region given or let the placement choose one, the decision is kept with the business
 	dataval, dataok = indata[platform_common.FLD_BUSINESS_REGION_ID]
-	if !dataok {
-		err := &utils.AppError{ErrorCode: "S3030202", ErrorMsg: "Business region missing!", ErrorDetail: "Business Region should be specified!"}
-		return indata, err
-	}
-	_, err = p.daoAppRegion.Get(dataval.(string))
-	if err != nil {
-		err := &utils.AppError{ErrorCode: "S3030203", ErrorMsg: "Invalid Business region !", ErrorDetail: "Business Region given is invalid"}
-		return indata, err
+	if dataok {
+		if _, isStr := dataval.(string); !isStr {
+			err := &utils.AppError{ErrorCode: "S3030202", ErrorMsg: "Business region missing!", ErrorDetail: "Business Region should be specified!"}
+			return indata, err
+		}
 	}
 
-	dataBusiness, err := p.daoBusiness.Create(indata)
+	// The capacity is checked again after the create, a region filled meanwhile rolls it back
+	var dataBusiness utils.Map
+	err = runInTransaction(&p.DatabaseService, func() error {
+		placement, err := placeRegion(p.daoBusiness, p.daoAppRegion, indata, nil)
+		if err != nil {
+			return err
+		}
+		regionId, _ := placement[platform_common.FLD_REGION_ID].(string)
+		indata[platform_common.FLD_BUSINESS_REGION_ID] = regionId
+		delete(placement, platform_common.FLD_REGION_ID)
+		indata[FLD_BUSINESS_PLACEMENT] = placement
+
+		dataBusiness, err = p.daoBusiness.Create(indata)
+		if err != nil {
+			return err
+		}
+		return checkRegionCapacity(p.daoBusiness, p.daoAppRegion, regionId)
+	})
 	if err != nil {
 		return indata, err
 	}
@@ -184,6 +202,7 @@ func (p *businessBaseService) Update(businessId string, indata utils.Map) (utils
 	delete(indata, platform_common.FLD_BUSINESS_ID)
 	delete(indata, platform_common.FLD_BUSINESS_REGION_ID)
 	delete(indata, platform_common.FLD_BUSINESS_IS_TENANT_DB)
+	delete(indata, FLD_BUSINESS_PLACEMENT)
 
 	data, err := p.daoBusiness.Update(businessId, indata)
 
@@ -0,0 +1,475 @@
+package platform_service
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/zapscloud/golib-utils/utils"
+)
+
+// Conditions are boolean expressions over request attributes, for example
+//
+//	amount < 10000 && site in ['site_a', 'site_b']
+//	hour >= 9 && hour < 18 && weekday != 'sunday'
+//	owner == user_id
+//
+// Supported operators are == != < <= > >= in && || ! and parentheses. Operands are
+// attribute names, numbers, quoted strings, true/false and [..] lists. When a "time"
+// attribute is given, "hour", "minute", "weekday" and "date" are derived from it.
+// The condition has to be true or false, so attributes are always compared, also the
+// ones holding true/false (is_owner == true).
+const (
+	COND_ATTR_TIME    = "time"
+	COND_ATTR_HOUR    = "hour"
+	COND_ATTR_MINUTE  = "minute"
+	COND_ATTR_WEEKDAY = "weekday"
+	COND_ATTR_DATE    = "date"
+)
+
+type condToken struct {
+	kind  string // ident, number, string, op
+	value string
+}
+
+// condAttribute - Attribute whose value is not known while a condition is only validated
+type condAttribute string
+
+type condParser struct {
+	tokens     []condToken
+	pos        int
+	attributes utils.Map
+}
+
+// ValidateCondition - Check the syntax of the condition without evaluating it, and that it
+// results in true or false
+func ValidateCondition(condition string) error {
+	tokens, err := tokenizeCondition(condition)
+	if err != nil {
+		return err
+	}
+
+	parser := &condParser{tokens: tokens}
+	result, err := parser.parseOr(false)
+	if err != nil {
+		return err
+	}
+	if parser.pos < len(parser.tokens) {
+		return conditionError("unexpected '" + parser.tokens[parser.pos].value + "'")
+	}
+	if _, ok := result.(bool); !ok {
+		return conditionError("does not evaluate to true or false")
+	}
+	return nil
+}
+
+// EvaluateCondition - Evaluate the condition against the given request attributes
+func EvaluateCondition(condition string, attributes utils.Map) (bool, error) {
+	tokens, err := tokenizeCondition(condition)
+	if err != nil {
+		return false, err
+	}
+
+	parser := &condParser{tokens: tokens, attributes: deriveConditionAttributes(attributes)}
+	result, err := parser.parseOr(true)
+	if err != nil {
+		return false, err
+	}
+	if parser.pos < len(parser.tokens) {
+		return false, conditionError("unexpected '" + parser.tokens[parser.pos].value + "'")
+	}
+
+	boolVal, ok := result.(bool)
+	if !ok {
+		return false, conditionError("condition does not evaluate to true or false")
+	}
+	return boolVal, nil
+}
+
+func conditionError(detail string) error {
+	return &utils.AppError{ErrorStatus: 400, ErrorMsg: "Invalid condition", ErrorDetail: "Condition " + detail}
+}
+
+// deriveConditionAttributes - Normalize numbers and add the time based attributes
+func deriveConditionAttributes(attributes utils.Map) utils.Map {
+	derived := utils.Map{}
+	for key, value := range attributes {
+		derived[key] = normalizeConditionValue(value)
+	}
+
+	if timeVal, err := getMemberDataTime(attributes, COND_ATTR_TIME); err == nil {
+		setIfMissing := func(key string, value interface{}) {
+			if _, found := attributes[key]; !found {
+				derived[key] = value
+			}
+		}
+		setIfMissing(COND_ATTR_HOUR, float64(timeVal.Hour()))
+		setIfMissing(COND_ATTR_MINUTE, float64(timeVal.Minute()))
+		setIfMissing(COND_ATTR_WEEKDAY, strings.ToLower(timeVal.Weekday().String()))
+		setIfMissing(COND_ATTR_DATE, timeVal.Format("2006-01-02"))
+		derived[COND_ATTR_TIME] = timeVal.Format(time.RFC3339)
+	}
+	return derived
+}
+
+func normalizeConditionValue(value interface{}) interface{} {
+	switch val := value.(type) {
+	case int:
+		return float64(val)
+	case int32:
+		return float64(val)
+	case int64:
+		return float64(val)
+	case float32:
+		return float64(val)
+	case []string:
+		list := []interface{}{}
+		for _, item := range val {
+			list = append(list, item)
+		}
+		return list
+	case []interface{}:
+		list := []interface{}{}
+		for _, item := range val {
+			list = append(list, normalizeConditionValue(item))
+		}
+		return list
+	}
+	return value
+}
+
+func tokenizeCondition(condition string) ([]condToken, error) {
+	tokens := []condToken{}
+	runes := []rune(condition)
+
+	for idx := 0; idx < len(runes); {
+		curRune := runes[idx]
+
+		switch {
+		case unicode.IsSpace(curRune):
+			idx++
+
+		case curRune == '\'' || curRune == '"':
+			end := idx + 1
+			for end < len(runes) && runes[end] != curRune {
+				end++
+			}
+			if end >= len(runes) {
+				return nil, conditionError("has an unterminated string")
+			}
+			tokens = append(tokens, condToken{kind: "string", value: string(runes[idx+1 : end])})
+			idx = end + 1
+
+		case unicode.IsDigit(curRune) || (curRune == '-' && idx+1 < len(runes) && unicode.IsDigit(runes[idx+1])):
+			end := idx + 1
+			for end < len(runes) && (unicode.IsDigit(runes[end]) || runes[end] == '.') {
+				end++
+			}
+			tokens = append(tokens, condToken{kind: "number", value: string(runes[idx:end])})
+			idx = end
+
+		case unicode.IsLetter(curRune) || curRune == '_':
+			end := idx + 1
+			for end < len(runes) && (unicode.IsLetter(runes[end]) || unicode.IsDigit(runes[end]) || runes[end] == '_' || runes[end] == '.') {
+				end++
+			}
+			tokens = append(tokens, condToken{kind: "ident", value: string(runes[idx:end])})
+			idx = end
+
+		default:
+			twoChars := ""
+			if idx+1 < len(runes) {
+				twoChars = string(runes[idx : idx+2])
+			}
+			switch twoChars {
+			case "==", "!=", "<=", ">=", "&&", "||":
+				tokens = append(tokens, condToken{kind: "op", value: twoChars})
+				idx += 2
+				continue
+			}
+			if !strings.ContainsRune("<>!()[],", curRune) {
+				return nil, conditionError("has an unexpected character '" + string(curRune) + "'")
+			}
+			tokens = append(tokens, condToken{kind: "op", value: string(curRune)})
+			idx++
+		}
+	}
+	return tokens, nil
+}
+
+func (p *condParser) peek() (condToken, bool) {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos], true
+	}
+	return condToken{}, false
+}
+
+func (p *condParser) isNext(kind string, value string) bool {
+	token, ok := p.peek()
+	return ok && token.kind == kind && token.value == value
+}
+
+func (p *condParser) expect(value string) error {
+	if !p.isNext("op", value) {
+		return conditionError("expects '" + value + "'")
+	}
+	p.pos++
+	return nil
+}
+
+// parseOr - or := and ('||' and)*
+func (p *condParser) parseOr(eval bool) (interface{}, error) {
+	left, err := p.parseAnd(eval)
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isNext("op", "||") {
+		p.pos++
+
+		// Skip evaluating the right side once the result is decided
+		leftBool, isBool := left.(bool)
+		isDecided := eval && isBool && leftBool
+		right, err := p.parseAnd(eval && !isDecided)
+		if err != nil {
+			return nil, err
+		}
+		if !eval {
+			// Validation only checks both sides are true or false
+			if _, _, err := conditionBools(left, right); err != nil {
+				return nil, err
+			}
+			left = false
+		} else if !isDecided {
+			leftBool, rightBool, err := conditionBools(left, right)
+			if err != nil {
+				return nil, err
+			}
+			left = leftBool || rightBool
+		}
+	}
+	return left, nil
+}
+
+// parseAnd - and := unary ('&&' unary)*
+func (p *condParser) parseAnd(eval bool) (interface{}, error) {
+	left, err := p.parseUnary(eval)
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isNext("op", "&&") {
+		p.pos++
+
+		// Skip evaluating the right side once the result is decided
+		leftBool, isBool := left.(bool)
+		isDecided := eval && isBool && !leftBool
+		right, err := p.parseUnary(eval && !isDecided)
+		if err != nil {
+			return nil, err
+		}
+		if !eval {
+			// Validation only checks both sides are true or false
+			if _, _, err := conditionBools(left, right); err != nil {
+				return nil, err
+			}
+			left = false
+		} else if !isDecided {
+			leftBool, rightBool, err := conditionBools(left, right)
+			if err != nil {
+				return nil, err
+			}
+			left = leftBool && rightBool
+		}
+	}
+	return left, nil
+}
+
+// parseUnary - unary := '!' unary | comparison
+func (p *condParser) parseUnary(eval bool) (interface{}, error) {
+	if p.isNext("op", "!") {
+		p.pos++
+		value, err := p.parseUnary(eval)
+		if err != nil {
+			return nil, err
+		}
+		boolVal, ok := value.(bool)
+		if !ok {
+			return nil, conditionError("applies '!' to a value which is not true or false")
+		}
+		return !boolVal, nil
+	}
+	return p.parseComparison(eval)
+}
+
+// parseComparison - comparison := operand (op operand)?
+func (p *condParser) parseComparison(eval bool) (interface{}, error) {
+	left, err := p.parseOperand(eval)
+	if err != nil {
+		return nil, err
+	}
+
+	token, ok := p.peek()
+	if !ok {
+		return left, nil
+	}
+
+	operator := token.value
+	switch {
+	case token.kind == "op" && (operator == "==" || operator == "!=" || operator == "<" || operator == "<=" || operator == ">" || operator == ">="):
+	case token.kind == "ident" && operator == "in":
+	default:
+		return left, nil
+	}
+	p.pos++
+
+	right, err := p.parseOperand(eval)
+	if err != nil {
+		return nil, err
+	}
+	if !eval {
+		// Any comparison results in true or false
+		return false, nil
+	}
+	return compareConditionValues(left, operator, right)
+}
+
+// parseOperand - operand := '(' or ')' | '[' list ']' | literal | attribute
+func (p *condParser) parseOperand(eval bool) (interface{}, error) {
+	token, ok := p.peek()
+	if !ok {
+		return nil, conditionError("ends unexpectedly")
+	}
+	p.pos++
+
+	switch token.kind {
+	case "op":
+		if token.value == "(" {
+			value, err := p.parseOr(eval)
+			if err != nil {
+				return nil, err
+			}
+			return value, p.expect(")")
+		} else if token.value == "[" {
+			list := []interface{}{}
+			for !p.isNext("op", "]") {
+				item, err := p.parseOperand(eval)
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, item)
+				if !p.isNext("op", ",") {
+					break
+				}
+				p.pos++
+			}
+			return list, p.expect("]")
+		}
+		return nil, conditionError("has an unexpected '" + token.value + "'")
+
+	case "number":
+		numVal, err := strconv.ParseFloat(token.value, 64)
+		if err != nil {
+			return nil, conditionError("has an invalid number " + token.value)
+		}
+		return numVal, nil
+
+	case "string":
+		return token.value, nil
+	}
+
+	// Identifiers
+	switch token.value {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	if !eval {
+		return condAttribute(token.value), nil
+	}
+
+	value, found := p.attributes[token.value]
+	if !found {
+		return nil, conditionError("needs the attribute " + token.value)
+	}
+	return value, nil
+}
+
+func conditionBools(left interface{}, right interface{}) (bool, bool, error) {
+	leftBool, okLeft := left.(bool)
+	rightBool, okRight := right.(bool)
+	if !okLeft || !okRight {
+		return false, false, conditionError("combines values which are not true or false")
+	}
+	return leftBool, rightBool, nil
+}
+
+func compareConditionValues(left interface{}, operator string, right interface{}) (bool, error) {
+
+	if operator == "in" {
+		list, ok := right.([]interface{})
+		if !ok {
+			return false, conditionError("expects a list after 'in'")
+		}
+		for _, item := range list {
+			if equal, _ := compareConditionValues(left, "==", item); equal {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	switch leftVal := left.(type) {
+	case float64:
+		rightVal, ok := right.(float64)
+		if !ok {
+			return false, conditionError(fmt.Sprintf("compares number %v with %v", leftVal, right))
+		}
+		switch operator {
+		case "==":
+			return leftVal == rightVal, nil
+		case "!=":
+			return leftVal != rightVal, nil
+		case "<":
+			return leftVal < rightVal, nil
+		case "<=":
+			return leftVal <= rightVal, nil
+		case ">":
+			return leftVal > rightVal, nil
+		case ">=":
+			return leftVal >= rightVal, nil
+		}
+
+	case string:
+		rightVal, ok := right.(string)
+		if !ok {
+			return false, conditionError(fmt.Sprintf("compares text %v with %v", leftVal, right))
+		}
+		switch operator {
+		case "==":
+			return leftVal == rightVal, nil
+		case "!=":
+			return leftVal != rightVal, nil
+		case "<":
+			return leftVal < rightVal, nil
+		case "<=":
+			return leftVal <= rightVal, nil
+		case ">":
+			return leftVal > rightVal, nil
+		case ">=":
+			return leftVal >= rightVal, nil
+		}
+
+	case bool:
+		rightVal, ok := right.(bool)
+		if !ok || (operator != "==" && operator != "!=") {
+			return false, conditionError(fmt.Sprintf("cannot apply %s to %v and %v", operator, leftVal, right))
+		}
+		return (leftVal == rightVal) == (operator == "=="), nil
+	}
+
+	return false, conditionError(fmt.Sprintf("cannot compare %v with %v", left, right))
+}
@@ -0,0 +1,96 @@
+package platform_service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zapscloud/golib-utils/utils"
+)
+
+func TestValidateCondition(t *testing.T) {
+
+	tests := []struct {
+		condition string
+		wantErr   bool
+	}{
+		{"amount < 10000", false},
+		{"amount < 10000 && site in ['site_a', 'site_b']", false},
+		{"hour >= 9 && hour < 18 && weekday != 'sunday'", false},
+		{"owner == user_id", false},
+		{"!(amount > 100) || is_owner == true", false},
+		{"true", false},
+		{"(amount < 10)", false},
+		{"amount", true},
+		{"'text'", true},
+		{"100", true},
+		{"['a', 'b']", true},
+		{"is_owner && amount < 10", true},
+		{"!amount", true},
+		{"amount < 10 || site", true},
+		{"amount <", true},
+		{"amount < 10)", true},
+		{"(amount < 10", true},
+		{"site == 'open", true},
+		{"amount # 10", true},
+		{"", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.condition, func(t *testing.T) {
+			if err := ValidateCondition(tt.condition); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateCondition(%q) error = %v, wantErr %v", tt.condition, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEvaluateCondition(t *testing.T) {
+
+	attributes := utils.Map{
+		"amount":   5000,
+		"site":     "site_a",
+		"owner":    "user_1",
+		"user_id":  "user_1",
+		"is_owner": true,
+		"tags":     []string{"urgent"},
+		"time":     time.Date(2026, 10, 18, 10, 30, 0, 0, time.UTC),
+	}
+
+	tests := []struct {
+		condition string
+		want      bool
+		wantErr   bool
+	}{
+		{"amount < 10000", true, false},
+		{"amount >= 5000.5", false, false},
+		{"amount < 10000 && site in ['site_a', 'site_b']", true, false},
+		{"site in ['site_b']", false, false},
+		{"owner == user_id", true, false},
+		{"is_owner == true", true, false},
+		{"!(amount > 100)", false, false},
+		{"amount > 100000 || site == 'site_a'", true, false},
+		{"hour >= 9 && hour < 18", true, false},
+		{"weekday != 'sunday'", false, false},
+		{"date == '2026-10-18'", true, false},
+		{"-1 < amount", true, false},
+		// The decided side is not evaluated, a missing attribute there is no error
+		{"site == 'site_a' || missing == 1", true, false},
+		{"site == 'site_b' && missing == 1", false, false},
+		{"missing == 1", false, true},
+		{"amount == 'text'", false, true},
+		{"amount", false, true},
+		{"site in 'site_a'", false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.condition, func(t *testing.T) {
+			got, err := EvaluateCondition(tt.condition, attributes)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("EvaluateCondition(%q) error = %v, wantErr %v", tt.condition, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("EvaluateCondition(%q) = %v, want %v", tt.condition, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package platform_service
+
+import (
+	"strings"
+
+	"github.com/zapscloud/golib-utils/utils"
+)
+
+// Credentials are written as "resource:action". The resource may be hierarchical with
+// "." separated segments. A "*" matches any action, any resource, or every resource
+// below a prefix ("billing.*"). Credentials starting with "!" are explicit denies and
+// override any allow.
+const (
+	CREDENTIAL_SEPARATOR      = ":"
+	CREDENTIAL_RESOURCE_SEP   = "."
+	CREDENTIAL_WILDCARD       = "*"
+	CREDENTIAL_DENY_PREFIX    = "!"
+	CREDENTIAL_RESULT_ALLOWED = "is_allowed"
+	CREDENTIAL_RESULT_MATCHED = "matched_credential"
+	CREDENTIAL_RESULT_DENIED  = "is_denied"
+)
+
+// NormalizeCredential - Trim and lowercase the credential
+func NormalizeCredential(credential string) string {
+	return strings.ToLower(strings.TrimSpace(credential))
+}
+
+// IsDenyCredential - Check whether the credential is an explicit deny entry
+func IsDenyCredential(credential string) bool {
+	return strings.HasPrefix(NormalizeCredential(credential), CREDENTIAL_DENY_PREFIX)
+}
+
+// ValidateCredential - Check the credential follows the resource:action format. Plain names
+// without a separator are accepted as legacy credentials, they only match exactly.
+func ValidateCredential(credential string) error {
+
+	credential = strings.TrimPrefix(NormalizeCredential(credential), CREDENTIAL_DENY_PREFIX)
+	if credential == CREDENTIAL_WILDCARD {
+		return nil
+	}
+
+	resource, action, found := strings.Cut(credential, CREDENTIAL_SEPARATOR)
+	if !found && !utils.IsEmpty(credential) && !strings.Contains(credential, CREDENTIAL_WILDCARD) {
+		// Plain credential names from before the resource:action format stay valid
+		return nil
+	}
+	if !found || utils.IsEmpty(resource) || utils.IsEmpty(action) || strings.Contains(action, CREDENTIAL_SEPARATOR) {
+		err := &utils.AppError{ErrorStatus: 400, ErrorMsg: "Invalid credential", ErrorDetail: "Credential " + credential + " should be in resource:action format"}
+		return err
+	}
+
+	for _, segment := range strings.Split(resource, CREDENTIAL_RESOURCE_SEP) {
+		if utils.IsEmpty(segment) {
+			err := &utils.AppError{ErrorStatus: 400, ErrorMsg: "Invalid credential", ErrorDetail: "Credential " + credential + " has an empty resource segment"}
+			return err
+		}
+	}
+	return nil
+}
+
+// MatchCredential - Check whether the granted credential pattern covers the requested credential.
+// The deny prefix of the pattern is ignored here, use EvaluateCredentials to apply denies.
+func MatchCredential(pattern string, credential string) bool {
+
+	pattern = strings.TrimPrefix(NormalizeCredential(pattern), CREDENTIAL_DENY_PREFIX)
+	credential = NormalizeCredential(credential)
+
+	if pattern == CREDENTIAL_WILDCARD || pattern == credential {
+		return true
+	}
+
+	patResource, patAction, patFound := strings.Cut(pattern, CREDENTIAL_SEPARATOR)
+	credResource, credAction, credFound := strings.Cut(credential, CREDENTIAL_SEPARATOR)
+	if !patFound || !credFound {
+		// Plain credentials only match exactly
+		return false
+	}
+
+	if patAction != CREDENTIAL_WILDCARD && patAction != credAction {
+		return false
+	}
+
+	return matchCredentialResource(patResource, credResource)
+}
+
+// EvaluateCredentials - Check the requested credential against the granted credentials.
+// Returns whether it is allowed and the granted credential which decided it.
+func EvaluateCredentials(granted []string, credential string) (bool, string) {
+
+	allowedBy := ""
+	for _, pattern := range granted {
+		if !MatchCredential(pattern, credential) {
+			continue
+		}
+		if IsDenyCredential(pattern) {
+			// Explicit deny always wins
+			return false, pattern
+		}
+		if allowedBy == "" {
+			allowedBy = pattern
+		}
+	}
+
+	return allowedBy != "", allowedBy
+}
+
+func matchCredentialResource(patResource string, credResource string) bool {
+
+	if patResource == CREDENTIAL_WILDCARD || patResource == credResource {
+		return true
+	}
+
+	patSegments := strings.Split(patResource, CREDENTIAL_RESOURCE_SEP)
+	credSegments := strings.Split(credResource, CREDENTIAL_RESOURCE_SEP)
+
+	for idx, patSegment := range patSegments {
+		if patSegment == CREDENTIAL_WILDCARD && idx == len(patSegments)-1 {
+			// Trailing wildcard covers everything below the prefix
+			return len(credSegments) > idx
+		}
+		if idx >= len(credSegments) || (patSegment != CREDENTIAL_WILDCARD && patSegment != credSegments[idx]) {
+			return false
+		}
+	}
+
+	return len(patSegments) == len(credSegments)
+}
@@ -10,6 +10,8 @@ import (
 	"github.com/zapscloud/golib-utils/utils"
 )
 
+// OpenRegionDatabaseService - Open the database of the business region, props may set read_preference
+// to replica for read-only work
 func OpenRegionDatabaseService(props utils.Map) (db_utils.DatabaseService, error) {
 	var dbRegion db_utils.DatabaseService
 
@@ -67,33 +69,34 @@ func getRegionAndTenantDBInfo(props utils.Map) (utils.Map, error) {
 		return nil, err
 	}
 
-	// Get all the Database information from the Region
-	dbType, _ := utils.GetMemberDataInt(dataRegion, platform_common.FLD_REGION_DB_TYPE, true)
-	dbServer, _ := utils.GetMemberDataStr(dataRegion, platform_common.FLD_REGION_MONGODB_SERVER)
-	dbUser, _ := utils.GetMemberDataStr(dataRegion, platform_common.FLD_REGION_MONGODB_USER)
-	dbSecret, _ := utils.GetMemberDataStr(dataRegion, platform_common.FLD_REGION_MONGODB_SECRET)
-	dbName, _ := utils.GetMemberDataStr(dataRegion, platform_common.FLD_REGION_MONGODB_NAME)
+	// Decrypt the region secrets to connect, the decrypted copy is never stored or returned by the region APIs
+	dataRegion, err = decryptRegionSecrets(dataRegion)
+	if err != nil {
+		log.Println("GetTenantDBInfo:: Region secrets cannot be decrypted", regionId, err)
+		return nil, err
+	}
+
+	// Readers may ask for a replica instead of the primary
+	readPreference, _ := utils.GetMemberDataStr(props, FLD_READ_PREFERENCE)
+	dataRegion, err = selectRegionEndpoint(dataRegion, readPreference, businessId)
+	if err != nil {
+		return nil, err
+	}
+
+	// Get all the Database information from the Region, the fields depend on the database type
+	regionDBProps, err := getRegionDbProps(dataRegion)
+	if err != nil {
+		log.Println("GetTenantDBInfo:: Invalid region database settings", regionId, err)
+		return nil, err
+	}
 
 	// Check whether the business has the tenant database enabled
 	isTenantDB, _ := utils.GetMemberDataBool(dataBusiness, platform_common.FLD_BUSINESS_IS_TENANT_DB)
 	if isTenantDB {
-		dbName = dbName + "-" + businessId
-		// **** IMPORTANT ******: The maximum allowed database name length in MongoDB is only 38 bytes
-		mongoDBAllowedLen := 38
-		if len(dbName) > mongoDBAllowedLen {
-			dbName = utils.Right(dbName, mongoDBAllowedLen)
-		}
-	}
-
-	// Create Region's Database Props
-	regionDBProps := utils.Map{
-		db_common.DB_TYPE:               db_common.DatabaseType(dbType),
-		db_common.DB_SERVER:             dbServer,
-		db_common.DB_USER:               dbUser,
-		db_common.DB_SECRET:             dbSecret,
-		db_common.DB_NAME:               dbName,
-		platform_common.FLD_BUSINESS_ID: businessId,
+		dbName, _ := utils.GetMemberDataStr(regionDBProps, db_common.DB_NAME)
+		regionDBProps[db_common.DB_NAME] = getTenantDbName(regionDBProps[db_common.DB_TYPE].(db_common.DatabaseType), dbName, businessId)
 	}
+	regionDBProps[platform_common.FLD_BUSINESS_ID] = businessId
 
 	return regionDBProps, nil
 
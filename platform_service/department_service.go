@@ -0,0 +1,298 @@
+package platform_service
+
+import (
+	"log"
+	"strconv"
+
+	"github.com/zapscloud/golib-dbutils/db_common"
+	"github.com/zapscloud/golib-dbutils/db_utils"
+	"github.com/zapscloud/golib-platform-repository/platform_common"
+	"github.com/zapscloud/golib-platform-repository/platform_repository"
+	"github.com/zapscloud/golib-utils/utils"
+)
+
+// Department fields
+const (
+	FLD_APP_DEPT_NAME = "app_dept_name"
+)
+
+// DepartmentService - Departments of a business, each department belongs to a site
+type DepartmentService interface {
+	List(filter string, sort string, skip int64, limit int64) (utils.Map, error)
+	ListBySite(site_id string, sort string, skip int64, limit int64) (utils.Map, error)
+	Get(dept_id string) (utils.Map, error)
+	Find(filter string) (utils.Map, error)
+	Create(indata utils.Map) (utils.Map, error)
+	Update(dept_id string, indata utils.Map) (utils.Map, error)
+	// Delete fails while access grants still reference the department
+	Delete(dept_id string, delete_permanent bool) error
+
+	BeginTransaction()
+	CommitTransaction()
+	RollbackTransaction()
+
+	EndService()
+}
+
+type departmentBaseService struct {
+	db_utils.DatabaseService
+	daoDepartment platform_repository.DepartmentDao
+	daoSite       platform_repository.SiteDao
+	daoSysAccess  platform_repository.SysAccessDao
+	daoRequest    platform_repository.SysAccessRequestDao
+	daoBusiness   platform_repository.BusinessDao
+	child         DepartmentService
+	businessID    string
+}
+
+func init() {
+	log.SetFlags(log.Lshortfile | log.LstdFlags | log.Lmicroseconds)
+}
+
+func NewDepartmentService(props utils.Map) (DepartmentService, error) {
+	funcode := platform_common.GetServiceModuleCode() + "M" + "01"
+
+	p := departmentBaseService{}
+
+	// Open Database Service
+	err := p.OpenDatabaseService(props)
+	if err != nil {
+		log.Println("NewDepartmentMongoService Connection Error ", err)
+		return nil, err
+	}
+
+	// Verify whether the business id data passed
+	businessId, err := utils.GetMemberDataStr(props, platform_common.FLD_BUSINESS_ID)
+	if err != nil {
+		p.CloseDatabaseService()
+		return nil, err
+	}
+
+	// Assign the BusinessId
+	p.businessID = businessId
+	log.Printf("DepartmentMongoService ")
+
+	p.daoDepartment = platform_repository.NewDepartmentDao(p.GetClient(), p.businessID)
+	p.daoSite = platform_repository.NewSiteDao(p.GetClient(), p.businessID)
+	p.daoSysAccess = platform_repository.NewSysAccessDao(p.GetClient(), p.businessID)
+	p.daoRequest = platform_repository.NewSysAccessRequestDao(p.GetClient(), p.businessID)
+	p.daoBusiness = platform_repository.NewBusinessDao(p.GetClient())
+
+	_, err = p.daoBusiness.Get(businessId)
+	if err != nil {
+		p.CloseDatabaseService()
+		err := &utils.AppError{ErrorCode: funcode + "01", ErrorMsg: "Invalid sys_business_id", ErrorDetail: "Given sys_business_id is not exist"}
+		return nil, err
+	}
+
+	p.child = &p
+
+	return &p, nil
+}
+
+func (p *departmentBaseService) EndService() {
+	log.Printf("EndDepartmentService ")
+	p.CloseDatabaseService()
+}
+
+func (p *departmentBaseService) getServiceModuleCode() string {
+	return platform_common.GetServiceModuleCode() + "11"
+}
+
+// List - List All records
+func (p *departmentBaseService) List(filter string, sort string, skip int64, limit int64) (utils.Map, error) {
+
+	log.Println("DepartmentService::FindAll - Begin")
+
+	dataresponse, err := p.daoDepartment.List(filter, sort, skip, limit)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("DepartmentService::FindAll - End ")
+	return dataresponse, nil
+}
+
+// ListBySite - List the departments of the site
+func (p *departmentBaseService) ListBySite(site_id string, sort string, skip int64, limit int64) (utils.Map, error) {
+
+	log.Println("DepartmentService::ListBySite - Begin", site_id)
+
+	filter := buildFilter(utils.Map{FLD_APP_SITE_ID: site_id})
+	dataresponse, err := p.daoDepartment.List(filter, sort, skip, limit)
+
+	log.Println("DepartmentService::ListBySite - End ", err)
+	return dataresponse, err
+}
+
+// Get - Find By Code
+func (p *departmentBaseService) Get(dept_id string) (utils.Map, error) {
+	log.Printf("DepartmentService::Get::  Begin %v", dept_id)
+
+	data, err := p.daoDepartment.Get(dept_id)
+
+	log.Println("DepartmentService::Get:: End ", err)
+	return data, err
+}
+
+func (p *departmentBaseService) Find(filter string) (utils.Map, error) {
+	log.Println("DepartmentService::Find::  Begin ", filter)
+
+	data, err := p.daoDepartment.Find(filter)
+
+	log.Println("DepartmentService::Find:: End ", err)
+	return data, err
+}
+
+// Create - Create Service
+func (p *departmentBaseService) Create(indata utils.Map) (utils.Map, error) {
+
+	funcode := p.getServiceModuleCode() + "01"
+
+	log.Println("DepartmentService::Create - Begin")
+
+	if _, err := utils.GetMemberDataStr(indata, FLD_APP_DEPT_NAME); err != nil {
+		err := &utils.AppError{ErrorCode: funcode + "01", ErrorMsg: "Missing value", ErrorDetail: "Parameter " + FLD_APP_DEPT_NAME + " is missing"}
+		return indata, err
+	}
+
+	if err := p.validateSite(indata, funcode); err != nil {
+		return indata, err
+	}
+
+	deptId, _ := utils.GetMemberDataStr(indata, FLD_APP_DEPT_ID)
+	if deptId == "" {
+		deptId = utils.GenerateUniqueId("dept")
+	} else if _, err := p.daoDepartment.Get(deptId); err == nil {
+		err := &utils.AppError{ErrorCode: funcode + "02", ErrorMsg: "Existing Department ID !", ErrorDetail: "Given " + FLD_APP_DEPT_ID + " already exist"}
+		return indata, err
+	}
+
+	indata[FLD_APP_DEPT_ID] = deptId
+	indata[platform_common.FLD_BUSINESS_ID] = p.businessID
+
+	dataDept, err := p.daoDepartment.Create(indata)
+
+	log.Println("DepartmentService::Create - End ", err)
+	return dataDept, err
+}
+
+// Update - Update Service. Moving the department to another site is refused while access grants
+// reference it, since those grants are scoped to the current site.
+func (p *departmentBaseService) Update(dept_id string, indata utils.Map) (utils.Map, error) {
+
+	funcode := p.getServiceModuleCode() + "02"
+
+	log.Println("DepartmentService::Update - Begin")
+
+	dataDept, err := p.validateKeyExist(dept_id)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, found := indata[FLD_APP_SITE_ID]; found {
+		if err := p.validateSite(indata, funcode); err != nil {
+			return nil, err
+		}
+
+		curSiteId, _ := utils.GetMemberDataStr(dataDept, FLD_APP_SITE_ID)
+		newSiteId, _ := utils.GetMemberDataStr(indata, FLD_APP_SITE_ID)
+		if curSiteId != newSiteId {
+			grantCount, err := countAccessGrants(p.daoSysAccess, FLD_APP_DEPT_ID, dept_id)
+			if err != nil {
+				return nil, err
+			} else if grantCount > 0 {
+				err := &utils.AppError{ErrorCode: funcode + "03", ErrorMsg: "Department in use", ErrorDetail: "Department is referenced by " + strconv.Itoa(grantCount) + " access grant(s) and cannot move to another site"}
+				return nil, err
+			}
+		}
+	}
+
+	// Remove key and default fields from indata
+	delete(indata, FLD_APP_DEPT_ID)
+	delete(indata, platform_common.FLD_BUSINESS_ID)
+
+	data, err := p.daoDepartment.Update(dept_id, indata)
+
+	log.Println("DepartmentService::Update - End ")
+	return data, err
+}
+
+// Delete - Delete Service
+func (p *departmentBaseService) Delete(dept_id string, delete_permanent bool) error {
+
+	funcode := p.getServiceModuleCode() + "03"
+
+	log.Println("DepartmentService::Delete - Begin", dept_id)
+
+	_, err := p.validateKeyExist(dept_id)
+	if err != nil {
+		return err
+	}
+
+	// Check and delete in one transaction, so no grant or request is added in between
+	err = runInTransaction(&p.DatabaseService, func() error {
+		grantCount, err := countAccessGrants(p.daoSysAccess, FLD_APP_DEPT_ID, dept_id)
+		if err != nil {
+			return err
+		} else if grantCount > 0 {
+			err := &utils.AppError{ErrorCode: funcode + "01", ErrorMsg: "Department in use", ErrorDetail: "Department is referenced by " + strconv.Itoa(grantCount) + " access grant(s)"}
+			return err
+		}
+
+		requestCount, err := countOpenAccessRequests(p.daoRequest, FLD_APP_DEPT_ID, dept_id)
+		if err != nil {
+			return err
+		} else if requestCount > 0 {
+			err := &utils.AppError{ErrorCode: funcode + "02", ErrorMsg: "Department in use", ErrorDetail: "Department is referenced by " + strconv.Itoa(requestCount) + " pending or approved access request(s)"}
+			return err
+		}
+
+		if delete_permanent {
+			result, err := p.daoDepartment.Delete(dept_id)
+			if err != nil {
+				return err
+			}
+			log.Printf("Delete %v", result)
+		} else {
+			indata := utils.Map{db_common.FLD_IS_DELETED: true}
+			data, err := p.daoDepartment.Update(dept_id, indata)
+			if err != nil {
+				return err
+			}
+			log.Println("Update for Delete Flag", data)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("DepartmentService::Delete - End")
+	return nil
+}
+
+func (p *departmentBaseService) validateKeyExist(key string) (utils.Map, error) {
+	data, err := p.daoDepartment.Get(key)
+	if err != nil {
+		err := &utils.AppError{ErrorStatus: 400, ErrorMsg: "Bad Request", ErrorDetail: "Department not found"}
+		return utils.Map{}, err
+	}
+	return data, nil
+}
+
+// validateSite - The department should belong to an existing site of the business
+func (p *departmentBaseService) validateSite(indata utils.Map, funcode string) error {
+
+	siteId, err := utils.GetMemberDataStr(indata, FLD_APP_SITE_ID)
+	if err != nil {
+		err := &utils.AppError{ErrorCode: funcode + "07", ErrorMsg: "Missing value", ErrorDetail: "Parameter " + FLD_APP_SITE_ID + " is missing"}
+		return err
+	}
+
+	dataSite, err := p.daoSite.Get(siteId)
+	if isDeleted, _ := utils.GetMemberDataBool(dataSite, db_common.FLD_IS_DELETED); err != nil || isDeleted {
+		err := &utils.AppError{ErrorCode: funcode + "08", ErrorMsg: "SiteId not found", ErrorDetail: "Given " + FLD_APP_SITE_ID + " does not exist"}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,436 @@
+package platform_service
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zapscloud/golib-dbutils/db_common"
+	"github.com/zapscloud/golib-dbutils/db_utils"
+	"github.com/zapscloud/golib-platform-repository/platform_common"
+	"github.com/zapscloud/golib-platform-repository/platform_repository"
+	"github.com/zapscloud/golib-utils/utils"
+)
+
+// Feature flag fields
+const (
+	FLD_FEATURE_FLAG_ID   = "feature_flag_id"
+	FLD_FLAG_NAME         = "flag_name"
+	FLD_FLAG_DESCRIPTION  = "description"
+	FLD_FLAG_IS_ENABLED   = "is_enabled"
+	FLD_FLAG_VARIANTS     = "variants"
+	FLD_FLAG_DEFAULT      = "default_variant"
+	FLD_FLAG_OFF_VARIANT  = "off_variant"
+	FLD_FLAG_TARGETS      = "targets"
+	FLD_FLAG_ROLLOUT      = "rollout"
+	FLD_FLAG_ATTRIBUTE    = "attribute"
+	FLD_FLAG_VALUES       = "values"
+	FLD_FLAG_VARIANT      = "variant"
+	FLD_FLAG_PERCENTAGE   = "percentage"
+	FLD_FLAG_HASH_KEY     = "hash_key"
+	FLD_FLAG_REASON       = "reason"
+	FLD_FLAG_TARGET_INDEX = "target_index"
+	FLD_FLAG_CONTEXT      = "context"
+	FLD_FLAG_EVALUATED_AT = "evaluated_at"
+	FLD_INDUSTRY_ID       = "industry_id"
+
+	FLAG_VARIANT_ON      = "on"
+	FLAG_VARIANT_OFF     = "off"
+	FLAG_REASON_DISABLED = "disabled"
+	FLAG_REASON_TARGET   = "target_match"
+	FLAG_REASON_ROLLOUT  = "rollout"
+	FLAG_REASON_DEFAULT  = "default"
+)
+
+// FLAG_EVALUATION_LOG_MAX - Evaluations kept in the in-process log
+const FLAG_EVALUATION_LOG_MAX = 1000
+
+// FeatureFlagService - Feature flags with targeting and percentage rollouts
+type FeatureFlagService interface {
+	List(filter string, sort string, skip int64, limit int64) (utils.Map, error)
+	Get(flag_id string) (utils.Map, error)
+	Create(indata utils.Map) (utils.Map, error)
+	Update(flag_id string, indata utils.Map) (utils.Map, error)
+	Delete(flag_id string) error
+
+	// Evaluate the flag for the context of business_id, app_user_id, region_id and industry_id.
+	// Returns the variant and the reason it was chosen.
+	Evaluate(flag_id string, context utils.Map) (utils.Map, error)
+	IsEnabled(flag_id string, context utils.Map) bool
+	// Recent evaluations of the flag in this process, newest first
+	GetEvaluationLog(flag_id string, limit int) []utils.Map
+
+	BeginTransaction()
+	CommitTransaction()
+	RollbackTransaction()
+
+	EndService()
+}
+
+type featureFlagBaseService struct {
+	db_utils.DatabaseService
+	daoFlag     platform_repository.FeatureFlagDao
+	daoBusiness platform_repository.BusinessDao
+	child       FeatureFlagService
+}
+
+// featureFlagTargetAttributes - Context attributes a target may match on
+var featureFlagTargetAttributes = []string{
+	platform_common.FLD_BUSINESS_ID,
+	platform_common.FLD_APP_USER_ID,
+	platform_common.FLD_REGION_ID,
+	FLD_INDUSTRY_ID,
+}
+
+// Evaluations are kept in process for debugging, shared by all service instances
+var (
+	flagEvaluationLog   = []utils.Map{}
+	flagEvaluationLogMu sync.Mutex
+)
+
+func init() {
+	log.SetFlags(log.Lshortfile | log.LstdFlags | log.Lmicroseconds)
+}
+
+func NewFeatureFlagService(props utils.Map) (FeatureFlagService, error) {
+	p := featureFlagBaseService{}
+
+	err := p.OpenDatabaseService(props)
+	if err != nil {
+		log.Println("NewFeatureFlagService: Connection Error ", err)
+		return nil, err
+	}
+	log.Printf("NewFeatureFlagService ")
+
+	p.daoFlag = platform_repository.NewFeatureFlagDao(p.GetClient())
+	p.daoBusiness = platform_repository.NewBusinessDao(p.GetClient())
+	p.child = &p
+
+	return &p, nil
+}
+
+func (p *featureFlagBaseService) EndService() {
+	p.CloseDatabaseService()
+}
+
+func (p *featureFlagBaseService) getServiceModuleCode() string {
+	return platform_common.GetServiceModuleCode() + "12"
+}
+
+// List - List All records
+func (p *featureFlagBaseService) List(filter string, sort string, skip int64, limit int64) (utils.Map, error) {
+
+	log.Println("FeatureFlagService::FindAll - Begin")
+
+	dataresponse, err := p.daoFlag.List(filter, sort, skip, limit)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("FeatureFlagService::FindAll - End ")
+	return dataresponse, nil
+}
+
+// Get - Find By Code
+func (p *featureFlagBaseService) Get(flag_id string) (utils.Map, error) {
+	log.Printf("FeatureFlagService::Get::  Begin %v", flag_id)
+
+	data, err := p.daoFlag.Get(strings.ToLower(flag_id))
+
+	log.Println("FeatureFlagService::Get:: End ", err)
+	return data, err
+}
+
+// Create - Create Service
+func (p *featureFlagBaseService) Create(indata utils.Map) (utils.Map, error) {
+
+	funcode := p.getServiceModuleCode() + "01"
+
+	log.Println("FeatureFlagService::Create - Begin")
+
+	flagId, err := utils.GetMemberDataStr(indata, FLD_FEATURE_FLAG_ID)
+	if err != nil {
+		err := &utils.AppError{ErrorCode: funcode + "01", ErrorMsg: "Missing value", ErrorDetail: "Parameter " + FLD_FEATURE_FLAG_ID + " is missing"}
+		return indata, err
+	}
+	flagId = strings.ToLower(flagId)
+
+	if _, err := p.daoFlag.Get(flagId); err == nil {
+		err := &utils.AppError{ErrorCode: funcode + "02", ErrorMsg: "Existing flag", ErrorDetail: "Given " + FLD_FEATURE_FLAG_ID + " already exist"}
+		return indata, err
+	}
+
+	indata[FLD_FEATURE_FLAG_ID] = flagId
+	if _, found := indata[FLD_FLAG_VARIANTS]; !found {
+		indata[FLD_FLAG_VARIANTS] = []string{FLAG_VARIANT_ON, FLAG_VARIANT_OFF}
+	}
+	if _, found := indata[FLD_FLAG_DEFAULT]; !found {
+		indata[FLD_FLAG_DEFAULT] = FLAG_VARIANT_OFF
+	}
+	if _, found := indata[FLD_FLAG_OFF_VARIANT]; !found {
+		indata[FLD_FLAG_OFF_VARIANT] = FLAG_VARIANT_OFF
+	}
+
+	if err := validateFeatureFlag(indata, funcode); err != nil {
+		return indata, err
+	}
+
+	dataFlag, err := p.daoFlag.Create(indata)
+
+	log.Println("FeatureFlagService::Create - End ", err)
+	return dataFlag, err
+}
+
+// Update - Update Service
+func (p *featureFlagBaseService) Update(flag_id string, indata utils.Map) (utils.Map, error) {
+
+	funcode := p.getServiceModuleCode() + "02"
+
+	log.Println("FeatureFlagService::Update - Begin")
+
+	flag_id = strings.ToLower(flag_id)
+	dataFlag, err := p.daoFlag.Get(flag_id)
+	if err != nil {
+		return nil, err
+	}
+
+	// Delete the Key fields
+	delete(indata, FLD_FEATURE_FLAG_ID)
+
+	// Validate the flag as it will be after the update
+	merged := utils.Map{}
+	for key, value := range dataFlag {
+		merged[key] = value
+	}
+	for key, value := range indata {
+		merged[key] = value
+	}
+	if err := validateFeatureFlag(merged, funcode); err != nil {
+		return nil, err
+	}
+
+	data, err := p.daoFlag.Update(flag_id, indata)
+
+	log.Println("FeatureFlagService::Update - End ")
+	return data, err
+}
+
+// Delete - Delete Service
+func (p *featureFlagBaseService) Delete(flag_id string) error {
+
+	log.Println("FeatureFlagService::Delete - Begin", flag_id)
+
+	result, err := p.daoFlag.Delete(strings.ToLower(flag_id))
+	if err != nil {
+		return err
+	}
+
+	log.Printf("FeatureFlagService::Delete - End %v", result)
+	return nil
+}
+
+// Evaluate - Choose the variant of the flag for the context. A disabled flag gives the off variant,
+// then the first matching target wins, then the percentage rollout, then the default variant.
+// The region and industry of the business are used when the context does not give them.
+func (p *featureFlagBaseService) Evaluate(flag_id string, context utils.Map) (utils.Map, error) {
+
+	log.Println("FeatureFlagService::Evaluate - Begin", flag_id)
+
+	flag_id = strings.ToLower(flag_id)
+	dataFlag, err := p.daoFlag.Get(flag_id)
+	if err != nil {
+		return nil, err
+	}
+
+	context = p.getEvaluationContext(context)
+	result := evaluateFeatureFlag(dataFlag, context)
+	result[FLD_FEATURE_FLAG_ID] = flag_id
+
+	logFlagEvaluation(result, context)
+
+	log.Println("FeatureFlagService::Evaluate - End ", result[FLD_FLAG_VARIANT], result[FLD_FLAG_REASON])
+	return result, nil
+}
+
+// IsEnabled - Check whether the flag evaluates to the on variant, false when it cannot be evaluated
+func (p *featureFlagBaseService) IsEnabled(flag_id string, context utils.Map) bool {
+	result, err := p.Evaluate(flag_id, context)
+	if err != nil {
+		return false
+	}
+	variant, _ := utils.GetMemberDataStr(result, FLD_FLAG_VARIANT)
+	return variant == FLAG_VARIANT_ON
+}
+
+// GetEvaluationLog - Recent evaluations of the flag, newest first
+func (p *featureFlagBaseService) GetEvaluationLog(flag_id string, limit int) []utils.Map {
+
+	flag_id = strings.ToLower(flag_id)
+
+	flagEvaluationLogMu.Lock()
+	defer flagEvaluationLogMu.Unlock()
+
+	entries := []utils.Map{}
+	for idx := len(flagEvaluationLog) - 1; idx >= 0; idx-- {
+		if limit > 0 && len(entries) >= limit {
+			break
+		}
+		if flagId, _ := utils.GetMemberDataStr(flagEvaluationLog[idx], FLD_FEATURE_FLAG_ID); flagId == flag_id {
+			entries = append(entries, flagEvaluationLog[idx])
+		}
+	}
+	return entries
+}
+
+// getEvaluationContext - Copy the context and fill the region and industry from the business
+func (p *featureFlagBaseService) getEvaluationContext(context utils.Map) utils.Map {
+
+	evalContext := utils.Map{}
+	for key, value := range context {
+		evalContext[key] = value
+	}
+
+	businessId, _ := utils.GetMemberDataStr(evalContext, platform_common.FLD_BUSINESS_ID)
+	_, hasRegion := evalContext[platform_common.FLD_REGION_ID]
+	_, hasIndustry := evalContext[FLD_INDUSTRY_ID]
+	if businessId != "" && (!hasRegion || !hasIndustry) {
+		if dataBusiness, err := p.daoBusiness.Get(businessId); err == nil {
+			if !hasRegion {
+				evalContext[platform_common.FLD_REGION_ID] = dataBusiness[platform_common.FLD_BUSINESS_REGION_ID]
+			}
+			if !hasIndustry {
+				evalContext[FLD_INDUSTRY_ID] = dataBusiness[FLD_INDUSTRY_ID]
+			}
+		}
+	}
+	return evalContext
+}
+
+// evaluateFeatureFlag - Choose the variant of the flag for the context
+func evaluateFeatureFlag(dataFlag utils.Map, context utils.Map) utils.Map {
+
+	newResult := func(variant interface{}, reason string) utils.Map {
+		return utils.Map{FLD_FLAG_VARIANT: variant, FLD_FLAG_REASON: reason}
+	}
+
+	isEnabled, _ := utils.GetMemberDataBool(dataFlag, FLD_FLAG_IS_ENABLED)
+	isDeleted, _ := utils.GetMemberDataBool(dataFlag, db_common.FLD_IS_DELETED)
+	if !isEnabled || isDeleted {
+		return newResult(dataFlag[FLD_FLAG_OFF_VARIANT], FLAG_REASON_DISABLED)
+	}
+
+	for idx, target := range getMapList(dataFlag[FLD_FLAG_TARGETS]) {
+		attribute, _ := utils.GetMemberDataStr(target, FLD_FLAG_ATTRIBUTE)
+		if context[attribute] == nil {
+			continue
+		}
+		contextVal := fmt.Sprint(context[attribute])
+		for _, value := range getStringList(target[FLD_FLAG_VALUES]) {
+			if value == contextVal {
+				result := newResult(target[FLD_FLAG_VARIANT], FLAG_REASON_TARGET)
+				result[FLD_FLAG_TARGET_INDEX] = idx
+				return result
+			}
+		}
+	}
+
+	if rollouts := getMapList([]interface{}{dataFlag[FLD_FLAG_ROLLOUT]}); len(rollouts) > 0 {
+		rollout := rollouts[0]
+		hashKey, _ := utils.GetMemberDataStr(rollout, FLD_FLAG_HASH_KEY)
+		if hashKey == "" {
+			hashKey = platform_common.FLD_APP_USER_ID
+		}
+		percentage, _ := toSettingFloat(rollout[FLD_FLAG_PERCENTAGE])
+		if keyVal, err := utils.GetMemberDataStr(context, hashKey); err == nil && keyVal != "" {
+			flagId, _ := utils.GetMemberDataStr(dataFlag, FLD_FEATURE_FLAG_ID)
+			if getRolloutBucket(flagId, keyVal) < percentage {
+				return newResult(rollout[FLD_FLAG_VARIANT], FLAG_REASON_ROLLOUT)
+			}
+		}
+	}
+
+	return newResult(dataFlag[FLD_FLAG_DEFAULT], FLAG_REASON_DEFAULT)
+}
+
+// getRolloutBucket - Stable position of the key in 0..100 for the flag, so each key keeps its result
+// while the percentage grows and different flags roll out to different keys
+func getRolloutBucket(flagId string, keyVal string) float64 {
+	hasher := fnv.New32a()
+	hasher.Write([]byte(flagId + ":" + keyVal))
+	return float64(hasher.Sum32()%10000) / 100
+}
+
+// validateFeatureFlag - Variants used by the flag should be declared, percentages within 0..100
+func validateFeatureFlag(dataFlag utils.Map, funcode string) error {
+
+	variants := getStringList(dataFlag[FLD_FLAG_VARIANTS])
+	isVariant := func(value interface{}) bool {
+		for _, variant := range variants {
+			if fmt.Sprint(value) == variant {
+				return true
+			}
+		}
+		return false
+	}
+	invalid := func(detail string) error {
+		return &utils.AppError{ErrorCode: funcode + "05", ErrorMsg: "Invalid feature flag", ErrorDetail: detail}
+	}
+
+	if len(variants) == 0 {
+		return invalid("Flag should declare " + FLD_FLAG_VARIANTS)
+	}
+	if !isVariant(dataFlag[FLD_FLAG_DEFAULT]) || !isVariant(dataFlag[FLD_FLAG_OFF_VARIANT]) {
+		return invalid(FLD_FLAG_DEFAULT + " and " + FLD_FLAG_OFF_VARIANT + " should be declared variants")
+	}
+
+	for idx, target := range getMapList(dataFlag[FLD_FLAG_TARGETS]) {
+		attribute, _ := utils.GetMemberDataStr(target, FLD_FLAG_ATTRIBUTE)
+		isAttribute := false
+		for _, targetAttribute := range featureFlagTargetAttributes {
+			isAttribute = isAttribute || attribute == targetAttribute
+		}
+		if !isAttribute {
+			return invalid(fmt.Sprintf("Target %d should target one of %v", idx, featureFlagTargetAttributes))
+		}
+		if len(getStringList(target[FLD_FLAG_VALUES])) == 0 || !isVariant(target[FLD_FLAG_VARIANT]) {
+			return invalid(fmt.Sprintf("Target %d needs %s and a declared %s", idx, FLD_FLAG_VALUES, FLD_FLAG_VARIANT))
+		}
+	}
+
+	if dataRollout, found := dataFlag[FLD_FLAG_ROLLOUT]; found && dataRollout != nil {
+		rollouts := getMapList([]interface{}{dataRollout})
+		if len(rollouts) == 0 {
+			return invalid(FLD_FLAG_ROLLOUT + " should be an object")
+		}
+		percentage, ok := toSettingFloat(rollouts[0][FLD_FLAG_PERCENTAGE])
+		if !ok || percentage < 0 || percentage > 100 {
+			return invalid("Rollout " + FLD_FLAG_PERCENTAGE + " should be between 0 and 100")
+		}
+		if !isVariant(rollouts[0][FLD_FLAG_VARIANT]) {
+			return invalid("Rollout " + FLD_FLAG_VARIANT + " should be a declared variant")
+		}
+	}
+	return nil
+}
+
+// logFlagEvaluation - Keep the evaluation in the bounded in-process log
+func logFlagEvaluation(result utils.Map, context utils.Map) {
+
+	entry := utils.Map{
+		FLD_FLAG_CONTEXT:      context,
+		FLD_FLAG_EVALUATED_AT: time.Now(),
+	}
+	for key, value := range result {
+		entry[key] = value
+	}
+
+	flagEvaluationLogMu.Lock()
+	defer flagEvaluationLogMu.Unlock()
+
+	flagEvaluationLog = append(flagEvaluationLog, entry)
+	if len(flagEvaluationLog) > FLAG_EVALUATION_LOG_MAX {
+		flagEvaluationLog = flagEvaluationLog[len(flagEvaluationLog)-FLAG_EVALUATION_LOG_MAX:]
+	}
+}
@@ -0,0 +1,156 @@
+package platform_service
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/zapscloud/golib-dbutils/db_common"
+	"github.com/zapscloud/golib-platform-repository/platform_common"
+	"github.com/zapscloud/golib-utils/utils"
+)
+
+func TestEvaluateFeatureFlag(t *testing.T) {
+
+	flag := func(isEnabled bool, percentage float64) utils.Map {
+		return utils.Map{
+			FLD_FEATURE_FLAG_ID:  "new_checkout",
+			FLD_FLAG_IS_ENABLED:  isEnabled,
+			FLD_FLAG_VARIANTS:    []interface{}{"on", "off", "beta"},
+			FLD_FLAG_DEFAULT:     "off",
+			FLD_FLAG_OFF_VARIANT: "off",
+			FLD_FLAG_TARGETS: []interface{}{
+				map[string]interface{}{FLD_FLAG_ATTRIBUTE: platform_common.FLD_BUSINESS_ID, FLD_FLAG_VALUES: []interface{}{"biz_1", "biz_2"}, FLD_FLAG_VARIANT: "beta"},
+				map[string]interface{}{FLD_FLAG_ATTRIBUTE: platform_common.FLD_REGION_ID, FLD_FLAG_VALUES: []interface{}{"eu"}, FLD_FLAG_VARIANT: "on"},
+			},
+			FLD_FLAG_ROLLOUT: map[string]interface{}{FLD_FLAG_PERCENTAGE: percentage, FLD_FLAG_VARIANT: "on"},
+		}
+	}
+	deleted := flag(true, 100)
+	deleted[db_common.FLD_IS_DELETED] = true
+
+	tests := []struct {
+		name        string
+		dataFlag    utils.Map
+		context     utils.Map
+		wantVariant string
+		wantReason  string
+	}{
+		{"disabled", flag(false, 100), utils.Map{platform_common.FLD_BUSINESS_ID: "biz_1"}, "off", FLAG_REASON_DISABLED},
+		{"deleted", deleted, utils.Map{platform_common.FLD_BUSINESS_ID: "biz_1"}, "off", FLAG_REASON_DISABLED},
+		{"first target", flag(true, 0), utils.Map{platform_common.FLD_BUSINESS_ID: "biz_2", platform_common.FLD_REGION_ID: "eu"}, "beta", FLAG_REASON_TARGET},
+		{"second target", flag(true, 0), utils.Map{platform_common.FLD_BUSINESS_ID: "biz_9", platform_common.FLD_REGION_ID: "eu"}, "on", FLAG_REASON_TARGET},
+		{"full rollout", flag(true, 100), utils.Map{platform_common.FLD_APP_USER_ID: "user_1"}, "on", FLAG_REASON_ROLLOUT},
+		{"no rollout", flag(true, 0), utils.Map{platform_common.FLD_APP_USER_ID: "user_1"}, "off", FLAG_REASON_DEFAULT},
+		{"rollout without hash key", flag(true, 100), utils.Map{platform_common.FLD_BUSINESS_ID: "biz_9"}, "off", FLAG_REASON_DEFAULT},
+		{"empty context", flag(true, 100), utils.Map{}, "off", FLAG_REASON_DEFAULT},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := evaluateFeatureFlag(tt.dataFlag, tt.context)
+			if result[FLD_FLAG_VARIANT] != tt.wantVariant || result[FLD_FLAG_REASON] != tt.wantReason {
+				t.Errorf("evaluateFeatureFlag() = %v, %v, want %v, %v", result[FLD_FLAG_VARIANT], result[FLD_FLAG_REASON], tt.wantVariant, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestGetRolloutBucket(t *testing.T) {
+
+	// Buckets are stable and spread evenly over 0..100
+	counts := make([]int, 10)
+	for idx := 0; idx < 10000; idx++ {
+		keyVal := fmt.Sprintf("user_%d", idx)
+		bucket := getRolloutBucket("new_checkout", keyVal)
+		if bucket < 0 || bucket >= 100 {
+			t.Fatalf("getRolloutBucket(%q) = %v, want within 0..100", keyVal, bucket)
+		}
+		if bucket != getRolloutBucket("new_checkout", keyVal) {
+			t.Fatalf("getRolloutBucket(%q) is not stable", keyVal)
+		}
+		counts[int(bucket/10)]++
+	}
+	for idx, count := range counts {
+		if count < 800 || count > 1200 {
+			t.Errorf("bucket range %d0..%d0 has %d of 10000 keys, want about 1000", idx, idx+1, count)
+		}
+	}
+
+	// A key rolled out at a percentage stays rolled out when the percentage grows
+	dataFlag := utils.Map{
+		FLD_FEATURE_FLAG_ID:  "new_checkout",
+		FLD_FLAG_IS_ENABLED:  true,
+		FLD_FLAG_DEFAULT:     "off",
+		FLD_FLAG_OFF_VARIANT: "off",
+	}
+	for idx := 0; idx < 1000; idx++ {
+		context := utils.Map{platform_common.FLD_APP_USER_ID: fmt.Sprintf("user_%d", idx)}
+		wasOn := false
+		for _, percentage := range []float64{5, 25, 50, 100} {
+			dataFlag[FLD_FLAG_ROLLOUT] = utils.Map{FLD_FLAG_PERCENTAGE: percentage, FLD_FLAG_VARIANT: "on"}
+			isOn := evaluateFeatureFlag(dataFlag, context)[FLD_FLAG_VARIANT] == "on"
+			if wasOn && !isOn {
+				t.Fatalf("user_%d rolled back when the percentage grew to %v", idx, percentage)
+			}
+			wasOn = isOn
+		}
+		if !wasOn {
+			t.Fatalf("user_%d is not rolled out at 100 percent", idx)
+		}
+	}
+
+	// Different flags roll out to different keys
+	sameBucket := 0
+	for idx := 0; idx < 1000; idx++ {
+		keyVal := fmt.Sprintf("user_%d", idx)
+		if (getRolloutBucket("flag_a", keyVal) < 50) == (getRolloutBucket("flag_b", keyVal) < 50) {
+			sameBucket++
+		}
+	}
+	if sameBucket > 600 {
+		t.Errorf("flag_a and flag_b agree on %d of 1000 keys at 50 percent, want about 500", sameBucket)
+	}
+}
+
+func TestValidateFeatureFlag(t *testing.T) {
+
+	flag := func(update utils.Map) utils.Map {
+		dataFlag := utils.Map{
+			FLD_FLAG_VARIANTS:    []interface{}{"on", "off"},
+			FLD_FLAG_DEFAULT:     "off",
+			FLD_FLAG_OFF_VARIANT: "off",
+		}
+		for key, value := range update {
+			dataFlag[key] = value
+		}
+		return dataFlag
+	}
+	target := func(attribute string, variant string) []interface{} {
+		return []interface{}{map[string]interface{}{FLD_FLAG_ATTRIBUTE: attribute, FLD_FLAG_VALUES: []interface{}{"x"}, FLD_FLAG_VARIANT: variant}}
+	}
+
+	tests := []struct {
+		name     string
+		dataFlag utils.Map
+		wantErr  bool
+	}{
+		{"valid", flag(nil), false},
+		{"no variants", flag(utils.Map{FLD_FLAG_VARIANTS: []interface{}{}}), true},
+		{"undeclared default", flag(utils.Map{FLD_FLAG_DEFAULT: "beta"}), true},
+		{"target", flag(utils.Map{FLD_FLAG_TARGETS: target(FLD_INDUSTRY_ID, "on")}), false},
+		{"target on unknown attribute", flag(utils.Map{FLD_FLAG_TARGETS: target("email", "on")}), true},
+		{"target with undeclared variant", flag(utils.Map{FLD_FLAG_TARGETS: target(FLD_INDUSTRY_ID, "beta")}), true},
+		{"rollout", flag(utils.Map{FLD_FLAG_ROLLOUT: utils.Map{FLD_FLAG_PERCENTAGE: 25, FLD_FLAG_VARIANT: "on"}}), false},
+		{"rollout above 100", flag(utils.Map{FLD_FLAG_ROLLOUT: utils.Map{FLD_FLAG_PERCENTAGE: 101, FLD_FLAG_VARIANT: "on"}}), true},
+		{"rollout below 0", flag(utils.Map{FLD_FLAG_ROLLOUT: utils.Map{FLD_FLAG_PERCENTAGE: -1, FLD_FLAG_VARIANT: "on"}}), true},
+		{"rollout not an object", flag(utils.Map{FLD_FLAG_ROLLOUT: 25}), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateFeatureFlag(tt.dataFlag, "F"); (err != nil) != tt.wantErr {
+				t.Errorf("validateFeatureFlag() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,197 @@
+package platform_service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/zapscloud/golib-dbutils/db_common"
+	"github.com/zapscloud/golib-platform-repository/platform_common"
+	"github.com/zapscloud/golib-utils/utils"
+)
+
+// MySQL connection fields of a region
+const (
+	FLD_REGION_MYSQL_SERVER = "mysql_server"
+	FLD_REGION_MYSQL_PORT   = "mysql_port"
+	FLD_REGION_MYSQL_USER   = "mysql_user"
+	FLD_REGION_MYSQL_SECRET = "mysql_secret"
+	FLD_REGION_MYSQL_NAME   = "mysql_name"
+
+	REGION_MYSQL_DEFAULT_PORT = "3306"
+
+	// Hex digits of the hash ending tenant database names which had to be shortened
+	TENANT_DB_HASH_LEN = 16
+)
+
+// regionDbEngine - Region fields holding the connection settings of a database type, and the
+// rules for naming the tenant databases on it
+type regionDbEngine struct {
+	Name           string
+	ServerField    string
+	PortField      string
+	UserField      string
+	SecretField    string
+	NameField      string
+	RequiredFields []string
+	DefaultPort    string
+	TenantSep      string
+	MaxDbNameLen   int
+	// Escape the business id so every business gets its own unquoted identifier
+	IsEscapedTenant bool
+}
+
+var regionDbEngines = map[db_common.DatabaseType]regionDbEngine{
+	db_common.DATABASE_TYPE_MONGODB: {
+		Name:        "mongodb",
+		ServerField: platform_common.FLD_REGION_MONGODB_SERVER,
+		UserField:   platform_common.FLD_REGION_MONGODB_USER,
+		SecretField: platform_common.FLD_REGION_MONGODB_SECRET,
+		NameField:   platform_common.FLD_REGION_MONGODB_NAME,
+		// User and secret are part of the server url for a local server
+		RequiredFields: []string{platform_common.FLD_REGION_MONGODB_SERVER, platform_common.FLD_REGION_MONGODB_NAME},
+		TenantSep:      "-",
+		// **** IMPORTANT ******: The maximum allowed database name length in MongoDB is only 38 bytes
+		MaxDbNameLen: 38,
+	},
+	db_common.DATABASE_TYPE_MYSQLDB: {
+		Name:           "mysql",
+		ServerField:    FLD_REGION_MYSQL_SERVER,
+		PortField:      FLD_REGION_MYSQL_PORT,
+		UserField:      FLD_REGION_MYSQL_USER,
+		SecretField:    FLD_REGION_MYSQL_SECRET,
+		NameField:      FLD_REGION_MYSQL_NAME,
+		RequiredFields: []string{FLD_REGION_MYSQL_SERVER, FLD_REGION_MYSQL_USER, FLD_REGION_MYSQL_SECRET, FLD_REGION_MYSQL_NAME},
+		DefaultPort:    REGION_MYSQL_DEFAULT_PORT,
+		// Hyphens would need quoting in every statement
+		TenantSep:       "_",
+		MaxDbNameLen:    64,
+		IsEscapedTenant: true,
+	},
+}
+
+// getRegionDbEngine - Engine for the db_type of the region
+func getRegionDbEngine(dataRegion utils.Map) (db_common.DatabaseType, regionDbEngine, error) {
+
+	dbType, err := utils.GetMemberDataInt(dataRegion, platform_common.FLD_REGION_DB_TYPE, true)
+	if err != nil {
+		return db_common.DATABASE_TYPE_NONE, regionDbEngine{}, err
+	}
+
+	engine, found := regionDbEngines[db_common.DatabaseType(dbType)]
+	if !found {
+		err := &utils.AppError{ErrorCode: "S30102", ErrorMsg: "Invalid value", ErrorDetail: fmt.Sprintf("Parameter %s %v is not supported for regions", platform_common.FLD_REGION_DB_TYPE, dbType)}
+		return db_common.DATABASE_TYPE_NONE, regionDbEngine{}, err
+	}
+	return db_common.DatabaseType(dbType), engine, nil
+}
+
+// validateRegionDbFields - Check the connection fields needed by the db_type of the region
+func validateRegionDbFields(dataRegion utils.Map) error {
+
+	_, engine, err := getRegionDbEngine(dataRegion)
+	if err != nil {
+		return err
+	}
+
+	for _, field := range engine.RequiredFields {
+		// Secrets are already encrypted when the stored region is validated
+		if field == engine.SecretField && dataRegion[field] != nil {
+			continue
+		}
+		if value, err := utils.GetMemberDataStr(dataRegion, field); err != nil || strings.TrimSpace(value) == "" {
+			err := &utils.AppError{ErrorCode: "S30102", ErrorMsg: "Missing value", ErrorDetail: "Parameter " + field + " is missing for " + engine.Name + " regions"}
+			return err
+		}
+	}
+	return nil
+}
+
+// isRegionDbChange - Whether the update touches the database type or connection fields
+func isRegionDbChange(indata utils.Map) bool {
+
+	if _, found := indata[platform_common.FLD_REGION_DB_TYPE]; found {
+		return true
+	}
+	for _, engine := range regionDbEngines {
+		for _, field := range []string{engine.ServerField, engine.PortField, engine.UserField, engine.SecretField, engine.NameField} {
+			if _, found := indata[field]; found && field != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// getRegionDbProps - Database props of the region, the secret is expected decrypted
+func getRegionDbProps(dataRegion utils.Map) (utils.Map, error) {
+
+	dbType, engine, err := getRegionDbEngine(dataRegion)
+	if err != nil {
+		return nil, err
+	}
+
+	dbServer, _ := utils.GetMemberDataStr(dataRegion, engine.ServerField)
+	dbUser, _ := utils.GetMemberDataStr(dataRegion, engine.UserField)
+	dbSecret, _ := utils.GetMemberDataStr(dataRegion, engine.SecretField)
+	dbName, _ := utils.GetMemberDataStr(dataRegion, engine.NameField)
+
+	regionDBProps := utils.Map{
+		db_common.DB_TYPE:   dbType,
+		db_common.DB_SERVER: dbServer,
+		db_common.DB_USER:   dbUser,
+		db_common.DB_SECRET: dbSecret,
+		db_common.DB_NAME:   dbName,
+	}
+
+	if engine.PortField != "" {
+		dbPort := engine.DefaultPort
+		if dataPort, found := dataRegion[engine.PortField]; found && dataPort != nil && fmt.Sprint(dataPort) != "" {
+			dbPort = fmt.Sprint(dataPort)
+		}
+		regionDBProps[db_common.DB_PORT] = dbPort
+	}
+	return regionDBProps, nil
+}
+
+// getTenantDbName - Name of the tenant database of the business following the rules of the engine
+func getTenantDbName(dbType db_common.DatabaseType, dbName string, businessId string) string {
+
+	engine := regionDbEngines[dbType]
+
+	if !engine.IsEscapedTenant {
+		tenantDbName := dbName + engine.TenantSep + businessId
+		// Keep the right part, the business id makes the name unique
+		if engine.MaxDbNameLen > 0 && len(tenantDbName) > engine.MaxDbNameLen {
+			tenantDbName = utils.Right(tenantDbName, engine.MaxDbNameLen)
+		}
+		return tenantDbName
+	}
+
+	tenantDbName := strings.ReplaceAll(dbName, "-", engine.TenantSep) + engine.TenantSep + escapeTenantDbName(businessId)
+	// Too long names keep their start and end with a hash of the full name
+	if engine.MaxDbNameLen > 0 && len(tenantDbName) > engine.MaxDbNameLen {
+		hash := sha256.Sum256([]byte(tenantDbName))
+		suffix := engine.TenantSep + hex.EncodeToString(hash[:])[:TENANT_DB_HASH_LEN]
+		tenantDbName = tenantDbName[:engine.MaxDbNameLen-len(suffix)] + suffix
+	}
+	return tenantDbName
+}
+
+// escapeTenantDbName - Keep lower case letters, digits and underscores, every other byte becomes
+// $ and its hex code. Different business ids always give different names, also where the
+// server compares names case insensitively.
+func escapeTenantDbName(businessId string) string {
+
+	var escaped strings.Builder
+	for idx := 0; idx < len(businessId); idx++ {
+		char := businessId[idx]
+		if (char >= 'a' && char <= 'z') || (char >= '0' && char <= '9') || char == '_' {
+			escaped.WriteByte(char)
+			continue
+		}
+		escaped.WriteString(fmt.Sprintf("$%02x", char))
+	}
+	return escaped.String()
+}
@@ -0,0 +1,49 @@
+package platform_service
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/zapscloud/golib-dbutils/db_common"
+)
+
+func TestGetTenantDbName(t *testing.T) {
+
+	longId := strings.Repeat("b", 70)
+
+	tests := []struct {
+		name       string
+		dbType     db_common.DatabaseType
+		dbName     string
+		businessId string
+		want       string
+	}{
+		{"mongodb", db_common.DATABASE_TYPE_MONGODB, "zc", "biz-1", "zc-biz-1"},
+		{"mongodb keeps the right part", db_common.DATABASE_TYPE_MONGODB, "zc", longId, longId[:38]},
+		{"mysql", db_common.DATABASE_TYPE_MYSQLDB, "zc", "biz_1", "zc_biz_1"},
+		{"mysql hyphen", db_common.DATABASE_TYPE_MYSQLDB, "zc-db", "biz-1", "zc_db_biz$2d1"},
+		{"mysql upper case", db_common.DATABASE_TYPE_MYSQLDB, "zc", "Biz", "zc_$42iz"},
+		{"mysql dollar", db_common.DATABASE_TYPE_MYSQLDB, "zc", "b$2d", "zc_b$242d"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := getTenantDbName(tt.dbType, tt.dbName, tt.businessId); got != tt.want {
+				t.Errorf("getTenantDbName(%q, %q) = %q, want %q", tt.dbName, tt.businessId, got, tt.want)
+			}
+		})
+	}
+
+	// Business ids which the hyphen replacement used to map to the same database
+	names := map[string]string{}
+	for _, businessId := range []string{"biz-1", "biz_1", "Biz_1", "biz$2d1", longId, longId + "c", longId + "-", longId + "_"} {
+		name := getTenantDbName(db_common.DATABASE_TYPE_MYSQLDB, "zc", businessId)
+		if len(name) > 64 {
+			t.Errorf("getTenantDbName(%q) = %q is longer than 64", businessId, name)
+		}
+		if other, found := names[name]; found {
+			t.Errorf("getTenantDbName() = %q for both %q and %q", name, businessId, other)
+		}
+		names[name] = businessId
+	}
+}
@@ -0,0 +1,286 @@
+package platform_service
+
+import (
+	"log"
+	"time"
+
+	"github.com/zapscloud/golib-dbutils/db_common"
+	"github.com/zapscloud/golib-platform-repository/platform_common"
+	"github.com/zapscloud/golib-utils/utils"
+)
+
+// Decommission state, kept on the region as
+// {"status": .., "started_at": .., "started_by": .., "was_accepting_tenants": ..,
+// "migrations": [{"business_id": .., "target_region_id": .., "status": ..}]}
+const (
+	FLD_REGION_DECOMMISSION   = "decommission"
+	FLD_DECOMMISSION_STATUS   = "status"
+	FLD_DECOMMISSION_STARTED  = "started_at"
+	FLD_DECOMMISSION_BY       = "started_by"
+	FLD_DECOMMISSION_RETIRED  = "retired_at"
+	FLD_DECOMMISSION_MIGRATED = "migrated_at"
+	FLD_DECOMMISSION_PENDING  = "pending"
+	FLD_DECOMMISSION_ACCEPTED = "was_accepting_tenants"
+	FLD_REGION_MIGRATIONS     = "migrations"
+	FLD_TARGET_REGION_ID      = "target_region_id"
+
+	DECOMMISSION_STATUS_ACTIVE  = "decommissioning"
+	DECOMMISSION_STATUS_RETIRED = "retired"
+
+	MIGRATION_STATUS_PENDING  = "pending"
+	MIGRATION_STATUS_MIGRATED = "migrated"
+
+	PLACEMENT_MODE_MIGRATION = "migration"
+)
+
+// Decommission - Stop new placements in the region and plan a target region for each of its
+// businesses. Calling it again refreshes the plan and reports the progress.
+func (p *regionBaseService) Decommission(regionid string, changedBy string) (utils.Map, error) {
+
+	log.Println("RegionService::Decommission - Begin", regionid)
+
+	dataRegion, err := p.validateKeyExist(regionid)
+	if err != nil {
+		return nil, err
+	}
+
+	decommission := getDecommissionState(dataRegion)
+	status, _ := utils.GetMemberDataStr(decommission, FLD_DECOMMISSION_STATUS)
+	if status == DECOMMISSION_STATUS_RETIRED {
+		err := &utils.AppError{ErrorCode: "S30105", ErrorMsg: "Region retired", ErrorDetail: "Region " + regionid + " is already retired"}
+		return nil, err
+	}
+	if status == "" {
+		decommission = utils.Map{
+			FLD_DECOMMISSION_STATUS:   DECOMMISSION_STATUS_ACTIVE,
+			FLD_DECOMMISSION_STARTED:  time.Now(),
+			FLD_DECOMMISSION_BY:       changedBy,
+			FLD_DECOMMISSION_ACCEPTED: isRegionAcceptingTenants(dataRegion),
+			FLD_REGION_MIGRATIONS:     []utils.Map{},
+		}
+	}
+
+	// Close the region first, so the placement of the targets cannot choose it
+	_, err = p.daoRegion.Update(regionid, utils.Map{FLD_REGION_IS_ACCEPTING_TENANTS: false, FLD_REGION_DECOMMISSION: decommission})
+	if err != nil {
+		return nil, err
+	}
+
+	tenants, err := listRegionTenants(p.daoBusiness, []string{regionid})
+	if err != nil {
+		return nil, err
+	}
+
+	// Targets planned but not migrated yet count against the max_tenants of their region
+	migrations := getMapList(decommission[FLD_REGION_MIGRATIONS])
+	plannedCounts := map[string]int{}
+	for _, migration := range migrations {
+		targetRegionId, _ := utils.GetMemberDataStr(migration, FLD_TARGET_REGION_ID)
+		if status, _ := utils.GetMemberDataStr(migration, FLD_DECOMMISSION_STATUS); targetRegionId != "" && status == MIGRATION_STATUS_PENDING {
+			plannedCounts[targetRegionId]++
+		}
+	}
+
+	// Plan the businesses without a target, a failed placement is retried on the next call
+	for _, dataBusiness := range tenants {
+		businessId, _ := utils.GetMemberDataStr(dataBusiness, platform_common.FLD_BUSINESS_ID)
+		migrationIdx := findMigration(migrations, businessId)
+		if migrationIdx < 0 {
+			migrations = append(migrations, utils.Map{
+				platform_common.FLD_BUSINESS_ID: businessId,
+				FLD_DECOMMISSION_STATUS:         MIGRATION_STATUS_PENDING,
+			})
+			migrationIdx = len(migrations) - 1
+		}
+		if targetRegionId, _ := utils.GetMemberDataStr(migrations[migrationIdx], FLD_TARGET_REGION_ID); targetRegionId != "" {
+			continue
+		}
+
+		dataPlace := copySettingValue(dataBusiness)
+		delete(dataPlace, platform_common.FLD_BUSINESS_REGION_ID)
+		if placement, err := placeRegion(p.daoBusiness, p.daoRegion, dataPlace, plannedCounts); err == nil {
+			targetRegionId, _ := utils.GetMemberDataStr(placement, platform_common.FLD_REGION_ID)
+			migrations[migrationIdx][FLD_TARGET_REGION_ID] = targetRegionId
+			plannedCounts[targetRegionId]++
+		} else {
+			log.Println("RegionService::Decommission - No target for ", businessId, err)
+		}
+	}
+	decommission[FLD_REGION_MIGRATIONS] = migrations
+
+	_, err = p.daoRegion.Update(regionid, utils.Map{FLD_REGION_DECOMMISSION: decommission})
+	if err != nil {
+		return nil, err
+	}
+
+	response := getDecommissionReport(regionid, decommission, len(tenants))
+
+	log.Println("RegionService::Decommission - End ", len(tenants))
+	return response, nil
+}
+
+// MigrateBusiness - Move the business to its target region once its data has been copied there.
+// An empty targetRegionId uses the planned target.
+func (p *regionBaseService) MigrateBusiness(regionid string, businessId string, targetRegionId string) (utils.Map, error) {
+
+	log.Println("RegionService::MigrateBusiness - Begin", regionid, businessId, targetRegionId)
+
+	dataRegion, err := p.validateKeyExist(regionid)
+	if err != nil {
+		return nil, err
+	}
+
+	decommission := getDecommissionState(dataRegion)
+	if status, _ := utils.GetMemberDataStr(decommission, FLD_DECOMMISSION_STATUS); status != DECOMMISSION_STATUS_ACTIVE {
+		err := &utils.AppError{ErrorCode: "S30105", ErrorMsg: "Not decommissioning", ErrorDetail: "Region " + regionid + " is not being decommissioned"}
+		return nil, err
+	}
+
+	migrations := getMapList(decommission[FLD_REGION_MIGRATIONS])
+	migrationIdx := findMigration(migrations, businessId)
+	if migrationIdx < 0 {
+		err := &utils.AppError{ErrorCode: "S30105", ErrorMsg: "Unknown business", ErrorDetail: "Business " + businessId + " is not planned for migration, run Decommission again"}
+		return nil, err
+	}
+	if targetRegionId == "" {
+		targetRegionId, _ = utils.GetMemberDataStr(migrations[migrationIdx], FLD_TARGET_REGION_ID)
+	}
+	if targetRegionId == "" || targetRegionId == regionid {
+		err := &utils.AppError{ErrorCode: "S30105", ErrorMsg: "Missing target", ErrorDetail: "Business " + businessId + " needs a target region"}
+		return nil, err
+	}
+
+	dataBusiness, err := p.daoBusiness.Get(businessId)
+	if err != nil {
+		return nil, err
+	}
+	if currentRegion, _ := utils.GetMemberDataStr(dataBusiness, platform_common.FLD_BUSINESS_REGION_ID); currentRegion != regionid {
+		err := &utils.AppError{ErrorCode: "S30105", ErrorMsg: "Invalid business", ErrorDetail: "Business " + businessId + " is not in region " + regionid}
+		return nil, err
+	}
+
+	placement, err := placeExplicit(p.daoBusiness, p.daoRegion, targetRegionId, nil)
+	if err != nil {
+		return nil, err
+	}
+	delete(placement, platform_common.FLD_REGION_ID)
+	placement[FLD_PLACEMENT_MODE] = PLACEMENT_MODE_MIGRATION
+	placement[FLD_PLACEMENT_REASON] = "decommission of region " + regionid
+
+	migrations[migrationIdx][FLD_TARGET_REGION_ID] = targetRegionId
+	migrations[migrationIdx][FLD_DECOMMISSION_STATUS] = MIGRATION_STATUS_MIGRATED
+	migrations[migrationIdx][FLD_DECOMMISSION_MIGRATED] = time.Now()
+	decommission[FLD_REGION_MIGRATIONS] = migrations
+
+	err = runInTransaction(&p.DatabaseService, func() error {
+		_, err := p.daoBusiness.Update(businessId, utils.Map{platform_common.FLD_BUSINESS_REGION_ID: targetRegionId, FLD_BUSINESS_PLACEMENT: placement})
+		if err != nil {
+			return err
+		}
+		_, err = p.daoRegion.Update(regionid, utils.Map{FLD_REGION_DECOMMISSION: decommission})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Println("RegionService::MigrateBusiness - End ")
+	return migrations[migrationIdx], nil
+}
+
+// RetireRegion - Mark the decommissioned region retired once no business is left in it
+func (p *regionBaseService) RetireRegion(regionid string) (utils.Map, error) {
+
+	log.Println("RegionService::RetireRegion - Begin", regionid)
+
+	dataRegion, err := p.validateKeyExist(regionid)
+	if err != nil {
+		return nil, err
+	}
+
+	decommission := getDecommissionState(dataRegion)
+	if status, _ := utils.GetMemberDataStr(decommission, FLD_DECOMMISSION_STATUS); status != DECOMMISSION_STATUS_ACTIVE {
+		err := &utils.AppError{ErrorCode: "S30105", ErrorMsg: "Not decommissioning", ErrorDetail: "Region " + regionid + " is not being decommissioned"}
+		return nil, err
+	}
+	if err := p.validateRegionEmpty(regionid); err != nil {
+		return nil, err
+	}
+
+	decommission[FLD_DECOMMISSION_STATUS] = DECOMMISSION_STATUS_RETIRED
+	decommission[FLD_DECOMMISSION_RETIRED] = time.Now()
+
+	data, err := p.daoRegion.Update(regionid, utils.Map{FLD_REGION_DECOMMISSION: decommission, db_common.FLD_IS_DELETED: true})
+	data = redactRegionSecrets(data)
+
+	log.Println("RegionService::RetireRegion - End ", err)
+	return data, err
+}
+
+// CancelDecommission - Take new businesses again when the region did before the decommission,
+// migrated businesses stay where they are
+func (p *regionBaseService) CancelDecommission(regionid string) (utils.Map, error) {
+
+	log.Println("RegionService::CancelDecommission - Begin", regionid)
+
+	dataRegion, err := p.validateKeyExist(regionid)
+	if err != nil {
+		return nil, err
+	}
+
+	decommission := getDecommissionState(dataRegion)
+	if status, _ := utils.GetMemberDataStr(decommission, FLD_DECOMMISSION_STATUS); status != DECOMMISSION_STATUS_ACTIVE {
+		err := &utils.AppError{ErrorCode: "S30105", ErrorMsg: "Not decommissioning", ErrorDetail: "Region " + regionid + " is not being decommissioned"}
+		return nil, err
+	}
+
+	// Decommissions started before the flag was kept reopen the region
+	wasAccepting, err := utils.GetMemberDataBool(decommission, FLD_DECOMMISSION_ACCEPTED)
+	if err != nil {
+		wasAccepting = true
+	}
+
+	data, err := p.daoRegion.Update(regionid, utils.Map{FLD_REGION_IS_ACCEPTING_TENANTS: wasAccepting, FLD_REGION_DECOMMISSION: nil})
+	data = redactRegionSecrets(data)
+
+	log.Println("RegionService::CancelDecommission - End ", err)
+	return data, err
+}
+
+// validateRegionEmpty - Fail while businesses still use the region
+func (p *regionBaseService) validateRegionEmpty(regionid string) error {
+
+	tenantCounts, err := countRegionTenants(p.daoBusiness, []string{regionid})
+	if err != nil {
+		return err
+	}
+	if tenantCount := tenantCounts[regionid]; tenantCount > 0 {
+		err := &utils.AppError{ErrorCode: "S30105", ErrorMsg: "Region in use", ErrorDetail: "Region " + regionid + " still has businesses, decommission it and migrate them first"}
+		return err
+	}
+	return nil
+}
+
+func getDecommissionState(dataRegion utils.Map) utils.Map {
+	dataList := getMapList([]interface{}{dataRegion[FLD_REGION_DECOMMISSION]})
+	if len(dataList) == 0 {
+		return utils.Map{}
+	}
+	return dataList[0]
+}
+
+func findMigration(migrations []utils.Map, businessId string) int {
+	for idx, migration := range migrations {
+		if id, _ := utils.GetMemberDataStr(migration, platform_common.FLD_BUSINESS_ID); id == businessId {
+			return idx
+		}
+	}
+	return -1
+}
+
+func getDecommissionReport(regionid string, decommission utils.Map, pending int) utils.Map {
+	report := copySettingValue(decommission)
+	report[platform_common.FLD_REGION_ID] = regionid
+	report[FLD_DECOMMISSION_PENDING] = pending
+	return report
+}
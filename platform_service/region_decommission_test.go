@@ -0,0 +1,81 @@
+package platform_service
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/zapscloud/golib-platform-repository/platform_common"
+	"github.com/zapscloud/golib-utils/utils"
+)
+
+func TestDecommissionCapacity(t *testing.T) {
+
+	daoRegion, daoBusiness := newFakePlacement([]utils.Map{
+		{platform_common.FLD_REGION_ID: "r_old"},
+		{platform_common.FLD_REGION_ID: "r_a", FLD_REGION_MAX_TENANTS: 3},
+		{platform_common.FLD_REGION_ID: "r_b", FLD_REGION_MAX_TENANTS: 2},
+	}, map[string]int{"r_old": 6, "r_a": 1})
+	p := &regionBaseService{daoRegion: daoRegion, daoBusiness: daoBusiness}
+
+	report, err := p.Decommission("r_old", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two more fit in each region, the remaining businesses wait for capacity
+	targets := map[string]int{}
+	for _, migration := range getMapList(report[FLD_REGION_MIGRATIONS]) {
+		targetRegionId, _ := utils.GetMemberDataStr(migration, FLD_TARGET_REGION_ID)
+		targets[targetRegionId]++
+	}
+	want := map[string]int{"r_a": 2, "r_b": 2, "": 2}
+	if fmt.Sprint(targets) != fmt.Sprint(want) {
+		t.Errorf("Decommission() planned %v, want %v", targets, want)
+	}
+
+	// Planning again keeps the targets and does not overfill the regions
+	report, err = p.Decommission("r_old", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	targets = map[string]int{}
+	for _, migration := range getMapList(report[FLD_REGION_MIGRATIONS]) {
+		targetRegionId, _ := utils.GetMemberDataStr(migration, FLD_TARGET_REGION_ID)
+		targets[targetRegionId]++
+	}
+	if fmt.Sprint(targets) != fmt.Sprint(want) {
+		t.Errorf("Decommission() planned %v on the second call, want %v", targets, want)
+	}
+}
+
+func TestCancelDecommission(t *testing.T) {
+
+	tests := []struct {
+		name          string
+		region        utils.Map
+		wantAccepting bool
+	}{
+		{"open region reopened", utils.Map{platform_common.FLD_REGION_ID: "r_old"}, true},
+		{"closed region stays closed", utils.Map{platform_common.FLD_REGION_ID: "r_old", FLD_REGION_IS_ACCEPTING_TENANTS: false}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			daoRegion, daoBusiness := newFakePlacement([]utils.Map{tt.region}, nil)
+			p := &regionBaseService{daoRegion: daoRegion, daoBusiness: daoBusiness}
+
+			if _, err := p.Decommission("r_old", "admin"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := p.CancelDecommission("r_old"); err != nil {
+				t.Fatal(err)
+			}
+			if isAccepting := isRegionAcceptingTenants(tt.region); isAccepting != tt.wantAccepting {
+				t.Errorf("CancelDecommission() accepting tenants = %v, want %v", isAccepting, tt.wantAccepting)
+			}
+			if tt.region[FLD_REGION_DECOMMISSION] != nil {
+				t.Errorf("CancelDecommission() kept the decommission state %v", tt.region[FLD_REGION_DECOMMISSION])
+			}
+		})
+	}
+}
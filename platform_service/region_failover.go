@@ -0,0 +1,299 @@
+package platform_service
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/zapscloud/golib-platform-repository/platform_common"
+	"github.com/zapscloud/golib-utils/utils"
+)
+
+// Region endpoints. The server fields of the region are the primary, endpoints lists the secondaries
+// and read replicas as {"endpoint_id": .., "role": .., "server": .., "port": ..}. Endpoints share
+// the user and secret of the region.
+const (
+	FLD_REGION_ENDPOINTS       = "endpoints"
+	FLD_REGION_FAILOVER_EVENTS = "failover_events"
+	FLD_ENDPOINT_ID            = "endpoint_id"
+	FLD_ENDPOINT_ROLE          = "role"
+	FLD_ENDPOINT_SERVER        = "server"
+	FLD_ENDPOINT_PORT          = "port"
+	FLD_FAILOVER_MODE          = "mode"
+	FLD_FAILOVER_FROM_SERVER   = "from_server"
+	FLD_FAILOVER_TO_SERVER     = "to_server"
+	FLD_FAILOVER_REASON        = "reason"
+	FLD_FAILOVER_CHANGED_BY    = "changed_by"
+	FLD_FAILOVER_AT            = "failover_at"
+	FLD_FAILOVER_DONE          = "failed_over"
+
+	// Option of OpenRegionDatabaseService
+	FLD_READ_PREFERENCE = "read_preference"
+
+	ENDPOINT_ROLE_PRIMARY      = "primary"
+	ENDPOINT_ROLE_SECONDARY    = "secondary"
+	ENDPOINT_ROLE_READ_REPLICA = "read_replica"
+
+	READ_PREFERENCE_PRIMARY = "primary"
+	READ_PREFERENCE_REPLICA = "replica"
+
+	FAILOVER_MODE_MANUAL = "manual"
+	FAILOVER_MODE_AUTO   = "auto"
+
+	REGION_FAILOVER_EVENTS_MAX = 100
+)
+
+// Failover - Promote the secondary endpoint to primary, the current primary takes the place of the
+// endpoint as a secondary. Read replicas cannot be promoted. The switch is recorded in
+// failover_events of the region.
+func (p *regionBaseService) Failover(regionid string, endpointId string, reason string, changedBy string) (utils.Map, error) {
+
+	log.Println("RegionService::Failover - Begin", regionid, endpointId)
+
+	dataRegion, err := p.validateKeyExist(regionid)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := p.failoverToEndpoint(regionid, dataRegion, endpointId, FAILOVER_MODE_MANUAL, reason, changedBy)
+
+	log.Println("RegionService::Failover - End ", err)
+	return data, err
+}
+
+// AutoFailover - Check the primary and, when it is down, promote the first healthy secondary.
+// Read replicas are never promoted automatically.
+func (p *regionBaseService) AutoFailover(regionid string, changedBy string) (utils.Map, error) {
+
+	log.Println("RegionService::AutoFailover - Begin", regionid)
+
+	dataRegion, err := p.validateKeyExist(regionid)
+	if err != nil {
+		return nil, err
+	}
+	dataPlain, err := decryptRegionSecrets(dataRegion)
+	if err != nil {
+		return nil, err
+	}
+
+	// A rejected login is not solved by a failover, the endpoints share the credentials
+	dataHealth := checkRegionConnection(dataPlain)
+	if isReachable, _ := utils.GetMemberDataBool(dataHealth, FLD_REGION_IS_REACHABLE); isReachable {
+		log.Println("RegionService::AutoFailover - End, primary is healthy")
+		return utils.Map{platform_common.FLD_REGION_ID: regionid, FLD_FAILOVER_DONE: false}, nil
+	}
+	primaryError, _ := utils.GetMemberDataStr(dataHealth, FLD_REGION_HEALTH_ERROR)
+
+	for _, endpoint := range getRegionEndpoints(dataRegion) {
+		role, _ := utils.GetMemberDataStr(endpoint, FLD_ENDPOINT_ROLE)
+		if role != ENDPOINT_ROLE_SECONDARY {
+			continue
+		}
+		if err := validateRegionConnection(applyRegionEndpoint(dataPlain, endpoint)); err != nil {
+			continue
+		}
+
+		endpointId, _ := utils.GetMemberDataStr(endpoint, FLD_ENDPOINT_ID)
+		data, err := p.failoverToEndpoint(regionid, dataRegion, endpointId, FAILOVER_MODE_AUTO, "Primary unreachable: "+primaryError, changedBy)
+		if err != nil {
+			return nil, err
+		}
+		data[FLD_FAILOVER_DONE] = true
+
+		log.Println("RegionService::AutoFailover - End, promoted ", endpointId)
+		return data, nil
+	}
+
+	err = &utils.AppError{ErrorCode: "S30104", ErrorMsg: "Failover not possible", ErrorDetail: "Primary of region " + regionid + " is unreachable and no secondary is healthy"}
+	return nil, err
+}
+
+// failoverToEndpoint - Swap the primary with the endpoint. The region is read again in the
+// transaction, a failover done meanwhile by another caller is a conflict and is not swapped back.
+func (p *regionBaseService) failoverToEndpoint(regionid string, dataRegion utils.Map, endpointId string, mode string, reason string, changedBy string) (utils.Map, error) {
+
+	_, engine, err := getRegionDbEngine(dataRegion)
+	if err != nil {
+		return nil, err
+	}
+	checkedServer, _ := utils.GetMemberDataStr(dataRegion, engine.ServerField)
+
+	var data utils.Map
+	err = runInTransaction(&p.DatabaseService, func() error {
+		dataRegion, err := p.daoRegion.Get(regionid)
+		if err != nil {
+			return err
+		}
+		if oldServer, _ := utils.GetMemberDataStr(dataRegion, engine.ServerField); oldServer != checkedServer {
+			err := &utils.AppError{ErrorStatus: 409, ErrorMsg: "Region changed", ErrorDetail: "Primary of region " + regionid + " changed during the failover, check the region again"}
+			return err
+		}
+
+		indata, err := getFailoverUpdate(regionid, dataRegion, engine, endpointId, mode, reason, changedBy)
+		if err != nil {
+			return err
+		}
+		data, err = p.daoRegion.Update(regionid, indata)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return redactRegionSecrets(data), nil
+}
+
+// getFailoverUpdate - Region fields swapping the primary with the endpoint, with the failover event
+func getFailoverUpdate(regionid string, dataRegion utils.Map, engine regionDbEngine, endpointId string, mode string, reason string, changedBy string) (utils.Map, error) {
+
+	endpoints := getRegionEndpoints(dataRegion)
+	endpointIdx := -1
+	for idx, endpoint := range endpoints {
+		if id, _ := utils.GetMemberDataStr(endpoint, FLD_ENDPOINT_ID); id == endpointId {
+			endpointIdx = idx
+		}
+	}
+	if endpointIdx < 0 {
+		err := &utils.AppError{ErrorCode: "S30104", ErrorMsg: "Invalid endpoint", ErrorDetail: "Endpoint " + endpointId + " is not defined for region " + regionid}
+		return nil, err
+	}
+
+	promoted := endpoints[endpointIdx]
+	if role, _ := utils.GetMemberDataStr(promoted, FLD_ENDPOINT_ROLE); role != ENDPOINT_ROLE_SECONDARY {
+		err := &utils.AppError{ErrorCode: "S30104", ErrorMsg: "Invalid endpoint", ErrorDetail: "Endpoint " + endpointId + " is a " + role + ", only a " + ENDPOINT_ROLE_SECONDARY + " can be promoted"}
+		return nil, err
+	}
+	oldServer, _ := utils.GetMemberDataStr(dataRegion, engine.ServerField)
+	newServer, _ := utils.GetMemberDataStr(promoted, FLD_ENDPOINT_SERVER)
+
+	// The old primary keeps the id of the endpoint it swapped with
+	demoted := utils.Map{
+		FLD_ENDPOINT_ID:     endpointId,
+		FLD_ENDPOINT_ROLE:   ENDPOINT_ROLE_SECONDARY,
+		FLD_ENDPOINT_SERVER: oldServer,
+	}
+	indata := utils.Map{engine.ServerField: newServer}
+	if engine.PortField != "" {
+		if oldPort, found := dataRegion[engine.PortField]; found {
+			demoted[FLD_ENDPOINT_PORT] = oldPort
+		}
+		if newPort, found := promoted[FLD_ENDPOINT_PORT]; found {
+			indata[engine.PortField] = newPort
+		}
+	}
+	endpoints[endpointIdx] = demoted
+	indata[FLD_REGION_ENDPOINTS] = endpoints
+
+	event := utils.Map{
+		FLD_ENDPOINT_ID:          endpointId,
+		FLD_FAILOVER_MODE:        mode,
+		FLD_FAILOVER_FROM_SERVER: oldServer,
+		FLD_FAILOVER_TO_SERVER:   newServer,
+		FLD_FAILOVER_REASON:      reason,
+		FLD_FAILOVER_CHANGED_BY:  changedBy,
+		FLD_FAILOVER_AT:          time.Now(),
+	}
+	events := append(getMapList(dataRegion[FLD_REGION_FAILOVER_EVENTS]), event)
+	if len(events) > REGION_FAILOVER_EVENTS_MAX {
+		events = events[len(events)-REGION_FAILOVER_EVENTS_MAX:]
+	}
+	indata[FLD_REGION_FAILOVER_EVENTS] = events
+	return indata, nil
+}
+
+// validateRegionEndpoints - Endpoints need a unique id, a server and the role secondary or read_replica
+func validateRegionEndpoints(dataRegion utils.Map) error {
+
+	dataVal, found := dataRegion[FLD_REGION_ENDPOINTS]
+	if !found || dataVal == nil {
+		return nil
+	}
+
+	endpointIds := map[string]bool{}
+	for _, endpoint := range getRegionEndpoints(dataRegion) {
+		endpointId, _ := utils.GetMemberDataStr(endpoint, FLD_ENDPOINT_ID)
+		role, _ := utils.GetMemberDataStr(endpoint, FLD_ENDPOINT_ROLE)
+		server, _ := utils.GetMemberDataStr(endpoint, FLD_ENDPOINT_SERVER)
+
+		errDetail := ""
+		if strings.TrimSpace(endpointId) == "" {
+			errDetail = "Every endpoint needs an " + FLD_ENDPOINT_ID
+		} else if endpointIds[endpointId] {
+			errDetail = "Endpoint " + endpointId + " is given twice"
+		} else if role != ENDPOINT_ROLE_SECONDARY && role != ENDPOINT_ROLE_READ_REPLICA {
+			errDetail = "Role of endpoint " + endpointId + " should be " + ENDPOINT_ROLE_SECONDARY + " or " + ENDPOINT_ROLE_READ_REPLICA
+		} else if strings.TrimSpace(server) == "" {
+			errDetail = "Endpoint " + endpointId + " has no " + FLD_ENDPOINT_SERVER
+		}
+		if errDetail != "" {
+			err := &utils.AppError{ErrorCode: "S30102", ErrorMsg: "Invalid endpoint", ErrorDetail: errDetail}
+			return err
+		}
+		endpointIds[endpointId] = true
+	}
+	return nil
+}
+
+func getRegionEndpoints(dataRegion utils.Map) []utils.Map {
+	return getMapList(dataRegion[FLD_REGION_ENDPOINTS])
+}
+
+// applyRegionEndpoint - Copy of the region connecting to the endpoint instead of the primary
+func applyRegionEndpoint(dataRegion utils.Map, endpoint utils.Map) utils.Map {
+
+	dataEndpoint := copySettingValue(dataRegion)
+
+	_, engine, err := getRegionDbEngine(dataRegion)
+	if err != nil {
+		return dataEndpoint
+	}
+	dataEndpoint[engine.ServerField], _ = utils.GetMemberDataStr(endpoint, FLD_ENDPOINT_SERVER)
+	if port, found := endpoint[FLD_ENDPOINT_PORT]; found && engine.PortField != "" {
+		dataEndpoint[engine.PortField] = port
+	}
+	return dataEndpoint
+}
+
+// selectRegionEndpoint - Region to connect to for the read preference. Readers asking for a replica
+// get one of the secondaries or read replicas, always the same one for a business, and the primary
+// when the region has none.
+func selectRegionEndpoint(dataRegion utils.Map, readPreference string, businessId string) (utils.Map, error) {
+
+	switch readPreference {
+	case "", READ_PREFERENCE_PRIMARY:
+		return dataRegion, nil
+	case READ_PREFERENCE_REPLICA:
+	default:
+		err := &utils.AppError{ErrorStatus: 400, ErrorMsg: "Invalid value", ErrorDetail: fmt.Sprintf("%s should be %s or %s", FLD_READ_PREFERENCE, READ_PREFERENCE_PRIMARY, READ_PREFERENCE_REPLICA)}
+		return nil, err
+	}
+
+	replicas := []utils.Map{}
+	for _, endpoint := range getRegionEndpoints(dataRegion) {
+		role, _ := utils.GetMemberDataStr(endpoint, FLD_ENDPOINT_ROLE)
+		if role == ENDPOINT_ROLE_SECONDARY || role == ENDPOINT_ROLE_READ_REPLICA {
+			replicas = append(replicas, endpoint)
+		}
+	}
+	if len(replicas) == 0 {
+		return dataRegion, nil
+	}
+
+	hasher := fnv.New32a()
+	hasher.Write([]byte(businessId))
+	return applyRegionEndpoint(dataRegion, replicas[hasher.Sum32()%uint32(len(replicas))]), nil
+}
+
+// checkRegionEndpoints - Health of each endpoint of the region, the secrets are expected decrypted
+func checkRegionEndpoints(dataRegion utils.Map) []utils.Map {
+
+	endpointsHealth := []utils.Map{}
+	for _, endpoint := range getRegionEndpoints(dataRegion) {
+		dataHealth := checkRegionConnection(applyRegionEndpoint(dataRegion, endpoint))
+		dataHealth[FLD_ENDPOINT_ID] = endpoint[FLD_ENDPOINT_ID]
+		dataHealth[FLD_ENDPOINT_ROLE] = endpoint[FLD_ENDPOINT_ROLE]
+		endpointsHealth = append(endpointsHealth, dataHealth)
+	}
+	return endpointsHealth
+}
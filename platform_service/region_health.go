@@ -0,0 +1,220 @@
+package platform_service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/zapscloud/golib-dbutils/db_common"
+	"github.com/zapscloud/golib-dbutils/mysql_utils"
+	"github.com/zapscloud/golib-platform-repository/platform_common"
+	"github.com/zapscloud/golib-utils/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// Region health fields. Create and Update test-connect when indata has test_connection set to true.
+const (
+	FLD_REGION_TEST_CONNECTION = "test_connection"
+	FLD_REGION_IS_REACHABLE    = "is_reachable"
+	FLD_REGION_AUTH_STATUS     = "auth_status"
+	FLD_REGION_LATENCY_MS      = "latency_ms"
+	FLD_REGION_SERVER_VERSION  = "server_version"
+	FLD_REGION_HEALTH_ERROR    = "error"
+	FLD_REGION_CHECKED_AT      = "checked_at"
+
+	REGION_AUTH_OK      = "ok"
+	REGION_AUTH_FAILED  = "failed"
+	REGION_AUTH_UNKNOWN = "unknown"
+
+	REGION_CONNECT_TIMEOUT = 10 * time.Second
+)
+
+// HealthCheck - Connect to the database server of the region and report latency, server version and auth status
+func (p *regionBaseService) HealthCheck(regionid string) (utils.Map, error) {
+
+	log.Println("RegionService::HealthCheck - Begin", regionid)
+
+	dataRegion, err := p.validateKeyExist(regionid)
+	if err != nil {
+		return nil, err
+	}
+
+	dataRegion, err = decryptRegionSecrets(dataRegion)
+	if err != nil {
+		return nil, err
+	}
+
+	dataHealth := checkRegionConnection(dataRegion)
+	dataHealth[platform_common.FLD_REGION_ID] = regionid
+	dataHealth[FLD_ENDPOINT_ROLE] = ENDPOINT_ROLE_PRIMARY
+	dataHealth[FLD_REGION_ENDPOINTS] = checkRegionEndpoints(dataRegion)
+
+	log.Println("RegionService::HealthCheck - End ", dataHealth)
+	return dataHealth, nil
+}
+
+// testConnectionRequested - Read and remove the test_connection flag, it is not stored with the region
+func testConnectionRequested(indata utils.Map) bool {
+	testConnection, _ := utils.GetMemberDataBool(indata, FLD_REGION_TEST_CONNECTION)
+	delete(indata, FLD_REGION_TEST_CONNECTION)
+	return testConnection
+}
+
+// validateRegionConnection - Fail unless the region database accepts the given credentials
+func validateRegionConnection(dataRegion utils.Map) error {
+
+	dataHealth := checkRegionConnection(dataRegion)
+
+	isReachable, _ := utils.GetMemberDataBool(dataHealth, FLD_REGION_IS_REACHABLE)
+	authStatus, _ := utils.GetMemberDataStr(dataHealth, FLD_REGION_AUTH_STATUS)
+	if isReachable && authStatus == REGION_AUTH_OK {
+		return nil
+	}
+
+	errDetail, _ := utils.GetMemberDataStr(dataHealth, FLD_REGION_HEALTH_ERROR)
+	errMsg := "Region not reachable"
+	if authStatus == REGION_AUTH_FAILED {
+		errMsg = "Region authentication failed"
+	}
+	err := &utils.AppError{ErrorCode: "S30103", ErrorMsg: errMsg, ErrorDetail: errDetail}
+	return err
+}
+
+// checkRegionConnection - Test-connect with the connection settings of the region
+func checkRegionConnection(dataRegion utils.Map) utils.Map {
+
+	dataHealth := utils.Map{
+		FLD_REGION_IS_REACHABLE:   false,
+		FLD_REGION_AUTH_STATUS:    REGION_AUTH_UNKNOWN,
+		FLD_REGION_LATENCY_MS:     int64(0),
+		FLD_REGION_SERVER_VERSION: "",
+		FLD_REGION_HEALTH_ERROR:   "",
+		FLD_REGION_CHECKED_AT:     time.Now(),
+	}
+
+	dbProps, err := getRegionDbProps(dataRegion)
+	if err != nil {
+		dataHealth[FLD_REGION_HEALTH_ERROR] = err.Error()
+		return dataHealth
+	}
+
+	switch dbProps[db_common.DB_TYPE] {
+	case db_common.DATABASE_TYPE_MONGODB:
+		checkMongoRegionConnection(dbProps, dataHealth)
+	case db_common.DATABASE_TYPE_MYSQLDB:
+		checkMySqlRegionConnection(dbProps, dataHealth)
+	}
+	return dataHealth
+}
+
+// checkMongoRegionConnection - Uses its own client rather than db_utils, whose cached connections
+// would hide a wrong secret
+func checkMongoRegionConnection(dbProps utils.Map, dataHealth utils.Map) {
+
+	dbServer, _ := utils.GetMemberDataStr(dbProps, db_common.DB_SERVER)
+	dbUser, _ := utils.GetMemberDataStr(dbProps, db_common.DB_USER)
+	dbSecret, _ := utils.GetMemberDataStr(dbProps, db_common.DB_SECRET)
+
+	// Same URL as golib-dbutils builds for the tenants
+	dbUrl := dbServer
+	if !strings.Contains(dbServer, "localhost") && !strings.Contains(dbServer, "127.0.0.1") {
+		dbUrl = fmt.Sprintf("mongodb+srv://%s:%s@%s/?retryWrites=true&w=majority", dbUser, dbSecret, dbServer)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), REGION_CONNECT_TIMEOUT)
+	defer cancel()
+
+	clientOptions := options.Client().ApplyURI(dbUrl).SetServerSelectionTimeout(REGION_CONNECT_TIMEOUT)
+	client, err := mongo.Connect(ctx, clientOptions)
+	if err != nil {
+		dataHealth[FLD_REGION_HEALTH_ERROR] = err.Error()
+		return
+	}
+	defer client.Disconnect(context.Background())
+
+	// Connect is lazy, the first ping opens the connection and authenticates
+	if err := client.Ping(ctx, readpref.Primary()); err != nil {
+		dataHealth[FLD_REGION_HEALTH_ERROR] = err.Error()
+		if isRegionAuthError(err) {
+			dataHealth[FLD_REGION_IS_REACHABLE] = true
+			dataHealth[FLD_REGION_AUTH_STATUS] = REGION_AUTH_FAILED
+		}
+		return
+	}
+	dataHealth[FLD_REGION_IS_REACHABLE] = true
+	dataHealth[FLD_REGION_AUTH_STATUS] = REGION_AUTH_OK
+
+	// Time a second ping, so the latency leaves out the handshake
+	startTime := time.Now()
+	if err := client.Ping(ctx, readpref.Primary()); err == nil {
+		dataHealth[FLD_REGION_LATENCY_MS] = time.Since(startTime).Milliseconds()
+	}
+
+	var buildInfo bson.M
+	if err := client.Database("admin").RunCommand(ctx, bson.D{{Key: "buildInfo", Value: 1}}).Decode(&buildInfo); err == nil {
+		dataHealth[FLD_REGION_SERVER_VERSION], _ = buildInfo["version"].(string)
+	}
+}
+
+// checkMySqlRegionConnection - Connects to the database of the region rather than a tenant one
+func checkMySqlRegionConnection(dbProps utils.Map, dataHealth utils.Map) {
+
+	dbServer, _ := utils.GetMemberDataStr(dbProps, db_common.DB_SERVER)
+	dbPort, _ := utils.GetMemberDataStr(dbProps, db_common.DB_PORT)
+	dbUser, _ := utils.GetMemberDataStr(dbProps, db_common.DB_USER)
+	dbSecret, _ := utils.GetMemberDataStr(dbProps, db_common.DB_SECRET)
+	dbName, _ := utils.GetMemberDataStr(dbProps, db_common.DB_NAME)
+
+	ctx, cancel := context.WithTimeout(context.Background(), REGION_CONNECT_TIMEOUT)
+	defer cancel()
+
+	// Same DSN as golib-dbutils builds for the tenants
+	db, err := sql.Open("mysql", mysql_utils.BuildDSN(dbServer, dbPort, dbUser, dbSecret, dbName))
+	if err != nil {
+		dataHealth[FLD_REGION_HEALTH_ERROR] = err.Error()
+		return
+	}
+	defer db.Close()
+
+	if err := db.PingContext(ctx); err != nil {
+		dataHealth[FLD_REGION_HEALTH_ERROR] = err.Error()
+		if isRegionAuthError(err) {
+			dataHealth[FLD_REGION_IS_REACHABLE] = true
+			dataHealth[FLD_REGION_AUTH_STATUS] = REGION_AUTH_FAILED
+		}
+		return
+	}
+	dataHealth[FLD_REGION_IS_REACHABLE] = true
+	dataHealth[FLD_REGION_AUTH_STATUS] = REGION_AUTH_OK
+
+	startTime := time.Now()
+	if err := db.PingContext(ctx); err == nil {
+		dataHealth[FLD_REGION_LATENCY_MS] = time.Since(startTime).Milliseconds()
+	}
+
+	var version string
+	if err := db.QueryRowContext(ctx, "SELECT VERSION()").Scan(&version); err == nil {
+		dataHealth[FLD_REGION_SERVER_VERSION] = version
+	}
+}
+
+func isRegionAuthError(err error) bool {
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && (cmdErr.Code == 18 || cmdErr.Code == 13) {
+		return true
+	}
+	// Access denied, or no access to the database
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) && (mysqlErr.Number == 1045 || mysqlErr.Number == 1044) {
+		return true
+	}
+	return strings.Contains(strings.ToLower(err.Error()), "auth")
+}
@@ -0,0 +1,326 @@
+package platform_service
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/zapscloud/golib-dbutils/db_common"
+	"github.com/zapscloud/golib-platform-repository/platform_common"
+	"github.com/zapscloud/golib-platform-repository/platform_repository"
+	"github.com/zapscloud/golib-utils/utils"
+)
+
+// Placement fields of regions and businesses
+const (
+	// Region
+	FLD_REGION_COUNTRY              = "country"
+	FLD_REGION_SERVED_COUNTRIES     = "served_countries"
+	FLD_REGION_RESIDENCY_ZONES      = "residency_zones"
+	FLD_REGION_MAX_TENANTS          = "max_tenants"
+	FLD_REGION_IS_ACCEPTING_TENANTS = "is_accepting_tenants"
+
+	// Business
+	FLD_BUSINESS_COUNTRY        = "country"
+	FLD_BUSINESS_DATA_RESIDENCY = "data_residency"
+	FLD_BUSINESS_PLACEMENT      = "placement"
+
+	// Placement decision
+	FLD_PLACEMENT_MODE         = "mode"
+	FLD_PLACEMENT_REASON       = "reason"
+	FLD_PLACEMENT_TENANT_COUNT = "tenant_count"
+	FLD_PLACEMENT_CANDIDATES   = "candidates"
+	FLD_PLACEMENT_DECIDED_AT   = "decided_at"
+
+	PLACEMENT_MODE_AUTO     = "auto"
+	PLACEMENT_MODE_EXPLICIT = "explicit"
+
+	PLACEMENT_REASON_EXPLICIT       = "chosen by caller"
+	PLACEMENT_REASON_HOME_COUNTRY   = "region in the business country"
+	PLACEMENT_REASON_SERVED_COUNTRY = "region serving the business country"
+	PLACEMENT_REASON_LEAST_UTILIZED = "least utilized region"
+)
+
+// regionCandidate - Region open for the business with its current load
+type regionCandidate struct {
+	regionId    string
+	dataRegion  utils.Map
+	tenantCount int
+	maxTenants  int
+	rank        int
+}
+
+// PlaceRegion - Choose the region for a new business without creating it. A region given in indata
+// is checked as the explicit choice, otherwise the region is chosen from the country and
+// data_residency of the business, the regions accepting tenants and their free capacity.
+func (p *businessBaseService) PlaceRegion(indata utils.Map) (utils.Map, error) {
+
+	log.Println("BusinessService::PlaceRegion - Begin")
+
+	decision, err := placeRegion(p.daoBusiness, p.daoAppRegion, indata, nil)
+
+	log.Println("BusinessService::PlaceRegion - End ", decision, err)
+	return decision, err
+}
+
+// placeRegion - Choose the region counting the planned businesses of each region as its tenants,
+// so placing a batch of businesses respects max_tenants
+func placeRegion(daoBusiness platform_repository.BusinessDao, daoRegion platform_repository.RegionDao, indata utils.Map, plannedCounts map[string]int) (utils.Map, error) {
+
+	regionId, _ := utils.GetMemberDataStr(indata, platform_common.FLD_BUSINESS_REGION_ID)
+	if regionId != "" {
+		return placeExplicit(daoBusiness, daoRegion, regionId, plannedCounts)
+	}
+
+	country, _ := utils.GetMemberDataStr(indata, FLD_BUSINESS_COUNTRY)
+	residency, _ := utils.GetMemberDataStr(indata, FLD_BUSINESS_DATA_RESIDENCY)
+	country, residency = strings.ToLower(country), strings.ToLower(residency)
+
+	candidates, err := getRegionCandidates(daoBusiness, daoRegion, plannedCounts)
+	if err != nil {
+		return nil, err
+	}
+
+	eligible := []*regionCandidate{}
+	for _, candidate := range candidates {
+		if residency != "" && !meetsDataResidency(candidate.dataRegion, residency) {
+			continue
+		}
+		candidate.rank = getCountryRank(candidate.dataRegion, country)
+		eligible = append(eligible, candidate)
+	}
+
+	if len(eligible) == 0 {
+		errDetail := "No region is accepting tenants"
+		if residency != "" {
+			errDetail = "No region accepting tenants meets the data residency " + residency
+		}
+		err := &utils.AppError{ErrorCode: "S3030204", ErrorMsg: "No region available", ErrorDetail: errDetail}
+		return nil, err
+	}
+
+	// Best country match first, then the lowest share of the capacity in use and the fewest
+	// tenants, the region id keeps the choice stable
+	sort.SliceStable(eligible, func(i, j int) bool {
+		if eligible[i].rank != eligible[j].rank {
+			return eligible[i].rank < eligible[j].rank
+		}
+		if usedI, usedJ := eligible[i].getUsedShare(), eligible[j].getUsedShare(); usedI != usedJ {
+			return usedI < usedJ
+		}
+		if eligible[i].tenantCount != eligible[j].tenantCount {
+			return eligible[i].tenantCount < eligible[j].tenantCount
+		}
+		return eligible[i].regionId < eligible[j].regionId
+	})
+
+	chosen := eligible[0]
+	reason := []string{PLACEMENT_REASON_HOME_COUNTRY, PLACEMENT_REASON_SERVED_COUNTRY, PLACEMENT_REASON_LEAST_UTILIZED}[chosen.rank]
+	if residency != "" {
+		reason += ", within data residency " + residency
+	}
+
+	decision := utils.Map{
+		platform_common.FLD_REGION_ID: chosen.regionId,
+		FLD_PLACEMENT_MODE:            PLACEMENT_MODE_AUTO,
+		FLD_PLACEMENT_REASON:          reason,
+		FLD_PLACEMENT_TENANT_COUNT:    chosen.tenantCount,
+		FLD_PLACEMENT_CANDIDATES:      len(eligible),
+		FLD_PLACEMENT_DECIDED_AT:      time.Now(),
+	}
+	return decision, nil
+}
+
+// placeExplicit - Accept the region chosen by the caller when it takes new tenants and has capacity
+func placeExplicit(daoBusiness platform_repository.BusinessDao, daoRegion platform_repository.RegionDao, regionId string, plannedCounts map[string]int) (utils.Map, error) {
+
+	dataRegion, err := daoRegion.Get(regionId)
+	if err != nil {
+		err := &utils.AppError{ErrorCode: "S3030203", ErrorMsg: "Invalid Business region !", ErrorDetail: "Business Region given is invalid"}
+		return nil, err
+	}
+	if !isRegionAcceptingTenants(dataRegion) {
+		err := &utils.AppError{ErrorCode: "S3030205", ErrorMsg: "Region closed !", ErrorDetail: "Region " + regionId + " is not accepting new businesses"}
+		return nil, err
+	}
+
+	tenantCounts, err := countRegionTenants(daoBusiness, []string{regionId})
+	if err != nil {
+		return nil, err
+	}
+	tenantCount := tenantCounts[regionId] + plannedCounts[regionId]
+	if exceedsMaxTenants(dataRegion, tenantCount+1) {
+		err := &utils.AppError{ErrorCode: "S3030206", ErrorMsg: "Region full !", ErrorDetail: "Region " + regionId + " has reached its max_tenants"}
+		return nil, err
+	}
+
+	decision := utils.Map{
+		platform_common.FLD_REGION_ID: regionId,
+		FLD_PLACEMENT_MODE:            PLACEMENT_MODE_EXPLICIT,
+		FLD_PLACEMENT_REASON:          PLACEMENT_REASON_EXPLICIT,
+		FLD_PLACEMENT_TENANT_COUNT:    tenantCount,
+		FLD_PLACEMENT_DECIDED_AT:      time.Now(),
+	}
+	return decision, nil
+}
+
+// getRegionCandidates - Regions accepting tenants which still have capacity, the planned counts
+// are added to the businesses already in each region
+func getRegionCandidates(daoBusiness platform_repository.BusinessDao, daoRegion platform_repository.RegionDao, plannedCounts map[string]int) ([]*regionCandidate, error) {
+
+	dataRegions, err := daoRegion.List("", "", 0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	regionIds := []string{}
+	openRegions := []utils.Map{}
+	for _, dataRegion := range getListResult(dataRegions) {
+		if !isRegionAcceptingTenants(dataRegion) {
+			continue
+		}
+		regionId, _ := utils.GetMemberDataStr(dataRegion, platform_common.FLD_REGION_ID)
+		regionIds = append(regionIds, regionId)
+		openRegions = append(openRegions, dataRegion)
+	}
+	if len(regionIds) == 0 {
+		return []*regionCandidate{}, nil
+	}
+
+	tenantCounts, err := countRegionTenants(daoBusiness, regionIds)
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := []*regionCandidate{}
+	for idx, dataRegion := range openRegions {
+		maxTenants, _ := utils.GetMemberDataInt(dataRegion, FLD_REGION_MAX_TENANTS, true)
+		candidate := &regionCandidate{
+			regionId:    regionIds[idx],
+			dataRegion:  dataRegion,
+			tenantCount: tenantCounts[regionIds[idx]] + plannedCounts[regionIds[idx]],
+			maxTenants:  int(maxTenants),
+		}
+		if exceedsMaxTenants(dataRegion, candidate.tenantCount+1) {
+			continue
+		}
+		candidates = append(candidates, candidate)
+	}
+	return candidates, nil
+}
+
+// countRegionTenants - Number of active businesses in each of the regions
+func countRegionTenants(daoBusiness platform_repository.BusinessDao, regionIds []string) (map[string]int, error) {
+
+	dataBusinesses, err := listRegionTenants(daoBusiness, regionIds)
+	if err != nil {
+		return nil, err
+	}
+
+	tenantCounts := map[string]int{}
+	for _, dataBusiness := range dataBusinesses {
+		regionId, _ := utils.GetMemberDataStr(dataBusiness, platform_common.FLD_BUSINESS_REGION_ID)
+		tenantCounts[regionId]++
+	}
+	return tenantCounts, nil
+}
+
+// listRegionTenants - Active businesses in the regions
+func listRegionTenants(daoBusiness platform_repository.BusinessDao, regionIds []string) ([]utils.Map, error) {
+
+	filter := buildFilter(utils.Map{platform_common.FLD_BUSINESS_REGION_ID: utils.Map{"$in": regionIds}})
+	dataBusinesses, err := daoBusiness.List(filter, "", 0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	tenants := []utils.Map{}
+	for _, dataBusiness := range getListResult(dataBusinesses) {
+		if isDeleted, _ := utils.GetMemberDataBool(dataBusiness, db_common.FLD_IS_DELETED); isDeleted {
+			continue
+		}
+		tenants = append(tenants, dataBusiness)
+	}
+	return tenants, nil
+}
+
+// checkRegionCapacity - Count the tenants of the region again once the business is stored, so two
+// businesses placed at the same time cannot both take its last free place
+func checkRegionCapacity(daoBusiness platform_repository.BusinessDao, daoRegion platform_repository.RegionDao, regionId string) error {
+
+	dataRegion, err := daoRegion.Get(regionId)
+	if err != nil {
+		return err
+	}
+	tenantCounts, err := countRegionTenants(daoBusiness, []string{regionId})
+	if err != nil {
+		return err
+	}
+	if exceedsMaxTenants(dataRegion, tenantCounts[regionId]) {
+		err := &utils.AppError{ErrorCode: "S3030206", ErrorMsg: "Region full !", ErrorDetail: "Region " + regionId + " has reached its max_tenants"}
+		return err
+	}
+	return nil
+}
+
+// exceedsMaxTenants - Whether the tenant count is above the max_tenants of the region, regions
+// without a limit never are
+func exceedsMaxTenants(dataRegion utils.Map, tenantCount int) bool {
+	maxTenants, _ := utils.GetMemberDataInt(dataRegion, FLD_REGION_MAX_TENANTS, true)
+	return maxTenants > 0 && tenantCount > maxTenants
+}
+
+// getUsedShare - Share of the capacity in use, none for regions without a limit
+func (c *regionCandidate) getUsedShare() float64 {
+	if c.maxTenants > 0 {
+		return float64(c.tenantCount) / float64(c.maxTenants)
+	}
+	return 0
+}
+
+// isRegionAcceptingTenants - Regions take new businesses unless deleted or closed for tenants
+func isRegionAcceptingTenants(dataRegion utils.Map) bool {
+	if isDeleted, _ := utils.GetMemberDataBool(dataRegion, db_common.FLD_IS_DELETED); isDeleted {
+		return false
+	}
+	if isAccepting, err := utils.GetMemberDataBool(dataRegion, FLD_REGION_IS_ACCEPTING_TENANTS); err == nil {
+		return isAccepting
+	}
+	// Regions created before the flag existed keep taking tenants
+	return true
+}
+
+// meetsDataResidency - The residency is a country or a zone such as eu, the region must be in the
+// country or list the zone in its residency_zones
+func meetsDataResidency(dataRegion utils.Map, residency string) bool {
+
+	regionCountry, _ := utils.GetMemberDataStr(dataRegion, FLD_REGION_COUNTRY)
+	if strings.EqualFold(regionCountry, residency) {
+		return true
+	}
+	for _, zone := range getStringList(dataRegion[FLD_REGION_RESIDENCY_ZONES]) {
+		if strings.EqualFold(zone, residency) {
+			return true
+		}
+	}
+	return false
+}
+
+// getCountryRank - 0 for a region in the country, 1 for a region serving it, 2 otherwise
+func getCountryRank(dataRegion utils.Map, country string) int {
+
+	if country == "" {
+		return 2
+	}
+	regionCountry, _ := utils.GetMemberDataStr(dataRegion, FLD_REGION_COUNTRY)
+	if strings.EqualFold(regionCountry, country) {
+		return 0
+	}
+	for _, served := range getStringList(dataRegion[FLD_REGION_SERVED_COUNTRIES]) {
+		if strings.EqualFold(served, country) {
+			return 1
+		}
+	}
+	return 2
+}
@@ -0,0 +1,144 @@
+package platform_service
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/zapscloud/golib-dbutils/db_common"
+	"github.com/zapscloud/golib-platform-repository/platform_common"
+	"github.com/zapscloud/golib-platform-repository/platform_repository"
+	"github.com/zapscloud/golib-utils/utils"
+)
+
+// fakeRegionDao - In-memory regions, the embedded interface panics on calls not faked here
+type fakeRegionDao struct {
+	platform_repository.RegionDao
+	regions []utils.Map
+}
+
+func (d *fakeRegionDao) List(filter string, sort string, skip int64, limit int64) (utils.Map, error) {
+	return listResult(d.regions), nil
+}
+
+func (d *fakeRegionDao) Get(id string) (utils.Map, error) {
+	for _, dataRegion := range d.regions {
+		if dataRegion[platform_common.FLD_REGION_ID] == id {
+			return dataRegion, nil
+		}
+	}
+	return nil, errFakeNotFound
+}
+
+func (d *fakeRegionDao) Update(id string, indata utils.Map) (utils.Map, error) {
+	dataRegion, err := d.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range indata {
+		dataRegion[key] = value
+	}
+	return dataRegion, nil
+}
+
+// fakeBusinessDao - In-memory businesses
+type fakeBusinessDao struct {
+	platform_repository.BusinessDao
+	businesses []utils.Map
+	users      []utils.Map
+}
+
+func (d *fakeBusinessDao) List(filter string, sort string, skip int64, limit int64) (utils.Map, error) {
+	records := []utils.Map{}
+	for _, dataBusiness := range d.businesses {
+		if matchFakeFilter(dataBusiness, filter) {
+			records = append(records, dataBusiness)
+		}
+	}
+	return listResult(records), nil
+}
+
+func (d *fakeBusinessDao) UserList(businessId string, filter string, sort string, skip int64, limit int64) (utils.Map, error) {
+	records := []utils.Map{}
+	for _, dataUser := range d.users {
+		if dataUser[platform_common.FLD_BUSINESS_ID] == businessId && matchFakeFilter(dataUser, filter) {
+			records = append(records, dataUser)
+		}
+	}
+	return listResult(records), nil
+}
+
+// newFakePlacement - Regions and the number of businesses placed in each of them
+func newFakePlacement(regions []utils.Map, tenantCounts map[string]int) (*fakeRegionDao, *fakeBusinessDao) {
+	daoBusiness := &fakeBusinessDao{}
+	for regionId, count := range tenantCounts {
+		for idx := 0; idx < count; idx++ {
+			daoBusiness.businesses = append(daoBusiness.businesses, utils.Map{
+				platform_common.FLD_BUSINESS_ID:        fmt.Sprintf("%s_biz_%d", regionId, idx),
+				platform_common.FLD_BUSINESS_REGION_ID: regionId,
+			})
+		}
+	}
+	return &fakeRegionDao{regions: regions}, daoBusiness
+}
+
+func TestPlaceRegion(t *testing.T) {
+
+	region := func(regionId string, country string, fields utils.Map) utils.Map {
+		dataRegion := utils.Map{platform_common.FLD_REGION_ID: regionId, FLD_REGION_COUNTRY: country}
+		for key, value := range fields {
+			dataRegion[key] = value
+		}
+		return dataRegion
+	}
+
+	daoRegion, daoBusiness := newFakePlacement([]utils.Map{
+		region("r_in", "in", utils.Map{FLD_REGION_MAX_TENANTS: 10}),
+		region("r_sg", "sg", utils.Map{FLD_REGION_SERVED_COUNTRIES: []interface{}{"in", "my"}}),
+		region("r_us", "us", nil),
+		region("r_us2", "us", nil),
+		region("r_de", "de", utils.Map{FLD_REGION_RESIDENCY_ZONES: []interface{}{"eu"}, FLD_REGION_MAX_TENANTS: 2}),
+		region("r_fr", "fr", utils.Map{FLD_REGION_RESIDENCY_ZONES: []interface{}{"eu"}, FLD_REGION_MAX_TENANTS: 10}),
+		region("r_full", "in", utils.Map{FLD_REGION_MAX_TENANTS: 1}),
+		region("r_big", "jp", utils.Map{FLD_REGION_RESIDENCY_ZONES: []interface{}{"apac"}, FLD_REGION_MAX_TENANTS: 100}),
+		region("r_small", "kr", utils.Map{FLD_REGION_RESIDENCY_ZONES: []interface{}{"apac"}, FLD_REGION_MAX_TENANTS: 10}),
+		region("r_closed", "my", utils.Map{FLD_REGION_IS_ACCEPTING_TENANTS: false}),
+		region("r_deleted", "my", utils.Map{db_common.FLD_IS_DELETED: true}),
+	}, map[string]int{"r_in": 3, "r_sg": 1, "r_de": 1, "r_fr": 1, "r_full": 1, "r_big": 5, "r_small": 1})
+	p := &businessBaseService{daoBusiness: daoBusiness, daoAppRegion: daoRegion}
+
+	tests := []struct {
+		name       string
+		indata     utils.Map
+		wantRegion string
+		wantReason string
+		wantErr    bool
+	}{
+		{"home country before fewer tenants", utils.Map{FLD_BUSINESS_COUNTRY: "IN"}, "r_in", PLACEMENT_REASON_HOME_COUNTRY, false},
+		{"served country", utils.Map{FLD_BUSINESS_COUNTRY: "my"}, "r_sg", PLACEMENT_REASON_SERVED_COUNTRY, false},
+		{"no share in use, then fewest tenants and region id", utils.Map{FLD_BUSINESS_COUNTRY: "cn"}, "r_us", PLACEMENT_REASON_LEAST_UTILIZED, false},
+		{"lower share before fewer tenants", utils.Map{FLD_BUSINESS_DATA_RESIDENCY: "apac"}, "r_big", PLACEMENT_REASON_LEAST_UTILIZED + ", within data residency apac", false},
+		{"lowest share of capacity", utils.Map{FLD_BUSINESS_DATA_RESIDENCY: "eu"}, "r_fr", PLACEMENT_REASON_LEAST_UTILIZED + ", within data residency eu", false},
+		{"home country within residency", utils.Map{FLD_BUSINESS_COUNTRY: "de", FLD_BUSINESS_DATA_RESIDENCY: "EU"}, "r_de", PLACEMENT_REASON_HOME_COUNTRY + ", within data residency eu", false},
+		{"full region skipped", utils.Map{FLD_BUSINESS_DATA_RESIDENCY: "in"}, "r_in", PLACEMENT_REASON_LEAST_UTILIZED + ", within data residency in", false},
+		{"residency not met", utils.Map{FLD_BUSINESS_DATA_RESIDENCY: "au"}, "", "", true},
+		{"explicit", utils.Map{platform_common.FLD_BUSINESS_REGION_ID: "r_sg"}, "r_sg", PLACEMENT_REASON_EXPLICIT, false},
+		{"explicit full", utils.Map{platform_common.FLD_BUSINESS_REGION_ID: "r_full"}, "", "", true},
+		{"explicit closed", utils.Map{platform_common.FLD_BUSINESS_REGION_ID: "r_closed"}, "", "", true},
+		{"explicit unknown", utils.Map{platform_common.FLD_BUSINESS_REGION_ID: "r_none"}, "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decision, err := p.PlaceRegion(tt.indata)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("PlaceRegion() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if decision[platform_common.FLD_REGION_ID] != tt.wantRegion || decision[FLD_PLACEMENT_REASON] != tt.wantReason {
+				t.Errorf("PlaceRegion() = %v, %q, want %v, %q", decision[platform_common.FLD_REGION_ID], decision[FLD_PLACEMENT_REASON], tt.wantRegion, tt.wantReason)
+			}
+		})
+	}
+}
@@ -0,0 +1,343 @@
+package platform_service
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"log"
+	"sync"
+
+	"github.com/zapscloud/golib-dbutils/db_common"
+	"github.com/zapscloud/golib-platform-repository/platform_common"
+	"github.com/zapscloud/golib-utils/utils"
+)
+
+// Region secrets use envelope encryption. Each secret is encrypted with its own data key, and the
+// data key is wrapped by the key provider, so the value is stored as
+// {"key_id": .., "wrapped_key": .., "ciphertext": ..}. Read APIs return the secrets redacted.
+const (
+	FLD_SECRET_WRAPPED_KEY = "wrapped_key"
+	FLD_REGION_ROTATED     = "rotated"
+	FLD_REGION_FAILED      = "failed"
+	REGION_SECRET_REDACTED = "********"
+)
+
+// regionSecretFields - Connection fields of a region stored encrypted
+var regionSecretFields = []string{
+	platform_common.FLD_REGION_MONGODB_SECRET,
+	FLD_REGION_MYSQL_SECRET,
+}
+
+// RegionKeyProvider - Wraps and unwraps the data keys of region secrets, e.g. through a KMS.
+// New data keys are wrapped with the current key, older ones are unwrapped with the key they name.
+type RegionKeyProvider interface {
+	CurrentKeyId() string
+	WrapKey(keyId string, dataKey []byte) ([]byte, error)
+	UnwrapKey(keyId string, wrappedKey []byte) ([]byte, error)
+}
+
+var (
+	regionKeyProvider   RegionKeyProvider
+	regionKeyProviderMu sync.RWMutex
+)
+
+// SetRegionKeyProvider - Set the key provider used for region secrets by the process
+func SetRegionKeyProvider(provider RegionKeyProvider) {
+	regionKeyProviderMu.Lock()
+	defer regionKeyProviderMu.Unlock()
+	regionKeyProvider = provider
+}
+
+func getRegionKeyProvider() (RegionKeyProvider, error) {
+	regionKeyProviderMu.RLock()
+	defer regionKeyProviderMu.RUnlock()
+
+	if regionKeyProvider == nil {
+		err := &utils.AppError{ErrorStatus: 500, ErrorMsg: "Missing key provider", ErrorDetail: "Region secrets need a key provider, see SetRegionKeyProvider"}
+		return nil, err
+	}
+	return regionKeyProvider, nil
+}
+
+// localRegionKeyProvider - Wraps the data keys with AES-256-GCM under locally held keys
+type localRegionKeyProvider struct {
+	keys SettingKeyProvider
+}
+
+// NewLocalRegionKeyProvider - Region key provider wrapping data keys with the keys of the given provider
+func NewLocalRegionKeyProvider(keys SettingKeyProvider) RegionKeyProvider {
+	return &localRegionKeyProvider{keys: keys}
+}
+
+func (k *localRegionKeyProvider) CurrentKeyId() string {
+	return k.keys.CurrentKeyId()
+}
+
+func (k *localRegionKeyProvider) WrapKey(keyId string, dataKey []byte) ([]byte, error) {
+	key, err := k.keys.GetKey(keyId)
+	if err != nil {
+		return nil, err
+	}
+	return sealRegionSecret(key, dataKey, []byte(keyId))
+}
+
+func (k *localRegionKeyProvider) UnwrapKey(keyId string, wrappedKey []byte) ([]byte, error) {
+	key, err := k.keys.GetKey(keyId)
+	if err != nil {
+		return nil, err
+	}
+	return openRegionSecret(key, wrappedKey, []byte(keyId))
+}
+
+// RotateSecrets - Re-encrypt the secrets of every region with a new data key under the current key
+func (p *regionBaseService) RotateSecrets() (utils.Map, error) {
+
+	log.Println("RegionService::RotateSecrets - Begin")
+
+	provider, err := getRegionKeyProvider()
+	if err != nil {
+		return nil, err
+	}
+
+	dataRegions, err := p.daoRegion.List("", "", 0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	rotated := []string{}
+	failed := []utils.Map{}
+	for _, dataRegion := range getListResult(dataRegions) {
+		regionId, _ := utils.GetMemberDataStr(dataRegion, platform_common.FLD_REGION_ID)
+
+		err := p.rotateRegionSecrets(regionId, dataRegion)
+		if err != nil {
+			log.Println("RegionService::RotateSecrets - Failed ", regionId, err)
+			failed = append(failed, utils.Map{platform_common.FLD_REGION_ID: regionId, FLD_REGION_HEALTH_ERROR: err.Error()})
+			continue
+		}
+		rotated = append(rotated, regionId)
+	}
+
+	response := utils.Map{
+		FLD_SECRET_KEY_ID:  provider.CurrentKeyId(),
+		FLD_REGION_ROTATED: rotated,
+		FLD_REGION_FAILED:  failed,
+	}
+
+	log.Println("RegionService::RotateSecrets - End ", len(rotated), len(failed))
+	return response, nil
+}
+
+// rotateRegionSecrets - Store the secrets of the region under new data keys. The update only goes
+// through while the stored secrets are still the ones which were read, so a secret changed in the
+// meantime is not overwritten with its old value.
+func (p *regionBaseService) rotateRegionSecrets(regionId string, dataRegion utils.Map) error {
+
+	dataPlain, err := decryptRegionSecrets(dataRegion)
+	if err != nil {
+		return err
+	}
+
+	dataSecrets := utils.Map{}
+	for _, field := range regionSecretFields {
+		if secret, err := utils.GetMemberDataStr(dataPlain, field); err == nil && secret != "" {
+			dataSecrets[field] = secret
+		}
+	}
+	if len(dataSecrets) == 0 {
+		return nil
+	}
+
+	if err := encryptRegionSecrets(regionId, dataSecrets); err != nil {
+		return err
+	}
+
+	return runInTransaction(&p.DatabaseService, func() error {
+		dataCurrent, err := p.daoRegion.Get(regionId)
+		if err != nil {
+			return err
+		}
+		for _, field := range regionSecretFields {
+			if !isSamePolicyValue(dataCurrent[field], dataRegion[field]) {
+				err := &utils.AppError{ErrorStatus: 409, ErrorMsg: "Region changed", ErrorDetail: "Secrets of region " + regionId + " changed during the rotation, rotate again"}
+				return err
+			}
+		}
+		_, err = p.daoRegion.Update(regionId, dataSecrets)
+		return err
+	})
+}
+
+// encryptRegionSecrets - Replace the plain secrets in indata with their envelopes. A redacted value
+// sent back by a client is dropped, so the stored secret is kept.
+func encryptRegionSecrets(regionId string, indata utils.Map) error {
+
+	for _, field := range regionSecretFields {
+		dataVal, found := indata[field]
+		if !found {
+			continue
+		}
+		secret, isStr := dataVal.(string)
+		if !isStr {
+			err := &utils.AppError{ErrorStatus: 400, ErrorMsg: "Invalid Datatype", ErrorDetail: field + " value should be a string"}
+			return err
+		}
+		if secret == REGION_SECRET_REDACTED {
+			delete(indata, field)
+			continue
+		}
+
+		envelope, err := sealRegionEnvelope(regionId, field, secret)
+		if err != nil {
+			return err
+		}
+		indata[field] = envelope
+	}
+	return nil
+}
+
+// decryptRegionSecrets - Copy of the region with the secrets decrypted. Secrets stored before
+// encryption was introduced are plain strings and are returned as they are.
+func decryptRegionSecrets(dataRegion utils.Map) (utils.Map, error) {
+
+	regionId, _ := utils.GetMemberDataStr(dataRegion, platform_common.FLD_REGION_ID)
+
+	dataPlain := copySettingValue(dataRegion)
+	for _, field := range regionSecretFields {
+		dataVal, found := dataRegion[field]
+		if !found {
+			continue
+		}
+		if _, isStr := dataVal.(string); isStr {
+			continue
+		}
+
+		secret, err := openRegionEnvelope(regionId, field, dataVal)
+		if err != nil {
+			return nil, err
+		}
+		dataPlain[field] = secret
+	}
+	return dataPlain, nil
+}
+
+func sealRegionEnvelope(regionId string, field string, secret string) (utils.Map, error) {
+
+	provider, err := getRegionKeyProvider()
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey := make([]byte, SETTING_SECRET_KEY_LEN)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, err
+	}
+
+	keyId := provider.CurrentKeyId()
+	wrappedKey, err := provider.WrapKey(keyId, dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// The region and field are bound as additional data, so a ciphertext cannot be moved elsewhere
+	sealed, err := sealRegionSecret(dataKey, []byte(secret), []byte(regionId+":"+field))
+	if err != nil {
+		return nil, err
+	}
+
+	envelope := utils.Map{
+		FLD_SECRET_KEY_ID:      keyId,
+		FLD_SECRET_WRAPPED_KEY: base64.StdEncoding.EncodeToString(wrappedKey),
+		FLD_SECRET_CIPHERTEXT:  base64.StdEncoding.EncodeToString(sealed),
+	}
+	return envelope, nil
+}
+
+func openRegionEnvelope(regionId string, field string, dataVal interface{}) (string, error) {
+
+	invalid := &utils.AppError{ErrorStatus: 500, ErrorMsg: "Invalid secret", ErrorDetail: "Stored " + field + " of region " + regionId + " cannot be decrypted"}
+
+	dataList := getMapList([]interface{}{dataVal})
+	if len(dataList) == 0 {
+		return "", invalid
+	}
+	keyId, _ := utils.GetMemberDataStr(dataList[0], FLD_SECRET_KEY_ID)
+	wrappedStr, errKey := utils.GetMemberDataStr(dataList[0], FLD_SECRET_WRAPPED_KEY)
+	cipherStr, errText := utils.GetMemberDataStr(dataList[0], FLD_SECRET_CIPHERTEXT)
+	if errKey != nil || errText != nil {
+		return "", invalid
+	}
+	wrappedKey, errKey := base64.StdEncoding.DecodeString(wrappedStr)
+	sealed, errText := base64.StdEncoding.DecodeString(cipherStr)
+	if errKey != nil || errText != nil {
+		return "", invalid
+	}
+
+	provider, err := getRegionKeyProvider()
+	if err != nil {
+		return "", err
+	}
+	dataKey, err := provider.UnwrapKey(keyId, wrappedKey)
+	if err != nil {
+		return "", err
+	}
+
+	secret, err := openRegionSecret(dataKey, sealed, []byte(regionId+":"+field))
+	if err != nil {
+		return "", invalid
+	}
+	return string(secret), nil
+}
+
+// sealRegionSecret - AES-256-GCM with the nonce prepended to the ciphertext
+func sealRegionSecret(key []byte, plainText []byte, additionalData []byte) ([]byte, error) {
+	gcm, err := newSettingCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plainText, additionalData), nil
+}
+
+func openRegionSecret(key []byte, sealed []byte, additionalData []byte) ([]byte, error) {
+	gcm, err := newSettingCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		err := &utils.AppError{ErrorStatus: 500, ErrorMsg: "Invalid secret", ErrorDetail: "Sealed value is too short"}
+		return nil, err
+	}
+	nonce, sealed := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, sealed, additionalData)
+}
+
+// redactRegionSecrets - Copy of the region with the secrets redacted
+func redactRegionSecrets(dataRegion utils.Map) utils.Map {
+	if dataRegion == nil {
+		return nil
+	}
+	redacted := copySettingValue(dataRegion)
+	for _, field := range regionSecretFields {
+		if _, found := redacted[field]; found {
+			redacted[field] = REGION_SECRET_REDACTED
+		}
+	}
+	return redacted
+}
+
+// redactRegionList - Redact the secrets of a List styled response
+func redactRegionList(dataList utils.Map) utils.Map {
+	if _, found := dataList[db_common.LIST_RESULT]; !found {
+		return dataList
+	}
+	results := getListResult(dataList)
+	for idx, dataRegion := range results {
+		results[idx] = redactRegionSecrets(dataRegion)
+	}
+	dataList[db_common.LIST_RESULT] = results
+	return dataList
+}
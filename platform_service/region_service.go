@@ -20,6 +20,14 @@ type RegionService interface {
 	Create(indata utils.Map) (utils.Map, error)
 	Update(regionid string, indata utils.Map) (utils.Map, error)
 	Delete(regionid string, delete_permanent bool) error
+	HealthCheck(regionid string) (utils.Map, error)
+	RotateSecrets() (utils.Map, error)
+	Failover(regionid string, endpointId string, reason string, changedBy string) (utils.Map, error)
+	AutoFailover(regionid string, changedBy string) (utils.Map, error)
+	Decommission(regionid string, changedBy string) (utils.Map, error)
+	MigrateBusiness(regionid string, businessId string, targetRegionId string) (utils.Map, error)
+	RetireRegion(regionid string) (utils.Map, error)
+	CancelDecommission(regionid string) (utils.Map, error)
 
 	BeginTransaction()
 	CommitTransaction()
@@ -30,8 +38,9 @@ type RegionService interface {
 
 type regionBaseService struct {
 	db_utils.DatabaseService
-	daoRegion platform_repository.RegionDao
-	child     RegionService
+	daoRegion   platform_repository.RegionDao
+	daoBusiness platform_repository.BusinessDao
+	child       RegionService
 }
 
 func init() {
@@ -49,6 +58,7 @@ func NewRegionService(props utils.Map) (RegionService, error) {
 
 	log.Printf("RegionMongoService ")
 	p.daoRegion = platform_repository.NewRegionDao(p.GetClient())
+	p.daoBusiness = platform_repository.NewBusinessDao(p.GetClient())
 	p.child = &p
 
 	return &p, nil
@@ -68,7 +78,7 @@ func (p *regionBaseService) List(filter string, sort string, skip int64, limit i
 		return nil, err
 	}
 	log.Println("RegionService::FindAll - End ")
-	return dataresponse, nil
+	return redactRegionList(dataresponse), nil
 }
 
 // GetDetails - Find By Code
@@ -76,6 +86,7 @@ func (p *regionBaseService) Get(regionid string) (utils.Map, error) {
 	log.Printf("RegionService::GetDetails::  Begin %v", regionid)
 
 	data, err := p.daoRegion.Get(regionid)
+	data = redactRegionSecrets(data)
 
 	log.Println("RegionService::GetDetails:: End ", data, err)
 	return data, err
@@ -85,6 +96,7 @@ func (p *regionBaseService) Find(filter string) (utils.Map, error) {
 	fmt.Println("RegionService::GetDetails::  Begin ", filter)
 
 	data, err := p.daoRegion.Find(filter)
+	data = redactRegionSecrets(data)
 
 	log.Println("RegionService::GetDetails:: End ", data, err)
 	return data, err
@@ -98,6 +110,7 @@ func (p *regionBaseService) Create(indata utils.Map) (utils.Map, error) {
 	// Conver the RegionId to Lowercase
 	regionId := strings.ToLower(indata[platform_common.FLD_REGION_ID].(string))
 
+	testConnection := testConnectionRequested(indata)
 	indata, err := p.validateCreate(indata)
 	if err != nil {
 		return nil, err
@@ -113,13 +126,23 @@ func (p *regionBaseService) Create(indata utils.Map) (utils.Map, error) {
 		return indata, err
 	}
 
+	if testConnection {
+		if err := validateRegionConnection(indata); err != nil {
+			return indata, err
+		}
+	}
+
+	if err := encryptRegionSecrets(regionId, indata); err != nil {
+		return redactRegionSecrets(indata), err
+	}
+
 	_, err = p.daoRegion.Create(indata)
 	if err != nil {
-		return indata, err
+		return redactRegionSecrets(indata), err
 	}
 
 	log.Println("UserService::Create - End ")
-	return p.daoRegion.Get(regionId)
+	return p.Get(regionId)
 }
 
 // Update - Update Service
@@ -134,8 +157,43 @@ func (p *regionBaseService) Update(regionid string, indata utils.Map) (utils.Map
 
 	// Remove key and default fields from indata
 	delete(indata, platform_common.FLD_REGION_ID)
+	for _, field := range regionSecretFields {
+		if indata[field] == REGION_SECRET_REDACTED {
+			delete(indata, field)
+		}
+	}
+
+	// Validate the stored settings overlaid by the changed ones
+	testConnection := testConnectionRequested(indata)
+	dataRegion := copySettingValue(result)
+	for key, value := range indata {
+		dataRegion[key] = value
+	}
+	if isRegionDbChange(indata) {
+		if err := validateRegionDbFields(dataRegion); err != nil {
+			return nil, err
+		}
+	}
+	if err := validateRegionEndpoints(indata); err != nil {
+		return nil, err
+	}
+
+	if testConnection {
+		dataRegion, err := decryptRegionSecrets(dataRegion)
+		if err != nil {
+			return nil, err
+		}
+		if err := validateRegionConnection(dataRegion); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := encryptRegionSecrets(regionid, indata); err != nil {
+		return nil, err
+	}
 
 	data, err := p.daoRegion.Update(regionid, indata)
+	data = redactRegionSecrets(data)
 
 	log.Println("UserService::Update - End ")
 	return data, err
@@ -151,6 +209,11 @@ func (p *regionBaseService) Delete(regionid string, delete_permanent bool) error
 		return err
 	}
 
+	// Businesses would lose their database, they have to be migrated away first
+	if err := p.validateRegionEmpty(regionid); err != nil {
+		return err
+	}
+
 	if delete_permanent {
 		result, err := p.daoRegion.Delete(regionid)
 		if err != nil {
@@ -182,15 +245,21 @@ func (p *regionBaseService) validateKeyExist(key string) (utils.Map, error) {
 // Private functions
 func (p *regionBaseService) validateCreate(dataRegion utils.Map) (utils.Map, error) {
 
-	var err error = nil
-
 	if _, err := utils.GetMemberDataStr(dataRegion, platform_common.FLD_REGION_ID); err != nil {
-		err = &utils.AppError{ErrorCode: "S30102", ErrorMsg: "Missing Region ID!", ErrorDetail: "Region ID parameter is missing"}
+		err := &utils.AppError{ErrorCode: "S30102", ErrorMsg: "Missing Region ID!", ErrorDetail: "Region ID parameter is missing"}
+		return dataRegion, err
 	} else if _, err := utils.GetMemberDataStr(dataRegion, platform_common.FLD_REGION_NAME); err != nil {
-		err = &utils.AppError{ErrorCode: "S30102", ErrorMsg: "Missing value", ErrorDetail: "Parameter " + platform_common.FLD_REGION_NAME + " is missing"}
-	} else if _, err := utils.GetMemberDataStr(dataRegion, platform_common.FLD_REGION_DB_TYPE); err != nil {
-		err = &utils.AppError{ErrorCode: "S30102", ErrorMsg: "Missing value", ErrorDetail: "Parameter " + platform_common.FLD_REGION_DB_TYPE + " is missing"}
+		err := &utils.AppError{ErrorCode: "S30102", ErrorMsg: "Missing value", ErrorDetail: "Parameter " + platform_common.FLD_REGION_NAME + " is missing"}
+		return dataRegion, err
+	} else if _, found := dataRegion[platform_common.FLD_REGION_DB_TYPE]; !found {
+		err := &utils.AppError{ErrorCode: "S30102", ErrorMsg: "Missing value", ErrorDetail: "Parameter " + platform_common.FLD_REGION_DB_TYPE + " is missing"}
+		return dataRegion, err
 	}
 
+	// Connection fields depend on the database type
+	if err := validateRegionDbFields(dataRegion); err != nil {
+		return dataRegion, err
+	}
+	err := validateRegionEndpoints(dataRegion)
 	return dataRegion, err
 }
@@ -0,0 +1,628 @@
+package platform_service
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/zapscloud/golib-dbutils/db_common"
+	"github.com/zapscloud/golib-dbutils/db_utils"
+	"github.com/zapscloud/golib-platform-repository/platform_common"
+	"github.com/zapscloud/golib-utils/utils"
+)
+
+// Role fields maintained by the service layer
+const (
+	FLD_APP_ROLE_PARENT_IDS = "app_role_parent_ids"
+	FLD_APP_ROLE_CREDENTIAL = "app_role_credential"
+	FLD_SYS_ROLE_PARENT_IDS = "sys_role_parent_ids"
+	FLD_SYS_ROLE_CREDENTIAL = "sys_role_credential"
+	FLD_ROLE_INHERITED_FROM = "inherited_from"
+	FLD_ROLE_IS_INHERITED   = "is_inherited"
+
+	// Credential conditions
+	FLD_ROLE_CREDENTIAL_CONDITION = "condition"
+	FLD_ROLE_CONDITION_REASON     = "reason"
+	FLD_ROLE_FAILED_CONDS         = "failed_conditions"
+
+	// Role assignment validity
+	FLD_ROLE_USER_VALID_FROM  = "valid_from"
+	FLD_ROLE_USER_VALID_UNTIL = "valid_until"
+	FLD_ROLE_USER_IS_ACTIVE   = "is_assignment_active"
+	FLD_ROLE_SKIPPED_ROLES    = "skipped_roles"
+
+	// Role delete summary
+	FLD_ROLE_REMOVED_USERS  = "removed_users"
+	FLD_ROLE_REMOVED_CREDS  = "removed_credentials"
+	FLD_ROLE_DETACHED_ROLES = "detached_child_roles"
+	FLD_ROLE_REVOKED_GRANTS = "revoked_grants"
+	FLD_ROLE_IS_DELETED     = "is_role_deleted"
+)
+
+// Role types
+const (
+	ROLE_TYPE_APP = "app_role"
+	ROLE_TYPE_SYS = "sys_role"
+)
+
+// roleDao - DAO operations common to AppRoleDao and SysRoleDao
+type roleDao interface {
+	List(filter string, sort string, skip int64, limit int64) (utils.Map, error)
+	Get(role_id string) (utils.Map, error)
+	Update(role_id string, indata utils.Map) (utils.Map, error)
+	Delete(role_id string) (int64, error)
+	Create(indata utils.Map) (utils.Map, error)
+	AddCredentials(role_id string, indata utils.Map) (utils.Map, error)
+	GetCredentials(role_id string) (utils.Map, error)
+	FindCredential(filter string) (utils.Map, error)
+	RemoveCredentials(role_id string, credentials []string) (int64, error)
+	AddUsers(role_id string, indata utils.Map) (utils.Map, error)
+	FindUser(filter string) (utils.Map, error)
+	GetUsers(role_id string) (utils.Map, error)
+	RemoveUsers(role_id string, user_ids []string) (int64, error)
+	ListUsers(filter string, sort string, skip int64, limit int64) (utils.Map, error)
+}
+
+// roleGrants - Access grants kept outside the role collection which refer to the role
+type roleGrants interface {
+	listRoleGrants(roleId string) ([]utils.Map, error)
+	revokeRoleGrant(grant utils.Map) error
+}
+
+// roleFields - Field names which differ between app roles and sys roles
+type roleFields struct {
+	RoleType   string
+	RoleId     string
+	UserId     string
+	ParentIds  string
+	Credential string
+}
+
+var appRoleFields = roleFields{
+	RoleType:   ROLE_TYPE_APP,
+	RoleId:     platform_common.FLD_APP_ROLE_ID,
+	UserId:     platform_common.FLD_APP_USER_ID,
+	ParentIds:  FLD_APP_ROLE_PARENT_IDS,
+	Credential: FLD_APP_ROLE_CREDENTIAL,
+}
+
+var sysRoleFields = roleFields{
+	RoleType:   ROLE_TYPE_SYS,
+	RoleId:     platform_common.FLD_SYS_ROLE_ID,
+	UserId:     platform_common.FLD_SYS_USER_ID,
+	ParentIds:  FLD_SYS_ROLE_PARENT_IDS,
+	Credential: FLD_SYS_ROLE_CREDENTIAL,
+}
+
+// getRoleParentIds - Get the parent role ids of the given role
+func getRoleParentIds(dataRole utils.Map, fields roleFields) []string {
+	return getStringList(dataRole[fields.ParentIds])
+}
+
+// validateRoleParents - Check the parent roles exist and the hierarchy has no cycle
+func validateRoleParents(dao roleDao, fields roleFields, roleId string, parentIds []string, funcode string) error {
+
+	for _, parentId := range parentIds {
+		if parentId == roleId {
+			err := &utils.AppError{ErrorCode: funcode + "01", ErrorMsg: "Invalid parent role", ErrorDetail: "Role " + roleId + " cannot inherit from itself"}
+			return err
+		}
+		if _, err := dao.Get(parentId); err != nil {
+			err := &utils.AppError{ErrorCode: funcode + "02", ErrorMsg: "Invalid parent role", ErrorDetail: "Parent role " + parentId + " does not exist"}
+			return err
+		}
+	}
+
+	// Walk up from every parent, reaching roleId again means a cycle
+	visited := map[string]bool{}
+	pending := append([]string{}, parentIds...)
+	for len(pending) > 0 {
+		curId := pending[0]
+		pending = pending[1:]
+
+		if curId == roleId {
+			err := &utils.AppError{ErrorCode: funcode + "03", ErrorMsg: "Cyclic role inheritance", ErrorDetail: "Role " + roleId + " is already an ancestor of the given parent roles"}
+			return err
+		}
+		if visited[curId] {
+			continue
+		}
+		visited[curId] = true
+
+		dataRole, err := dao.Get(curId)
+		if err != nil {
+			log.Println("validateRoleParents:: Role not found ", curId, err)
+			continue
+		}
+		pending = append(pending, getRoleParentIds(dataRole, fields)...)
+	}
+
+	return nil
+}
+
+// getEffectiveCredentials - Collect the credentials of the role and all of its ancestors.
+// Every credential is tagged with the role it came from, the nearest role wins on duplicates.
+// Any role of the hierarchy which cannot be read fails the lookup.
+func getEffectiveCredentials(dao roleDao, fields roleFields, roleId string) (utils.Map, error) {
+
+	if _, err := dao.Get(roleId); err != nil {
+		return nil, err
+	}
+
+	credentials := []utils.Map{}
+	credFound := map[string]bool{}
+	visited := map[string]bool{roleId: true}
+
+	// Walk the hierarchy level by level so that nearer roles are visited first
+	curRoleIds := []string{roleId}
+	for len(curRoleIds) > 0 {
+		nextRoleIds := []string{}
+
+		for _, curRoleId := range curRoleIds {
+			// A parent which cannot be read fails the whole lookup, its denies would be lost otherwise
+			dataRole, err := dao.Get(curRoleId)
+			if err != nil {
+				log.Println("getEffectiveCredentials:: Role not found ", curRoleId, err)
+				return nil, err
+			}
+
+			dataCreds, err := dao.GetCredentials(curRoleId)
+			if err != nil {
+				log.Println("getEffectiveCredentials:: Unable to get credentials of role ", curRoleId, err)
+				return nil, err
+			}
+
+			for _, cred := range getListResult(dataCreds) {
+				credName, _ := utils.GetMemberDataStr(cred, fields.Credential)
+				if credFound[credName] {
+					continue
+				}
+				credFound[credName] = true
+
+				effCred := utils.CopyMap(cred)
+				effCred[FLD_ROLE_INHERITED_FROM] = curRoleId
+				effCred[FLD_ROLE_IS_INHERITED] = curRoleId != roleId
+				credentials = append(credentials, effCred)
+			}
+
+			for _, parentId := range getRoleParentIds(dataRole, fields) {
+				if !visited[parentId] {
+					visited[parentId] = true
+					nextRoleIds = append(nextRoleIds, parentId)
+				}
+			}
+		}
+		curRoleIds = nextRoleIds
+	}
+
+	response := utils.Map{
+		fields.RoleId:             roleId,
+		db_common.LIST_RESULTSIZE: len(credentials),
+		db_common.LIST_RESULT:     credentials,
+	}
+	return response, nil
+}
+
+// diffRoleCredentials - Compare the existing credentials of a role with the wanted list and
+// return the credentials to be added and the credential names to be removed. A credential
+// whose condition changed is both removed and added again.
+func diffRoleCredentials(existing []utils.Map, wanted []utils.Map, fields roleFields) ([]utils.Map, []string) {
+
+	existConds := map[string]string{}
+	for _, cred := range existing {
+		credName, _ := utils.GetMemberDataStr(cred, fields.Credential)
+		existConds[credName], _ = utils.GetMemberDataStr(cred, FLD_ROLE_CREDENTIAL_CONDITION)
+	}
+
+	credsAdd := []utils.Map{}
+	wantConds := map[string]string{}
+	for _, cred := range wanted {
+		credName, _ := utils.GetMemberDataStr(cred, fields.Credential)
+		if _, found := wantConds[credName]; found {
+			continue
+		}
+		wantConds[credName], _ = utils.GetMemberDataStr(cred, FLD_ROLE_CREDENTIAL_CONDITION)
+
+		if existCond, found := existConds[credName]; !found || existCond != wantConds[credName] {
+			credsAdd = append(credsAdd, cred)
+		}
+	}
+
+	credsRemove := []string{}
+	for credName, existCond := range existConds {
+		if wantCond, found := wantConds[credName]; !found || wantCond != existCond {
+			credsRemove = append(credsRemove, credName)
+		}
+	}
+	sort.Strings(credsRemove)
+
+	return credsAdd, credsRemove
+}
+
+// checkRoleCredential - Evaluate the credential against the effective credentials of the role
+func checkRoleCredential(dao roleDao, fields roleFields, roleId string, credential string, attributes utils.Map) (utils.Map, error) {
+
+	if err := ValidateCredential(credential); err != nil {
+		return nil, err
+	}
+
+	dataCreds, err := getEffectiveCredentials(dao, fields, roleId)
+	if err != nil {
+		return nil, err
+	}
+
+	response := evaluateGrantedCredentials(getListResult(dataCreds), fields, credential, attributes)
+	response[fields.RoleId] = roleId
+	return response, nil
+}
+
+// findRoleCredential - Find the credential of the role which grants the credential in the filter.
+// It is matched like in checkRoleCredential, over the inherited credentials and without request
+// attributes, so a conditional grant or a matching deny means no credential is found. Filters
+// without both role and credential go to the DAO as is.
+func findRoleCredential(dao roleDao, fields roleFields, filter string) (utils.Map, error) {
+
+	dataFilter := utils.Map{}
+	if err := json.Unmarshal([]byte(filter), &dataFilter); err != nil {
+		return dao.FindCredential(filter)
+	}
+	roleId, _ := utils.GetMemberDataStr(dataFilter, fields.RoleId)
+	credential, _ := utils.GetMemberDataStr(dataFilter, fields.Credential)
+	if roleId == "" || credential == "" || len(dataFilter) != 2 {
+		return dao.FindCredential(filter)
+	}
+
+	if err := ValidateCredential(credential); err != nil {
+		return nil, err
+	}
+
+	dataCreds, err := getEffectiveCredentials(dao, fields, roleId)
+	if err != nil {
+		return nil, err
+	}
+	grantedCreds := getListResult(dataCreds)
+
+	dataCheck := evaluateGrantedCredentials(grantedCreds, fields, credential, utils.Map{})
+	if isAllowed, _ := utils.GetMemberDataBool(dataCheck, CREDENTIAL_RESULT_ALLOWED); isAllowed {
+		matched, _ := utils.GetMemberDataStr(dataCheck, CREDENTIAL_RESULT_MATCHED)
+		for _, cred := range grantedCreds {
+			if credName, _ := utils.GetMemberDataStr(cred, fields.Credential); credName == matched {
+				return cred, nil
+			}
+		}
+	}
+
+	err = &utils.AppError{ErrorStatus: 404, ErrorMsg: "Credential not found", ErrorDetail: "Role " + roleId + " does not grant " + NormalizeCredential(credential)}
+	return nil, err
+}
+
+// evaluateGrantedCredentials - Evaluate the credential against the granted credential records.
+// Records whose condition does not hold for the attributes are left out and reported back. A deny
+// whose condition cannot be evaluated still applies, only allows may be dropped on an error.
+func evaluateGrantedCredentials(grantedCreds []utils.Map, fields roleFields, credential string, attributes utils.Map) utils.Map {
+
+	granted := []string{}
+	grantedFrom := map[string]string{}
+	failedConditions := []utils.Map{}
+	for _, cred := range grantedCreds {
+		credName, _ := utils.GetMemberDataStr(cred, fields.Credential)
+
+		condition, _ := utils.GetMemberDataStr(cred, FLD_ROLE_CREDENTIAL_CONDITION)
+		if condition != "" && MatchCredential(credName, credential) {
+			isMet, err := EvaluateCondition(condition, attributes)
+			if err != nil || !isMet {
+				reason := "condition not met"
+				if err != nil {
+					reason = err.Error()
+				}
+				failedConditions = append(failedConditions, utils.Map{
+					fields.Credential:             credName,
+					FLD_ROLE_CREDENTIAL_CONDITION: condition,
+					FLD_ROLE_INHERITED_FROM:       cred[FLD_ROLE_INHERITED_FROM],
+					FLD_ROLE_CONDITION_REASON:     reason,
+				})
+				// Fail closed, a deny is only lifted by a condition which is known to be false
+				if err == nil || !IsDenyCredential(credName) {
+					continue
+				}
+			}
+		}
+
+		if _, found := grantedFrom[credName]; !found {
+			granted = append(granted, credName)
+			grantedFrom[credName], _ = utils.GetMemberDataStr(cred, FLD_ROLE_INHERITED_FROM)
+		}
+	}
+
+	isAllowed, matched := EvaluateCredentials(granted, credential)
+
+	response := utils.Map{
+		fields.Credential:         NormalizeCredential(credential),
+		CREDENTIAL_RESULT_ALLOWED: isAllowed,
+		CREDENTIAL_RESULT_DENIED:  !isAllowed && matched != "",
+		CREDENTIAL_RESULT_MATCHED: matched,
+		FLD_ROLE_INHERITED_FROM:   grantedFrom[matched],
+		FLD_ROLE_FAILED_CONDS:     failedConditions,
+	}
+	return response
+}
+
+// normalizeRoleCredential - Validate and normalize the credential name given in indata
+func normalizeRoleCredential(indata utils.Map, fields roleFields) error {
+
+	credential, err := utils.GetMemberDataStr(indata, fields.Credential)
+	if err != nil {
+		return err
+	}
+
+	if err := ValidateCredential(credential); err != nil {
+		return err
+	}
+	indata[fields.Credential] = NormalizeCredential(credential)
+
+	// The optional condition is checked for syntax only, attributes come with each request
+	if _, dataOk := indata[FLD_ROLE_CREDENTIAL_CONDITION]; dataOk {
+		condition, err := utils.GetMemberDataStr(indata, FLD_ROLE_CREDENTIAL_CONDITION)
+		if err != nil {
+			return err
+		}
+		if err := ValidateCondition(condition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteRole - Delete the role. Without cascade the delete is refused while users, credentials,
+// child roles or access grants still refer to the role. With cascade they are detached in one transaction.
+func deleteRole(dbService *db_utils.DatabaseService, dao roleDao, grants roleGrants, fields roleFields, roleId string, cascade bool, funcode string) (utils.Map, error) {
+
+	if _, err := dao.Get(roleId); err != nil {
+		return nil, err
+	}
+
+	// Read the references inside the transaction, so nothing can be attached in between
+	userIds := []string{}
+	credentials := []string{}
+	childRoleIds := []string{}
+	grantIds := []string{}
+	err := runInTransaction(dbService, func() error {
+		dataUsers, err := dao.GetUsers(roleId)
+		if err != nil {
+			return err
+		}
+		for _, user := range getListResult(dataUsers) {
+			if userId, err := utils.GetMemberDataStr(user, fields.UserId); err == nil {
+				userIds = append(userIds, userId)
+			}
+		}
+
+		dataCreds, err := dao.GetCredentials(roleId)
+		if err != nil {
+			return err
+		}
+		for _, cred := range getListResult(dataCreds) {
+			if credName, err := utils.GetMemberDataStr(cred, fields.Credential); err == nil {
+				credentials = append(credentials, credName)
+			}
+		}
+
+		filter := buildFilter(utils.Map{fields.ParentIds: roleId})
+		dataChildren, err := dao.List(filter, "", 0, 0)
+		if err != nil {
+			return err
+		}
+		childRoles := getListResult(dataChildren)
+
+		roleGrantList := []utils.Map{}
+		if grants != nil {
+			roleGrantList, err = grants.listRoleGrants(roleId)
+			if err != nil {
+				return err
+			}
+		}
+
+		if !cascade && (len(userIds) > 0 || len(credentials) > 0 || len(childRoles) > 0 || len(roleGrantList) > 0) {
+			err := &utils.AppError{ErrorCode: funcode + "01", ErrorMsg: "Role in use",
+				ErrorDetail: fmt.Sprintf("Role %s still has %d users, %d credentials, %d child roles and %d access grants, delete with cascade to remove them",
+					roleId, len(userIds), len(credentials), len(childRoles), len(roleGrantList))}
+			return err
+		}
+
+		for _, grant := range roleGrantList {
+			if err := grants.revokeRoleGrant(grant); err != nil {
+				return err
+			}
+			accessId, _ := utils.GetMemberDataStr(grant, platform_common.FLD_SYS_ACCESS_ID)
+			grantIds = append(grantIds, accessId)
+		}
+
+		if len(userIds) > 0 {
+			if _, err := dao.RemoveUsers(roleId, userIds); err != nil {
+				return err
+			}
+		}
+
+		if len(credentials) > 0 {
+			if _, err := dao.RemoveCredentials(roleId, credentials); err != nil {
+				return err
+			}
+		}
+
+		// Drop the role from the parents of its child roles
+		for _, childRole := range childRoles {
+			childRoleId, _ := utils.GetMemberDataStr(childRole, fields.RoleId)
+
+			parentIds := []string{}
+			for _, parentId := range getRoleParentIds(childRole, fields) {
+				if parentId != roleId {
+					parentIds = append(parentIds, parentId)
+				}
+			}
+			if _, err := dao.Update(childRoleId, utils.Map{fields.ParentIds: parentIds}); err != nil {
+				return err
+			}
+			childRoleIds = append(childRoleIds, childRoleId)
+		}
+
+		_, err = dao.Delete(roleId)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	response := utils.Map{
+		fields.RoleId:           roleId,
+		FLD_ROLE_IS_DELETED:     true,
+		FLD_ROLE_REMOVED_USERS:  userIds,
+		FLD_ROLE_REMOVED_CREDS:  credentials,
+		FLD_ROLE_DETACHED_ROLES: childRoleIds,
+		FLD_ROLE_REVOKED_GRANTS: grantIds,
+	}
+	return response, nil
+}
+
+// normalizeRoleAssignment - Validate the optional validity window given while assigning users
+func normalizeRoleAssignment(indata utils.Map) error {
+
+	validFrom, errFrom := getMemberDataTime(indata, FLD_ROLE_USER_VALID_FROM)
+	if _, dataOk := indata[FLD_ROLE_USER_VALID_FROM]; dataOk && errFrom != nil {
+		return errFrom
+	} else if dataOk {
+		indata[FLD_ROLE_USER_VALID_FROM] = validFrom
+	}
+
+	validUntil, errUntil := getMemberDataTime(indata, FLD_ROLE_USER_VALID_UNTIL)
+	if _, dataOk := indata[FLD_ROLE_USER_VALID_UNTIL]; dataOk && errUntil != nil {
+		return errUntil
+	} else if dataOk {
+		indata[FLD_ROLE_USER_VALID_UNTIL] = validUntil
+	}
+
+	if errFrom == nil && errUntil == nil && !validUntil.After(validFrom) {
+		err := &utils.AppError{ErrorStatus: 400, ErrorMsg: "Invalid validity", ErrorDetail: FLD_ROLE_USER_VALID_UNTIL + " should be later than " + FLD_ROLE_USER_VALID_FROM}
+		return err
+	}
+	return nil
+}
+
+// isRoleAssignmentActive - Check whether the assignment is within its validity window at the given time
+func isRoleAssignmentActive(assignment utils.Map, atTime time.Time) bool {
+
+	// A bound which is present but can not be read makes the assignment inactive, not unbounded
+	if assignment[FLD_ROLE_USER_VALID_FROM] != nil {
+		validFrom, err := getMemberDataTime(assignment, FLD_ROLE_USER_VALID_FROM)
+		if err != nil || atTime.Before(validFrom) {
+			return false
+		}
+	}
+	if assignment[FLD_ROLE_USER_VALID_UNTIL] != nil {
+		validUntil, err := getMemberDataTime(assignment, FLD_ROLE_USER_VALID_UNTIL)
+		if err != nil || !atTime.Before(validUntil) {
+			return false
+		}
+	}
+	return true
+}
+
+// markRoleAssignments - Flag each assignment of a GetUsers styled response with its current status
+func markRoleAssignments(dataUsers utils.Map) utils.Map {
+	if dataUsers == nil {
+		return dataUsers
+	}
+
+	curTime := time.Now()
+	assignments := getListResult(dataUsers)
+	for _, assignment := range assignments {
+		assignment[FLD_ROLE_USER_IS_ACTIVE] = isRoleAssignmentActive(assignment, curTime)
+	}
+	dataUsers[db_common.LIST_RESULT] = assignments
+	return dataUsers
+}
+
+// findRoleAssignment - Find the role assignment matching the filter. An assignment which is expired
+// or not yet active is not found, so callers cannot take it as a granted role.
+func findRoleAssignment(dao roleDao, filter string) (utils.Map, error) {
+
+	assignment, err := dao.FindUser(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isRoleAssignmentActive(assignment, time.Now()) {
+		err := &utils.AppError{ErrorStatus: 404, ErrorMsg: "Role assignment not active", ErrorDetail: "The role assignment is expired or not yet valid"}
+		return nil, err
+	}
+	assignment[FLD_ROLE_USER_IS_ACTIVE] = true
+	return assignment, nil
+}
+
+// getExpiringRoleAssignments - List the assignments whose validity ends within the given duration
+func getExpiringRoleAssignments(dao roleDao, within time.Duration) (utils.Map, error) {
+
+	curTime := time.Now()
+	filter := buildFilter(utils.Map{FLD_ROLE_USER_VALID_UNTIL: utils.Map{
+		"$gt":  getFilterDate(curTime),
+		"$lte": getFilterDate(curTime.Add(within)),
+	}})
+	dataUsers, err := dao.ListUsers(filter, "", 0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	expiring := getListResult(dataUsers)
+	for _, assignment := range expiring {
+		assignment[FLD_ROLE_USER_IS_ACTIVE] = isRoleAssignmentActive(assignment, curTime)
+	}
+
+	response := utils.Map{
+		db_common.LIST_RESULTSIZE: len(expiring),
+		db_common.LIST_RESULT:     expiring,
+	}
+	return response, nil
+}
+
+// checkUserCredential - Evaluate the credential against every role actively assigned to the user.
+// Expired or not yet active assignments are skipped and reported back.
+func checkUserCredential(dao roleDao, fields roleFields, userId string, credential string, attributes utils.Map) (utils.Map, error) {
+
+	if err := ValidateCredential(credential); err != nil {
+		return nil, err
+	}
+
+	filter := buildFilter(utils.Map{fields.UserId: userId})
+	dataUsers, err := dao.ListUsers(filter, "", 0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	curTime := time.Now()
+	grantedCreds := []utils.Map{}
+	skippedRoles := []string{}
+	for _, assignment := range getListResult(dataUsers) {
+		roleId, err := utils.GetMemberDataStr(assignment, fields.RoleId)
+		if err != nil {
+			continue
+		}
+
+		if !isRoleAssignmentActive(assignment, curTime) {
+			skippedRoles = append(skippedRoles, roleId)
+			continue
+		}
+
+		dataCreds, err := getEffectiveCredentials(dao, fields, roleId)
+		if err != nil {
+			log.Println("checkUserCredential:: Unable to get credentials of role ", roleId, err)
+			continue
+		}
+		grantedCreds = append(grantedCreds, getListResult(dataCreds)...)
+	}
+
+	response := evaluateGrantedCredentials(grantedCreds, fields, credential, attributes)
+	response[fields.UserId] = userId
+	response[FLD_ROLE_SKIPPED_ROLES] = skippedRoles
+	return response, nil
+}
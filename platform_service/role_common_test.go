@@ -0,0 +1,169 @@
+package platform_service
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/zapscloud/golib-utils/utils"
+)
+
+func TestEvaluateGrantedCredentials(t *testing.T) {
+
+	cred := func(name string, condition string) utils.Map {
+		dataCred := utils.Map{FLD_SYS_ROLE_CREDENTIAL: name, FLD_ROLE_INHERITED_FROM: "role_a"}
+		if condition != "" {
+			dataCred[FLD_ROLE_CREDENTIAL_CONDITION] = condition
+		}
+		return dataCred
+	}
+
+	tests := []struct {
+		name       string
+		granted    []utils.Map
+		attributes utils.Map
+		wantAllow  bool
+		wantDeny   bool
+	}{
+		{"plain allow", []utils.Map{cred("invoice:*", "")}, utils.Map{}, true, false},
+		{"allow with condition met", []utils.Map{cred("invoice:approve", "amount < 100")}, utils.Map{"amount": 50}, true, false},
+		{"allow with condition not met", []utils.Map{cred("invoice:approve", "amount < 100")}, utils.Map{"amount": 500}, false, false},
+		{"allow with condition error", []utils.Map{cred("invoice:approve", "amount < 100")}, utils.Map{}, false, false},
+		{"deny with condition met", []utils.Map{cred("invoice:*", ""), cred("!invoice:approve", "amount > 100")}, utils.Map{"amount": 500}, false, true},
+		{"deny with condition not met", []utils.Map{cred("invoice:*", ""), cred("!invoice:approve", "amount > 100")}, utils.Map{"amount": 50}, true, false},
+		{"deny with condition error still applies", []utils.Map{cred("invoice:*", ""), cred("!invoice:approve", "amount > 100")}, utils.Map{}, false, true},
+		{"deny of other credential", []utils.Map{cred("invoice:*", ""), cred("!invoice:delete", "amount > 100")}, utils.Map{}, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := evaluateGrantedCredentials(tt.granted, sysRoleFields, "invoice:approve", tt.attributes)
+
+			isAllowed, _ := utils.GetMemberDataBool(result, CREDENTIAL_RESULT_ALLOWED)
+			isDenied, _ := utils.GetMemberDataBool(result, CREDENTIAL_RESULT_DENIED)
+			if isAllowed != tt.wantAllow || isDenied != tt.wantDeny {
+				t.Errorf("evaluateGrantedCredentials() allowed = %v, denied = %v, want %v, %v", isAllowed, isDenied, tt.wantAllow, tt.wantDeny)
+			}
+		})
+	}
+}
+
+func TestGetEffectiveCredentials(t *testing.T) {
+
+	role := func(roleId string, parentIds ...string) utils.Map {
+		return utils.Map{sysRoleFields.RoleId: roleId, sysRoleFields.ParentIds: parentIds}
+	}
+	cred := func(name string) utils.Map {
+		return utils.Map{sysRoleFields.Credential: name}
+	}
+
+	dao := &fakeRoleDao{
+		roles: map[string]utils.Map{
+			"clerk":   role("clerk", "staff"),
+			"staff":   role("staff", "base"),
+			"base":    role("base"),
+			"orphan":  role("orphan", "missing"),
+			"partial": role("partial", "staff", "missing"),
+		},
+		creds: map[string][]utils.Map{
+			"clerk": {cred("invoice:create")},
+			"staff": {cred("invoice:*"), cred("!invoice:delete")},
+			"base":  {cred("invoice:create"), cred("profile:read")},
+		},
+	}
+
+	dataCreds, err := getEffectiveCredentials(dao, sysRoleFields, "clerk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inheritedFrom := map[string]interface{}{}
+	for _, effCred := range getListResult(dataCreds) {
+		inheritedFrom[effCred[sysRoleFields.Credential].(string)] = effCred[FLD_ROLE_INHERITED_FROM]
+	}
+	want := map[string]interface{}{"invoice:create": "clerk", "invoice:*": "staff", "!invoice:delete": "staff", "profile:read": "base"}
+	if !reflect.DeepEqual(inheritedFrom, want) {
+		t.Errorf("getEffectiveCredentials() = %v, want %v", inheritedFrom, want)
+	}
+
+	// A parent which cannot be read could hold a deny, so the lookup fails
+	for _, roleId := range []string{"orphan", "partial", "missing"} {
+		if _, err := getEffectiveCredentials(dao, sysRoleFields, roleId); err == nil {
+			t.Errorf("getEffectiveCredentials(%q) should fail on the missing role", roleId)
+		}
+	}
+}
+
+func TestFindRoleCredential(t *testing.T) {
+
+	dao := &fakeRoleDao{
+		roles: map[string]utils.Map{
+			"clerk": {sysRoleFields.RoleId: "clerk", sysRoleFields.ParentIds: []string{"staff"}},
+			"staff": {sysRoleFields.RoleId: "staff"},
+		},
+		creds: map[string][]utils.Map{
+			"clerk": {
+				{sysRoleFields.Credential: "invoice:approve", FLD_ROLE_CREDENTIAL_CONDITION: "amount < 100"},
+				{sysRoleFields.Credential: "report:*"},
+			},
+			"staff": {
+				{sysRoleFields.Credential: "invoice:read"},
+				{sysRoleFields.Credential: "!report:delete"},
+			},
+		},
+	}
+
+	tests := []struct {
+		credential string
+		wantFrom   string
+		wantErr    bool
+	}{
+		{"report:view", "clerk", false},
+		{"invoice:read", "staff", false},
+		{"invoice:approve", "", true},
+		{"report:delete", "", true},
+		{"invoice:delete", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.credential, func(t *testing.T) {
+			filter := buildFilter(utils.Map{sysRoleFields.RoleId: "clerk", sysRoleFields.Credential: tt.credential})
+			cred, err := findRoleCredential(dao, sysRoleFields, filter)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("findRoleCredential(%q) error = %v, wantErr %v", tt.credential, err, tt.wantErr)
+			}
+			if err == nil && cred[FLD_ROLE_INHERITED_FROM] != tt.wantFrom {
+				t.Errorf("findRoleCredential(%q) found %v from %v, want from %v", tt.credential, cred[sysRoleFields.Credential], cred[FLD_ROLE_INHERITED_FROM], tt.wantFrom)
+			}
+		})
+	}
+}
+
+func TestIsRoleAssignmentActive(t *testing.T) {
+
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		assignment utils.Map
+		want       bool
+	}{
+		{"no bounds", utils.Map{}, true},
+		{"within", utils.Map{FLD_ROLE_USER_VALID_FROM: "2026-10-01T00:00:00Z", FLD_ROLE_USER_VALID_UNTIL: "2026-11-01T00:00:00Z"}, true},
+		{"not yet valid", utils.Map{FLD_ROLE_USER_VALID_FROM: "2026-10-20T00:00:00Z"}, false},
+		{"expired", utils.Map{FLD_ROLE_USER_VALID_UNTIL: now}, false},
+		{"unreadable from", utils.Map{FLD_ROLE_USER_VALID_FROM: "yesterday"}, false},
+		{"unreadable until", utils.Map{FLD_ROLE_USER_VALID_UNTIL: 20261101}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isRoleAssignmentActive(tt.assignment, now); got != tt.want {
+				t.Errorf("isRoleAssignmentActive(%v) = %v, want %v", tt.assignment, got, tt.want)
+			}
+		})
+	}
+
+	if err := normalizeRoleAssignment(utils.Map{FLD_ROLE_USER_VALID_UNTIL: "next week"}); err == nil {
+		t.Errorf("normalizeRoleAssignment() of an unreadable date should fail")
+	}
+}
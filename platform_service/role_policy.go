@@ -0,0 +1,616 @@
+package platform_service
+
+import (
+	"encoding/json"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/zapscloud/golib-dbutils/db_common"
+	"github.com/zapscloud/golib-dbutils/db_utils"
+	"github.com/zapscloud/golib-utils/utils"
+	"gopkg.in/yaml.v3"
+)
+
+// ROLE_POLICY_VERSION - Version of the role policy document written by ExportPolicy
+const ROLE_POLICY_VERSION = 1
+
+const (
+	ROLE_POLICY_FORMAT_JSON = "json"
+	ROLE_POLICY_FORMAT_YAML = "yaml"
+
+	ROLE_POLICY_ACTION_CREATE    = "create"
+	ROLE_POLICY_ACTION_UPDATE    = "update"
+	ROLE_POLICY_ACTION_UNCHANGED = "unchanged"
+
+	FLD_POLICY_VERSION        = "version"
+	FLD_POLICY_IS_APPLIED     = "is_applied"
+	FLD_POLICY_ROLES          = "roles"
+	FLD_POLICY_ACTION         = "action"
+	FLD_POLICY_CHANGED_FIELDS = "changed_fields"
+	FLD_POLICY_CREDS_ADDED    = "credentials_added"
+	FLD_POLICY_CREDS_REMOVED  = "credentials_removed"
+	FLD_POLICY_USERS_ADDED    = "users_added"
+	FLD_POLICY_USERS_REMOVED  = "users_removed"
+)
+
+// RolePolicyDocument - Versioned definition of roles which can be kept in version control
+type RolePolicyDocument struct {
+	Version    int          `json:"version" yaml:"version"`
+	RoleType   string       `json:"role_type" yaml:"role_type"`
+	ExportedAt time.Time    `json:"exported_at" yaml:"exported_at"`
+	WithUsers  bool         `json:"with_users" yaml:"with_users"`
+	Roles      []RolePolicy `json:"roles" yaml:"roles"`
+}
+
+// RolePolicy - Definition of a single role
+type RolePolicy struct {
+	RoleId      string                 `json:"role_id" yaml:"role_id"`
+	Attributes  map[string]interface{} `json:"attributes,omitempty" yaml:"attributes,omitempty"`
+	ParentIds   []string               `json:"parent_ids,omitempty" yaml:"parent_ids,omitempty"`
+	Credentials []RolePolicyCredential `json:"credentials,omitempty" yaml:"credentials,omitempty"`
+	Users       []RolePolicyUser       `json:"users,omitempty" yaml:"users,omitempty"`
+}
+
+// RolePolicyCredential - Credential granted by a role
+type RolePolicyCredential struct {
+	Credential string `json:"credential" yaml:"credential"`
+	Condition  string `json:"condition,omitempty" yaml:"condition,omitempty"`
+}
+
+// RolePolicyUser - User assigned to a role
+type RolePolicyUser struct {
+	UserId     string     `json:"user_id" yaml:"user_id"`
+	ValidFrom  *time.Time `json:"valid_from,omitempty" yaml:"valid_from,omitempty"`
+	ValidUntil *time.Time `json:"valid_until,omitempty" yaml:"valid_until,omitempty"`
+}
+
+// Role fields which are not exported as attributes
+var rolePolicySkipFields = []string{
+	db_common.FLD_DEFAULT_ID,
+	db_common.FLD_CREATED_AT,
+	db_common.FLD_CREATED_BY,
+	db_common.FLD_UPDATED_AT,
+	db_common.FLD_UPDATED_BY,
+	db_common.FLD_IS_DELETED,
+}
+
+// exportRolePolicy - Export the given roles, or every role when roleIds is empty
+func exportRolePolicy(dao roleDao, fields roleFields, roleIds []string, withUsers bool, format string) ([]byte, error) {
+
+	dataRoles := []utils.Map{}
+	if len(roleIds) == 0 {
+		dataList, err := dao.List("", "", 0, 0)
+		if err != nil {
+			return nil, err
+		}
+		dataRoles = getListResult(dataList)
+	} else {
+		for _, roleId := range roleIds {
+			dataRole, err := dao.Get(roleId)
+			if err != nil {
+				return nil, err
+			}
+			dataRoles = append(dataRoles, dataRole)
+		}
+	}
+
+	policyDoc := RolePolicyDocument{
+		Version:    ROLE_POLICY_VERSION,
+		RoleType:   fields.RoleType,
+		ExportedAt: time.Now().UTC(),
+		WithUsers:  withUsers,
+		Roles:      []RolePolicy{},
+	}
+
+	for _, dataRole := range dataRoles {
+		roleId, err := utils.GetMemberDataStr(dataRole, fields.RoleId)
+		if err != nil {
+			continue
+		}
+
+		rolePolicy := RolePolicy{
+			RoleId:      roleId,
+			Attributes:  getRolePolicyAttributes(dataRole, fields),
+			ParentIds:   getRoleParentIds(dataRole, fields),
+			Credentials: []RolePolicyCredential{},
+		}
+
+		dataCreds, err := dao.GetCredentials(roleId)
+		if err != nil {
+			log.Println("exportRolePolicy:: No credentials for role ", roleId, err)
+		}
+		for _, cred := range getListResult(dataCreds) {
+			credName, _ := utils.GetMemberDataStr(cred, fields.Credential)
+			condition, _ := utils.GetMemberDataStr(cred, FLD_ROLE_CREDENTIAL_CONDITION)
+			rolePolicy.Credentials = append(rolePolicy.Credentials, RolePolicyCredential{Credential: credName, Condition: condition})
+		}
+		sort.Slice(rolePolicy.Credentials, func(i, j int) bool {
+			return rolePolicy.Credentials[i].Credential < rolePolicy.Credentials[j].Credential
+		})
+
+		if withUsers {
+			rolePolicy.Users = getRolePolicyUsers(dao, fields, roleId)
+		}
+
+		policyDoc.Roles = append(policyDoc.Roles, rolePolicy)
+	}
+	sort.Slice(policyDoc.Roles, func(i, j int) bool {
+		return policyDoc.Roles[i].RoleId < policyDoc.Roles[j].RoleId
+	})
+
+	return marshalRolePolicy(policyDoc, format)
+}
+
+// importRolePolicy - Compare the policy document with the stored roles and return the difference.
+// The difference is applied in one transaction only when confirm is set. Roles missing from the
+// document are left untouched.
+func importRolePolicy(dbService *db_utils.DatabaseService, dao roleDao, fields roleFields, document []byte, format string, confirm bool, funcode string) (utils.Map, error) {
+
+	policyDoc, err := unmarshalRolePolicy(document, format)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateRolePolicy(dao, fields, policyDoc, funcode)
+	if err != nil {
+		return nil, err
+	}
+
+	// With confirm the stored roles are read inside the transaction, so the applied difference
+	// is the one returned
+	roleDiffs := []utils.Map{}
+	diffRoles := func(apply bool) error {
+		for _, rolePolicy := range policyDoc.Roles {
+			roleDiff, applyFunc, err := diffRolePolicy(dao, fields, rolePolicy, policyDoc.WithUsers)
+			if err != nil {
+				return err
+			}
+			if apply {
+				if err := applyFunc(); err != nil {
+					return err
+				}
+			}
+			roleDiffs = append(roleDiffs, roleDiff)
+		}
+		return nil
+	}
+
+	response := utils.Map{
+		FLD_POLICY_VERSION:    policyDoc.Version,
+		FLD_POLICY_IS_APPLIED: false,
+	}
+	if !confirm {
+		if err := diffRoles(false); err != nil {
+			return nil, err
+		}
+		response[FLD_POLICY_ROLES] = roleDiffs
+		return response, nil
+	}
+
+	err = runInTransaction(dbService, func() error {
+		roleDiffs = []utils.Map{}
+		return diffRoles(true)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	response[FLD_POLICY_ROLES] = roleDiffs
+	response[FLD_POLICY_IS_APPLIED] = true
+	return response, nil
+}
+
+func marshalRolePolicy(policyDoc RolePolicyDocument, format string) ([]byte, error) {
+	switch strings.ToLower(format) {
+	case ROLE_POLICY_FORMAT_YAML, "yml":
+		return yaml.Marshal(policyDoc)
+	case ROLE_POLICY_FORMAT_JSON, "":
+		return json.MarshalIndent(policyDoc, "", "  ")
+	}
+	err := &utils.AppError{ErrorStatus: 400, ErrorMsg: "Invalid format", ErrorDetail: "Role policy format should be json or yaml"}
+	return nil, err
+}
+
+func unmarshalRolePolicy(document []byte, format string) (RolePolicyDocument, error) {
+	var policyDoc RolePolicyDocument
+	var err error
+
+	switch strings.ToLower(format) {
+	case ROLE_POLICY_FORMAT_YAML, "yml":
+		err = yaml.Unmarshal(document, &policyDoc)
+	case ROLE_POLICY_FORMAT_JSON, "":
+		err = json.Unmarshal(document, &policyDoc)
+	default:
+		err = &utils.AppError{ErrorStatus: 400, ErrorMsg: "Invalid format", ErrorDetail: "Role policy format should be json or yaml"}
+	}
+	if err != nil {
+		return policyDoc, err
+	}
+
+	// Role ids are stored in lowercase
+	for idx := range policyDoc.Roles {
+		policyDoc.Roles[idx].RoleId = strings.ToLower(policyDoc.Roles[idx].RoleId)
+		for parentIdx, parentId := range policyDoc.Roles[idx].ParentIds {
+			policyDoc.Roles[idx].ParentIds[parentIdx] = strings.ToLower(parentId)
+		}
+	}
+	return policyDoc, nil
+}
+
+// validateRolePolicy - Check the document version, credentials and the resulting role hierarchy
+func validateRolePolicy(dao roleDao, fields roleFields, policyDoc RolePolicyDocument, funcode string) error {
+
+	if policyDoc.Version != ROLE_POLICY_VERSION {
+		err := &utils.AppError{ErrorCode: funcode + "01", ErrorMsg: "Unsupported policy version", ErrorDetail: "Role policy version should be 1"}
+		return err
+	}
+
+	if policyDoc.RoleType != fields.RoleType {
+		err := &utils.AppError{ErrorCode: funcode + "02", ErrorMsg: "Invalid role type", ErrorDetail: "Role policy is for " + policyDoc.RoleType + " not " + fields.RoleType}
+		return err
+	}
+
+	// Start from the stored hierarchy and overlay the document
+	roleParents := map[string][]string{}
+	dataList, err := dao.List("", "", 0, 0)
+	if err == nil {
+		for _, dataRole := range getListResult(dataList) {
+			roleId, _ := utils.GetMemberDataStr(dataRole, fields.RoleId)
+			roleParents[roleId] = getRoleParentIds(dataRole, fields)
+		}
+	}
+
+	docRoles := map[string]bool{}
+	for _, rolePolicy := range policyDoc.Roles {
+		if utils.IsEmpty(rolePolicy.RoleId) {
+			err := &utils.AppError{ErrorCode: funcode + "03", ErrorMsg: "Missing role id", ErrorDetail: "Every role in the policy should have a role_id"}
+			return err
+		}
+		if docRoles[rolePolicy.RoleId] {
+			err := &utils.AppError{ErrorCode: funcode + "04", ErrorMsg: "Duplicate role", ErrorDetail: "Role " + rolePolicy.RoleId + " is defined more than once"}
+			return err
+		}
+		docRoles[rolePolicy.RoleId] = true
+		roleParents[rolePolicy.RoleId] = rolePolicy.ParentIds
+
+		for _, cred := range rolePolicy.Credentials {
+			if err := ValidateCredential(cred.Credential); err != nil {
+				return err
+			}
+			if cred.Condition != "" {
+				if err := ValidateCondition(cred.Condition); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	for roleId, parentIds := range roleParents {
+		for _, parentId := range parentIds {
+			if _, found := roleParents[parentId]; !found {
+				err := &utils.AppError{ErrorCode: funcode + "05", ErrorMsg: "Invalid parent role", ErrorDetail: "Parent role " + parentId + " of " + roleId + " does not exist"}
+				return err
+			}
+		}
+	}
+
+	if cycleRoleId, found := findRoleCycle(roleParents); found {
+		err := &utils.AppError{ErrorCode: funcode + "06", ErrorMsg: "Cyclic role inheritance", ErrorDetail: "Role " + cycleRoleId + " inherits from itself through its parents"}
+		return err
+	}
+	return nil
+}
+
+// findRoleCycle - Find a role which is its own ancestor in the given hierarchy
+func findRoleCycle(roleParents map[string][]string) (string, bool) {
+	const (
+		notVisited = iota
+		inProgress
+		completed
+	)
+	state := map[string]int{}
+
+	var visit func(roleId string) bool
+	visit = func(roleId string) bool {
+		switch state[roleId] {
+		case inProgress:
+			return true
+		case completed:
+			return false
+		}
+		state[roleId] = inProgress
+		for _, parentId := range roleParents[roleId] {
+			if visit(parentId) {
+				return true
+			}
+		}
+		state[roleId] = completed
+		return false
+	}
+
+	roleIds := []string{}
+	for roleId := range roleParents {
+		roleIds = append(roleIds, roleId)
+	}
+	sort.Strings(roleIds)
+
+	for _, roleId := range roleIds {
+		if state[roleId] == notVisited && visit(roleId) {
+			return roleId, true
+		}
+	}
+	return "", false
+}
+
+// diffRolePolicy - Compare one role of the document with the stored role. Returns the difference
+// and a function which applies it.
+func diffRolePolicy(dao roleDao, fields roleFields, rolePolicy RolePolicy, withUsers bool) (utils.Map, func() error, error) {
+
+	roleId := rolePolicy.RoleId
+	wantCreds := []utils.Map{}
+	for _, cred := range rolePolicy.Credentials {
+		dataCred := utils.Map{fields.Credential: NormalizeCredential(cred.Credential)}
+		if cred.Condition != "" {
+			dataCred[FLD_ROLE_CREDENTIAL_CONDITION] = cred.Condition
+		}
+		wantCreds = append(wantCreds, dataCred)
+	}
+
+	wantRole := utils.Map{}
+	for key, value := range rolePolicy.Attributes {
+		wantRole[key] = value
+	}
+	wantRole[fields.ParentIds] = append([]string{}, rolePolicy.ParentIds...)
+
+	roleDiff := utils.Map{fields.RoleId: roleId}
+	changedFields := utils.Map{}
+	isNewRole := false
+
+	dataRole, err := dao.Get(roleId)
+	if err != nil {
+		isNewRole = true
+		changedFields = wantRole
+	} else {
+		for key, value := range wantRole {
+			if !isSamePolicyValue(dataRole[key], value) {
+				changedFields[key] = value
+			}
+		}
+		// Attributes dropped from the document are cleared
+		for key, value := range getRolePolicyAttributes(dataRole, fields) {
+			if _, found := wantRole[key]; !found && value != nil {
+				changedFields[key] = nil
+			}
+		}
+	}
+
+	existCreds := []utils.Map{}
+	existUsers := []utils.Map{}
+	if !isNewRole {
+		if dataCreds, err := dao.GetCredentials(roleId); err == nil {
+			existCreds = getListResult(dataCreds)
+		}
+		if dataUsers, err := dao.GetUsers(roleId); err == nil {
+			existUsers = getListResult(dataUsers)
+		}
+	}
+	credsAdd, credsRemove := diffRoleCredentials(existCreds, wantCreds, fields)
+
+	usersAdd, usersRemove := []utils.Map{}, []string{}
+	if withUsers {
+		usersAdd, usersRemove = diffRolePolicyUsers(existUsers, rolePolicy.Users, fields)
+	}
+
+	credsAdded := []string{}
+	for _, cred := range credsAdd {
+		credsAdded = append(credsAdded, cred[fields.Credential].(string))
+	}
+	usersAdded := []string{}
+	for _, user := range usersAdd {
+		usersAdded = append(usersAdded, user[fields.UserId].(string))
+	}
+
+	action := ROLE_POLICY_ACTION_UNCHANGED
+	if isNewRole {
+		action = ROLE_POLICY_ACTION_CREATE
+	} else if len(changedFields) > 0 || len(credsAdd) > 0 || len(credsRemove) > 0 || len(usersAdd) > 0 || len(usersRemove) > 0 {
+		action = ROLE_POLICY_ACTION_UPDATE
+	}
+
+	roleDiff[FLD_POLICY_ACTION] = action
+	roleDiff[FLD_POLICY_CHANGED_FIELDS] = changedFields
+	roleDiff[FLD_POLICY_CREDS_ADDED] = credsAdded
+	roleDiff[FLD_POLICY_CREDS_REMOVED] = credsRemove
+	roleDiff[FLD_POLICY_USERS_ADDED] = usersAdded
+	roleDiff[FLD_POLICY_USERS_REMOVED] = usersRemove
+
+	applyFunc := func() error {
+		if isNewRole {
+			dataCreate := utils.CopyMap(wantRole)
+			dataCreate[fields.RoleId] = roleId
+			if _, err := dao.Create(dataCreate); err != nil {
+				return err
+			}
+		} else if len(changedFields) > 0 {
+			if _, err := dao.Update(roleId, utils.CopyMap(changedFields)); err != nil {
+				return err
+			}
+		}
+
+		if len(credsRemove) > 0 {
+			if _, err := dao.RemoveCredentials(roleId, credsRemove); err != nil {
+				return err
+			}
+		}
+		for _, cred := range credsAdd {
+			if _, err := dao.AddCredentials(roleId, cred); err != nil {
+				return err
+			}
+		}
+
+		if len(usersRemove) > 0 {
+			if _, err := dao.RemoveUsers(roleId, usersRemove); err != nil {
+				return err
+			}
+		}
+		for _, user := range usersAdd {
+			if _, err := dao.AddUsers(roleId, user); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return roleDiff, applyFunc, nil
+}
+
+// diffRolePolicyUsers - Compare the stored assignments with the wanted ones. An assignment whose
+// validity changed is removed and added again.
+func diffRolePolicyUsers(existing []utils.Map, wanted []RolePolicyUser, fields roleFields) ([]utils.Map, []string) {
+
+	assignmentKey := func(validFrom *time.Time, validUntil *time.Time) string {
+		key := "|"
+		if validFrom != nil {
+			key = validFrom.UTC().Format(time.RFC3339) + key
+		}
+		if validUntil != nil {
+			key = key + validUntil.UTC().Format(time.RFC3339)
+		}
+		return key
+	}
+
+	// User ids are compared in lower case, the stored id is kept for removing the assignment
+	existKeys := map[string]string{}
+	existIds := map[string]string{}
+	for _, user := range existing {
+		storedId, err := utils.GetMemberDataStr(user, fields.UserId)
+		if err != nil {
+			continue
+		}
+		userId := strings.ToLower(storedId)
+		existIds[userId] = storedId
+		validFrom, errFrom := getMemberDataTime(user, FLD_ROLE_USER_VALID_FROM)
+		validUntil, errUntil := getMemberDataTime(user, FLD_ROLE_USER_VALID_UNTIL)
+
+		var ptrFrom, ptrUntil *time.Time
+		if errFrom == nil {
+			ptrFrom = &validFrom
+		}
+		if errUntil == nil {
+			ptrUntil = &validUntil
+		}
+		existKeys[userId] = assignmentKey(ptrFrom, ptrUntil)
+	}
+
+	usersAdd := []utils.Map{}
+	wantKeys := map[string]string{}
+	for _, user := range wanted {
+		userId := strings.ToLower(user.UserId)
+		if _, found := wantKeys[userId]; found || utils.IsEmpty(userId) {
+			continue
+		}
+		wantKeys[userId] = assignmentKey(user.ValidFrom, user.ValidUntil)
+
+		if existKey, found := existKeys[userId]; !found || existKey != wantKeys[userId] {
+			dataUser := utils.Map{fields.UserId: userId}
+			if user.ValidFrom != nil {
+				dataUser[FLD_ROLE_USER_VALID_FROM] = *user.ValidFrom
+			}
+			if user.ValidUntil != nil {
+				dataUser[FLD_ROLE_USER_VALID_UNTIL] = *user.ValidUntil
+			}
+			usersAdd = append(usersAdd, dataUser)
+		}
+	}
+
+	usersRemove := []string{}
+	for userId, existKey := range existKeys {
+		if wantKey, found := wantKeys[userId]; !found || wantKey != existKey {
+			usersRemove = append(usersRemove, existIds[userId])
+		}
+	}
+	sort.Strings(usersRemove)
+
+	return usersAdd, usersRemove
+}
+
+func getRolePolicyAttributes(dataRole utils.Map, fields roleFields) map[string]interface{} {
+	attributes := map[string]interface{}{}
+	for key, value := range dataRole {
+		attributes[key] = normalizePolicyValue(value)
+	}
+
+	delete(attributes, fields.RoleId)
+	delete(attributes, fields.ParentIds)
+	for _, key := range rolePolicySkipFields {
+		delete(attributes, key)
+	}
+	return attributes
+}
+
+func getRolePolicyUsers(dao roleDao, fields roleFields, roleId string) []RolePolicyUser {
+	policyUsers := []RolePolicyUser{}
+
+	dataUsers, err := dao.GetUsers(roleId)
+	if err != nil {
+		log.Println("getRolePolicyUsers:: No users for role ", roleId, err)
+		return policyUsers
+	}
+
+	for _, user := range getListResult(dataUsers) {
+		userId, err := utils.GetMemberDataStr(user, fields.UserId)
+		if err != nil {
+			continue
+		}
+
+		policyUser := RolePolicyUser{UserId: userId}
+		if validFrom, err := getMemberDataTime(user, FLD_ROLE_USER_VALID_FROM); err == nil {
+			policyUser.ValidFrom = &validFrom
+		}
+		if validUntil, err := getMemberDataTime(user, FLD_ROLE_USER_VALID_UNTIL); err == nil {
+			policyUser.ValidUntil = &validUntil
+		}
+		policyUsers = append(policyUsers, policyUser)
+	}
+
+	sort.Slice(policyUsers, func(i, j int) bool {
+		return policyUsers[i].UserId < policyUsers[j].UserId
+	})
+	return policyUsers
+}
+
+// normalizePolicyValue - Round trip the value through JSON so stored values and values read
+// from a document compare alike
+func normalizePolicyValue(value interface{}) interface{} {
+	valueJson, err := json.Marshal(value)
+	if err != nil {
+		return value
+	}
+
+	var normalized interface{}
+	if err := json.Unmarshal(valueJson, &normalized); err != nil {
+		return value
+	}
+	return normalized
+}
+
+func isSamePolicyValue(stored interface{}, wanted interface{}) bool {
+	stored = normalizePolicyValue(stored)
+	wanted = normalizePolicyValue(wanted)
+
+	// A missing value and an empty list or map are the same
+	isEmpty := func(value interface{}) bool {
+		if value == nil {
+			return true
+		}
+		refVal := reflect.ValueOf(value)
+		return (refVal.Kind() == reflect.Slice || refVal.Kind() == reflect.Map) && refVal.Len() == 0
+	}
+	if isEmpty(stored) && isEmpty(wanted) {
+		return true
+	}
+	return reflect.DeepEqual(stored, wanted)
+}
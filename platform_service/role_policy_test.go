@@ -0,0 +1,350 @@
+package platform_service
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/zapscloud/golib-dbutils/db_common"
+	"github.com/zapscloud/golib-utils/utils"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// fakeRoleDao - In-memory roleDao holding roles, their credentials and user assignments
+type fakeRoleDao struct {
+	roles map[string]utils.Map
+	creds map[string][]utils.Map
+	users map[string][]utils.Map
+}
+
+var errFakeNotFound = errors.New("not found")
+
+func listResult(records []utils.Map) utils.Map {
+	return utils.Map{db_common.LIST_RESULTSIZE: len(records), db_common.LIST_RESULT: records}
+}
+
+func (d *fakeRoleDao) List(filter string, sort string, skip int64, limit int64) (utils.Map, error) {
+	records := []utils.Map{}
+	for _, dataRole := range d.roles {
+		records = append(records, dataRole)
+	}
+	return listResult(records), nil
+}
+
+func (d *fakeRoleDao) Get(role_id string) (utils.Map, error) {
+	if dataRole, found := d.roles[role_id]; found {
+		return dataRole, nil
+	}
+	return nil, errFakeNotFound
+}
+
+func (d *fakeRoleDao) Update(role_id string, indata utils.Map) (utils.Map, error) {
+	for key, value := range indata {
+		d.roles[role_id][key] = value
+	}
+	return d.roles[role_id], nil
+}
+
+func (d *fakeRoleDao) Delete(role_id string) (int64, error) {
+	delete(d.roles, role_id)
+	return 1, nil
+}
+
+func (d *fakeRoleDao) Create(indata utils.Map) (utils.Map, error) {
+	d.roles[indata[sysRoleFields.RoleId].(string)] = indata
+	return indata, nil
+}
+
+func (d *fakeRoleDao) AddCredentials(role_id string, indata utils.Map) (utils.Map, error) {
+	d.creds[role_id] = append(d.creds[role_id], indata)
+	return indata, nil
+}
+
+func (d *fakeRoleDao) GetCredentials(role_id string) (utils.Map, error) {
+	return listResult(d.creds[role_id]), nil
+}
+
+func (d *fakeRoleDao) FindCredential(filter string) (utils.Map, error) {
+	return nil, errFakeNotFound
+}
+
+func (d *fakeRoleDao) RemoveCredentials(role_id string, credentials []string) (int64, error) {
+	return 0, nil
+}
+
+func (d *fakeRoleDao) AddUsers(role_id string, indata utils.Map) (utils.Map, error) {
+	d.users[role_id] = append(d.users[role_id], indata)
+	return indata, nil
+}
+
+func (d *fakeRoleDao) FindUser(filter string) (utils.Map, error) {
+	return nil, errFakeNotFound
+}
+
+func (d *fakeRoleDao) GetUsers(role_id string) (utils.Map, error) {
+	return listResult(d.users[role_id]), nil
+}
+
+func (d *fakeRoleDao) RemoveUsers(role_id string, user_ids []string) (int64, error) {
+	var removed int64
+	users := []utils.Map{}
+	for _, user := range d.users[role_id] {
+		isRemoved := false
+		for _, userId := range user_ids {
+			if user[appRoleFields.UserId] == userId || user[sysRoleFields.UserId] == userId {
+				isRemoved = true
+			}
+		}
+		if isRemoved {
+			removed++
+		} else {
+			users = append(users, user)
+		}
+	}
+	d.users[role_id] = users
+	return removed, nil
+}
+
+func (d *fakeRoleDao) ListUsers(filter string, sort string, skip int64, limit int64) (utils.Map, error) {
+	records := []utils.Map{}
+	for _, users := range d.users {
+		for _, user := range users {
+			if matchFakeFilter(user, filter) {
+				records = append(records, user)
+			}
+		}
+	}
+	return listResult(records), nil
+}
+
+func TestDiffRoleCredentials(t *testing.T) {
+
+	cred := func(name string, condition string) utils.Map {
+		dataCred := utils.Map{FLD_SYS_ROLE_CREDENTIAL: name}
+		if condition != "" {
+			dataCred[FLD_ROLE_CREDENTIAL_CONDITION] = condition
+		}
+		return dataCred
+	}
+
+	tests := []struct {
+		name       string
+		existing   []utils.Map
+		wanted     []utils.Map
+		wantAdd    []string
+		wantRemove []string
+	}{
+		{"unchanged", []utils.Map{cred("a:read", "")}, []utils.Map{cred("a:read", "")}, []string{}, []string{}},
+		{"added", []utils.Map{}, []utils.Map{cred("a:read", "")}, []string{"a:read"}, []string{}},
+		{"removed", []utils.Map{cred("a:read", ""), cred("b:read", "")}, []utils.Map{cred("a:read", "")}, []string{}, []string{"b:read"}},
+		{"condition changed", []utils.Map{cred("a:read", "amount < 10")}, []utils.Map{cred("a:read", "amount < 20")}, []string{"a:read"}, []string{"a:read"}},
+		{"condition dropped", []utils.Map{cred("a:read", "amount < 10")}, []utils.Map{cred("a:read", "")}, []string{"a:read"}, []string{"a:read"}},
+		{"duplicate wanted", []utils.Map{}, []utils.Map{cred("a:read", ""), cred("a:read", "amount < 10")}, []string{"a:read"}, []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			credsAdd, credsRemove := diffRoleCredentials(tt.existing, tt.wanted, sysRoleFields)
+
+			added := []string{}
+			for _, cred := range credsAdd {
+				added = append(added, cred[FLD_SYS_ROLE_CREDENTIAL].(string))
+			}
+			if !reflect.DeepEqual(added, tt.wantAdd) || !reflect.DeepEqual(credsRemove, tt.wantRemove) {
+				t.Errorf("diffRoleCredentials() = %v, %v, want %v, %v", added, credsRemove, tt.wantAdd, tt.wantRemove)
+			}
+		})
+	}
+}
+
+func TestDiffRolePolicyUsers(t *testing.T) {
+
+	validUntil := time.Date(2026, 12, 31, 0, 0, 0, 0, time.UTC)
+	laterUntil := validUntil.AddDate(0, 1, 0)
+
+	tests := []struct {
+		name       string
+		existing   []utils.Map
+		wanted     []RolePolicyUser
+		wantAdd    []string
+		wantRemove []string
+	}{
+		{"unchanged", []utils.Map{{sysRoleFields.UserId: "u1"}}, []RolePolicyUser{{UserId: "u1"}}, []string{}, []string{}},
+		{"added and removed", []utils.Map{{sysRoleFields.UserId: "u1"}}, []RolePolicyUser{{UserId: "u2"}}, []string{"u2"}, []string{"u1"}},
+		{"same validity", []utils.Map{{sysRoleFields.UserId: "u1", FLD_ROLE_USER_VALID_UNTIL: validUntil}}, []RolePolicyUser{{UserId: "u1", ValidUntil: &validUntil}}, []string{}, []string{}},
+		{"validity changed", []utils.Map{{sysRoleFields.UserId: "u1", FLD_ROLE_USER_VALID_UNTIL: validUntil}}, []RolePolicyUser{{UserId: "u1", ValidUntil: &laterUntil}}, []string{"u1"}, []string{"u1"}},
+		{"user id case", []utils.Map{{sysRoleFields.UserId: "u1"}}, []RolePolicyUser{{UserId: "U1"}}, []string{}, []string{}},
+		{"stored user id case", []utils.Map{{sysRoleFields.UserId: "U1"}, {sysRoleFields.UserId: "U2"}}, []RolePolicyUser{{UserId: "u1"}}, []string{}, []string{"U2"}},
+		{"empty user id", []utils.Map{}, []RolePolicyUser{{UserId: ""}}, []string{}, []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			usersAdd, usersRemove := diffRolePolicyUsers(tt.existing, tt.wanted, sysRoleFields)
+
+			added := []string{}
+			for _, user := range usersAdd {
+				added = append(added, user[sysRoleFields.UserId].(string))
+			}
+			if !reflect.DeepEqual(added, tt.wantAdd) || !reflect.DeepEqual(usersRemove, tt.wantRemove) {
+				t.Errorf("diffRolePolicyUsers() = %v, %v, want %v, %v", added, usersRemove, tt.wantAdd, tt.wantRemove)
+			}
+		})
+	}
+}
+
+func TestIsSamePolicyValue(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		stored interface{}
+		wanted interface{}
+		want   bool
+	}{
+		{"same string", "Admin", "Admin", true},
+		{"different string", "Admin", "Viewer", false},
+		{"int and float", int64(3), float64(3), true},
+		{"bson array and list", primitive.A{"a", "b"}, []string{"a", "b"}, true},
+		{"list order", []string{"a", "b"}, []string{"b", "a"}, false},
+		{"missing and empty list", nil, []string{}, true},
+		{"missing and empty map", nil, map[string]interface{}{}, true},
+		{"missing and value", nil, "a", false},
+		{"nested map", utils.Map{"level": 1}, map[string]interface{}{"level": 1}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isSamePolicyValue(tt.stored, tt.wanted); got != tt.want {
+				t.Errorf("isSamePolicyValue(%v, %v) = %v, want %v", tt.stored, tt.wanted, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindRoleCycle(t *testing.T) {
+
+	tests := []struct {
+		name        string
+		roleParents map[string][]string
+		wantFound   bool
+	}{
+		{"no parents", map[string][]string{"a": nil, "b": nil}, false},
+		{"chain", map[string][]string{"a": {"b"}, "b": {"c"}, "c": nil}, false},
+		{"diamond", map[string][]string{"a": {"b", "c"}, "b": {"d"}, "c": {"d"}, "d": nil}, false},
+		{"self", map[string][]string{"a": {"a"}}, true},
+		{"loop", map[string][]string{"a": {"b"}, "b": {"c"}, "c": {"a"}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, found := findRoleCycle(tt.roleParents); found != tt.wantFound {
+				t.Errorf("findRoleCycle() found = %v, want %v", found, tt.wantFound)
+			}
+		})
+	}
+}
+
+func TestDiffRolePolicy(t *testing.T) {
+
+	newDao := func() *fakeRoleDao {
+		return &fakeRoleDao{
+			roles: map[string]utils.Map{
+				"admin": {sysRoleFields.RoleId: "admin", "name": "Admin", FLD_SYS_ROLE_PARENT_IDS: primitive.A{"viewer"}},
+			},
+			creds: map[string][]utils.Map{
+				"admin": {{FLD_SYS_ROLE_CREDENTIAL: "invoice:*"}},
+			},
+			users: map[string][]utils.Map{
+				"admin": {{sysRoleFields.UserId: "u1"}},
+			},
+		}
+	}
+
+	tests := []struct {
+		name        string
+		policy      RolePolicy
+		withUsers   bool
+		wantAction  string
+		wantFields  []string
+		wantAdded   []string
+		wantRemoved []string
+	}{
+		{
+			name:       "unchanged",
+			policy:     RolePolicy{RoleId: "admin", Attributes: map[string]interface{}{"name": "Admin"}, ParentIds: []string{"viewer"}, Credentials: []RolePolicyCredential{{Credential: "invoice:*"}}},
+			wantAction: ROLE_POLICY_ACTION_UNCHANGED, wantFields: []string{}, wantAdded: []string{}, wantRemoved: []string{},
+		},
+		{
+			name:       "users ignored without with_users",
+			policy:     RolePolicy{RoleId: "admin", Attributes: map[string]interface{}{"name": "Admin"}, ParentIds: []string{"viewer"}, Credentials: []RolePolicyCredential{{Credential: "invoice:*"}}},
+			withUsers:  false,
+			wantAction: ROLE_POLICY_ACTION_UNCHANGED, wantFields: []string{}, wantAdded: []string{}, wantRemoved: []string{},
+		},
+		{
+			name:       "attribute and credentials changed",
+			policy:     RolePolicy{RoleId: "admin", Attributes: map[string]interface{}{"name": "Administrator"}, ParentIds: []string{"viewer"}, Credentials: []RolePolicyCredential{{Credential: "Invoice:Read"}}},
+			wantAction: ROLE_POLICY_ACTION_UPDATE, wantFields: []string{"name"}, wantAdded: []string{"invoice:read"}, wantRemoved: []string{"invoice:*"},
+		},
+		{
+			name:       "parents dropped",
+			policy:     RolePolicy{RoleId: "admin", Attributes: map[string]interface{}{"name": "Admin"}, Credentials: []RolePolicyCredential{{Credential: "invoice:*"}}},
+			wantAction: ROLE_POLICY_ACTION_UPDATE, wantFields: []string{FLD_SYS_ROLE_PARENT_IDS}, wantAdded: []string{}, wantRemoved: []string{},
+		},
+		{
+			name:       "attribute dropped",
+			policy:     RolePolicy{RoleId: "admin", ParentIds: []string{"viewer"}, Credentials: []RolePolicyCredential{{Credential: "invoice:*"}}},
+			wantAction: ROLE_POLICY_ACTION_UPDATE, wantFields: []string{"name"}, wantAdded: []string{}, wantRemoved: []string{},
+		},
+		{
+			name:       "new role",
+			policy:     RolePolicy{RoleId: "auditor", Attributes: map[string]interface{}{"name": "Auditor"}, Credentials: []RolePolicyCredential{{Credential: "invoice:read"}}},
+			wantAction: ROLE_POLICY_ACTION_CREATE, wantFields: []string{"name", FLD_SYS_ROLE_PARENT_IDS}, wantAdded: []string{"invoice:read"}, wantRemoved: []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			roleDiff, _, err := diffRolePolicy(newDao(), sysRoleFields, tt.policy, tt.withUsers)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			changedFields := []string{}
+			for key := range roleDiff[FLD_POLICY_CHANGED_FIELDS].(utils.Map) {
+				changedFields = append(changedFields, key)
+			}
+			sort.Strings(changedFields)
+			sort.Strings(tt.wantFields)
+
+			if roleDiff[FLD_POLICY_ACTION] != tt.wantAction {
+				t.Errorf("action = %v, want %v", roleDiff[FLD_POLICY_ACTION], tt.wantAction)
+			}
+			if !reflect.DeepEqual(changedFields, tt.wantFields) {
+				t.Errorf("changed fields = %v, want %v", changedFields, tt.wantFields)
+			}
+			if !reflect.DeepEqual(roleDiff[FLD_POLICY_CREDS_ADDED], tt.wantAdded) || !reflect.DeepEqual(roleDiff[FLD_POLICY_CREDS_REMOVED], tt.wantRemoved) {
+				t.Errorf("credentials = %v, %v, want %v, %v", roleDiff[FLD_POLICY_CREDS_ADDED], roleDiff[FLD_POLICY_CREDS_REMOVED], tt.wantAdded, tt.wantRemoved)
+			}
+		})
+	}
+
+	t.Run("apply", func(t *testing.T) {
+		dao := newDao()
+		policy := RolePolicy{RoleId: "auditor", Attributes: map[string]interface{}{"name": "Auditor"}, Credentials: []RolePolicyCredential{{Credential: "invoice:read", Condition: "amount < 10"}}}
+		_, applyFunc, err := diffRolePolicy(dao, sysRoleFields, policy, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := applyFunc(); err != nil {
+			t.Fatal(err)
+		}
+		if _, found := dao.roles["auditor"]; !found {
+			t.Errorf("role auditor not created")
+		}
+		if creds := dao.creds["auditor"]; len(creds) != 1 || creds[0][FLD_ROLE_CREDENTIAL_CONDITION] != "amount < 10" {
+			t.Errorf("credentials of auditor = %v", creds)
+		}
+	})
+}
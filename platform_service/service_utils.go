@@ -0,0 +1,178 @@
+package platform_service
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zapscloud/golib-dbutils/db_common"
+	"github.com/zapscloud/golib-dbutils/db_utils"
+	"github.com/zapscloud/golib-utils/utils"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// isInTransaction - Check whether a transaction is already open on the given service
+func isInTransaction(dbService *db_utils.DatabaseService) bool {
+	dbClient := dbService.GetClient()
+
+	_, okSession := dbClient["session_context"]
+	_, okTxn := dbClient[db_common.DB_TRANSACTION]
+	return okSession || okTxn
+}
+
+// isNotFoundError - Whether a DAO lookup failed because the record does not exist, rather than
+// because the database could not be read
+func isNotFoundError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, mongo.ErrNoDocuments) || errors.Is(err, sql.ErrNoRows) {
+		return true
+	}
+
+	errText := err.Error()
+	var appErr *utils.AppError
+	if errors.As(err, &appErr) {
+		if appErr.ErrorStatus == 404 {
+			return true
+		}
+		errText = appErr.ErrorMsg + " " + appErr.ErrorDetail
+	}
+	// The database utils report a closed connection as not found too
+	errText = strings.ToLower(errText)
+	if strings.Contains(errText, "connection") {
+		return false
+	}
+	return strings.Contains(errText, "not found") || strings.Contains(errText, "not exist")
+}
+
+// runInTransaction - Run fnTxn inside a transaction. When the caller has already begun
+// a transaction, fnTxn joins it and the commit or rollback is left to the caller.
+func runInTransaction(dbService *db_utils.DatabaseService, fnTxn func() error) error {
+
+	if isInTransaction(dbService) {
+		return fnTxn()
+	}
+
+	dbService.BeginTransaction()
+	err := fnTxn()
+	if err != nil {
+		dbService.RollbackTransaction()
+		return err
+	}
+	dbService.CommitTransaction()
+	return nil
+}
+
+// getStringList - Convert []string, []interface{} or bson arrays to []string
+func getStringList(dataVal interface{}) []string {
+	retVal := []string{}
+
+	if dataVal == nil {
+		return retVal
+	}
+
+	refVal := reflect.ValueOf(dataVal)
+	if refVal.Kind() != reflect.Slice && refVal.Kind() != reflect.Array {
+		return retVal
+	}
+
+	for idx := 0; idx < refVal.Len(); idx++ {
+		if strVal, ok := refVal.Index(idx).Interface().(string); ok && !utils.IsEmpty(strVal) {
+			retVal = append(retVal, strVal)
+		}
+	}
+	return retVal
+}
+
+// getMapList - Convert the given list value to []utils.Map
+func getMapList(dataVal interface{}) []utils.Map {
+	retVal := []utils.Map{}
+
+	if dataVal == nil {
+		return retVal
+	}
+
+	refVal := reflect.ValueOf(dataVal)
+	if refVal.Kind() != reflect.Slice && refVal.Kind() != reflect.Array {
+		return retVal
+	}
+
+	for idx := 0; idx < refVal.Len(); idx++ {
+		if mapVal, ok := toMap(refVal.Index(idx).Interface()); ok {
+			retVal = append(retVal, mapVal)
+		}
+	}
+	return retVal
+}
+
+// toMap - Convert maps and embedded bson documents, which decode as primitive.D, to utils.Map
+func toMap(dataVal interface{}) (utils.Map, bool) {
+	switch mapVal := dataVal.(type) {
+	case utils.Map:
+		return mapVal, true
+	case map[string]interface{}:
+		return utils.Map(mapVal), true
+	case primitive.M:
+		return utils.Map(mapVal), true
+	case primitive.D:
+		retVal := utils.Map{}
+		for _, elem := range mapVal {
+			retVal[elem.Key] = elem.Value
+		}
+		return retVal, true
+	}
+	return nil, false
+}
+
+// getListResult - Get the result records from a List styled response
+func getListResult(dataList utils.Map) []utils.Map {
+	return getMapList(dataList[db_common.LIST_RESULT])
+}
+
+// buildFilter - Build the JSON filter string accepted by the DAO List and Find calls
+func buildFilter(filter utils.Map) string {
+	filterJson, err := json.Marshal(filter)
+	if err != nil {
+		log.Println("buildFilter:: Error while building filter ", filter, err)
+		return ""
+	}
+	return string(filterJson)
+}
+
+// getFilterDate - Date value for a JSON filter, in the extended JSON form the DAOs decode to a
+// database date
+func getFilterDate(dateVal time.Time) utils.Map {
+	return utils.Map{"$date": utils.Map{"$numberLong": strconv.FormatInt(dateVal.UnixMilli(), 10)}}
+}
+
+// getMemberDataTime - Get a time value given as time.Time, a database date or an RFC3339 string
+func getMemberDataTime(data utils.Map, memberName string) (time.Time, error) {
+
+	dataVal, dataOk := data[memberName]
+	if !dataOk || dataVal == nil {
+		err := &utils.AppError{ErrorStatus: 400, ErrorMsg: "Missing Data", ErrorDetail: memberName + " value should be sent"}
+		return time.Time{}, err
+	}
+
+	switch timeVal := dataVal.(type) {
+	case time.Time:
+		return timeVal, nil
+	case interface{ Time() time.Time }:
+		return timeVal.Time(), nil
+	case string:
+		parsedTime, err := time.Parse(time.RFC3339, timeVal)
+		if err == nil {
+			return parsedTime, nil
+		}
+	}
+
+	err := &utils.AppError{ErrorStatus: 400, ErrorMsg: "Invalid Datatype", ErrorDetail: memberName + " value should be a RFC3339 date time"}
+	return time.Time{}, err
+}
@@ -0,0 +1,79 @@
+package platform_service
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/zapscloud/golib-utils/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestGetMapList(t *testing.T) {
+
+	// Lists read back from MongoDB hold their embedded documents as bson types
+	rawDoc, err := bson.Marshal(bson.D{{Key: "list", Value: bson.A{
+		bson.D{{Key: "role_id", Value: "admin"}},
+		bson.D{{Key: "role_id", Value: "viewer"}},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := struct {
+		List interface{} `bson:"list"`
+	}{}
+	if err := bson.Unmarshal(rawDoc, &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		dataVal interface{}
+		want    []utils.Map
+	}{
+		{"nil", nil, []utils.Map{}},
+		{"not a list", "admin", []utils.Map{}},
+		{"utils.Map", []utils.Map{{"role_id": "admin"}}, []utils.Map{{"role_id": "admin"}}},
+		{"plain maps", []interface{}{map[string]interface{}{"role_id": "admin"}}, []utils.Map{{"role_id": "admin"}}},
+		{"primitive.M", primitive.A{primitive.M{"role_id": "admin"}}, []utils.Map{{"role_id": "admin"}}},
+		{"primitive.D", primitive.A{primitive.D{{Key: "role_id", Value: "admin"}}}, []utils.Map{{"role_id": "admin"}}},
+		{"skips non maps", []interface{}{"admin", utils.Map{"role_id": "viewer"}, 1}, []utils.Map{{"role_id": "viewer"}}},
+		{"bson decoded", decoded.List, []utils.Map{{"role_id": "admin"}, {"role_id": "viewer"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := getMapList(tt.dataVal); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("getMapList() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsNotFoundError(t *testing.T) {
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"no error", nil, false},
+		{"no documents", mongo.ErrNoDocuments, true},
+		{"wrapped no documents", fmt.Errorf("get: %w", mongo.ErrNoDocuments), true},
+		{"status 404", &utils.AppError{ErrorStatus: 404, ErrorMsg: "Missing"}, true},
+		{"record not found", &utils.AppError{ErrorCode: "S30102", ErrorMsg: "Record Not Found", ErrorDetail: "Given id is not found"}, true},
+		{"no connection", &utils.AppError{ErrorCode: "S020102", ErrorMsg: "Database Connection not Found", ErrorDetail: "Database connection not opened already"}, false},
+		{"server error", errors.New("server selection timeout"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isNotFoundError(tt.err); got != tt.want {
+				t.Errorf("isNotFoundError(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
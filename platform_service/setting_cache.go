@@ -0,0 +1,251 @@
+package platform_service
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zapscloud/golib-utils/utils"
+)
+
+// SETTINGS_CACHE_DEFAULT_INTERVAL - Polling interval used when none is given
+const SETTINGS_CACHE_DEFAULT_INTERVAL = 30 * time.Second
+
+// SettingChangeHandler - Called with the new value of a changed setting, value is nil once deleted
+type SettingChangeHandler func(settingId string, value utils.Map)
+
+// SettingsCache - In-process cache of settings. Changes are picked up by polling the version of the
+// cached settings, or pushed through Notify by a change stream watcher.
+type SettingsCache struct {
+	service  SysSettingService
+	interval time.Duration
+
+	mu          sync.RWMutex
+	entries     map[string]*settingCacheEntry
+	subscribers map[string]map[int]SettingChangeHandler
+	nextSubId   int
+
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+type settingCacheEntry struct {
+	value   utils.Map
+	version int
+	err     error
+}
+
+// NewSettingsCache - Create a cache over the setting service, call Start to begin polling
+func NewSettingsCache(service SysSettingService, interval time.Duration) *SettingsCache {
+	if interval <= 0 {
+		interval = SETTINGS_CACHE_DEFAULT_INTERVAL
+	}
+	return &SettingsCache{
+		service:     service,
+		interval:    interval,
+		entries:     map[string]*settingCacheEntry{},
+		subscribers: map[string]map[int]SettingChangeHandler{},
+	}
+}
+
+// Get - Get the setting from the cache, loading it on first use
+func (c *SettingsCache) Get(settingId string) (utils.Map, error) {
+
+	settingId = strings.ToLower(settingId)
+
+	c.mu.RLock()
+	entry, found := c.entries[settingId]
+	c.mu.RUnlock()
+
+	if !found {
+		entry = c.load(settingId)
+		c.mu.Lock()
+		c.entries[settingId] = entry
+		c.mu.Unlock()
+	}
+	return copySettingValue(entry.value), entry.err
+}
+
+// Subscribe - Call the handler whenever one of the settings changes. Returns a function to unsubscribe.
+func (c *SettingsCache) Subscribe(settingIds []string, handler SettingChangeHandler) func() {
+
+	c.mu.Lock()
+	subId := c.nextSubId
+	c.nextSubId++
+
+	normalizedIds := []string{}
+	for _, settingId := range settingIds {
+		settingId = strings.ToLower(settingId)
+		if c.subscribers[settingId] == nil {
+			c.subscribers[settingId] = map[int]SettingChangeHandler{}
+		}
+		c.subscribers[settingId][subId] = handler
+		normalizedIds = append(normalizedIds, settingId)
+	}
+	c.mu.Unlock()
+
+	// Load the settings so their version is tracked from now on
+	for _, settingId := range normalizedIds {
+		c.Get(settingId)
+	}
+
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for _, settingId := range normalizedIds {
+			delete(c.subscribers[settingId], subId)
+			if len(c.subscribers[settingId]) == 0 {
+				delete(c.subscribers, settingId)
+			}
+		}
+	}
+}
+
+// Invalidate - Drop the setting from the cache, it is loaded again on the next Get
+func (c *SettingsCache) Invalidate(settingId string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, strings.ToLower(settingId))
+}
+
+// Notify - Reload the setting and notify its subscribers, for change stream watchers
+func (c *SettingsCache) Notify(settingId string) {
+	settingId = strings.ToLower(settingId)
+	c.apply(settingId, c.load(settingId))
+}
+
+// Refresh - Compare the versions of the cached settings with the stored ones and reload the changed
+func (c *SettingsCache) Refresh() error {
+
+	c.mu.RLock()
+	settingIds := make([]string, 0, len(c.entries))
+	for settingId := range c.entries {
+		settingIds = append(settingIds, settingId)
+	}
+	c.mu.RUnlock()
+
+	if len(settingIds) == 0 {
+		return nil
+	}
+
+	latestVersions, err := c.service.GetLatestVersions(settingIds)
+	if err != nil {
+		return err
+	}
+
+	for _, settingId := range settingIds {
+		c.mu.RLock()
+		entry, found := c.entries[settingId]
+		c.mu.RUnlock()
+
+		if found && entry.version == latestVersions[settingId] {
+			continue
+		}
+		c.apply(settingId, c.load(settingId))
+	}
+	return nil
+}
+
+// Start - Poll for changes in the background until Stop is called
+func (c *SettingsCache) Start() {
+
+	c.mu.Lock()
+	if c.stop != nil {
+		c.mu.Unlock()
+		return
+	}
+	c.stop = make(chan struct{})
+	c.stopped = make(chan struct{})
+	stop, stopped := c.stop, c.stopped
+	c.mu.Unlock()
+
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := c.Refresh(); err != nil {
+					log.Println("SettingsCache::Refresh - Error ", err)
+				}
+			}
+		}
+	}()
+}
+
+// Stop - Stop polling and wait for the poller to finish
+func (c *SettingsCache) Stop() {
+
+	c.mu.Lock()
+	stop, stopped := c.stop, c.stopped
+	c.stop, c.stopped = nil, nil
+	c.mu.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-stopped
+	}
+}
+
+// load - Read the setting and its latest version from the service
+func (c *SettingsCache) load(settingId string) *settingCacheEntry {
+
+	entry := &settingCacheEntry{}
+
+	latestVersions, err := c.service.GetLatestVersions([]string{settingId})
+	if err != nil {
+		// Unknown version, so the next Refresh tries again
+		entry.version = -1
+		entry.err = err
+		return entry
+	}
+	entry.version = latestVersions[settingId]
+	entry.value, entry.err = c.service.Get(settingId)
+	if entry.err != nil {
+		entry.value = nil
+		// A deleted setting keeps its version, a failed read is tried again by the next Refresh
+		if !isNotFoundError(entry.err) {
+			entry.version = -1
+		}
+	}
+	return entry
+}
+
+// apply - Store the reloaded entry and call the subscribers when the value changed
+func (c *SettingsCache) apply(settingId string, entry *settingCacheEntry) {
+
+	c.mu.Lock()
+	oldEntry, found := c.entries[settingId]
+	c.entries[settingId] = entry
+
+	handlers := []SettingChangeHandler{}
+	isChanged := !found || oldEntry.version != entry.version || !isSamePolicyValue(oldEntry.value, entry.value)
+	if isChanged && entry.version >= 0 {
+		for _, handler := range c.subscribers[settingId] {
+			handlers = append(handlers, handler)
+		}
+	}
+	c.mu.Unlock()
+
+	for _, handler := range handlers {
+		handler(settingId, copySettingValue(entry.value))
+	}
+}
+
+// copySettingValue - Shallow copy, so callers cannot change the cached value
+func copySettingValue(value utils.Map) utils.Map {
+	if value == nil {
+		return nil
+	}
+	copied := utils.Map{}
+	for key, val := range value {
+		copied[key] = val
+	}
+	return copied
+}
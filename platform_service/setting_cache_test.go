@@ -0,0 +1,74 @@
+package platform_service
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/zapscloud/golib-utils/utils"
+)
+
+// fakeSettingService - Settings and their versions, getErr fails every Get
+type fakeSettingService struct {
+	SysSettingService
+	settings map[string]utils.Map
+	versions map[string]int
+	getErr   error
+}
+
+func (s *fakeSettingService) Get(settingId string) (utils.Map, error) {
+	if s.getErr != nil {
+		return nil, s.getErr
+	}
+	if dataSetting, found := s.settings[settingId]; found {
+		return dataSetting, nil
+	}
+	return nil, errFakeNotFound
+}
+
+func (s *fakeSettingService) GetLatestVersions(settingIds []string) (map[string]int, error) {
+	latestVersions := map[string]int{}
+	for _, settingId := range settingIds {
+		latestVersions[settingId] = s.versions[settingId]
+	}
+	return latestVersions, nil
+}
+
+func TestSettingsCacheRefresh(t *testing.T) {
+
+	service := &fakeSettingService{
+		settings: map[string]utils.Map{"test.theme": {FLD_SETTING_VALUE: "dark"}},
+		versions: map[string]int{"test.theme": 1},
+		getErr:   errors.New("server selection timeout"),
+	}
+	cache := NewSettingsCache(service, 0)
+
+	changes := []interface{}{}
+	unsubscribe := cache.Subscribe([]string{"test.theme"}, func(settingId string, value utils.Map) {
+		changes = append(changes, value[FLD_SETTING_VALUE])
+	})
+	defer unsubscribe()
+
+	// A failed read is not cached at the current version, so Refresh loads it once it can be read
+	if _, err := cache.Get("test.theme"); err == nil {
+		t.Fatalf("Get() should return the read error")
+	}
+	service.getErr = nil
+	if err := cache.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := cache.Get("test.theme"); err != nil || value[FLD_SETTING_VALUE] != "dark" {
+		t.Errorf("Get() after Refresh = %v, %v, want dark", value, err)
+	}
+
+	// A deleted setting is a value of its own and notified once
+	delete(service.settings, "test.theme")
+	service.versions["test.theme"] = 2
+	for idx := 0; idx < 2; idx++ {
+		if err := cache.Refresh(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(changes) != 2 || changes[0] != "dark" || changes[1] != nil {
+		t.Errorf("subscriber got %v, want [dark <nil>]", changes)
+	}
+}
@@ -0,0 +1,456 @@
+package platform_service
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zapscloud/golib-dbutils/db_common"
+	"github.com/zapscloud/golib-platform-repository/platform_common"
+	"github.com/zapscloud/golib-utils/utils"
+)
+
+// Setting version fields and actions
+const (
+	FLD_SETTING_VERSION_ID  = "setting_version_id"
+	FLD_SETTING_VERSION     = "version"
+	FLD_SETTING_ACTION      = "action"
+	FLD_SETTING_CHANGED_BY  = "changed_by"
+	FLD_SETTING_CHANGED_AT  = "changed_at"
+	FLD_SETTING_OLD_VALUE   = "old_value"
+	FLD_SETTING_NEW_VALUE   = "new_value"
+	FLD_SETTING_ROLLBACK_OF = "rollback_of"
+	FLD_SETTING_CHANGES     = "changes"
+	FLD_SETTING_FIELD       = "field"
+	FLD_SETTING_CHANGE      = "change"
+	FLD_SETTING_FROM        = "from"
+	FLD_SETTING_TO          = "to"
+
+	SETTING_ACTION_CREATE   = "create"
+	SETTING_ACTION_UPDATE   = "update"
+	SETTING_ACTION_DELETE   = "delete"
+	SETTING_ACTION_ROLLBACK = "rollback"
+
+	// Versions recording a change of an override
+	FLD_SETTING_OLD_OVERRIDE       = "old_override_value"
+	FLD_SETTING_NEW_OVERRIDE       = "new_override_value"
+	SETTING_ACTION_OVERRIDE        = "override"
+	SETTING_ACTION_REMOVE_OVERRIDE = "remove_override"
+
+	SETTING_CHANGE_ADDED   = "added"
+	SETTING_CHANGE_REMOVED = "removed"
+	SETTING_CHANGE_CHANGED = "changed"
+
+	// Transactions run again after their version was taken by a concurrent change
+	SETTING_VERSION_MAX_RETRIES = 5
+)
+
+// ListHistory - List the versions of the setting, oldest first. Values of secret settings are masked.
+func (p *appSettingBaseService) ListHistory(settingId string) (utils.Map, error) {
+
+	log.Println("SysSettingService::ListHistory - Begin", settingId)
+
+	settingId = strings.ToLower(settingId)
+	versions, err := p.getSettingVersions(settingId)
+	if err != nil {
+		return nil, err
+	}
+
+	isSecret := p.isSecretHistory(settingId, versions)
+	for idx, dataVersion := range versions {
+		versions[idx] = maskSettingVersion(dataVersion, isSecret)
+	}
+
+	response := utils.Map{
+		db_common.LIST_RESULTSIZE: len(versions),
+		db_common.LIST_RESULT:     versions,
+	}
+
+	log.Println("SysSettingService::ListHistory - End ", len(versions))
+	return response, nil
+}
+
+// GetVersion - Get one version of the setting, values of secret settings are masked
+func (p *appSettingBaseService) GetVersion(settingId string, version int) (utils.Map, error) {
+	log.Println("SysSettingService::GetVersion - Begin", settingId, version)
+
+	settingId = strings.ToLower(settingId)
+	data, err := p.daoVersion.Get(getSettingVersionId(settingId, version))
+	if err != nil {
+		return nil, err
+	}
+
+	versions, err := p.getSettingVersions(settingId)
+	if err != nil {
+		return nil, err
+	}
+	data = maskSettingVersion(data, p.isSecretHistory(settingId, versions))
+
+	log.Println("SysSettingService::GetVersion - End ")
+	return data, nil
+}
+
+// DiffVersions - Compare the setting as it was after each of the two versions
+func (p *appSettingBaseService) DiffVersions(settingId string, fromVersion int, toVersion int) (utils.Map, error) {
+
+	log.Println("SysSettingService::DiffVersions - Begin", settingId, fromVersion, toVersion)
+
+	settingId = strings.ToLower(settingId)
+	dataFrom, err := p.daoVersion.Get(getSettingVersionId(settingId, fromVersion))
+	if err != nil {
+		return nil, err
+	}
+	dataTo, err := p.daoVersion.Get(getSettingVersionId(settingId, toVersion))
+	if err != nil {
+		return nil, err
+	}
+
+	// Compare the stored values so a changed secret is still reported, only masked
+	changes := diffSettingSnapshots(getSettingSnapshot(dataFrom[FLD_SETTING_NEW_VALUE]), getSettingSnapshot(dataTo[FLD_SETTING_NEW_VALUE]))
+	versions, err := p.getSettingVersions(settingId)
+	if err != nil {
+		return nil, err
+	}
+	if p.isSecretHistory(settingId, versions) {
+		for _, change := range changes {
+			if change[FLD_SETTING_FIELD] != FLD_SETTING_VALUE {
+				continue
+			}
+			for _, side := range []string{FLD_SETTING_FROM, FLD_SETTING_TO} {
+				if change[side] != nil {
+					change[side] = SETTING_SECRET_MASK
+				}
+			}
+		}
+	}
+
+	response := utils.Map{
+		platform_common.FLD_SETTING_ID: strings.ToLower(settingId),
+		FLD_SETTING_FROM:               fromVersion,
+		FLD_SETTING_TO:                 toVersion,
+		FLD_SETTING_CHANGES:            changes,
+	}
+
+	log.Println("SysSettingService::DiffVersions - End ", len(changes))
+	return response, nil
+}
+
+// Rollback - Restore the setting as it was after the given version. Rolling back to a delete
+// removes the setting again. The rollback is recorded as a new version. A plain value restored
+// into a setting which is a secret now is encrypted.
+func (p *appSettingBaseService) Rollback(settingId string, version int, changedBy string) (utils.Map, error) {
+
+	log.Println("SysSettingService::Rollback - Begin", settingId, version, changedBy)
+
+	settingId = strings.ToLower(settingId)
+	dataVersion, err := p.daoVersion.Get(getSettingVersionId(settingId, version))
+	if err != nil {
+		return nil, err
+	}
+
+	dataOld, errOld := p.daoSysSetting.Get(settingId)
+	isExisting := errOld == nil
+
+	snapshot := getSettingSnapshot(dataVersion[FLD_SETTING_NEW_VALUE])
+	if snapshot != nil && !isSecretSetting(snapshot) {
+		// The schema may have changed since the version was stored
+		if isExisting && isSecretSetting(dataOld) {
+			snapshot[FLD_SETTING_IS_SECRET] = true
+			err = encryptSecretValue(settingId, snapshot)
+		} else {
+			err = validateSettingValue(settingId, snapshot)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var dataRes utils.Map
+	err = p.runSettingChange(settingId, func() error {
+		// Replace the whole document, so fields added after the version are removed as well
+		if isExisting {
+			if _, err := p.daoSysSetting.Delete(settingId); err != nil {
+				return err
+			}
+		}
+
+		var dataNew utils.Map
+		if snapshot != nil {
+			snapshot[platform_common.FLD_SETTING_ID] = settingId
+			if _, err := p.daoSysSetting.Create(snapshot); err != nil {
+				return err
+			}
+			var err error
+			if dataNew, err = p.daoSysSetting.Get(settingId); err != nil {
+				return err
+			}
+		}
+
+		if !isExisting {
+			dataOld = nil
+		}
+		var err error
+		dataRes, err = p.recordSettingVersion(settingId, SETTING_ACTION_ROLLBACK, changedBy, dataOld, dataNew, version)
+		return err
+	})
+	dataRes = maskSettingVersion(dataRes, isSecretSetting(snapshot) || (isExisting && isSecretSetting(dataOld)))
+	if err != nil {
+		return nil, err
+	}
+
+	log.Println("SysSettingService::Rollback - End ")
+	return dataRes, nil
+}
+
+// GetLatestVersions - Get the latest version of each setting, used to detect changes. Only the
+// highest version of each setting is read.
+func (p *appSettingBaseService) GetLatestVersions(settingIds []string) (map[string]int, error) {
+
+	latestVersions := map[string]int{}
+	sortDesc := buildFilter(utils.Map{FLD_SETTING_VERSION: -1})
+	for _, settingId := range settingIds {
+		settingId = strings.ToLower(settingId)
+		if _, found := latestVersions[settingId]; found {
+			continue
+		}
+		latestVersions[settingId] = 0
+
+		filter := buildFilter(utils.Map{platform_common.FLD_SETTING_ID: settingId})
+		dataVersions, err := p.daoVersion.List(filter, sortDesc, 0, 1)
+		if err != nil {
+			return nil, err
+		}
+		for _, dataVersion := range getListResult(dataVersions) {
+			version, _ := utils.GetMemberDataInt(dataVersion, FLD_SETTING_VERSION, true)
+			latestVersions[settingId] = int(version)
+		}
+	}
+	return latestVersions, nil
+}
+
+// recordSettingVersion - Store the change as the next version of the setting, called inside runSettingChange
+func (p *appSettingBaseService) recordSettingVersion(settingId string, action string, changedBy string, dataOld utils.Map, dataNew utils.Map, rollbackOf int) (utils.Map, error) {
+
+	dataVersion := utils.Map{
+		platform_common.FLD_SETTING_ID: settingId,
+		FLD_SETTING_ACTION:             action,
+		FLD_SETTING_CHANGED_BY:         changedBy,
+		FLD_SETTING_CHANGED_AT:         time.Now(),
+		FLD_SETTING_OLD_VALUE:          getSettingSnapshot(dataOld),
+		FLD_SETTING_NEW_VALUE:          getSettingSnapshot(dataNew),
+	}
+	if rollbackOf > 0 {
+		dataVersion[FLD_SETTING_ROLLBACK_OF] = rollbackOf
+	}
+	return p.storeSettingVersion(settingId, dataVersion)
+}
+
+// recordOverrideVersion - Store a change of an override as the next version of the setting, so
+// readers of the latest versions see it. The setting itself is unchanged, both of its snapshots
+// are the current setting and rolling back to the version restores it as it is.
+func (p *appSettingBaseService) recordOverrideVersion(settingId string, action string, layer string, scopeId string, oldValue interface{}, newValue interface{}) (utils.Map, error) {
+
+	dataSetting, err := p.daoSysSetting.Get(settingId)
+	if err != nil && !isNotFoundError(err) {
+		return nil, err
+	}
+
+	dataVersion := utils.Map{
+		platform_common.FLD_SETTING_ID: settingId,
+		FLD_SETTING_ACTION:             action,
+		FLD_SETTING_CHANGED_AT:         time.Now(),
+		FLD_SETTING_OLD_VALUE:          getSettingSnapshot(dataSetting),
+		FLD_SETTING_NEW_VALUE:          getSettingSnapshot(dataSetting),
+		FLD_SETTING_LAYER:              layer,
+		FLD_SETTING_SCOPE_ID:           scopeId,
+		FLD_SETTING_OLD_OVERRIDE:       oldValue,
+		FLD_SETTING_NEW_OVERRIDE:       newValue,
+	}
+	return p.storeSettingVersion(settingId, dataVersion)
+}
+
+func (p *appSettingBaseService) storeSettingVersion(settingId string, dataVersion utils.Map) (utils.Map, error) {
+
+	versions, err := p.getSettingVersions(settingId)
+	if err != nil {
+		return nil, err
+	}
+
+	version := 1
+	if len(versions) > 0 {
+		lastVersion, _ := utils.GetMemberDataInt(versions[len(versions)-1], FLD_SETTING_VERSION, true)
+		version = int(lastVersion) + 1
+	}
+
+	versionId := getSettingVersionId(settingId, version)
+	dataVersion[FLD_SETTING_VERSION_ID] = versionId
+	dataVersion[FLD_SETTING_VERSION] = version
+
+	dataRes, err := p.daoVersion.Create(dataVersion)
+	if err != nil {
+		// The failed insert aborts the transaction, runSettingChange finds out whether to run it again
+		return nil, &settingVersionError{versionId: versionId, err: err}
+	}
+	return dataRes, nil
+}
+
+// settingVersionError - Failure to store a version, with the version id which was tried
+type settingVersionError struct {
+	versionId string
+	err       error
+}
+
+func (e *settingVersionError) Error() string { return e.err.Error() }
+func (e *settingVersionError) Unwrap() error { return e.err }
+
+// runSettingChange - Run the change of the setting and the record of its version in one transaction.
+// A version is unique, and a failed insert aborts the transaction, so when a concurrent change took
+// the version first the whole transaction is run again. Joined to the caller's transaction it can
+// not be run again and the failure is returned.
+func (p *appSettingBaseService) runSettingChange(settingId string, fnTxn func() error) error {
+
+	isJoined := isInTransaction(&p.DatabaseService)
+	for attempt := 0; ; attempt++ {
+		err := runInTransaction(&p.DatabaseService, fnTxn)
+
+		var versionErr *settingVersionError
+		if err == nil || !errors.As(err, &versionErr) {
+			return err
+		}
+		if isJoined || attempt >= SETTING_VERSION_MAX_RETRIES {
+			return versionErr.err
+		}
+		// Only a version taken in the meantime is retried, any other failure is returned
+		if _, errGet := p.daoVersion.Get(versionErr.versionId); errGet != nil {
+			return versionErr.err
+		}
+		log.Println("SysSettingService::runSettingChange - Version taken, running again ", settingId, versionErr.versionId)
+	}
+}
+
+func (p *appSettingBaseService) getSettingVersions(settingId string) ([]utils.Map, error) {
+
+	filter := buildFilter(utils.Map{platform_common.FLD_SETTING_ID: settingId})
+	dataVersions, err := p.daoVersion.List(filter, "", 0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := getListResult(dataVersions)
+	sort.SliceStable(versions, func(i, j int) bool {
+		versionI, _ := utils.GetMemberDataInt(versions[i], FLD_SETTING_VERSION, true)
+		versionJ, _ := utils.GetMemberDataInt(versions[j], FLD_SETTING_VERSION, true)
+		return versionI < versionJ
+	})
+	return versions, nil
+}
+
+// isSecretHistory - Whether the setting is a secret now or was one in any of its versions. Values
+// of such a setting are masked in every version, including those stored while it was plain.
+func (p *appSettingBaseService) isSecretHistory(settingId string, versions []utils.Map) bool {
+
+	if dataSetting, err := p.daoSysSetting.Get(settingId); err == nil && isSecretSetting(dataSetting) {
+		return true
+	}
+	for _, dataVersion := range versions {
+		if isSecretSetting(getSettingSnapshot(dataVersion[FLD_SETTING_OLD_VALUE])) || isSecretSetting(getSettingSnapshot(dataVersion[FLD_SETTING_NEW_VALUE])) {
+			return true
+		}
+	}
+	return false
+}
+
+// maskSettingVersion - Copy of the version with the value of its snapshots masked
+func maskSettingVersion(dataVersion utils.Map, isSecret bool) utils.Map {
+	if dataVersion == nil {
+		return dataVersion
+	}
+
+	masked := utils.Map{}
+	for key, value := range dataVersion {
+		masked[key] = value
+	}
+	for _, field := range []string{FLD_SETTING_OLD_VALUE, FLD_SETTING_NEW_VALUE} {
+		snapshot := getSettingSnapshot(dataVersion[field])
+		if snapshot == nil || (!isSecret && !isSecretSetting(snapshot)) {
+			continue
+		}
+		if _, found := snapshot[FLD_SETTING_VALUE]; found {
+			snapshot[FLD_SETTING_VALUE] = SETTING_SECRET_MASK
+		}
+		masked[field] = snapshot
+	}
+	// Override versions carry the override values themselves
+	if isSecret {
+		for _, field := range []string{FLD_SETTING_OLD_OVERRIDE, FLD_SETTING_NEW_OVERRIDE} {
+			if value, found := masked[field]; found && value != nil {
+				masked[field] = SETTING_SECRET_MASK
+			}
+		}
+	}
+	return masked
+}
+
+func getSettingVersionId(settingId string, version int) string {
+	return settingId + ":v" + strconv.Itoa(version)
+}
+
+// getSettingSnapshot - Copy of the setting without the database maintained fields
+func getSettingSnapshot(dataVal interface{}) utils.Map {
+
+	dataList := getMapList([]interface{}{dataVal})
+	if len(dataList) == 0 {
+		return nil
+	}
+
+	snapshot := utils.Map{}
+	for key, value := range dataList[0] {
+		switch key {
+		case db_common.FLD_DEFAULT_ID, db_common.FLD_CREATED_AT, db_common.FLD_UPDATED_AT:
+			continue
+		}
+		snapshot[key] = value
+	}
+	return snapshot
+}
+
+// diffSettingSnapshots - List the fields added, removed or changed between the two snapshots
+func diffSettingSnapshots(dataFrom utils.Map, dataTo utils.Map) []utils.Map {
+
+	fields := []string{}
+	for key := range dataFrom {
+		fields = append(fields, key)
+	}
+	for key := range dataTo {
+		if _, found := dataFrom[key]; !found {
+			fields = append(fields, key)
+		}
+	}
+	sort.Strings(fields)
+
+	changes := []utils.Map{}
+	for _, field := range fields {
+		fromVal, inFrom := dataFrom[field]
+		toVal, inTo := dataTo[field]
+
+		change := SETTING_CHANGE_CHANGED
+		if !inFrom {
+			change = SETTING_CHANGE_ADDED
+		} else if !inTo {
+			change = SETTING_CHANGE_REMOVED
+		} else if isSamePolicyValue(fromVal, toVal) {
+			continue
+		}
+
+		changes = append(changes, utils.Map{
+			FLD_SETTING_FIELD:  field,
+			FLD_SETTING_CHANGE: change,
+			FLD_SETTING_FROM:   fromVal,
+			FLD_SETTING_TO:     toVal,
+		})
+	}
+	return changes
+}
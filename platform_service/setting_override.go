@@ -0,0 +1,278 @@
+package platform_service
+
+import (
+	"log"
+	"strings"
+
+	"github.com/zapscloud/golib-dbutils/db_common"
+	"github.com/zapscloud/golib-platform-repository/platform_common"
+	"github.com/zapscloud/golib-utils/utils"
+)
+
+// Setting override fields and layers, ordered from the least to the most specific
+const (
+	FLD_SETTING_OVERRIDE_ID = "setting_override_id"
+	FLD_SETTING_LAYER       = "setting_layer"
+	FLD_SETTING_SCOPE_ID    = "scope_id"
+
+	SETTING_LAYER_DEFAULT  = "default"
+	SETTING_LAYER_PLATFORM = "platform"
+	SETTING_LAYER_REGION   = "region"
+	SETTING_LAYER_BUSINESS = "business"
+	SETTING_LAYER_USER     = "user"
+)
+
+// settingOverrideLayers - Override layers from the most specific to the least, with the scope field naming them
+var settingOverrideLayers = []struct {
+	Layer      string
+	ScopeField string
+}{
+	{SETTING_LAYER_USER, platform_common.FLD_APP_USER_ID},
+	{SETTING_LAYER_BUSINESS, platform_common.FLD_BUSINESS_ID},
+	{SETTING_LAYER_REGION, platform_common.FLD_REGION_ID},
+}
+
+// SetOverride - Set the value of the setting for a region, business or user
+func (p *appSettingBaseService) SetOverride(settingId string, layer string, scopeId string, value interface{}) (utils.Map, error) {
+
+	log.Println("SysSettingService::SetOverride - Begin", settingId, layer, scopeId)
+
+	settingId = strings.ToLower(settingId)
+	if err := validateSettingLayer(layer, scopeId); err != nil {
+		return nil, err
+	}
+
+	dataOverride := utils.Map{
+		platform_common.FLD_SETTING_ID: settingId,
+		FLD_SETTING_LAYER:              layer,
+		FLD_SETTING_SCOPE_ID:           scopeId,
+		FLD_SETTING_VALUE:              value,
+	}
+	if err := validateSettingValue(settingId, dataOverride); err != nil {
+		return nil, err
+	}
+
+	// Overrides are stored plain, so secrets cannot be overridden
+	if dataSetting, err := p.daoSysSetting.Get(settingId); err == nil && isSecretSetting(dataSetting) {
+		err := &utils.AppError{ErrorStatus: 400, ErrorMsg: "Secret setting", ErrorDetail: "Setting " + settingId + " is a secret and cannot be overridden"}
+		return nil, err
+	}
+
+	overrideId := getSettingOverrideId(settingId, layer, scopeId)
+
+	// The change is recorded as a version, so caches watching the latest versions reload it
+	var dataRes utils.Map
+	err := p.runSettingChange(settingId, func() error {
+		var oldValue interface{}
+		dataOld, err := p.daoOverride.Get(overrideId)
+		if err == nil {
+			oldValue = dataOld[FLD_SETTING_VALUE]
+			dataRes, err = p.daoOverride.Update(overrideId, utils.Map{FLD_SETTING_VALUE: dataOverride[FLD_SETTING_VALUE]})
+		} else if isNotFoundError(err) {
+			dataOverride[FLD_SETTING_OVERRIDE_ID] = overrideId
+			dataRes, err = p.daoOverride.Create(dataOverride)
+		}
+		if err != nil {
+			return err
+		}
+
+		_, err = p.recordOverrideVersion(settingId, SETTING_ACTION_OVERRIDE, layer, scopeId, oldValue, dataOverride[FLD_SETTING_VALUE])
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Println("SysSettingService::SetOverride - End ")
+	return dataRes, nil
+}
+
+// RemoveOverride - Remove the override, the setting falls back to the next layer
+func (p *appSettingBaseService) RemoveOverride(settingId string, layer string, scopeId string) error {
+
+	log.Println("SysSettingService::RemoveOverride - Begin", settingId, layer, scopeId)
+
+	if err := validateSettingLayer(layer, scopeId); err != nil {
+		return err
+	}
+
+	settingId = strings.ToLower(settingId)
+	overrideId := getSettingOverrideId(settingId, layer, scopeId)
+	err := p.runSettingChange(settingId, func() error {
+		dataOld, err := p.daoOverride.Get(overrideId)
+		if err != nil {
+			return err
+		}
+		if _, err := p.daoOverride.Delete(overrideId); err != nil {
+			return err
+		}
+
+		_, err = p.recordOverrideVersion(settingId, SETTING_ACTION_REMOVE_OVERRIDE, layer, scopeId, dataOld[FLD_SETTING_VALUE], nil)
+		return err
+	})
+
+	log.Println("SysSettingService::RemoveOverride - End ", err)
+	return err
+}
+
+// ListOverrides - List every override of the setting
+func (p *appSettingBaseService) ListOverrides(settingId string) (utils.Map, error) {
+
+	log.Println("SysSettingService::ListOverrides - Begin", settingId)
+
+	settingId = strings.ToLower(settingId)
+	isSecret, err := p.isSecretSettingId(settingId)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := buildFilter(utils.Map{platform_common.FLD_SETTING_ID: settingId})
+	data, err := p.daoOverride.List(filter, "", 0, 0)
+	if err == nil && isSecret {
+		data = maskOverrideValues(data)
+	}
+
+	log.Println("SysSettingService::ListOverrides - End ", err)
+	return data, err
+}
+
+// Resolve - Get the effective value of the setting for the scope given as region_id, business_id and
+// app_user_id. The most specific layer wins: user, business, region, platform and finally the
+// registered default. The region of the business is used when the scope has no region_id.
+func (p *appSettingBaseService) Resolve(settingId string, scope utils.Map) (utils.Map, error) {
+
+	log.Println("SysSettingService::Resolve - Begin", settingId, scope)
+
+	settingId = strings.ToLower(settingId)
+	scopeIds := p.getResolveScopeIds(scope)
+
+	for _, overrideLayer := range settingOverrideLayers {
+		scopeId := scopeIds[overrideLayer.ScopeField]
+		if scopeId == "" {
+			continue
+		}
+		// Only a missing override falls through to the next layer
+		dataOverride, err := p.daoOverride.Get(getSettingOverrideId(settingId, overrideLayer.Layer, scopeId))
+		if isNotFoundError(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		// Overrides stored before the setting became a secret are never shown
+		value := dataOverride[FLD_SETTING_VALUE]
+		if isSecret, err := p.isSecretSettingId(settingId); err != nil {
+			return nil, err
+		} else if isSecret {
+			value = SETTING_SECRET_MASK
+		}
+		log.Println("SysSettingService::Resolve - End ", overrideLayer.Layer)
+		return newResolvedSetting(settingId, value, overrideLayer.Layer, scopeId), nil
+	}
+
+	if dataSetting, err := p.daoSysSetting.Get(settingId); err != nil && !isNotFoundError(err) {
+		return nil, err
+	} else if err == nil {
+		if _, found := dataSetting[FLD_SETTING_VALUE]; found {
+			log.Println("SysSettingService::Resolve - End ", SETTING_LAYER_PLATFORM)
+			dataSetting = maskSecretSetting(dataSetting)
+			return newResolvedSetting(settingId, dataSetting[FLD_SETTING_VALUE], SETTING_LAYER_PLATFORM, ""), nil
+		}
+	}
+
+	if schema, found := GetSettingSchema(settingId); found && schema.Default != nil {
+		log.Println("SysSettingService::Resolve - End ", SETTING_LAYER_DEFAULT)
+		return newResolvedSetting(settingId, schema.Default, SETTING_LAYER_DEFAULT, ""), nil
+	}
+
+	err := &utils.AppError{ErrorStatus: 404, ErrorMsg: "Setting not found", ErrorDetail: "Setting " + settingId + " has no value in any layer"}
+	return nil, err
+}
+
+// isSecretSettingId - Whether the stored setting is a secret, a missing setting is not
+func (p *appSettingBaseService) isSecretSettingId(settingId string) (bool, error) {
+	dataSetting, err := p.daoSysSetting.Get(settingId)
+	if isNotFoundError(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return isSecretSetting(dataSetting), nil
+}
+
+// checkNoOverrides - Overrides are stored plain, so a setting with overrides cannot become a secret
+func (p *appSettingBaseService) checkNoOverrides(settingId string) error {
+	filter := buildFilter(utils.Map{platform_common.FLD_SETTING_ID: settingId})
+	data, err := p.daoOverride.List(filter, "", 0, 1)
+	if err != nil {
+		return err
+	}
+	if len(getListResult(data)) > 0 {
+		err := &utils.AppError{ErrorStatus: 400, ErrorMsg: "Setting has overrides", ErrorDetail: "Setting " + settingId + " has overrides, remove them before making it a secret"}
+		return err
+	}
+	return nil
+}
+
+// maskOverrideValues - Mask the values of a List styled override response
+func maskOverrideValues(dataList utils.Map) utils.Map {
+	if _, found := dataList[db_common.LIST_RESULT]; !found {
+		return dataList
+	}
+	results := getListResult(dataList)
+	for idx, dataOverride := range results {
+		masked := utils.Map{}
+		for key, value := range dataOverride {
+			masked[key] = value
+		}
+		masked[FLD_SETTING_VALUE] = SETTING_SECRET_MASK
+		results[idx] = masked
+	}
+	dataList[db_common.LIST_RESULT] = results
+	return dataList
+}
+
+// getResolveScopeIds - Collect the scope ids, looking up the region of the business when it is not given
+func (p *appSettingBaseService) getResolveScopeIds(scope utils.Map) map[string]string {
+
+	scopeIds := map[string]string{}
+	for _, overrideLayer := range settingOverrideLayers {
+		scopeIds[overrideLayer.ScopeField], _ = utils.GetMemberDataStr(scope, overrideLayer.ScopeField)
+	}
+
+	businessId := scopeIds[platform_common.FLD_BUSINESS_ID]
+	if scopeIds[platform_common.FLD_REGION_ID] == "" && businessId != "" {
+		if dataBusiness, err := p.daoBusiness.Get(businessId); err == nil {
+			scopeIds[platform_common.FLD_REGION_ID], _ = utils.GetMemberDataStr(dataBusiness, platform_common.FLD_BUSINESS_REGION_ID)
+		}
+	}
+	return scopeIds
+}
+
+func validateSettingLayer(layer string, scopeId string) error {
+
+	for _, overrideLayer := range settingOverrideLayers {
+		if overrideLayer.Layer == layer {
+			if strings.TrimSpace(scopeId) == "" {
+				err := &utils.AppError{ErrorStatus: 400, ErrorMsg: "Missing scope", ErrorDetail: "Override of layer " + layer + " needs a scope id"}
+				return err
+			}
+			return nil
+		}
+	}
+
+	err := &utils.AppError{ErrorStatus: 400, ErrorMsg: "Invalid layer", ErrorDetail: "Override layer should be " + SETTING_LAYER_REGION + ", " + SETTING_LAYER_BUSINESS + " or " + SETTING_LAYER_USER}
+	return err
+}
+
+func getSettingOverrideId(settingId string, layer string, scopeId string) string {
+	return settingId + ":" + layer + ":" + scopeId
+}
+
+func newResolvedSetting(settingId string, value interface{}, layer string, scopeId string) utils.Map {
+	return utils.Map{
+		platform_common.FLD_SETTING_ID: settingId,
+		FLD_SETTING_VALUE:              value,
+		FLD_SETTING_LAYER:              layer,
+		FLD_SETTING_SCOPE_ID:           scopeId,
+	}
+}
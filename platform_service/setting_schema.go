@@ -0,0 +1,237 @@
+package platform_service
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zapscloud/golib-utils/utils"
+)
+
+// Typed setting fields and value types
+const (
+	FLD_SETTING_VALUE   = "setting_value"
+	FLD_SETTING_SCHEMAS = "setting_schemas"
+
+	SETTING_TYPE_STRING   = "string"
+	SETTING_TYPE_BOOL     = "bool"
+	SETTING_TYPE_INT      = "int"
+	SETTING_TYPE_FLOAT    = "float"
+	SETTING_TYPE_DURATION = "duration"
+	SETTING_TYPE_MAP      = "map"
+)
+
+// SettingSchema - Describes the value of a setting. Min and Max bound numbers and durations,
+// Enum lists the allowed values of strings and numbers.
+type SettingSchema struct {
+	SettingId   string        `json:"app_setting_id"`
+	Type        string        `json:"type"`
+	Default     interface{}   `json:"default,omitempty"`
+	Min         *float64      `json:"min,omitempty"`
+	Max         *float64      `json:"max,omitempty"`
+	Enum        []interface{} `json:"enum,omitempty"`
+	Description string        `json:"description,omitempty"`
+}
+
+var (
+	settingSchemas   = map[string]SettingSchema{}
+	settingSchemasMu sync.RWMutex
+)
+
+// RegisterSettingSchema - Register the schema of a setting, usually from the init of the consumer.
+// Registering the same setting again replaces the schema. Schemas are not stored, every process
+// has to register them before its setting service is created.
+func RegisterSettingSchema(schema SettingSchema) error {
+
+	schema.SettingId = strings.ToLower(strings.TrimSpace(schema.SettingId))
+	if schema.SettingId == "" {
+		err := &utils.AppError{ErrorStatus: 400, ErrorMsg: "Invalid schema", ErrorDetail: "Setting schema needs an app_setting_id"}
+		return err
+	}
+
+	switch schema.Type {
+	case SETTING_TYPE_STRING, SETTING_TYPE_BOOL, SETTING_TYPE_INT, SETTING_TYPE_FLOAT, SETTING_TYPE_DURATION, SETTING_TYPE_MAP:
+	default:
+		err := &utils.AppError{ErrorStatus: 400, ErrorMsg: "Invalid schema", ErrorDetail: "Setting " + schema.SettingId + " has unknown type " + schema.Type}
+		return err
+	}
+
+	if schema.Min != nil && schema.Max != nil && *schema.Min > *schema.Max {
+		err := &utils.AppError{ErrorStatus: 400, ErrorMsg: "Invalid schema", ErrorDetail: "Setting " + schema.SettingId + " has min greater than max"}
+		return err
+	}
+
+	if schema.Default != nil {
+		defaultVal, err := schema.Validate(schema.Default)
+		if err != nil {
+			return err
+		}
+		schema.Default = defaultVal
+	}
+
+	settingSchemasMu.Lock()
+	defer settingSchemasMu.Unlock()
+	settingSchemas[schema.SettingId] = schema
+	return nil
+}
+
+// GetSettingSchema - Get the registered schema of the setting
+func GetSettingSchema(settingId string) (SettingSchema, bool) {
+	settingSchemasMu.RLock()
+	defer settingSchemasMu.RUnlock()
+
+	schema, found := settingSchemas[strings.ToLower(settingId)]
+	return schema, found
+}
+
+// ListSettingSchemas - List the registered schemas ordered by setting id
+func ListSettingSchemas() []SettingSchema {
+	settingSchemasMu.RLock()
+	defer settingSchemasMu.RUnlock()
+
+	schemas := make([]SettingSchema, 0, len(settingSchemas))
+	for _, schema := range settingSchemas {
+		schemas = append(schemas, schema)
+	}
+	sort.Slice(schemas, func(i, j int) bool { return schemas[i].SettingId < schemas[j].SettingId })
+	return schemas
+}
+
+// Validate - Check the value against the schema and return it in its normalized form. Numbers are
+// returned as int64 or float64, durations as their string form.
+func (schema SettingSchema) Validate(value interface{}) (interface{}, error) {
+
+	invalid := func(detail string) error {
+		return &utils.AppError{ErrorStatus: 400, ErrorMsg: "Invalid setting value", ErrorDetail: "Setting " + schema.SettingId + " " + detail}
+	}
+
+	var normalized interface{}
+	var numVal float64
+	isNumber := false
+
+	switch schema.Type {
+	case SETTING_TYPE_STRING:
+		strVal, ok := value.(string)
+		if !ok {
+			return nil, invalid("should be text")
+		}
+		normalized = strVal
+
+	case SETTING_TYPE_BOOL:
+		boolVal, ok := value.(bool)
+		if !ok {
+			return nil, invalid("should be true or false")
+		}
+		normalized = boolVal
+
+	case SETTING_TYPE_INT:
+		floatVal, ok := toSettingFloat(value)
+		if !ok || floatVal != math.Trunc(floatVal) {
+			return nil, invalid("should be a whole number")
+		}
+		normalized, numVal, isNumber = int64(floatVal), floatVal, true
+
+	case SETTING_TYPE_FLOAT:
+		floatVal, ok := toSettingFloat(value)
+		if !ok {
+			return nil, invalid("should be a number")
+		}
+		normalized, numVal, isNumber = floatVal, floatVal, true
+
+	case SETTING_TYPE_DURATION:
+		duration, err := toSettingDuration(value)
+		if err != nil {
+			return nil, invalid("should be a duration such as 30s or 5m")
+		}
+		// Bounds of durations are given in seconds
+		normalized, numVal, isNumber = duration.String(), duration.Seconds(), true
+
+	case SETTING_TYPE_MAP:
+		mapVal := getMapList([]interface{}{value})
+		if len(mapVal) == 0 {
+			return nil, invalid("should be an object")
+		}
+		normalized = mapVal[0]
+
+	default:
+		return nil, invalid("has unknown type " + schema.Type)
+	}
+
+	if isNumber {
+		if schema.Min != nil && numVal < *schema.Min {
+			return nil, invalid(fmt.Sprintf("should be at least %v", *schema.Min))
+		}
+		if schema.Max != nil && numVal > *schema.Max {
+			return nil, invalid(fmt.Sprintf("should be at most %v", *schema.Max))
+		}
+	}
+
+	if len(schema.Enum) > 0 {
+		isAllowed := false
+		for _, enumVal := range schema.Enum {
+			isAllowed = isAllowed || fmt.Sprint(enumVal) == fmt.Sprint(normalized)
+		}
+		if !isAllowed {
+			return nil, invalid(fmt.Sprintf("should be one of %v", schema.Enum))
+		}
+	}
+
+	return normalized, nil
+}
+
+// validateSettingValue - Validate the value of a setting which has a registered schema. Settings
+// without a schema are stored as given.
+func validateSettingValue(settingId string, indata utils.Map) error {
+
+	schema, found := GetSettingSchema(settingId)
+	if !found {
+		return nil
+	}
+
+	value, found := indata[FLD_SETTING_VALUE]
+	if !found {
+		err := &utils.AppError{ErrorStatus: 400, ErrorMsg: "Missing setting value", ErrorDetail: "Setting " + settingId + " needs " + FLD_SETTING_VALUE}
+		return err
+	}
+
+	normalized, err := schema.Validate(value)
+	if err != nil {
+		return err
+	}
+	indata[FLD_SETTING_VALUE] = normalized
+	return nil
+}
+
+func toSettingFloat(value interface{}) (float64, bool) {
+	switch numVal := value.(type) {
+	case int:
+		return float64(numVal), true
+	case int32:
+		return float64(numVal), true
+	case int64:
+		return float64(numVal), true
+	case float32:
+		return float64(numVal), true
+	case float64:
+		return numVal, true
+	case string:
+		floatVal, err := strconv.ParseFloat(strings.TrimSpace(numVal), 64)
+		return floatVal, err == nil
+	}
+	return 0, false
+}
+
+// toSettingDuration - Durations are given as Go duration strings or as a number of seconds
+func toSettingDuration(value interface{}) (time.Duration, error) {
+	if strVal, ok := value.(string); ok {
+		return time.ParseDuration(strings.TrimSpace(strVal))
+	}
+	if floatVal, ok := toSettingFloat(value); ok {
+		return time.Duration(floatVal * float64(time.Second)), nil
+	}
+	return 0, fmt.Errorf("invalid duration %v", value)
+}
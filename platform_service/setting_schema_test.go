@@ -0,0 +1,103 @@
+package platform_service
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/zapscloud/golib-utils/utils"
+)
+
+func TestSettingSchemaValidate(t *testing.T) {
+
+	bound := func(value float64) *float64 { return &value }
+
+	tests := []struct {
+		name    string
+		schema  SettingSchema
+		value   interface{}
+		want    interface{}
+		wantErr bool
+	}{
+		{"string", SettingSchema{Type: SETTING_TYPE_STRING}, "dark", "dark", false},
+		{"string not text", SettingSchema{Type: SETTING_TYPE_STRING}, 10, nil, true},
+		{"string in enum", SettingSchema{Type: SETTING_TYPE_STRING, Enum: []interface{}{"dark", "light"}}, "light", "light", false},
+		{"string not in enum", SettingSchema{Type: SETTING_TYPE_STRING, Enum: []interface{}{"dark", "light"}}, "blue", nil, true},
+		{"bool", SettingSchema{Type: SETTING_TYPE_BOOL}, true, true, false},
+		{"bool as text", SettingSchema{Type: SETTING_TYPE_BOOL}, "true", nil, true},
+		{"int", SettingSchema{Type: SETTING_TYPE_INT}, 42, int64(42), false},
+		{"int from json number", SettingSchema{Type: SETTING_TYPE_INT}, float64(42), int64(42), false},
+		{"int from text", SettingSchema{Type: SETTING_TYPE_INT}, " 42 ", int64(42), false},
+		{"int with fraction", SettingSchema{Type: SETTING_TYPE_INT}, 4.2, nil, true},
+		{"int not a number", SettingSchema{Type: SETTING_TYPE_INT}, "many", nil, true},
+		{"int at min", SettingSchema{Type: SETTING_TYPE_INT, Min: bound(1), Max: bound(10)}, 1, int64(1), false},
+		{"int below min", SettingSchema{Type: SETTING_TYPE_INT, Min: bound(1), Max: bound(10)}, 0, nil, true},
+		{"int above max", SettingSchema{Type: SETTING_TYPE_INT, Min: bound(1), Max: bound(10)}, 11, nil, true},
+		{"int in enum", SettingSchema{Type: SETTING_TYPE_INT, Enum: []interface{}{10, 20}}, float64(20), int64(20), false},
+		{"float", SettingSchema{Type: SETTING_TYPE_FLOAT}, float32(0.5), float64(0.5), false},
+		{"float above max", SettingSchema{Type: SETTING_TYPE_FLOAT, Max: bound(1)}, 1.5, nil, true},
+		{"duration", SettingSchema{Type: SETTING_TYPE_DURATION}, "90s", "1m30s", false},
+		{"duration in seconds", SettingSchema{Type: SETTING_TYPE_DURATION}, 30, "30s", false},
+		{"duration invalid", SettingSchema{Type: SETTING_TYPE_DURATION}, "soon", nil, true},
+		{"duration above max seconds", SettingSchema{Type: SETTING_TYPE_DURATION, Max: bound(60)}, "2m", nil, true},
+		{"map", SettingSchema{Type: SETTING_TYPE_MAP}, map[string]interface{}{"a": 1}, utils.Map{"a": 1}, false},
+		{"map not an object", SettingSchema{Type: SETTING_TYPE_MAP}, []interface{}{1}, nil, true},
+		{"unknown type", SettingSchema{Type: "date"}, "2026-10-19", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.schema.Validate(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Validate(%v) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Validate(%v) = %#v, want %#v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegisterSettingSchema(t *testing.T) {
+
+	bound := func(value float64) *float64 { return &value }
+
+	tests := []struct {
+		name    string
+		schema  SettingSchema
+		wantErr bool
+	}{
+		{"valid", SettingSchema{SettingId: " Test.Page_Size ", Type: SETTING_TYPE_INT, Default: "20", Min: bound(1)}, false},
+		{"missing id", SettingSchema{Type: SETTING_TYPE_INT}, true},
+		{"unknown type", SettingSchema{SettingId: "test.unknown", Type: "date"}, true},
+		{"min above max", SettingSchema{SettingId: "test.range", Type: SETTING_TYPE_INT, Min: bound(10), Max: bound(1)}, true},
+		{"invalid default", SettingSchema{SettingId: "test.default", Type: SETTING_TYPE_INT, Default: 0, Min: bound(1)}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := RegisterSettingSchema(tt.schema); (err != nil) != tt.wantErr {
+				t.Errorf("RegisterSettingSchema() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	// The id is normalized and the default stored in its validated form
+	schema, found := GetSettingSchema("TEST.PAGE_SIZE")
+	if !found || schema.Default != int64(20) {
+		t.Errorf("GetSettingSchema() = %+v, %v, want the registered schema with default 20", schema, found)
+	}
+	if _, found := GetSettingSchema("test.default"); found {
+		t.Errorf("GetSettingSchema() found a schema which failed to register")
+	}
+
+	indata := utils.Map{FLD_SETTING_VALUE: "5"}
+	if err := validateSettingValue("test.page_size", indata); err != nil || indata[FLD_SETTING_VALUE] != int64(5) {
+		t.Errorf("validateSettingValue() = %v, value %#v, want 5", err, indata[FLD_SETTING_VALUE])
+	}
+	if err := validateSettingValue("test.page_size", utils.Map{}); err == nil {
+		t.Errorf("validateSettingValue() without a value should fail")
+	}
+	if err := validateSettingValue("test.no_schema", utils.Map{FLD_SETTING_VALUE: []int{1}}); err != nil {
+		t.Errorf("validateSettingValue() without a schema = %v, want nil", err)
+	}
+}
@@ -0,0 +1,274 @@
+package platform_service
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/zapscloud/golib-dbutils/db_common"
+	"github.com/zapscloud/golib-utils/utils"
+)
+
+// Secret setting fields. The value of a secret setting is stored encrypted as
+// {"key_id": .., "ciphertext": ..} and is masked everywhere except GetSecret.
+const (
+	FLD_SETTING_IS_SECRET  = "is_secret"
+	FLD_SECRET_KEY_ID      = "key_id"
+	FLD_SECRET_CIPHERTEXT  = "ciphertext"
+	SETTING_SECRET_MASK    = "********"
+	SETTING_SECRET_KEY_LEN = 32
+)
+
+// SettingKeyProvider - Supplies the AES-256 keys used to encrypt secret settings. New secrets are
+// encrypted with the current key, older ones are decrypted with the key they were stored with.
+type SettingKeyProvider interface {
+	CurrentKeyId() string
+	GetKey(keyId string) ([]byte, error)
+}
+
+var (
+	settingKeyProvider   SettingKeyProvider
+	settingKeyProviderMu sync.RWMutex
+)
+
+// SetSettingKeyProvider - Set the key provider used by all setting services of the process
+func SetSettingKeyProvider(provider SettingKeyProvider) {
+	settingKeyProviderMu.Lock()
+	defer settingKeyProviderMu.Unlock()
+	settingKeyProvider = provider
+}
+
+func getSettingKeyProvider() (SettingKeyProvider, error) {
+	settingKeyProviderMu.RLock()
+	defer settingKeyProviderMu.RUnlock()
+
+	if settingKeyProvider == nil {
+		err := &utils.AppError{ErrorStatus: 500, ErrorMsg: "Missing key provider", ErrorDetail: "Secret settings need a key provider, see SetSettingKeyProvider"}
+		return nil, err
+	}
+	return settingKeyProvider, nil
+}
+
+// keyFileProvider - Single key read from a local file, named after the file
+type keyFileProvider struct {
+	keyId string
+	key   []byte
+}
+
+// NewKeyFileProvider - Key provider over a local file holding a 32 byte key, either raw, hex or base64
+func NewKeyFileProvider(keyFile string) (SettingKeyProvider, error) {
+
+	content, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	key := content
+	trimmed := strings.TrimSpace(string(content))
+	if decoded, err := hex.DecodeString(trimmed); err == nil && len(decoded) == SETTING_SECRET_KEY_LEN {
+		key = decoded
+	} else if decoded, err := base64.StdEncoding.DecodeString(trimmed); err == nil && len(decoded) == SETTING_SECRET_KEY_LEN {
+		key = decoded
+	}
+
+	if len(key) != SETTING_SECRET_KEY_LEN {
+		err := &utils.AppError{ErrorStatus: 500, ErrorMsg: "Invalid key file", ErrorDetail: "Key file should hold a 32 byte key"}
+		return nil, err
+	}
+
+	keyId := strings.TrimSuffix(filepath.Base(keyFile), filepath.Ext(keyFile))
+	return &keyFileProvider{keyId: keyId, key: key}, nil
+}
+
+func (k *keyFileProvider) CurrentKeyId() string {
+	return k.keyId
+}
+
+func (k *keyFileProvider) GetKey(keyId string) ([]byte, error) {
+	if keyId != k.keyId {
+		err := &utils.AppError{ErrorStatus: 500, ErrorMsg: "Unknown key", ErrorDetail: "Key " + keyId + " is not available"}
+		return nil, err
+	}
+	return k.key, nil
+}
+
+// keyRingProvider - Current key plus earlier keys kept for decrypting what they encrypted
+type keyRingProvider struct {
+	current  SettingKeyProvider
+	previous []SettingKeyProvider
+}
+
+// NewKeyRingProvider - Key provider encrypting with the current key and decrypting with any of the keys,
+// used while rotating to a new key
+func NewKeyRingProvider(current SettingKeyProvider, previous ...SettingKeyProvider) SettingKeyProvider {
+	return &keyRingProvider{current: current, previous: previous}
+}
+
+func (k *keyRingProvider) CurrentKeyId() string {
+	return k.current.CurrentKeyId()
+}
+
+func (k *keyRingProvider) GetKey(keyId string) ([]byte, error) {
+	key, err := k.current.GetKey(keyId)
+	for idx := 0; err != nil && idx < len(k.previous); idx++ {
+		key, err = k.previous[idx].GetKey(keyId)
+	}
+	return key, err
+}
+
+// GetSecret - Decrypt the value of a secret setting
+func (p *appSettingBaseService) GetSecret(settingId string) (interface{}, error) {
+
+	log.Println("SysSettingService::GetSecret - Begin", settingId)
+
+	dataSetting, err := p.daoSysSetting.Get(strings.ToLower(settingId))
+	if err != nil {
+		return nil, err
+	}
+
+	if !isSecretSetting(dataSetting) {
+		err := &utils.AppError{ErrorStatus: 400, ErrorMsg: "Not a secret", ErrorDetail: "Setting " + settingId + " is not a secret, use Get"}
+		return nil, err
+	}
+
+	value, err := decryptSettingValue(strings.ToLower(settingId), dataSetting[FLD_SETTING_VALUE])
+
+	log.Println("SysSettingService::GetSecret - End ", err)
+	return value, err
+}
+
+// encryptSecretValue - Validate the plain value against the schema and replace it with the ciphertext
+func encryptSecretValue(settingId string, indata utils.Map) error {
+
+	if err := validateSettingValue(settingId, indata); err != nil {
+		return err
+	}
+
+	provider, err := getSettingKeyProvider()
+	if err != nil {
+		return err
+	}
+	keyId := provider.CurrentKeyId()
+	key, err := provider.GetKey(keyId)
+	if err != nil {
+		return err
+	}
+
+	plainText, err := json.Marshal(indata[FLD_SETTING_VALUE])
+	if err != nil {
+		return err
+	}
+
+	gcm, err := newSettingCipher(key)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+
+	indata[FLD_SETTING_VALUE] = utils.Map{
+		FLD_SECRET_KEY_ID:     keyId,
+		FLD_SECRET_CIPHERTEXT: base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, plainText, []byte(settingId))),
+	}
+	return nil
+}
+
+// decryptSettingValue - Decrypt the stored ciphertext back to the plain value
+func decryptSettingValue(settingId string, dataVal interface{}) (interface{}, error) {
+
+	invalid := &utils.AppError{ErrorStatus: 500, ErrorMsg: "Invalid secret", ErrorDetail: "Stored secret value cannot be decrypted"}
+
+	dataList := getMapList([]interface{}{dataVal})
+	if len(dataList) == 0 {
+		return nil, invalid
+	}
+	keyId, _ := utils.GetMemberDataStr(dataList[0], FLD_SECRET_KEY_ID)
+	cipherText, err := utils.GetMemberDataStr(dataList[0], FLD_SECRET_CIPHERTEXT)
+	if err != nil {
+		return nil, invalid
+	}
+	sealed, err := base64.StdEncoding.DecodeString(cipherText)
+	if err != nil {
+		return nil, invalid
+	}
+
+	provider, err := getSettingKeyProvider()
+	if err != nil {
+		return nil, err
+	}
+	key, err := provider.GetKey(keyId)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := newSettingCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, invalid
+	}
+
+	// The setting id is bound as additional data, so a ciphertext cannot be moved to another setting
+	nonce, sealed := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plainText, err := gcm.Open(nil, nonce, sealed, []byte(settingId))
+	if err != nil {
+		return nil, invalid
+	}
+
+	var value interface{}
+	if err := json.Unmarshal(plainText, &value); err != nil {
+		return nil, invalid
+	}
+	return value, nil
+}
+
+func newSettingCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func isSecretSetting(dataSetting utils.Map) bool {
+	isSecret, _ := utils.GetMemberDataBool(dataSetting, FLD_SETTING_IS_SECRET)
+	return isSecret
+}
+
+// maskSecretSetting - Copy of the setting with the secret value masked
+func maskSecretSetting(dataSetting utils.Map) utils.Map {
+	if !isSecretSetting(dataSetting) {
+		return dataSetting
+	}
+	masked := utils.Map{}
+	for key, value := range dataSetting {
+		masked[key] = value
+	}
+	masked[FLD_SETTING_VALUE] = SETTING_SECRET_MASK
+	return masked
+}
+
+// maskSecretSettings - Mask the secret values of a List styled response
+func maskSecretSettings(dataList utils.Map) utils.Map {
+	if _, found := dataList[db_common.LIST_RESULT]; !found {
+		return dataList
+	}
+	results := getListResult(dataList)
+	for idx, dataSetting := range results {
+		results[idx] = maskSecretSetting(dataSetting)
+	}
+	dataList[db_common.LIST_RESULT] = results
+	return dataList
+}
@@ -0,0 +1,132 @@
+package platform_service
+
+import (
+	"bytes"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/zapscloud/golib-utils/utils"
+)
+
+func newTestKeyProvider(t *testing.T, keyId string, fill byte) SettingKeyProvider {
+	keyFile := filepath.Join(t.TempDir(), keyId+".key")
+	if err := os.WriteFile(keyFile, []byte(hex.EncodeToString(bytes.Repeat([]byte{fill}, SETTING_SECRET_KEY_LEN))), 0600); err != nil {
+		t.Fatal(err)
+	}
+	provider, err := NewKeyFileProvider(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return provider
+}
+
+func TestSettingSecretRoundTrip(t *testing.T) {
+
+	oldKey := newTestKeyProvider(t, "key_2025", 1)
+	newKey := newTestKeyProvider(t, "key_2026", 2)
+	defer SetSettingKeyProvider(nil)
+
+	tests := []struct {
+		name  string
+		value interface{}
+	}{
+		{"text", "s3cr3t"},
+		{"number", float64(42)},
+		{"bool", true},
+		{"object", map[string]interface{}{"user": "api", "token": "t0k3n"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SetSettingKeyProvider(oldKey)
+			indata := utils.Map{FLD_SETTING_VALUE: tt.value}
+			if err := encryptSecretValue("test.secret", indata); err != nil {
+				t.Fatal(err)
+			}
+			stored := indata[FLD_SETTING_VALUE].(utils.Map)
+			if stored[FLD_SECRET_KEY_ID] != "key_2025" || reflect.DeepEqual(stored[FLD_SECRET_CIPHERTEXT], tt.value) {
+				t.Fatalf("encryptSecretValue() stored %v", stored)
+			}
+
+			// Decrypted with the key it was stored with, also after rotating to a new key
+			SetSettingKeyProvider(NewKeyRingProvider(newKey, oldKey))
+			value, err := decryptSettingValue("test.secret", stored)
+			if err != nil || !reflect.DeepEqual(value, tt.value) {
+				t.Errorf("decryptSettingValue() = %v, %v, want %v", value, err, tt.value)
+			}
+
+			// The ciphertext is bound to the setting and the key
+			if _, err := decryptSettingValue("test.other", stored); err == nil {
+				t.Errorf("decryptSettingValue() of another setting should fail")
+			}
+			SetSettingKeyProvider(newKey)
+			if _, err := decryptSettingValue("test.secret", stored); err == nil {
+				t.Errorf("decryptSettingValue() without the stored key should fail")
+			}
+		})
+	}
+
+	SetSettingKeyProvider(newKey)
+	first, second := utils.Map{FLD_SETTING_VALUE: "same"}, utils.Map{FLD_SETTING_VALUE: "same"}
+	if encryptSecretValue("test.secret", first) != nil || encryptSecretValue("test.secret", second) != nil {
+		t.Fatal("encryptSecretValue() failed")
+	}
+	if reflect.DeepEqual(first, second) {
+		t.Errorf("encryptSecretValue() gave the same ciphertext twice, the nonce should be random")
+	}
+
+	tampered := utils.Map{FLD_SECRET_KEY_ID: "key_2026", FLD_SECRET_CIPHERTEXT: "bm90IGEgY2lwaGVydGV4dA=="}
+	if _, err := decryptSettingValue("test.secret", tampered); err == nil {
+		t.Errorf("decryptSettingValue() of a tampered value should fail")
+	}
+}
+
+func TestMaskSettingVersion(t *testing.T) {
+
+	plain := utils.Map{FLD_SETTING_VALUE: "visible"}
+	secret := utils.Map{FLD_SETTING_VALUE: utils.Map{FLD_SECRET_CIPHERTEXT: "abc"}, FLD_SETTING_IS_SECRET: true}
+
+	tests := []struct {
+		name     string
+		isSecret bool
+		oldValue utils.Map
+		newValue utils.Map
+		wantOld  interface{}
+		wantNew  interface{}
+	}{
+		{"plain setting", false, plain, plain, "visible", "visible"},
+		{"made secret", false, plain, secret, "visible", SETTING_SECRET_MASK},
+		{"secret now", true, plain, plain, SETTING_SECRET_MASK, SETTING_SECRET_MASK},
+		{"created", true, nil, secret, nil, SETTING_SECRET_MASK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dataVersion := utils.Map{FLD_SETTING_OLD_VALUE: tt.oldValue, FLD_SETTING_NEW_VALUE: tt.newValue}
+			masked := maskSettingVersion(dataVersion, tt.isSecret)
+
+			for field, want := range map[string]interface{}{FLD_SETTING_OLD_VALUE: tt.wantOld, FLD_SETTING_NEW_VALUE: tt.wantNew} {
+				var got interface{}
+				if snapshot := getSettingSnapshot(masked[field]); snapshot != nil {
+					got = snapshot[FLD_SETTING_VALUE]
+				}
+				if got != want {
+					t.Errorf("maskSettingVersion() %s = %v, want %v", field, got, want)
+				}
+			}
+		})
+	}
+
+	if plain[FLD_SETTING_VALUE] != "visible" {
+		t.Errorf("maskSettingVersion() changed the stored snapshot")
+	}
+
+	dataOverride := utils.Map{FLD_SETTING_OLD_OVERRIDE: nil, FLD_SETTING_NEW_OVERRIDE: "visible"}
+	masked := maskSettingVersion(dataOverride, true)
+	if masked[FLD_SETTING_OLD_OVERRIDE] != nil || masked[FLD_SETTING_NEW_OVERRIDE] != SETTING_SECRET_MASK {
+		t.Errorf("maskSettingVersion() override values = %v, %v", masked[FLD_SETTING_OLD_OVERRIDE], masked[FLD_SETTING_NEW_OVERRIDE])
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"log"
 	"strings"
+	"time"
 
+	"github.com/zapscloud/golib-dbutils/db_common"
 	"github.com/zapscloud/golib-dbutils/db_utils"
 	"github.com/zapscloud/golib-platform-repository/platform_common"
 	"github.com/zapscloud/golib-platform-repository/platform_repository"
@@ -19,6 +21,32 @@ type SysSettingService interface {
 	Create(indata utils.Map) (string, error)
 	Update(clientid string, indata utils.Map) (utils.Map, error)
 	Delete(clientid string) error
+	// Delete recording the user deleting it in the history
+	DeleteBy(clientid string, deleted_by string) error
+
+	// Typed getters, falling back to the registered default when the setting is not stored
+	GetString(settingId string) (string, error)
+	GetBool(settingId string) (bool, error)
+	GetInt(settingId string) (int64, error)
+	GetFloat(settingId string) (float64, error)
+	GetDuration(settingId string) (time.Duration, error)
+
+	// Overrides per region, business or user; the most specific layer wins on Resolve
+	SetOverride(settingId string, layer string, scopeId string, value interface{}) (utils.Map, error)
+	RemoveOverride(settingId string, layer string, scopeId string) error
+	ListOverrides(settingId string) (utils.Map, error)
+	Resolve(settingId string, scope utils.Map) (utils.Map, error)
+
+	// Every change is kept as an immutable version which can be compared and restored
+	ListHistory(settingId string) (utils.Map, error)
+	GetVersion(settingId string, version int) (utils.Map, error)
+	DiffVersions(settingId string, fromVersion int, toVersion int) (utils.Map, error)
+	Rollback(settingId string, version int, changedBy string) (utils.Map, error)
+	// Latest version of each setting, 0 for settings without history
+	GetLatestVersions(settingIds []string) (map[string]int, error)
+
+	// Decrypted value of a secret setting, every other call returns it masked
+	GetSecret(settingId string) (interface{}, error)
 
 	BeginTransaction()
 	CommitTransaction()
@@ -30,6 +58,9 @@ type SysSettingService interface {
 type appSettingBaseService struct {
 	db_utils.DatabaseService
 	daoSysSetting platform_repository.SysSettingDao
+	daoOverride   platform_repository.SysSettingOverrideDao
+	daoVersion    platform_repository.SysSettingVersionDao
+	daoBusiness   platform_repository.BusinessDao
 	child         SysSettingService
 }
 
@@ -37,9 +68,25 @@ func init() {
 	log.SetFlags(log.Lshortfile | log.LstdFlags | log.Lmicroseconds)
 }
 
+// NewSysSettingService - Schemas are kept in memory by each process. Pass them as FLD_SETTING_SCHEMAS,
+// or register them before creating the service, in every process that writes settings; a process
+// without the schema stores values unchecked.
 func NewSysSettingService(props utils.Map) (SysSettingService, error) {
 	p := appSettingBaseService{}
 
+	if dataSchemas, found := props[FLD_SETTING_SCHEMAS]; found {
+		schemas, ok := dataSchemas.([]SettingSchema)
+		if !ok {
+			err := &utils.AppError{ErrorStatus: 400, ErrorMsg: "Invalid schemas", ErrorDetail: FLD_SETTING_SCHEMAS + " should be a list of SettingSchema"}
+			return nil, err
+		}
+		for _, schema := range schemas {
+			if err := RegisterSettingSchema(schema); err != nil {
+				return nil, err
+			}
+		}
+	}
+
 	err := p.OpenDatabaseService(props)
 	if err != nil {
 		log.Println("NewSysSettingService: Connection Error ", err)
@@ -48,6 +95,9 @@ func NewSysSettingService(props utils.Map) (SysSettingService, error) {
 	log.Printf("NewSysSettingService ")
 
 	p.daoSysSetting = platform_repository.NewSysSettingDao(p.GetClient())
+	p.daoOverride = platform_repository.NewSysSettingOverrideDao(p.GetClient())
+	p.daoVersion = platform_repository.NewSysSettingVersionDao(p.GetClient())
+	p.daoBusiness = platform_repository.NewBusinessDao(p.GetClient())
 	p.child = &p
 
 	return &p, nil
@@ -67,7 +117,7 @@ func (p *appSettingBaseService) List(filter string, sort string, skip int64, lim
 		return nil, err
 	}
 	log.Println("SysSettingService::FindAll - End ")
-	return dataresponse, nil
+	return maskSecretSettings(dataresponse), nil
 }
 
 // GetDetails - Find By Code
@@ -75,6 +125,10 @@ func (p *appSettingBaseService) Get(clientid string) (utils.Map, error) {
 	log.Printf("SysSettingService::GetDetails::  Begin %v", clientid)
 
 	data, err := p.daoSysSetting.Get(clientid)
+	if err != nil {
+		return nil, err
+	}
+	data = maskSecretSetting(data)
 
 	log.Println("SysSettingService::GetDetails:: End ", data, err)
 	return data, err
@@ -84,6 +138,10 @@ func (p *appSettingBaseService) Find(filter string) (utils.Map, error) {
 	fmt.Println("SysSettingService::GetDetails::  Begin ", filter)
 
 	data, err := p.daoSysSetting.Find(filter)
+	if err != nil {
+		return nil, err
+	}
+	data = maskSecretSetting(data)
 
 	log.Println("SysSettingService::GetDetails:: End ", data, err)
 	return data, err
@@ -98,6 +156,7 @@ func (p *appSettingBaseService) Create(indata utils.Map) (string, error) {
 	dataval, dataok := indata[platform_common.FLD_SETTING_ID]
 	if dataok {
 		settingsId = strings.ToLower(dataval.(string))
+		indata[platform_common.FLD_SETTING_ID] = settingsId
 	} else {
 		err := &utils.AppError{ErrorCode: "S3040101", ErrorMsg: "Missing app_setting_id", ErrorDetail: "Missing required field app_setting_id !!"}
 		return "", err
@@ -110,7 +169,34 @@ func (p *appSettingBaseService) Create(indata utils.Map) (string, error) {
 		return settingsId, err
 	}
 
-	createdId, err := p.daoSysSetting.Create(indata)
+	// Settings with a registered schema should carry a valid value, secrets are stored encrypted
+	if isSecretSetting(indata) {
+		if err = p.checkNoOverrides(settingsId); err == nil {
+			err = encryptSecretValue(settingsId, indata)
+		}
+	} else {
+		err = validateSettingValue(settingsId, indata)
+	}
+	if err != nil {
+		return settingsId, err
+	}
+
+	changedBy, _ := utils.GetMemberDataStr(indata, db_common.FLD_CREATED_BY)
+
+	var createdId string
+	err = p.runSettingChange(settingsId, func() error {
+		var err error
+		createdId, err = p.daoSysSetting.Create(indata)
+		if err != nil {
+			return err
+		}
+		dataNew, err := p.daoSysSetting.Get(settingsId)
+		if err != nil {
+			return err
+		}
+		_, err = p.recordSettingVersion(settingsId, SETTING_ACTION_CREATE, changedBy, nil, dataNew, 0)
+		return err
+	})
 	if err != nil {
 		return "", err
 	}
@@ -126,7 +212,30 @@ func (p *appSettingBaseService) Update(clientid string, indata utils.Map) (utils
 	// Delete the Key fields
 	delete(indata, platform_common.FLD_SETTING_ID)
 
-	data, err := p.daoSysSetting.Update(clientid, indata)
+	dataOld, err := p.daoSysSetting.Get(clientid)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.prepareSettingValue(clientid, dataOld, indata); err != nil {
+		return nil, err
+	}
+	changedBy, _ := utils.GetMemberDataStr(indata, db_common.FLD_UPDATED_BY)
+
+	var data utils.Map
+	err = p.runSettingChange(clientid, func() error {
+		var err error
+		data, err = p.daoSysSetting.Update(clientid, indata)
+		if err != nil {
+			return err
+		}
+		dataNew, err := p.daoSysSetting.Get(clientid)
+		if err != nil {
+			return err
+		}
+		_, err = p.recordSettingVersion(clientid, SETTING_ACTION_UPDATE, changedBy, dataOld, dataNew, 0)
+		return err
+	})
 
 	log.Println("ClientService::Update - End ")
 	return data, err
@@ -134,10 +243,30 @@ func (p *appSettingBaseService) Update(clientid string, indata utils.Map) (utils
 
 // Delete - Delete Service
 func (p *appSettingBaseService) Delete(clientid string) error {
+	return p.DeleteBy(clientid, "")
+}
+
+// DeleteBy - Delete the setting, the user deleting it is recorded in the history
+func (p *appSettingBaseService) DeleteBy(clientid string, deleted_by string) error {
 
-	log.Println("ClientService::Delete - Begin", clientid)
+	log.Println("ClientService::Delete - Begin", clientid, deleted_by)
+
+	dataOld, err := p.daoSysSetting.Get(clientid)
+	if err != nil {
+		return err
+	}
 
-	result, err := p.daoSysSetting.Delete(clientid)
+	// The deleted value stays in the history and can be restored by Rollback
+	var result int64
+	err = p.runSettingChange(clientid, func() error {
+		var err error
+		result, err = p.daoSysSetting.Delete(clientid)
+		if err != nil {
+			return err
+		}
+		_, err = p.recordSettingVersion(clientid, SETTING_ACTION_DELETE, deleted_by, dataOld, nil, 0)
+		return err
+	})
 	if err != nil {
 		return err
 	}
@@ -145,3 +274,114 @@ func (p *appSettingBaseService) Delete(clientid string) error {
 	log.Printf("ClientService::Delete - End %v", result)
 	return nil
 }
+
+// prepareSettingValue - Validate the updated value, encrypting it when the setting is or becomes a secret
+func (p *appSettingBaseService) prepareSettingValue(settingId string, dataOld utils.Map, indata utils.Map) error {
+
+	_, hasSecretFlag := indata[FLD_SETTING_IS_SECRET]
+	if isSecretSetting(dataOld) && hasSecretFlag && !isSecretSetting(indata) {
+		err := &utils.AppError{ErrorStatus: 400, ErrorMsg: "Invalid update", ErrorDetail: "Setting " + settingId + " is a secret and cannot be made plain, delete and create it again"}
+		return err
+	}
+
+	isSecret := isSecretSetting(dataOld) || isSecretSetting(indata)
+	_, hasValue := indata[FLD_SETTING_VALUE]
+
+	if isSecret && !isSecretSetting(dataOld) {
+		if err := p.checkNoOverrides(settingId); err != nil {
+			return err
+		}
+	}
+
+	if isSecret && !isSecretSetting(dataOld) && !hasValue {
+		// The plain value stored so far gets encrypted
+		if value, found := dataOld[FLD_SETTING_VALUE]; found {
+			indata[FLD_SETTING_VALUE] = value
+			hasValue = true
+		}
+	}
+
+	if !hasValue {
+		return nil
+	} else if isSecret {
+		return encryptSecretValue(settingId, indata)
+	}
+	return validateSettingValue(settingId, indata)
+}
+
+// GetString - Get the value of a string setting
+func (p *appSettingBaseService) GetString(settingId string) (string, error) {
+	value, err := p.getTypedValue(settingId, SETTING_TYPE_STRING)
+	if err != nil {
+		return "", err
+	}
+	return value.(string), nil
+}
+
+// GetBool - Get the value of a bool setting
+func (p *appSettingBaseService) GetBool(settingId string) (bool, error) {
+	value, err := p.getTypedValue(settingId, SETTING_TYPE_BOOL)
+	if err != nil {
+		return false, err
+	}
+	return value.(bool), nil
+}
+
+// GetInt - Get the value of an int setting
+func (p *appSettingBaseService) GetInt(settingId string) (int64, error) {
+	value, err := p.getTypedValue(settingId, SETTING_TYPE_INT)
+	if err != nil {
+		return 0, err
+	}
+	return value.(int64), nil
+}
+
+// GetFloat - Get the value of a float setting
+func (p *appSettingBaseService) GetFloat(settingId string) (float64, error) {
+	value, err := p.getTypedValue(settingId, SETTING_TYPE_FLOAT)
+	if err != nil {
+		return 0, err
+	}
+	return value.(float64), nil
+}
+
+// GetDuration - Get the value of a duration setting
+func (p *appSettingBaseService) GetDuration(settingId string) (time.Duration, error) {
+	value, err := p.getTypedValue(settingId, SETTING_TYPE_DURATION)
+	if err != nil {
+		return 0, err
+	}
+	return time.ParseDuration(value.(string))
+}
+
+// getTypedValue - Read the stored value through the schema, or the default when it is not stored
+func (p *appSettingBaseService) getTypedValue(settingId string, settingType string) (interface{}, error) {
+
+	schema, found := GetSettingSchema(settingId)
+	if !found {
+		// Without a schema the stored value is only checked against the requested type
+		schema = SettingSchema{SettingId: settingId, Type: settingType}
+	} else if schema.Type != settingType {
+		err := &utils.AppError{ErrorStatus: 400, ErrorMsg: "Invalid setting type", ErrorDetail: "Setting " + settingId + " is registered as " + schema.Type}
+		return nil, err
+	}
+
+	// Only a setting which is not stored falls back to the default
+	dataSetting, err := p.daoSysSetting.Get(strings.ToLower(settingId))
+	if err != nil && !isNotFoundError(err) {
+		return nil, err
+	} else if err == nil && isSecretSetting(dataSetting) {
+		err := &utils.AppError{ErrorStatus: 400, ErrorMsg: "Secret setting", ErrorDetail: "Setting " + settingId + " is a secret, use GetSecret"}
+		return nil, err
+	} else if err == nil {
+		if value, found := dataSetting[FLD_SETTING_VALUE]; found {
+			return schema.Validate(value)
+		}
+	}
+
+	if schema.Default == nil {
+		err := &utils.AppError{ErrorStatus: 404, ErrorMsg: "Setting not found", ErrorDetail: "Setting " + settingId + " has no value and no default"}
+		return nil, err
+	}
+	return schema.Default, nil
+}
@@ -0,0 +1,288 @@
+package platform_service
+
+import (
+	"log"
+	"strconv"
+
+	"github.com/zapscloud/golib-dbutils/db_common"
+	"github.com/zapscloud/golib-dbutils/db_utils"
+	"github.com/zapscloud/golib-platform-repository/platform_common"
+	"github.com/zapscloud/golib-platform-repository/platform_repository"
+	"github.com/zapscloud/golib-utils/utils"
+)
+
+// Site fields
+const (
+	FLD_APP_SITE_NAME    = "app_site_name"
+	FLD_APP_SITE_ADDRESS = "app_site_address"
+)
+
+// SiteService - Sites of a business, access grants may be scoped to a site
+type SiteService interface {
+	List(filter string, sort string, skip int64, limit int64) (utils.Map, error)
+	Get(site_id string) (utils.Map, error)
+	Find(filter string) (utils.Map, error)
+	Create(indata utils.Map) (utils.Map, error)
+	Update(site_id string, indata utils.Map) (utils.Map, error)
+	// Delete fails while departments or access grants still reference the site
+	Delete(site_id string, delete_permanent bool) error
+
+	BeginTransaction()
+	CommitTransaction()
+	RollbackTransaction()
+
+	EndService()
+}
+
+type siteBaseService struct {
+	db_utils.DatabaseService
+	daoSite       platform_repository.SiteDao
+	daoDepartment platform_repository.DepartmentDao
+	daoSysAccess  platform_repository.SysAccessDao
+	daoRequest    platform_repository.SysAccessRequestDao
+	daoBusiness   platform_repository.BusinessDao
+	child         SiteService
+	businessID    string
+}
+
+func init() {
+	log.SetFlags(log.Lshortfile | log.LstdFlags | log.Lmicroseconds)
+}
+
+func NewSiteService(props utils.Map) (SiteService, error) {
+	funcode := platform_common.GetServiceModuleCode() + "M" + "01"
+
+	p := siteBaseService{}
+
+	// Open Database Service
+	err := p.OpenDatabaseService(props)
+	if err != nil {
+		log.Println("NewSiteMongoService Connection Error ", err)
+		return nil, err
+	}
+
+	// Verify whether the business id data passed
+	businessId, err := utils.GetMemberDataStr(props, platform_common.FLD_BUSINESS_ID)
+	if err != nil {
+		p.CloseDatabaseService()
+		return nil, err
+	}
+
+	// Assign the BusinessId
+	p.businessID = businessId
+	log.Printf("SiteMongoService ")
+
+	p.daoSite = platform_repository.NewSiteDao(p.GetClient(), p.businessID)
+	p.daoDepartment = platform_repository.NewDepartmentDao(p.GetClient(), p.businessID)
+	p.daoSysAccess = platform_repository.NewSysAccessDao(p.GetClient(), p.businessID)
+	p.daoRequest = platform_repository.NewSysAccessRequestDao(p.GetClient(), p.businessID)
+	p.daoBusiness = platform_repository.NewBusinessDao(p.GetClient())
+
+	_, err = p.daoBusiness.Get(businessId)
+	if err != nil {
+		p.CloseDatabaseService()
+		err := &utils.AppError{ErrorCode: funcode + "01", ErrorMsg: "Invalid sys_business_id", ErrorDetail: "Given sys_business_id is not exist"}
+		return nil, err
+	}
+
+	p.child = &p
+
+	return &p, nil
+}
+
+func (p *siteBaseService) EndService() {
+	log.Printf("EndSiteService ")
+	p.CloseDatabaseService()
+}
+
+func (p *siteBaseService) getServiceModuleCode() string {
+	return platform_common.GetServiceModuleCode() + "10"
+}
+
+// List - List All records
+func (p *siteBaseService) List(filter string, sort string, skip int64, limit int64) (utils.Map, error) {
+
+	log.Println("SiteService::FindAll - Begin")
+
+	dataresponse, err := p.daoSite.List(filter, sort, skip, limit)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("SiteService::FindAll - End ")
+	return dataresponse, nil
+}
+
+// Get - Find By Code
+func (p *siteBaseService) Get(site_id string) (utils.Map, error) {
+	log.Printf("SiteService::Get::  Begin %v", site_id)
+
+	data, err := p.daoSite.Get(site_id)
+
+	log.Println("SiteService::Get:: End ", err)
+	return data, err
+}
+
+func (p *siteBaseService) Find(filter string) (utils.Map, error) {
+	log.Println("SiteService::Find::  Begin ", filter)
+
+	data, err := p.daoSite.Find(filter)
+
+	log.Println("SiteService::Find:: End ", err)
+	return data, err
+}
+
+// Create - Create Service
+func (p *siteBaseService) Create(indata utils.Map) (utils.Map, error) {
+
+	funcode := p.getServiceModuleCode() + "01"
+
+	log.Println("SiteService::Create - Begin")
+
+	if _, err := utils.GetMemberDataStr(indata, FLD_APP_SITE_NAME); err != nil {
+		err := &utils.AppError{ErrorCode: funcode + "01", ErrorMsg: "Missing value", ErrorDetail: "Parameter " + FLD_APP_SITE_NAME + " is missing"}
+		return indata, err
+	}
+
+	siteId, _ := utils.GetMemberDataStr(indata, FLD_APP_SITE_ID)
+	if siteId == "" {
+		siteId = utils.GenerateUniqueId("site")
+	} else if _, err := p.daoSite.Get(siteId); err == nil {
+		err := &utils.AppError{ErrorCode: funcode + "02", ErrorMsg: "Existing Site ID !", ErrorDetail: "Given " + FLD_APP_SITE_ID + " already exist"}
+		return indata, err
+	}
+
+	indata[FLD_APP_SITE_ID] = siteId
+	indata[platform_common.FLD_BUSINESS_ID] = p.businessID
+
+	dataSite, err := p.daoSite.Create(indata)
+
+	log.Println("SiteService::Create - End ", err)
+	return dataSite, err
+}
+
+// Update - Update Service
+func (p *siteBaseService) Update(site_id string, indata utils.Map) (utils.Map, error) {
+
+	log.Println("SiteService::Update - Begin")
+
+	_, err := p.validateKeyExist(site_id)
+	if err != nil {
+		return nil, err
+	}
+
+	// Remove key and default fields from indata
+	delete(indata, FLD_APP_SITE_ID)
+	delete(indata, platform_common.FLD_BUSINESS_ID)
+
+	data, err := p.daoSite.Update(site_id, indata)
+
+	log.Println("SiteService::Update - End ")
+	return data, err
+}
+
+// Delete - Delete Service
+func (p *siteBaseService) Delete(site_id string, delete_permanent bool) error {
+
+	funcode := p.getServiceModuleCode() + "02"
+
+	log.Println("SiteService::Delete - Begin", site_id)
+
+	_, err := p.validateKeyExist(site_id)
+	if err != nil {
+		return err
+	}
+
+	// Check and delete in one transaction, so no department or grant is added in between
+	err = runInTransaction(&p.DatabaseService, func() error {
+		filter := buildFilter(utils.Map{FLD_APP_SITE_ID: site_id})
+		dataDepts, err := p.daoDepartment.List(filter, "", 0, 0)
+		if err != nil {
+			return err
+		} else if deptCount := countActiveRecords(getListResult(dataDepts)); deptCount > 0 {
+			err := &utils.AppError{ErrorCode: funcode + "01", ErrorMsg: "Site in use", ErrorDetail: "Site has " + strconv.Itoa(deptCount) + " department(s)"}
+			return err
+		}
+
+		grantCount, err := countAccessGrants(p.daoSysAccess, FLD_APP_SITE_ID, site_id)
+		if err != nil {
+			return err
+		} else if grantCount > 0 {
+			err := &utils.AppError{ErrorCode: funcode + "02", ErrorMsg: "Site in use", ErrorDetail: "Site is referenced by " + strconv.Itoa(grantCount) + " access grant(s)"}
+			return err
+		}
+
+		requestCount, err := countOpenAccessRequests(p.daoRequest, FLD_APP_SITE_ID, site_id)
+		if err != nil {
+			return err
+		} else if requestCount > 0 {
+			err := &utils.AppError{ErrorCode: funcode + "03", ErrorMsg: "Site in use", ErrorDetail: "Site is referenced by " + strconv.Itoa(requestCount) + " pending or approved access request(s)"}
+			return err
+		}
+
+		if delete_permanent {
+			result, err := p.daoSite.Delete(site_id)
+			if err != nil {
+				return err
+			}
+			log.Printf("Delete %v", result)
+		} else {
+			indata := utils.Map{db_common.FLD_IS_DELETED: true}
+			data, err := p.Update(site_id, indata)
+			if err != nil {
+				return err
+			}
+			log.Println("Update for Delete Flag", data)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("SiteService::Delete - End")
+	return nil
+}
+
+func (p *siteBaseService) validateKeyExist(key string) (utils.Map, error) {
+	data, err := p.daoSite.Get(key)
+	if err != nil {
+		err := &utils.AppError{ErrorStatus: 400, ErrorMsg: "Bad Request", ErrorDetail: "Site not found"}
+		return utils.Map{}, err
+	}
+	return data, nil
+}
+
+// countAccessGrants - Count the access grants of the business still referencing the site or department
+func countAccessGrants(daoSysAccess platform_repository.SysAccessDao, field string, id string) (int, error) {
+
+	dataGrants, err := daoSysAccess.List(buildFilter(utils.Map{field: id}), "", 0, 0)
+	if err != nil {
+		return 0, err
+	}
+	return countActiveRecords(getListResult(dataGrants)), nil
+}
+
+// countOpenAccessRequests - Count the pending and approved access requests still referencing the site or department
+func countOpenAccessRequests(daoRequest platform_repository.SysAccessRequestDao, field string, id string) (int, error) {
+
+	filter := buildFilter(utils.Map{
+		field:              id,
+		FLD_REQUEST_STATUS: utils.Map{"$in": []string{ACCESS_REQUEST_PENDING, ACCESS_REQUEST_APPROVED}},
+	})
+	dataRequests, err := daoRequest.List(filter, "", 0, 0)
+	if err != nil {
+		return 0, err
+	}
+	return countActiveRecords(getListResult(dataRequests)), nil
+}
+
+// countActiveRecords - Count the records which are not soft deleted
+func countActiveRecords(records []utils.Map) int {
+	count := 0
+	for _, record := range records {
+		if isDeleted, _ := utils.GetMemberDataBool(record, db_common.FLD_IS_DELETED); !isDeleted {
+			count++
+		}
+	}
+	return count
+}
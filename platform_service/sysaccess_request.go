@@ -0,0 +1,387 @@
+package platform_service
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/zapscloud/golib-dbutils/db_common"
+	"github.com/zapscloud/golib-platform-repository/platform_common"
+	"github.com/zapscloud/golib-utils/utils"
+)
+
+// Just-in-time access request fields
+const (
+	FLD_SYS_ACCESS_REQUEST_ID  = "sys_access_request_id"
+	FLD_SYS_ACCESS_EXPIRES_AT  = "expires_at"
+	FLD_REQUEST_STATUS         = "request_status"
+	FLD_REQUEST_JUSTIFICATION  = "justification"
+	FLD_REQUEST_DURATION       = "duration"
+	FLD_REQUEST_APPROVER_ID    = "approver_id"
+	FLD_REQUEST_DECIDED_AT     = "decided_at"
+	FLD_REQUEST_IS_GRANT_OWNED = "is_grant_created"
+	FLD_REQUEST_HISTORY        = "history"
+	FLD_HISTORY_ACTION         = "action"
+	FLD_HISTORY_BY             = "by"
+	FLD_HISTORY_AT             = "at"
+	FLD_HISTORY_COMMENT        = "comment"
+
+	ACCESS_REQUEST_PENDING  = "pending"
+	ACCESS_REQUEST_APPROVED = "approved"
+	ACCESS_REQUEST_REJECTED = "rejected"
+	ACCESS_REQUEST_EXPIRED  = "expired"
+
+	ACCESS_REQUEST_ACTION_REQUESTED = "requested"
+	ACCESS_REQUEST_ACTION_APPROVED  = "approved"
+	ACCESS_REQUEST_ACTION_REJECTED  = "rejected"
+	ACCESS_REQUEST_ACTION_EXPIRED   = "expired"
+
+	// Credential an approver needs in the business, at the requested site/department
+	ACCESS_REQUEST_APPROVE_CREDENTIAL = "sys_access_request:approve"
+
+	ACCESS_REQUEST_SYSTEM_USER = "system"
+)
+
+// ACCESS_REQUEST_MAX_DURATION - Longest elevated access a request may ask for
+const ACCESS_REQUEST_MAX_DURATION = 7 * 24 * time.Hour
+
+// RequestAccess - Ask for a role at a scope for a limited duration. The duration is a Go duration
+// string such as "4h" or a number of minutes, a justification is mandatory.
+func (p *sysAccessBaseService) RequestAccess(indata utils.Map) (utils.Map, error) {
+
+	funcode := p.getServiceModuleCode() + "02"
+
+	log.Println("AccessService::RequestAccess - Begin", indata)
+
+	userId, err := utils.GetMemberDataStr(indata, platform_common.FLD_SYS_USER_ID)
+	if err != nil {
+		return indata, err
+	} else if _, err := p.daoSysUser.Get(userId); err != nil {
+		err := &utils.AppError{ErrorCode: funcode + "01", ErrorMsg: "UserId not found", ErrorDetail: "Given " + platform_common.FLD_SYS_USER_ID + " does not exist"}
+		return indata, err
+	}
+
+	roleId, err := utils.GetMemberDataStr(indata, platform_common.FLD_SYS_ROLE_ID)
+	if err != nil {
+		return indata, err
+	} else if _, err := p.daoSysAccess.GetRoleDetails(roleId); err != nil {
+		err := &utils.AppError{ErrorCode: funcode + "02", ErrorMsg: "RoleId not found", ErrorDetail: "Given " + platform_common.FLD_SYS_ROLE_ID + " does not exist"}
+		return indata, err
+	}
+
+	justification, err := utils.GetMemberDataStr(indata, FLD_REQUEST_JUSTIFICATION)
+	if err != nil || len(strings.TrimSpace(justification)) == 0 {
+		err := &utils.AppError{ErrorCode: funcode + "03", ErrorMsg: "Missing justification", ErrorDetail: "Parameter " + FLD_REQUEST_JUSTIFICATION + " is missing"}
+		return indata, err
+	}
+
+	duration, err := getRequestDuration(indata)
+	if err != nil {
+		return indata, err
+	} else if duration <= 0 || duration > ACCESS_REQUEST_MAX_DURATION {
+		err := &utils.AppError{ErrorCode: funcode + "04", ErrorMsg: "Invalid duration", ErrorDetail: "Requested duration should be more than zero and at most " + ACCESS_REQUEST_MAX_DURATION.String()}
+		return indata, err
+	}
+
+	siteId, _ := utils.GetMemberDataStr(indata, FLD_APP_SITE_ID)
+	deptId, _ := utils.GetMemberDataStr(indata, FLD_APP_DEPT_ID)
+	if err := p.validateGrantScope(siteId, deptId, funcode); err != nil {
+		return indata, err
+	}
+
+	dataRequest := utils.Map{
+		FLD_SYS_ACCESS_REQUEST_ID:       utils.GenerateUniqueId("acreq"),
+		platform_common.FLD_BUSINESS_ID: p.businessID,
+		platform_common.FLD_SYS_USER_ID: userId,
+		platform_common.FLD_SYS_ROLE_ID: roleId,
+		FLD_APP_SITE_ID:                 siteId,
+		FLD_APP_DEPT_ID:                 deptId,
+		FLD_REQUEST_JUSTIFICATION:       justification,
+		FLD_REQUEST_DURATION:            duration.String(),
+		FLD_REQUEST_STATUS:              ACCESS_REQUEST_PENDING,
+		FLD_REQUEST_HISTORY:             []utils.Map{newRequestHistory(ACCESS_REQUEST_ACTION_REQUESTED, userId, justification)},
+	}
+
+	dataRequest, err = p.daoRequest.Create(dataRequest)
+	log.Println("AccessService::RequestAccess - End ", err)
+	return dataRequest, err
+}
+
+// ApproveAccessRequest - Approve a pending request and grant the access until it expires. The grant
+// has an access id of its own, so it never shares a document with a permanent grant or another request.
+func (p *sysAccessBaseService) ApproveAccessRequest(requestId string, approverId string, comment string) (utils.Map, error) {
+
+	log.Println("AccessService::ApproveAccessRequest - Begin", requestId, approverId)
+
+	var dataRes utils.Map
+	err := runInTransaction(&p.DatabaseService, func() error {
+		// Read the request inside the transaction, so a concurrent decision can not be overwritten
+		dataRequest, err := p.validateRequestDecision(requestId, approverId)
+		if err != nil {
+			return err
+		}
+
+		duration, err := getRequestDuration(dataRequest)
+		if err != nil {
+			return err
+		}
+		expiresAt := time.Now().Add(duration)
+
+		accessId := GetElevatedAccessId(requestId)
+		grantData := utils.Map{
+			platform_common.FLD_SYS_ACCESS_ID: accessId,
+			platform_common.FLD_SYS_USER_ID:   dataRequest[platform_common.FLD_SYS_USER_ID],
+			platform_common.FLD_SYS_ROLE_ID:   dataRequest[platform_common.FLD_SYS_ROLE_ID],
+			FLD_APP_SITE_ID:                   dataRequest[FLD_APP_SITE_ID],
+			FLD_APP_DEPT_ID:                   dataRequest[FLD_APP_DEPT_ID],
+			FLD_SYS_ACCESS_EXPIRES_AT:         expiresAt,
+			FLD_SYS_ACCESS_REQUEST_ID:         requestId,
+		}
+		if _, err := p.daoSysAccess.GrantPermission(grantData); err != nil {
+			return err
+		}
+
+		dataUpdate := utils.Map{
+			FLD_REQUEST_STATUS:                ACCESS_REQUEST_APPROVED,
+			FLD_REQUEST_APPROVER_ID:           approverId,
+			FLD_REQUEST_DECIDED_AT:            time.Now(),
+			FLD_SYS_ACCESS_EXPIRES_AT:         expiresAt,
+			FLD_REQUEST_IS_GRANT_OWNED:        true,
+			platform_common.FLD_SYS_ACCESS_ID: accessId,
+			FLD_REQUEST_HISTORY:               appendRequestHistory(dataRequest, ACCESS_REQUEST_ACTION_APPROVED, approverId, comment),
+		}
+		dataRes, err = p.daoRequest.Update(requestId, dataUpdate)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Println("AccessService::ApproveAccessRequest - End ")
+	return dataRes, nil
+}
+
+// RejectAccessRequest - Reject a pending request
+func (p *sysAccessBaseService) RejectAccessRequest(requestId string, approverId string, comment string) (utils.Map, error) {
+
+	log.Println("AccessService::RejectAccessRequest - Begin", requestId, approverId)
+
+	var dataRes utils.Map
+	err := runInTransaction(&p.DatabaseService, func() error {
+		dataRequest, err := p.validateRequestDecision(requestId, approverId)
+		if err != nil {
+			return err
+		}
+
+		dataUpdate := utils.Map{
+			FLD_REQUEST_STATUS:      ACCESS_REQUEST_REJECTED,
+			FLD_REQUEST_APPROVER_ID: approverId,
+			FLD_REQUEST_DECIDED_AT:  time.Now(),
+			FLD_REQUEST_HISTORY:     appendRequestHistory(dataRequest, ACCESS_REQUEST_ACTION_REJECTED, approverId, comment),
+		}
+		dataRes, err = p.daoRequest.Update(requestId, dataUpdate)
+		return err
+	})
+
+	log.Println("AccessService::RejectAccessRequest - End ", err)
+	return dataRes, err
+}
+
+// GetAccessRequest - Get the request with its history
+func (p *sysAccessBaseService) GetAccessRequest(requestId string) (utils.Map, error) {
+	log.Println("AccessService::GetAccessRequest - Begin", requestId)
+
+	data, err := p.daoRequest.Get(requestId)
+
+	log.Println("AccessService::GetAccessRequest - End ", err)
+	return data, err
+}
+
+// ListAccessRequests - List the requests of this business
+func (p *sysAccessBaseService) ListAccessRequests(filter string, sort string, skip int64, limit int64) (utils.Map, error) {
+	log.Println("AccessService::ListAccessRequests - Begin")
+
+	data, err := p.daoRequest.List(filter, sort, skip, limit)
+
+	log.Println("AccessService::ListAccessRequests - End ", err)
+	return data, err
+}
+
+// ExpireElevatedAccess - Revoke the access of approved requests which have expired. Meant to be
+// called periodically, returns the requests that were expired.
+func (p *sysAccessBaseService) ExpireElevatedAccess() (utils.Map, error) {
+
+	log.Println("AccessService::ExpireElevatedAccess - Begin")
+
+	filter := buildFilter(utils.Map{FLD_REQUEST_STATUS: ACCESS_REQUEST_APPROVED})
+	dataRequests, err := p.daoRequest.List(filter, "", 0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	curTime := time.Now()
+	expiredIds := []string{}
+	for _, dataRequest := range getListResult(dataRequests) {
+		expiresAt, err := getMemberDataTime(dataRequest, FLD_SYS_ACCESS_EXPIRES_AT)
+		if err != nil || curTime.Before(expiresAt) {
+			continue
+		}
+		requestId, _ := utils.GetMemberDataStr(dataRequest, FLD_SYS_ACCESS_REQUEST_ID)
+
+		err = runInTransaction(&p.DatabaseService, func() error {
+			// Only revoke the grant while it still belongs to this request, a grant made
+			// permanent in the meantime stays
+			isGrantOwned, _ := utils.GetMemberDataBool(dataRequest, FLD_REQUEST_IS_GRANT_OWNED)
+			accessId, _ := utils.GetMemberDataStr(dataRequest, platform_common.FLD_SYS_ACCESS_ID)
+			if isGrantOwned && accessId != "" {
+				// A failed read keeps the request approved, so it is retried on the next run
+				dataAccess, err := p.daoSysAccess.Get(accessId)
+				if err != nil && !isNotFoundError(err) {
+					return err
+				}
+				grantRequestId, _ := utils.GetMemberDataStr(dataAccess, FLD_SYS_ACCESS_REQUEST_ID)
+				if err == nil && grantRequestId == requestId {
+					if _, err := p.daoSysAccess.RevokePermission(accessId); err != nil {
+						return err
+					}
+				}
+			}
+
+			dataUpdate := utils.Map{
+				FLD_REQUEST_STATUS:  ACCESS_REQUEST_EXPIRED,
+				FLD_REQUEST_HISTORY: appendRequestHistory(dataRequest, ACCESS_REQUEST_ACTION_EXPIRED, ACCESS_REQUEST_SYSTEM_USER, ""),
+			}
+			_, err := p.daoRequest.Update(requestId, dataUpdate)
+			return err
+		})
+		if err != nil {
+			log.Println("ExpireElevatedAccess:: Unable to expire request ", requestId, err)
+			continue
+		}
+		expiredIds = append(expiredIds, requestId)
+	}
+
+	response := utils.Map{
+		db_common.LIST_RESULTSIZE: len(expiredIds),
+		db_common.LIST_RESULT:     expiredIds,
+	}
+
+	log.Println("AccessService::ExpireElevatedAccess - End ", expiredIds)
+	return response, nil
+}
+
+// validateRequestDecision - The request should be pending and the approver should be another user
+// whose access grants at the requested site/department give the approve credential. Called inside
+// the transaction which stores the decision.
+func (p *sysAccessBaseService) validateRequestDecision(requestId string, approverId string) (utils.Map, error) {
+
+	funcode := p.getServiceModuleCode() + "03"
+
+	dataRequest, err := p.daoRequest.Get(requestId)
+	if err != nil {
+		return nil, err
+	}
+
+	status, _ := utils.GetMemberDataStr(dataRequest, FLD_REQUEST_STATUS)
+	if status != ACCESS_REQUEST_PENDING {
+		err := &utils.AppError{ErrorCode: funcode + "01", ErrorMsg: "Request not pending", ErrorDetail: "Access request is already " + status}
+		return nil, err
+	}
+
+	userId, _ := utils.GetMemberDataStr(dataRequest, platform_common.FLD_SYS_USER_ID)
+	if userId == approverId {
+		err := &utils.AppError{ErrorCode: funcode + "02", ErrorMsg: "Invalid approver", ErrorDetail: "Users cannot decide their own access requests"}
+		return nil, err
+	}
+
+	attributes := utils.Map{
+		platform_common.FLD_BUSINESS_ID: p.businessID,
+		FLD_APP_SITE_ID:                 dataRequest[FLD_APP_SITE_ID],
+		FLD_APP_DEPT_ID:                 dataRequest[FLD_APP_DEPT_ID],
+		COND_ATTR_TIME:                  time.Now(),
+	}
+	siteId, _ := utils.GetMemberDataStr(dataRequest, FLD_APP_SITE_ID)
+	deptId, _ := utils.GetMemberDataStr(dataRequest, FLD_APP_DEPT_ID)
+	dataCheck, err := p.checkScopedCredential(approverId, siteId, deptId, ACCESS_REQUEST_APPROVE_CREDENTIAL, attributes)
+	if err != nil {
+		return nil, err
+	}
+	if isAllowed, _ := utils.GetMemberDataBool(dataCheck, CREDENTIAL_RESULT_ALLOWED); !isAllowed {
+		err := &utils.AppError{ErrorCode: funcode + "03", ErrorMsg: "Not permitted", ErrorDetail: "Approver needs the " + ACCESS_REQUEST_APPROVE_CREDENTIAL + " credential at the requested site and department"}
+		return nil, err
+	}
+
+	return dataRequest, nil
+}
+
+// checkScopedCredential - Evaluate the credential against the roles the user is granted at the site
+// and department, business-wide grants included
+func (p *sysAccessBaseService) checkScopedCredential(userId string, siteId string, deptId string, credential string, attributes utils.Map) (utils.Map, error) {
+
+	if err := ValidateCredential(credential); err != nil {
+		return nil, err
+	}
+
+	dataAccess, err := p.ResolveUserAccess(userId, siteId, deptId)
+	if err != nil {
+		return nil, err
+	}
+
+	grantedCreds := []utils.Map{}
+	for _, roleId := range getStringList(dataAccess[FLD_SYS_ACCESS_ROLES]) {
+		dataCreds, err := getEffectiveCredentials(p.daoSysRole, sysRoleFields, roleId)
+		if err != nil {
+			log.Println("checkScopedCredential:: Unable to get credentials of role ", roleId, err)
+			return nil, err
+		}
+		grantedCreds = append(grantedCreds, getListResult(dataCreds)...)
+	}
+
+	response := evaluateGrantedCredentials(grantedCreds, sysRoleFields, credential, attributes)
+	response[platform_common.FLD_SYS_USER_ID] = userId
+	return response, nil
+}
+
+// isElevatedGrant - Whether the grant was created by an approved access request
+func isElevatedGrant(dataAccess utils.Map) bool {
+	requestId, _ := utils.GetMemberDataStr(dataAccess, FLD_SYS_ACCESS_REQUEST_ID)
+	return requestId != ""
+}
+
+// GetElevatedAccessId - Access id of the grant created by the access request
+func GetElevatedAccessId(requestId string) string {
+	return utils.GenerateChecksumId("aces", "request="+requestId)
+}
+
+// getRequestDuration - Read the duration as a Go duration string or a number of minutes
+func getRequestDuration(dataRequest utils.Map) (time.Duration, error) {
+
+	if strDuration, err := utils.GetMemberDataStr(dataRequest, FLD_REQUEST_DURATION); err == nil {
+		duration, err := time.ParseDuration(strDuration)
+		if err != nil {
+			err := &utils.AppError{ErrorStatus: 400, ErrorMsg: "Invalid duration", ErrorDetail: FLD_REQUEST_DURATION + " should be a duration such as 30m or 4h"}
+			return 0, err
+		}
+		return duration, nil
+	}
+
+	minutes, err := utils.GetMemberDataInt(dataRequest, FLD_REQUEST_DURATION, true)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(minutes) * time.Minute, nil
+}
+
+func newRequestHistory(action string, by string, comment string) utils.Map {
+	return utils.Map{
+		FLD_HISTORY_ACTION:  action,
+		FLD_HISTORY_BY:      by,
+		FLD_HISTORY_AT:      time.Now(),
+		FLD_HISTORY_COMMENT: comment,
+	}
+}
+
+func appendRequestHistory(dataRequest utils.Map, action string, by string, comment string) []utils.Map {
+	history := getMapList(dataRequest[FLD_REQUEST_HISTORY])
+	return append(history, newRequestHistory(action, by, comment))
+}
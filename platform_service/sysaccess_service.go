@@ -3,13 +3,46 @@ package platform_service
 import (
 	"fmt"
 	"log"
+	"strings"
+	"time"
 
+	"github.com/zapscloud/golib-dbutils/db_common"
 	"github.com/zapscloud/golib-dbutils/db_utils"
 	"github.com/zapscloud/golib-platform-repository/platform_common"
 	"github.com/zapscloud/golib-platform-repository/platform_repository"
 	"github.com/zapscloud/golib-utils/utils"
 )
 
+// Access grant scope fields
+const (
+	FLD_APP_SITE_ID = "app_site_id"
+	FLD_APP_DEPT_ID = "app_dept_id"
+
+	FLD_SYS_ACCESS_SCOPE = "access_scope"
+	FLD_SYS_ACCESS_ROLES = "roles"
+
+	ACCESS_SCOPE_DEPARTMENT = "department"
+	ACCESS_SCOPE_SITE       = "site"
+	ACCESS_SCOPE_BUSINESS   = "business"
+
+	// Bulk operation results
+	FLD_BULK_INDEX     = "index"
+	FLD_BULK_OPERATION = "operation"
+	FLD_BULK_STATUS    = "status"
+	FLD_BULK_ERROR     = "error"
+	FLD_BULK_SUCCEEDED = "is_succeeded"
+
+	BULK_OPERATION_GRANT   = "grant"
+	BULK_OPERATION_REVOKE  = "revoke"
+	BULK_STATUS_GRANTED    = "granted"
+	BULK_STATUS_EXISTING   = "existing"
+	BULK_STATUS_REVOKED    = "revoked"
+	BULK_STATUS_FAILED     = "failed"
+	BULK_STATUS_SKIPPED    = "skipped"
+	BULK_STATUS_ROLLEDBACK = "rolled_back"
+	BULK_STATUS_NOTAPPLIED = "not_applied"
+)
+
 // AccessService - Accesss Service structure
 type SysAccessService interface {
 	List(filter string, sort string, skip int64, limit int64) (utils.Map, error)
@@ -18,6 +51,24 @@ type SysAccessService interface {
 	GrantPermission(indata utils.Map) (utils.Map, error)
 	RevokePermission(access_id string) (int64, error)
 
+	// Apply all grants and revocations in one transaction, nothing is applied if any item fails
+	BulkUpdatePermissions(grants []utils.Map, revokeIds []string) (utils.Map, error)
+	RevokeAllForUser(userId string) (int64, error)
+	RevokeAllForRole(roleId string) (int64, error)
+
+	// Grants of the user which apply at the site/department, falling back to business-wide grants
+	ResolveUserAccess(userId string, siteId string, deptId string) (utils.Map, error)
+	// Users and their roles which apply at the site/department
+	GetSiteAccess(siteId string, deptId string) (utils.Map, error)
+
+	// Just-in-time elevated access
+	RequestAccess(indata utils.Map) (utils.Map, error)
+	ApproveAccessRequest(requestId string, approverId string, comment string) (utils.Map, error)
+	RejectAccessRequest(requestId string, approverId string, comment string) (utils.Map, error)
+	GetAccessRequest(requestId string) (utils.Map, error)
+	ListAccessRequests(filter string, sort string, skip int64, limit int64) (utils.Map, error)
+	ExpireElevatedAccess() (utils.Map, error)
+
 	BeginTransaction()
 	CommitTransaction()
 	RollbackTransaction()
@@ -29,8 +80,11 @@ type sysAccessBaseService struct {
 	db_utils.DatabaseService
 	daoSysAccess platform_repository.SysAccessDao
 	daoSysUser   platform_repository.SysUserDao
+	daoSysRole   platform_repository.SysRoleDao
+	daoRequest   platform_repository.SysAccessRequestDao
 	daoAppUser   platform_repository.AppUserDao
 	daoBusiness  platform_repository.BusinessDao
+	daoDept      platform_repository.DepartmentDao
 	child        SysAccessService
 	businessID   string
 }
@@ -63,8 +117,11 @@ func NewSysAccessService(props utils.Map) (SysAccessService, error) {
 
 	p.daoSysAccess = platform_repository.NewSysAccessDao(p.GetClient(), p.businessID)
 	p.daoSysUser = platform_repository.NewSysUserDao(p.GetClient())
+	p.daoSysRole = platform_repository.NewSysRoleDao(p.GetClient())
+	p.daoRequest = platform_repository.NewSysAccessRequestDao(p.GetClient(), p.businessID)
 	p.daoAppUser = platform_repository.NewAppUserDao(p.GetClient())
 	p.daoBusiness = platform_repository.NewBusinessDao(p.GetClient())
+	p.daoDept = platform_repository.NewDepartmentDao(p.GetClient(), p.businessID)
 
 	_, err = p.daoBusiness.Get(businessId)
 	if err != nil {
@@ -119,70 +176,151 @@ func (p *sysAccessBaseService) Find(filter string) (utils.Map, error) {
 	return data, err
 }
 
-// Update - Update Service
+// GrantPermission - Grant the role to the user at the optional site and department. The access id
+// is derived from the user, role, site and department, so granting the same combination again
+// returns the existing grant.
 func (p *sysAccessBaseService) GrantPermission(indata utils.Map) (utils.Map, error) {
 
+	log.Println("AccessService::GrantPermission - Begin")
+
+	dataAccess, _, err := p.grantPermission(indata)
+
+	log.Println("AccessService::GrantPermission - End ")
+	return dataAccess, err
+}
+
+// grantPermission - Validate and store the grant, reports whether the grant already existed
+func (p *sysAccessBaseService) grantPermission(indata utils.Map) (utils.Map, bool, error) {
+
 	funcode := p.getServiceModuleCode() + "01"
 
-	log.Println("AccessService::Update - Begin")
-
-	access_key := ""
-	if valUserId, okUserId := indata[platform_common.FLD_SYS_USER_ID]; !okUserId {
-		log.Println("GrantPermission: UserId not found  ", valUserId)
-		err := &utils.AppError{ErrorCode: funcode + "01", ErrorMsg: "UserId not found ", ErrorDetail: "UserId not found "}
-		return indata, err
-	} else if _, err := p.daoSysUser.Get(valUserId.(string)); err != nil {
-		log.Println("GrantPermission: UserId not found  ", valUserId)
-		err := &utils.AppError{ErrorCode: funcode + "02", ErrorMsg: "UserId not found ", ErrorDetail: "UserId not found "}
-		return indata, err
-	} else {
-		access_key += valUserId.(string)
-	}
-
-	if valRoleId, okRoleId := indata[platform_common.FLD_SYS_ROLE_ID]; !okRoleId {
-		log.Println("GrantPermission: Missing RoleId ", valRoleId)
-		err := &utils.AppError{ErrorCode: funcode + "03", ErrorMsg: "Missing RoleId ", ErrorDetail: "Missing RoleId "}
-		return indata, err
-
-	} else if _, err := p.daoSysAccess.GetRoleDetails(valRoleId.(string)); err != nil {
-		log.Println("GrantPermission: RoleId not found  ", valRoleId)
-		err := &utils.AppError{ErrorCode: funcode + "04", ErrorMsg: "UserId not found ", ErrorDetail: "UserId not found "}
-		return indata, err
-	}
-
-	if valSiteId, okSiteId := indata["app_site_id"]; !okSiteId {
-		// Ignore Site Id Field
-		access_key = "-" + access_key
-	} else if _, err := p.daoSysAccess.GetSiteDetails(valSiteId.(string)); err != nil {
-		log.Println("GrantPermission: RoleId not found  ", valSiteId)
-		err := &utils.AppError{ErrorCode: funcode + "04", ErrorMsg: "UserId not found ", ErrorDetail: "UserId not found "}
-		return indata, err
-	} else {
-		access_key += valSiteId.(string)
-	}
-
-	if valDeptId, okDeptId := indata["app_dept_id"]; !okDeptId {
-		// Ignore Department ID
-		access_key = "-" + access_key
-	} else if _, err := p.daoSysAccess.GetDepartmentDetails(valDeptId.(string)); err != nil {
-		log.Println("GrantPermission: RoleId not found  ", valDeptId)
-		err := &utils.AppError{ErrorCode: funcode + "04", ErrorMsg: "UserId not found ", ErrorDetail: "UserId not found "}
-		return indata, err
-	} else {
-		access_key += valDeptId.(string)
-	}
-
-	access_id := utils.GenerateChecksumId("aces", access_key)
-	dataAccess, err := p.daoSysAccess.Get(access_id)
+	userId, err := utils.GetMemberDataStr(indata, platform_common.FLD_SYS_USER_ID)
+	if err != nil {
+		log.Println("GrantPermission: Missing UserId ", err)
+		err := &utils.AppError{ErrorCode: funcode + "01", ErrorMsg: "Missing UserId", ErrorDetail: "Parameter " + platform_common.FLD_SYS_USER_ID + " is missing"}
+		return indata, false, err
+	} else if _, err := p.daoSysUser.Get(userId); err != nil {
+		log.Println("GrantPermission: UserId not found ", userId)
+		err := &utils.AppError{ErrorCode: funcode + "02", ErrorMsg: "UserId not found", ErrorDetail: "Given " + platform_common.FLD_SYS_USER_ID + " does not exist"}
+		return indata, false, err
+	}
+
+	roleId, err := utils.GetMemberDataStr(indata, platform_common.FLD_SYS_ROLE_ID)
 	if err != nil {
-		return dataAccess, err
+		log.Println("GrantPermission: Missing RoleId ", err)
+		err := &utils.AppError{ErrorCode: funcode + "03", ErrorMsg: "Missing RoleId", ErrorDetail: "Parameter " + platform_common.FLD_SYS_ROLE_ID + " is missing"}
+		return indata, false, err
+	} else if _, err := p.daoSysAccess.GetRoleDetails(roleId); err != nil {
+		log.Println("GrantPermission: RoleId not found ", roleId)
+		err := &utils.AppError{ErrorCode: funcode + "04", ErrorMsg: "RoleId not found", ErrorDetail: "Given " + platform_common.FLD_SYS_ROLE_ID + " does not exist"}
+		return indata, false, err
+	}
+
+	// Site and department are optional, an empty value means the grant is not scoped by it
+	siteId, _ := utils.GetMemberDataStr(indata, FLD_APP_SITE_ID)
+	deptId, _ := utils.GetMemberDataStr(indata, FLD_APP_DEPT_ID)
+	if err := p.validateGrantScope(siteId, deptId, funcode); err != nil {
+		return indata, false, err
 	}
 
-	indata[platform_common.FLD_SYS_ACCESS_ID] = access_id
+	accessId := GetSysAccessId(userId, roleId, siteId, deptId)
+
+	// Granting the same combination again is not an error. A revoked grant kept at the id is
+	// absent, it is stored again below and no longer marked deleted.
+	dataAccess, err := p.daoSysAccess.Get(accessId)
+	if isDeleted, _ := utils.GetMemberDataBool(dataAccess, db_common.FLD_IS_DELETED); err == nil && isDeleted {
+		log.Println("AccessService::GrantPermission - Restoring revoked grant ", accessId)
+	} else if err == nil && !isElevatedGrant(dataAccess) {
+		log.Println("AccessService::GrantPermission - Existing grant ", accessId)
+		return dataAccess, true, nil
+	} else if err == nil {
+		// Elevated grants approved before they had their own id share the id of the permanent
+		// grant. Replace it, so it does not expire, its request only revokes grants it owns.
+		log.Println("AccessService::GrantPermission - Replacing elevated grant ", accessId)
+		if _, err := p.daoSysAccess.RevokePermission(accessId); err != nil {
+			return indata, false, err
+		}
+	}
+
+	// Grants from before the deterministic ids keep the random id they were created with
+	dataAccess, found, err := p.findSysAccessByKey(userId, roleId, siteId, deptId)
+	if err != nil {
+		return indata, false, err
+	} else if found {
+		log.Println("AccessService::GrantPermission - Existing grant ", dataAccess[platform_common.FLD_SYS_ACCESS_ID])
+		return dataAccess, true, nil
+	}
+
+	indata[platform_common.FLD_SYS_ACCESS_ID] = accessId
+	indata[FLD_APP_SITE_ID] = siteId
+	indata[FLD_APP_DEPT_ID] = deptId
+	indata[db_common.FLD_IS_DELETED] = false
+	// Only approved access requests create grants which expire
+	delete(indata, FLD_SYS_ACCESS_EXPIRES_AT)
+	delete(indata, FLD_SYS_ACCESS_REQUEST_ID)
 
 	dataAccess, err = p.daoSysAccess.GrantPermission(indata)
-	log.Println("AccessService::Update - End ")
-	return dataAccess, err
+	return dataAccess, false, err
+}
+
+// findSysAccessByKey - Find the grant of the user, role, site and department whatever its access id
+func (p *sysAccessBaseService) findSysAccessByKey(userId string, roleId string, siteId string, deptId string) (utils.Map, bool, error) {
+
+	scopeValue := func(value string) interface{} {
+		if value == "" {
+			// Older grants have no site or department field at all
+			return utils.Map{"$in": []interface{}{"", nil}}
+		}
+		return value
+	}
+
+	filter := buildFilter(utils.Map{
+		platform_common.FLD_SYS_USER_ID: userId,
+		platform_common.FLD_SYS_ROLE_ID: roleId,
+		FLD_APP_SITE_ID:                 scopeValue(siteId),
+		FLD_APP_DEPT_ID:                 scopeValue(deptId),
+	})
+	dataGrants, err := p.daoSysAccess.List(filter, "", 0, 0)
+	if err != nil {
+		return nil, false, err
+	}
+
+	for _, grant := range getListResult(dataGrants) {
+		if isDeleted, _ := utils.GetMemberDataBool(grant, db_common.FLD_IS_DELETED); !isDeleted && !isElevatedGrant(grant) {
+			return grant, true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+// validateGrantScope - The site and department should exist and the department belong to the site
+func (p *sysAccessBaseService) validateGrantScope(siteId string, deptId string, funcode string) error {
+
+	if siteId != "" {
+		if _, err := p.daoSysAccess.GetSiteDetails(siteId); err != nil {
+			log.Println("validateGrantScope: SiteId not found ", siteId)
+			err := &utils.AppError{ErrorCode: funcode + "05", ErrorMsg: "SiteId not found", ErrorDetail: "Given " + FLD_APP_SITE_ID + " does not exist"}
+			return err
+		}
+	}
+
+	if deptId != "" {
+		dataDept, err := p.daoSysAccess.GetDepartmentDetails(deptId)
+		if err != nil {
+			log.Println("validateGrantScope: DeptId not found ", deptId)
+			err := &utils.AppError{ErrorCode: funcode + "06", ErrorMsg: "DeptId not found", ErrorDetail: "Given " + FLD_APP_DEPT_ID + " does not exist"}
+			return err
+		}
+
+		// The department should belong to the granted site
+		deptSiteId, _ := utils.GetMemberDataStr(dataDept, FLD_APP_SITE_ID)
+		if siteId != "" && deptSiteId != "" && deptSiteId != siteId {
+			log.Println("validateGrantScope: DeptId not in site ", deptId, siteId)
+			err := &utils.AppError{ErrorCode: funcode + "07", ErrorMsg: "DeptId not in site", ErrorDetail: "Given " + FLD_APP_DEPT_ID + " does not belong to the given " + FLD_APP_SITE_ID}
+			return err
+		}
+	}
+	return nil
 }
 
 // RevokePermission - RevokePermission Service
@@ -199,3 +337,301 @@ func (p *sysAccessBaseService) RevokePermission(access_id string) (int64, error)
 	log.Printf("UserService::Delete - End %v", result)
 	return result, nil
 }
+
+// BulkUpdatePermissions - Apply the grants and revocations in a single transaction. Every item gets
+// a result; when any item fails the transaction is rolled back, the items done before it are reported
+// rolled_back and the remaining items skipped. Within a transaction of the caller the items done are
+// reported not_applied, rolling back is then up to the caller.
+func (p *sysAccessBaseService) BulkUpdatePermissions(grants []utils.Map, revokeIds []string) (utils.Map, error) {
+
+	log.Println("AccessService::BulkUpdatePermissions - Begin", len(grants), len(revokeIds))
+
+	results := []utils.Map{}
+	for idx := range grants {
+		results = append(results, utils.Map{FLD_BULK_INDEX: idx, FLD_BULK_OPERATION: BULK_OPERATION_GRANT, FLD_BULK_STATUS: BULK_STATUS_SKIPPED})
+	}
+	for idx, accessId := range revokeIds {
+		results = append(results, utils.Map{FLD_BULK_INDEX: idx, FLD_BULK_OPERATION: BULK_OPERATION_REVOKE, FLD_BULK_STATUS: BULK_STATUS_SKIPPED,
+			platform_common.FLD_SYS_ACCESS_ID: accessId})
+	}
+
+	// Joined to the caller's transaction, the caller decides whether it is rolled back
+	isJoined := isInTransaction(&p.DatabaseService)
+	err := runInTransaction(&p.DatabaseService, func() error {
+		for idx, indata := range grants {
+			result := results[idx]
+
+			dataAccess, isExisting, err := p.grantPermission(indata)
+			if err != nil {
+				result[FLD_BULK_STATUS] = BULK_STATUS_FAILED
+				result[FLD_BULK_ERROR] = err.Error()
+				return err
+			}
+
+			result[platform_common.FLD_SYS_ACCESS_ID] = dataAccess[platform_common.FLD_SYS_ACCESS_ID]
+			result[FLD_BULK_STATUS] = BULK_STATUS_GRANTED
+			if isExisting {
+				result[FLD_BULK_STATUS] = BULK_STATUS_EXISTING
+			}
+		}
+
+		for idx, accessId := range revokeIds {
+			result := results[len(grants)+idx]
+
+			if _, err := p.daoSysAccess.RevokePermission(accessId); err != nil {
+				result[FLD_BULK_STATUS] = BULK_STATUS_FAILED
+				result[FLD_BULK_ERROR] = err.Error()
+				return err
+			}
+			result[FLD_BULK_STATUS] = BULK_STATUS_REVOKED
+		}
+		return nil
+	})
+	if err != nil {
+		undoneStatus := BULK_STATUS_ROLLEDBACK
+		if isJoined {
+			undoneStatus = BULK_STATUS_NOTAPPLIED
+		}
+		for _, result := range results {
+			switch result[FLD_BULK_STATUS] {
+			case BULK_STATUS_GRANTED, BULK_STATUS_EXISTING, BULK_STATUS_REVOKED:
+				result[FLD_BULK_STATUS] = undoneStatus
+			}
+		}
+	}
+
+	response := utils.Map{
+		FLD_BULK_SUCCEEDED:        err == nil,
+		db_common.LIST_RESULTSIZE: len(results),
+		db_common.LIST_RESULT:     results,
+	}
+
+	log.Println("AccessService::BulkUpdatePermissions - End ", err)
+	return response, err
+}
+
+// RevokeAllForUser - Revoke every grant of the user in this business
+func (p *sysAccessBaseService) RevokeAllForUser(userId string) (int64, error) {
+
+	log.Println("AccessService::RevokeAllForUser - Begin", userId)
+
+	filter := buildFilter(utils.Map{platform_common.FLD_SYS_USER_ID: userId})
+	result, err := p.revokeAll(filter)
+
+	log.Println("AccessService::RevokeAllForUser - End ", result, err)
+	return result, err
+}
+
+// RevokeAllForRole - Revoke every grant of the role in this business
+func (p *sysAccessBaseService) RevokeAllForRole(roleId string) (int64, error) {
+
+	log.Println("AccessService::RevokeAllForRole - Begin", roleId)
+
+	filter := buildFilter(utils.Map{platform_common.FLD_SYS_ROLE_ID: roleId})
+	result, err := p.revokeAll(filter)
+
+	log.Println("AccessService::RevokeAllForRole - End ", result, err)
+	return result, err
+}
+
+// revokeAll - Revoke the grants matching the filter in one transaction
+func (p *sysAccessBaseService) revokeAll(filter string) (int64, error) {
+
+	var revoked int64
+	err := runInTransaction(&p.DatabaseService, func() error {
+		// List inside the transaction, so a grant added meanwhile is not left behind
+		dataGrants, err := p.daoSysAccess.List(filter, "", 0, 0)
+		if err != nil {
+			return err
+		}
+
+		for _, grant := range getListResult(dataGrants) {
+			accessId, err := utils.GetMemberDataStr(grant, platform_common.FLD_SYS_ACCESS_ID)
+			if err != nil {
+				continue
+			}
+
+			result, err := p.daoSysAccess.RevokePermission(accessId)
+			if err != nil {
+				return err
+			}
+			revoked += result
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return revoked, nil
+}
+
+// ResolveUserAccess - Resolve the grants of the user at the given site and department. Department
+// grants, site grants and business-wide grants all apply, each grant is tagged with its scope.
+func (p *sysAccessBaseService) ResolveUserAccess(userId string, siteId string, deptId string) (utils.Map, error) {
+
+	log.Println("AccessService::ResolveUserAccess - Begin", userId, siteId, deptId)
+
+	filter := buildFilter(utils.Map{platform_common.FLD_SYS_USER_ID: userId})
+	dataGrants, err := p.daoSysAccess.List(filter, "", 0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	grants := filterScopedGrants(getListResult(dataGrants), siteId, deptId)
+
+	roleIds := []string{}
+	roleFound := map[string]bool{}
+	for _, grant := range grants {
+		roleId, _ := utils.GetMemberDataStr(grant, platform_common.FLD_SYS_ROLE_ID)
+		if !roleFound[roleId] {
+			roleFound[roleId] = true
+			roleIds = append(roleIds, roleId)
+		}
+	}
+
+	response := utils.Map{
+		platform_common.FLD_SYS_USER_ID: userId,
+		FLD_APP_SITE_ID:                 siteId,
+		FLD_APP_DEPT_ID:                 deptId,
+		FLD_SYS_ACCESS_ROLES:            roleIds,
+		db_common.LIST_RESULTSIZE:       len(grants),
+		db_common.LIST_RESULT:           grants,
+	}
+
+	log.Println("AccessService::ResolveUserAccess - End ", response)
+	return response, nil
+}
+
+// GetSiteAccess - List the users who can act on the given site and department with the roles
+// they hold there, including business-wide grants
+func (p *sysAccessBaseService) GetSiteAccess(siteId string, deptId string) (utils.Map, error) {
+
+	log.Println("AccessService::GetSiteAccess - Begin", siteId, deptId)
+
+	funcode := p.getServiceModuleCode() + "04"
+
+	// Site grants apply to a department of the site, so take the site from the department
+	if deptId != "" {
+		dataDept, err := p.daoDept.Get(deptId)
+		if err != nil {
+			return nil, err
+		}
+		deptSiteId, _ := utils.GetMemberDataStr(dataDept, FLD_APP_SITE_ID)
+		if siteId != "" && deptSiteId != "" && deptSiteId != siteId {
+			err := &utils.AppError{ErrorCode: funcode + "01", ErrorMsg: "DeptId not in site", ErrorDetail: "Given " + FLD_APP_DEPT_ID + " does not belong to the given " + FLD_APP_SITE_ID}
+			return nil, err
+		}
+		if siteId == "" {
+			siteId = deptSiteId
+		}
+	}
+
+	// Only the grants which can apply are read, older grants have no site or department field at all
+	scopeValues := func(value string) utils.Map {
+		values := []interface{}{"", nil}
+		if value != "" {
+			values = append(values, value)
+		}
+		return utils.Map{"$in": values}
+	}
+	filter := buildFilter(utils.Map{
+		FLD_APP_SITE_ID: scopeValues(siteId),
+		FLD_APP_DEPT_ID: scopeValues(deptId),
+	})
+	dataGrants, err := p.daoSysAccess.List(filter, "", 0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	grants := filterScopedGrants(getListResult(dataGrants), siteId, deptId)
+
+	userIds := []string{}
+	userGrants := map[string][]utils.Map{}
+	for _, grant := range grants {
+		userId, _ := utils.GetMemberDataStr(grant, platform_common.FLD_SYS_USER_ID)
+		if _, found := userGrants[userId]; !found {
+			userIds = append(userIds, userId)
+		}
+		userGrants[userId] = append(userGrants[userId], utils.Map{
+			platform_common.FLD_SYS_ROLE_ID:   grant[platform_common.FLD_SYS_ROLE_ID],
+			platform_common.FLD_SYS_ACCESS_ID: grant[platform_common.FLD_SYS_ACCESS_ID],
+			FLD_SYS_ACCESS_SCOPE:              grant[FLD_SYS_ACCESS_SCOPE],
+		})
+	}
+
+	users := []utils.Map{}
+	for _, userId := range userIds {
+		users = append(users, utils.Map{
+			platform_common.FLD_SYS_USER_ID: userId,
+			FLD_SYS_ACCESS_ROLES:            userGrants[userId],
+		})
+	}
+
+	response := utils.Map{
+		FLD_APP_SITE_ID:           siteId,
+		FLD_APP_DEPT_ID:           deptId,
+		db_common.LIST_RESULTSIZE: len(users),
+		db_common.LIST_RESULT:     users,
+	}
+
+	log.Println("AccessService::GetSiteAccess - End ")
+	return response, nil
+}
+
+// filterScopedGrants - Keep the grants which apply at the site and department and tag each with
+// the scope it matched. Ordered from the most specific scope to business-wide.
+func filterScopedGrants(grants []utils.Map, siteId string, deptId string) []utils.Map {
+
+	curTime := time.Now()
+	scopedGrants := map[string][]utils.Map{}
+	for _, grant := range grants {
+		isDeleted, _ := utils.GetMemberDataBool(grant, db_common.FLD_IS_DELETED)
+		if isDeleted {
+			continue
+		}
+
+		// Elevated grants stop applying once they expire, even before they are revoked
+		if expiresAt, err := getMemberDataTime(grant, FLD_SYS_ACCESS_EXPIRES_AT); err == nil && !curTime.Before(expiresAt) {
+			continue
+		}
+
+		grantSiteId, _ := utils.GetMemberDataStr(grant, FLD_APP_SITE_ID)
+		grantDeptId, _ := utils.GetMemberDataStr(grant, FLD_APP_DEPT_ID)
+
+		scope := ""
+		switch {
+		case grantDeptId != "":
+			if deptId != "" && grantDeptId == deptId && (grantSiteId == "" || siteId == "" || grantSiteId == siteId) {
+				scope = ACCESS_SCOPE_DEPARTMENT
+			}
+		case grantSiteId != "":
+			if siteId != "" && grantSiteId == siteId {
+				scope = ACCESS_SCOPE_SITE
+			}
+		default:
+			scope = ACCESS_SCOPE_BUSINESS
+		}
+
+		if scope != "" {
+			grant[FLD_SYS_ACCESS_SCOPE] = scope
+			scopedGrants[scope] = append(scopedGrants[scope], grant)
+		}
+	}
+
+	result := []utils.Map{}
+	for _, scope := range []string{ACCESS_SCOPE_DEPARTMENT, ACCESS_SCOPE_SITE, ACCESS_SCOPE_BUSINESS} {
+		result = append(result, scopedGrants[scope]...)
+	}
+	return result
+}
+
+// GetSysAccessKey - Composite key of a grant. Every part keeps its position so that an empty
+// site or department can never be confused with another combination.
+func GetSysAccessKey(userId string, roleId string, siteId string, deptId string) string {
+	return strings.Join([]string{"user=" + userId, "role=" + roleId, "site=" + siteId, "dept=" + deptId}, "|")
+}
+
+// GetSysAccessId - Deterministic access id of a grant
+func GetSysAccessId(userId string, roleId string, siteId string, deptId string) string {
+	return utils.GenerateChecksumId("aces", GetSysAccessKey(userId, roleId, siteId, deptId))
+}
@@ -0,0 +1,334 @@
+package platform_service
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/zapscloud/golib-dbutils/db_common"
+	"github.com/zapscloud/golib-platform-repository/platform_common"
+	"github.com/zapscloud/golib-platform-repository/platform_repository"
+	"github.com/zapscloud/golib-utils/utils"
+)
+
+// matchFakeFilter - Match a record against a JSON filter of plain values, $in and $exists
+func matchFakeFilter(record utils.Map, filter string) bool {
+
+	dataFilter := utils.Map{}
+	if filter != "" {
+		if err := json.Unmarshal([]byte(filter), &dataFilter); err != nil {
+			return false
+		}
+	}
+
+	for key, want := range dataFilter {
+		value, found := record[key]
+		wantOps, isOps := want.(map[string]interface{})
+		switch {
+		case isOps && wantOps["$in"] != nil:
+			isIn := false
+			for _, item := range wantOps["$in"].([]interface{}) {
+				if (item == nil && (!found || value == nil)) || (item != nil && found && fmt.Sprint(item) == fmt.Sprint(value)) {
+					isIn = true
+				}
+			}
+			if !isIn {
+				return false
+			}
+		case isOps && wantOps["$exists"] != nil:
+			if found != wantOps["$exists"].(bool) {
+				return false
+			}
+		case !found || fmt.Sprint(value) != fmt.Sprint(want):
+			return false
+		}
+	}
+	return true
+}
+
+// fakeSysAccessDao - In-memory grants, the embedded interface panics on calls not faked here
+type fakeSysAccessDao struct {
+	platform_repository.SysAccessDao
+	grants map[string]utils.Map
+}
+
+func (d *fakeSysAccessDao) List(filter string, sort string, skip int64, limit int64) (utils.Map, error) {
+	records := []utils.Map{}
+	for _, grant := range d.grants {
+		if matchFakeFilter(grant, filter) {
+			records = append(records, grant)
+		}
+	}
+	return listResult(records), nil
+}
+
+func (d *fakeSysAccessDao) Get(id string) (utils.Map, error) {
+	if grant, found := d.grants[id]; found {
+		return grant, nil
+	}
+	return nil, errFakeNotFound
+}
+
+func (d *fakeSysAccessDao) GetRoleDetails(id string) (utils.Map, error) {
+	return utils.Map{sysRoleFields.RoleId: id}, nil
+}
+
+func (d *fakeSysAccessDao) GetSiteDetails(id string) (utils.Map, error) {
+	return utils.Map{FLD_APP_SITE_ID: id}, nil
+}
+
+func (d *fakeSysAccessDao) GetDepartmentDetails(id string) (utils.Map, error) {
+	return utils.Map{FLD_APP_DEPT_ID: id}, nil
+}
+
+func (d *fakeSysAccessDao) GrantPermission(indata utils.Map) (utils.Map, error) {
+	accessId := indata[platform_common.FLD_SYS_ACCESS_ID].(string)
+	d.grants[accessId] = utils.CopyMap(indata)
+	return d.grants[accessId], nil
+}
+
+func (d *fakeSysAccessDao) RevokePermission(id string) (int64, error) {
+	if _, found := d.grants[id]; !found {
+		return 0, errFakeNotFound
+	}
+	delete(d.grants, id)
+	return 1, nil
+}
+
+// fakeSysUserDao - Every user exists
+type fakeSysUserDao struct {
+	platform_repository.SysUserDao
+}
+
+func (d *fakeSysUserDao) Get(id string) (utils.Map, error) {
+	return utils.Map{platform_common.FLD_SYS_USER_ID: id}, nil
+}
+
+// fakeDepartmentDao - Departments and the site they belong to
+type fakeDepartmentDao struct {
+	platform_repository.DepartmentDao
+	deptSites map[string]string
+}
+
+func (d *fakeDepartmentDao) Get(id string) (utils.Map, error) {
+	if siteId, found := d.deptSites[id]; found {
+		return utils.Map{FLD_APP_DEPT_ID: id, FLD_APP_SITE_ID: siteId}, nil
+	}
+	return nil, errFakeNotFound
+}
+
+func TestGetSysAccessKey(t *testing.T) {
+
+	// Every combination of given and empty user, role, site and department
+	keys := map[string]string{}
+	ids := map[string]string{}
+	for mask := 0; mask < 16; mask++ {
+		part := func(bit int, value string) string {
+			if mask&(1<<bit) != 0 {
+				return value
+			}
+			return ""
+		}
+		userId, roleId, siteId, deptId := part(0, "u1"), part(1, "r1"), part(2, "s1"), part(3, "d1")
+		combination := fmt.Sprintf("user=%q role=%q site=%q dept=%q", userId, roleId, siteId, deptId)
+
+		t.Run(combination, func(t *testing.T) {
+			key := GetSysAccessKey(userId, roleId, siteId, deptId)
+			if other, found := keys[key]; found {
+				t.Errorf("GetSysAccessKey() = %q for both %s and %s", key, combination, other)
+			}
+			keys[key] = combination
+
+			accessId := GetSysAccessId(userId, roleId, siteId, deptId)
+			if accessId != GetSysAccessId(userId, roleId, siteId, deptId) {
+				t.Errorf("GetSysAccessId() is not deterministic for %s", combination)
+			}
+			if other, found := ids[accessId]; found {
+				t.Errorf("GetSysAccessId() = %q for both %s and %s", accessId, combination, other)
+			}
+			ids[accessId] = combination
+		})
+	}
+
+	// The same value in another position gives another key
+	tests := []struct {
+		name  string
+		left  [4]string
+		right [4]string
+	}{
+		{"site or department", [4]string{"u1", "r1", "x", ""}, [4]string{"u1", "r1", "", "x"}},
+		{"user or role", [4]string{"x", "", "s1", "d1"}, [4]string{"", "x", "s1", "d1"}},
+		{"swapped ids", [4]string{"u1", "r1", "s1", "d1"}, [4]string{"r1", "u1", "d1", "s1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if GetSysAccessId(tt.left[0], tt.left[1], tt.left[2], tt.left[3]) == GetSysAccessId(tt.right[0], tt.right[1], tt.right[2], tt.right[3]) {
+				t.Errorf("GetSysAccessId(%v) == GetSysAccessId(%v)", tt.left, tt.right)
+			}
+		})
+	}
+}
+
+func TestGrantPermissionIdempotent(t *testing.T) {
+
+	grant := func(userId string, roleId string, siteId string, deptId string) utils.Map {
+		return utils.Map{
+			platform_common.FLD_SYS_USER_ID: userId,
+			platform_common.FLD_SYS_ROLE_ID: roleId,
+			FLD_APP_SITE_ID:                 siteId,
+			FLD_APP_DEPT_ID:                 deptId,
+		}
+	}
+
+	// A grant stored before the deterministic ids, without site and department fields
+	legacyGrant := utils.Map{
+		platform_common.FLD_SYS_ACCESS_ID: "aces_legacy",
+		platform_common.FLD_SYS_USER_ID:   "u2",
+		platform_common.FLD_SYS_ROLE_ID:   "r1",
+	}
+
+	tests := []struct {
+		name         string
+		indata       utils.Map
+		wantAccessId string
+		wantExisting bool
+	}{
+		{"new grant", grant("u1", "r1", "s1", ""), GetSysAccessId("u1", "r1", "s1", ""), false},
+		{"same grant again", grant("u1", "r1", "s1", ""), GetSysAccessId("u1", "r1", "s1", ""), true},
+		{"other department", grant("u1", "r1", "s1", "d1"), GetSysAccessId("u1", "r1", "s1", "d1"), false},
+		{"business-wide", grant("u1", "r1", "", ""), GetSysAccessId("u1", "r1", "", ""), false},
+		{"legacy grant", grant("u2", "r1", "", ""), "aces_legacy", true},
+		{"legacy user at a site", grant("u2", "r1", "s1", ""), GetSysAccessId("u2", "r1", "s1", ""), false},
+	}
+
+	daoSysAccess := &fakeSysAccessDao{grants: map[string]utils.Map{"aces_legacy": legacyGrant}}
+	p := &sysAccessBaseService{daoSysAccess: daoSysAccess, daoSysUser: &fakeSysUserDao{}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dataAccess, isExisting, err := p.grantPermission(utils.CopyMap(tt.indata))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if accessId := dataAccess[platform_common.FLD_SYS_ACCESS_ID]; accessId != tt.wantAccessId || isExisting != tt.wantExisting {
+				t.Errorf("grantPermission() = %v, %v, want %v, %v", accessId, isExisting, tt.wantAccessId, tt.wantExisting)
+			}
+		})
+	}
+
+	if len(daoSysAccess.grants) != 5 {
+		t.Errorf("stored %d grants, want 5", len(daoSysAccess.grants))
+	}
+
+	// A revoked grant left at its id is granted again
+	revokedId := GetSysAccessId("u1", "r1", "s1", "")
+	daoSysAccess.grants[revokedId][db_common.FLD_IS_DELETED] = true
+	dataAccess, isExisting, err := p.grantPermission(grant("u1", "r1", "s1", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isDeleted, _ := utils.GetMemberDataBool(daoSysAccess.grants[revokedId], db_common.FLD_IS_DELETED); isExisting || isDeleted || dataAccess[platform_common.FLD_SYS_ACCESS_ID] != revokedId {
+		t.Errorf("grantPermission() of a revoked grant = %v, %v, want it stored again", dataAccess, isExisting)
+	}
+}
+
+func TestGrantPermissionElevated(t *testing.T) {
+
+	permanentId := GetSysAccessId("u1", "r1", "s1", "")
+	elevatedId := GetElevatedAccessId("req_1")
+	if permanentId == elevatedId {
+		t.Fatalf("GetElevatedAccessId() = GetSysAccessId() = %q", elevatedId)
+	}
+
+	// A grant left by an access request approved before the elevated ids
+	legacyElevated := utils.Map{
+		platform_common.FLD_SYS_ACCESS_ID: permanentId,
+		platform_common.FLD_SYS_USER_ID:   "u1",
+		platform_common.FLD_SYS_ROLE_ID:   "r1",
+		FLD_APP_SITE_ID:                   "s1",
+		FLD_APP_DEPT_ID:                   "",
+		FLD_SYS_ACCESS_REQUEST_ID:         "req_0",
+	}
+	daoSysAccess := &fakeSysAccessDao{grants: map[string]utils.Map{permanentId: legacyElevated}}
+	p := &sysAccessBaseService{daoSysAccess: daoSysAccess, daoSysUser: &fakeSysUserDao{}}
+
+	dataAccess, isExisting, err := p.grantPermission(utils.Map{
+		platform_common.FLD_SYS_USER_ID: "u1",
+		platform_common.FLD_SYS_ROLE_ID: "r1",
+		FLD_APP_SITE_ID:                 "s1",
+		FLD_SYS_ACCESS_REQUEST_ID:       "req_2",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isExisting || isElevatedGrant(dataAccess) {
+		t.Errorf("grantPermission() = %v, existing %v, want a new permanent grant", dataAccess, isExisting)
+	}
+	if isElevatedGrant(daoSysAccess.grants[permanentId]) {
+		t.Errorf("grant %q is still elevated", permanentId)
+	}
+}
+
+func TestGetSiteAccess(t *testing.T) {
+
+	grant := func(userId string, siteId string, deptId string) utils.Map {
+		dataGrant := utils.Map{
+			platform_common.FLD_SYS_ACCESS_ID: GetSysAccessId(userId, "r1", siteId, deptId),
+			platform_common.FLD_SYS_USER_ID:   userId,
+			platform_common.FLD_SYS_ROLE_ID:   "r1",
+		}
+		if siteId != "" {
+			dataGrant[FLD_APP_SITE_ID] = siteId
+		}
+		if deptId != "" {
+			dataGrant[FLD_APP_DEPT_ID] = deptId
+		}
+		return dataGrant
+	}
+
+	daoSysAccess := &fakeSysAccessDao{grants: map[string]utils.Map{}}
+	for _, dataGrant := range []utils.Map{
+		grant("u_business", "", ""),
+		grant("u_site", "s1", ""),
+		grant("u_dept", "s1", "d1"),
+		grant("u_other_site", "s2", ""),
+		grant("u_other_dept", "s1", "d2"),
+	} {
+		daoSysAccess.grants[dataGrant[platform_common.FLD_SYS_ACCESS_ID].(string)] = dataGrant
+	}
+	p := &sysAccessBaseService{daoSysAccess: daoSysAccess, daoDept: &fakeDepartmentDao{deptSites: map[string]string{"d1": "s1", "d3": "s2"}}}
+
+	tests := []struct {
+		name      string
+		siteId    string
+		deptId    string
+		wantUsers []string
+		wantErr   bool
+	}{
+		{"business", "", "", []string{"u_business"}, false},
+		{"site", "s1", "", []string{"u_site", "u_business"}, false},
+		{"department", "s1", "d1", []string{"u_dept", "u_site", "u_business"}, false},
+		{"department without its site", "", "d1", []string{"u_dept", "u_site", "u_business"}, false},
+		{"department of another site", "s1", "d3", nil, true},
+		{"unknown department", "", "d9", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response, err := p.GetSiteAccess(tt.siteId, tt.deptId)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetSiteAccess() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			userIds := []string{}
+			for _, user := range getListResult(response) {
+				userIds = append(userIds, user[platform_common.FLD_SYS_USER_ID].(string))
+			}
+			if fmt.Sprint(userIds) != fmt.Sprint(tt.wantUsers) {
+				t.Errorf("GetSiteAccess() users = %v, want %v", userIds, tt.wantUsers)
+			}
+		})
+	}
+}
@@ -4,8 +4,10 @@ import (
 	"fmt"
 	"log"
 	"strings"
+	"time"
 
 	"github.com/rs/xid"
+	"github.com/zapscloud/golib-dbutils/db_common"
 	"github.com/zapscloud/golib-dbutils/db_utils"
 	"github.com/zapscloud/golib-platform-repository/platform_common"
 	"github.com/zapscloud/golib-platform-repository/platform_repository"
@@ -19,15 +21,26 @@ type SysRoleService interface {
 	Find(filter string) (utils.Map, error)
 	Create(indata utils.Map) (utils.Map, error)
 	Update(role_id string, indata utils.Map) (utils.Map, error)
-	Delete(role_id string) error
+	Delete(role_id string, cascade bool) (utils.Map, error)
 
 	AddCredentials(role_id string, indata utils.Map) (utils.Map, error)
 	GetCredentials(role_id string) (utils.Map, error)
+	// Credentials of the role together with those inherited from its parent roles
+	GetEffectiveCredentials(role_id string) (utils.Map, error)
 	FindCredential(filter string) (utils.Map, error)
+	CheckCredential(role_id string, credential string, attributes utils.Map) (utils.Map, error)
+	RemoveCredentials(role_id string, credentials []string) (int64, error)
+	ReplaceCredentials(role_id string, credentials []utils.Map) (utils.Map, error)
 
 	AddUsers(role_id string, indata utils.Map) (utils.Map, error)
 	FindUser(filter string) (utils.Map, error)
 	GetUsers(rold_id string) (utils.Map, error)
+	RemoveUsers(role_id string, user_ids []string) (int64, error)
+	GetExpiringUsers(within time.Duration) (utils.Map, error)
+	CheckUserCredential(user_id string, credential string, attributes utils.Map) (utils.Map, error)
+
+	ExportPolicy(role_ids []string, with_users bool, format string) ([]byte, error)
+	ImportPolicy(document []byte, format string, confirm bool) (utils.Map, error)
 
 	BeginTransaction()
 	CommitTransaction()
@@ -38,8 +51,9 @@ type SysRoleService interface {
 
 type sysRoleBaseService struct {
 	db_utils.DatabaseService
-	daoSysRole platform_repository.SysRoleDao
-	child      SysRoleService
+	daoSysRole  platform_repository.SysRoleDao
+	daoBusiness platform_repository.BusinessDao
+	child       SysRoleService
 }
 
 func init() {
@@ -57,6 +71,7 @@ func NewSysRoleService(props utils.Map) (SysRoleService, error) {
 
 	log.Printf("sysRoleMongoService ")
 	p.daoSysRole = platform_repository.NewSysRoleDao(p.GetClient())
+	p.daoBusiness = platform_repository.NewBusinessDao(p.GetClient())
 	p.child = &p
 
 	return &p, nil
@@ -67,6 +82,10 @@ func (p *sysRoleBaseService) EndService() {
 	p.CloseDatabaseService()
 }
 
+func (p *sysRoleBaseService) getServiceModuleCode() string {
+	return platform_common.GetServiceModuleCode() + "08"
+}
+
 // List - List All records
 func (p *sysRoleBaseService) List(filter string, sort string, skip int64, limit int64) (utils.Map, error) {
 
@@ -120,6 +139,12 @@ func (p *sysRoleBaseService) Create(indata utils.Map) (utils.Map, error) {
 	// Update converted/generated id back to indata
 	indata[platform_common.FLD_SYS_ROLE_ID] = sysRoleId
 
+	// Validate the parent roles if any given
+	err := p.validateParents(sysRoleId, indata)
+	if err != nil {
+		return indata, err
+	}
+
 	dataCreated, err := p.daoSysRole.Create(indata)
 	if err != nil {
 		return indata, err
@@ -136,24 +161,77 @@ func (p *sysRoleBaseService) Update(role_id string, indata utils.Map) (utils.Map
 	// Delete the Key fields
 	delete(indata, platform_common.FLD_SYS_ROLE_ID)
 
+	// Validate the parent roles if they are changed
+	err := p.validateParents(role_id, indata)
+	if err != nil {
+		return indata, err
+	}
+
 	data, err := p.daoSysRole.Update(role_id, indata)
 
 	log.Println("UserService::Update - End ")
 	return data, err
 }
 
-// Delete - Delete Service
-func (p *sysRoleBaseService) Delete(role_id string) error {
+// Delete - Delete Service. Refused while the role is still in use unless cascade is set,
+// the returned summary lists what was removed along with the role.
+func (p *sysRoleBaseService) Delete(role_id string, cascade bool) (utils.Map, error) {
 
-	log.Println("UserService::Delete - Begin", role_id)
+	log.Println("UserService::Delete - Begin", role_id, cascade)
 
-	result, err := p.daoSysRole.Delete(role_id)
+	funcode := p.getServiceModuleCode() + "02"
+
+	result, err := deleteRole(&p.DatabaseService, p.daoSysRole, p, sysRoleFields, role_id, cascade, funcode)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	log.Printf("UserService::Delete - End %v", result)
-	return nil
+	return result, nil
+}
+
+// listRoleGrants - SysAccess grants of the role. Grants are kept per business, so every business is looked at.
+func (p *sysRoleBaseService) listRoleGrants(roleId string) ([]utils.Map, error) {
+
+	dataBusinesses, err := p.daoBusiness.List("", "", 0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	grants := []utils.Map{}
+	filter := buildFilter(utils.Map{platform_common.FLD_SYS_ROLE_ID: roleId})
+	for _, business := range getListResult(dataBusinesses) {
+		businessId, err := utils.GetMemberDataStr(business, platform_common.FLD_BUSINESS_ID)
+		if err != nil {
+			continue
+		}
+
+		dataGrants, err := platform_repository.NewSysAccessDao(p.GetClient(), businessId).List(filter, "", 0, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, grant := range getListResult(dataGrants) {
+			if isDeleted, _ := utils.GetMemberDataBool(grant, db_common.FLD_IS_DELETED); isDeleted {
+				continue
+			}
+			grant[platform_common.FLD_BUSINESS_ID] = businessId
+			grants = append(grants, grant)
+		}
+	}
+	return grants, nil
+}
+
+// revokeRoleGrant - Revoke a grant returned by listRoleGrants
+func (p *sysRoleBaseService) revokeRoleGrant(grant utils.Map) error {
+
+	businessId, _ := utils.GetMemberDataStr(grant, platform_common.FLD_BUSINESS_ID)
+	accessId, err := utils.GetMemberDataStr(grant, platform_common.FLD_SYS_ACCESS_ID)
+	if err != nil {
+		return err
+	}
+
+	_, err = platform_repository.NewSysAccessDao(p.GetClient(), businessId).RevokePermission(accessId)
+	return err
 }
 
 // Create - Create Service
@@ -163,6 +241,11 @@ func (p *sysRoleBaseService) AddCredentials(role_id string, indata utils.Map) (u
 
 	log.Println("Provided Role ID:", role_id, indata)
 
+	err := normalizeRoleCredential(indata, sysRoleFields)
+	if err != nil {
+		return indata, err
+	}
+
 	dataRes, err := p.daoSysRole.AddCredentials(role_id, indata)
 	if err != nil {
 		return indata, err
@@ -171,14 +254,15 @@ func (p *sysRoleBaseService) AddCredentials(role_id string, indata utils.Map) (u
 	return dataRes, nil
 }
 
-// Check Credentails - Get Credentail by given role and credentail
+// FindCredential - Get the credential of the role which grants the credential given in the filter,
+// matched over the inherited credentials. A conditional grant or a deny means it is not found.
 func (p *sysRoleBaseService) FindCredential(filter string) (utils.Map, error) {
 
 	log.Println("AddCredentials::Add - Begin")
 
 	log.Println("Provided Role ID:", filter)
 
-	dataRes, err := p.daoSysRole.FindCredential(filter)
+	dataRes, err := findRoleCredential(p.daoSysRole, sysRoleFields, filter)
 	if err != nil {
 		return nil, err
 	}
@@ -201,6 +285,111 @@ func (p *sysRoleBaseService) GetCredentials(rold_id string) (utils.Map, error) {
 	return dataRes, nil
 }
 
+// GetEffectiveCredentials - Get the credentials of the role and the ones inherited from its parent roles,
+// each tagged with the role it came from
+func (p *sysRoleBaseService) GetEffectiveCredentials(role_id string) (utils.Map, error) {
+
+	log.Println("GetEffectiveCredentials::Get - Begin")
+
+	log.Println("Provided Role ID:", role_id)
+
+	dataCreds, err := getEffectiveCredentials(p.daoSysRole, sysRoleFields, role_id)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("GetEffectiveCredentials::Get - End ")
+	return dataCreds, nil
+}
+
+// CheckCredential - Check whether the role grants the credential, honouring wildcards,
+// explicit denies, inherited credentials and credential conditions on the request attributes
+func (p *sysRoleBaseService) CheckCredential(role_id string, credential string, attributes utils.Map) (utils.Map, error) {
+
+	log.Println("CheckCredential::Check - Begin")
+
+	log.Println("Provided Role ID:", role_id, credential, attributes)
+
+	dataRes, err := checkRoleCredential(p.daoSysRole, sysRoleFields, role_id, credential, attributes)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("CheckCredential::Check - End ", dataRes)
+	return dataRes, nil
+}
+
+// RemoveCredentials - Remove the given credentials from the role
+func (p *sysRoleBaseService) RemoveCredentials(role_id string, credentials []string) (int64, error) {
+
+	log.Println("RemoveCredentials::Remove - Begin")
+
+	log.Println("Provided Role ID:", role_id, credentials)
+
+	_, err := p.daoSysRole.Get(role_id)
+	if err != nil {
+		return 0, err
+	}
+
+	for idx, credential := range credentials {
+		credentials[idx] = NormalizeCredential(credential)
+	}
+
+	result, err := p.daoSysRole.RemoveCredentials(role_id, credentials)
+	if err != nil {
+		return result, err
+	}
+	log.Println("RemoveCredentials::Remove - End ", result)
+	return result, nil
+}
+
+// ReplaceCredentials - Set the full list of credentials of the role in one transaction
+func (p *sysRoleBaseService) ReplaceCredentials(role_id string, credentials []utils.Map) (utils.Map, error) {
+
+	log.Println("ReplaceCredentials::Replace - Begin")
+
+	log.Println("Provided Role ID:", role_id, credentials)
+
+	_, err := p.daoSysRole.Get(role_id)
+	if err != nil {
+		return nil, err
+	}
+
+	// Every credential should carry a valid name
+	for _, cred := range credentials {
+		if err := normalizeRoleCredential(cred, sysRoleFields); err != nil {
+			return nil, err
+		}
+	}
+
+	err = runInTransaction(&p.DatabaseService, func() error {
+		dataCreds, err := p.daoSysRole.GetCredentials(role_id)
+		if err != nil {
+			log.Println("ReplaceCredentials:: No existing credentials ", err)
+		}
+
+		credsAdd, credsRemove := diffRoleCredentials(getListResult(dataCreds), credentials, sysRoleFields)
+		if len(credsRemove) > 0 {
+			_, err = p.daoSysRole.RemoveCredentials(role_id, credsRemove)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, cred := range credsAdd {
+			_, err = p.daoSysRole.AddCredentials(role_id, cred)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Println("ReplaceCredentials::Replace - End ")
+	return p.daoSysRole.GetCredentials(role_id)
+}
+
 // Create - Create Service
 func (p *sysRoleBaseService) AddUsers(role_id string, indata utils.Map) (utils.Map, error) {
 
@@ -208,6 +397,12 @@ func (p *sysRoleBaseService) AddUsers(role_id string, indata utils.Map) (utils.M
 
 	log.Println("Provided Role ID:", role_id, indata)
 
+	// Validate the optional valid_from and valid_until of the assignment
+	err := normalizeRoleAssignment(indata)
+	if err != nil {
+		return indata, err
+	}
+
 	dataRes, err := p.daoSysRole.AddUsers(role_id, indata)
 	if err != nil {
 		return indata, err
@@ -216,14 +411,15 @@ func (p *sysRoleBaseService) AddUsers(role_id string, indata utils.Map) (utils.M
 	return dataRes, nil
 }
 
-// Check Credentails - Get Credentail by given role and credentail
+// FindUser - Find the role assignment matching the filter, expired or not yet valid
+// assignments are not found
 func (p *sysRoleBaseService) FindUser(filter string) (utils.Map, error) {
 
 	log.Println("FindUser::Add - Begin")
 
 	log.Println("Provided Role ID:", filter)
 
-	dataRes, err := p.daoSysRole.FindUser(filter)
+	dataRes, err := findRoleAssignment(p.daoSysRole, filter)
 	if err != nil {
 		return nil, err
 	}
@@ -243,5 +439,102 @@ func (p *sysRoleBaseService) GetUsers(rold_id string) (utils.Map, error) {
 		return nil, err
 	}
 	log.Println("GetUsers::Get - End ")
+	return markRoleAssignments(dataRes), nil
+}
+
+// RemoveUsers - Unassign the given users from the role
+func (p *sysRoleBaseService) RemoveUsers(role_id string, user_ids []string) (int64, error) {
+
+	log.Println("RemoveUsers::Remove - Begin")
+
+	log.Println("Provided Role ID:", role_id, user_ids)
+
+	_, err := p.daoSysRole.Get(role_id)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := p.daoSysRole.RemoveUsers(role_id, user_ids)
+	if err != nil {
+		return result, err
+	}
+	log.Println("RemoveUsers::Remove - End ", result)
+	return result, nil
+}
+
+// GetExpiringUsers - List the role assignments which expire within the given duration
+func (p *sysRoleBaseService) GetExpiringUsers(within time.Duration) (utils.Map, error) {
+
+	log.Println("GetExpiringUsers::Get - Begin", within)
+
+	dataRes, err := getExpiringRoleAssignments(p.daoSysRole, within)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("GetExpiringUsers::Get - End ")
 	return dataRes, nil
 }
+
+// CheckUserCredential - Check the credential against the roles currently assigned to the user,
+// ignoring assignments which are expired or not yet active. Conditions are evaluated on attributes.
+func (p *sysRoleBaseService) CheckUserCredential(user_id string, credential string, attributes utils.Map) (utils.Map, error) {
+
+	log.Println("CheckUserCredential::Check - Begin")
+
+	log.Println("Provided User ID:", user_id, credential, attributes)
+
+	dataRes, err := checkUserCredential(p.daoSysRole, sysRoleFields, user_id, credential, attributes)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("CheckUserCredential::Check - End ", dataRes)
+	return dataRes, nil
+}
+
+// ExportPolicy - Export the roles with their credentials, and optionally their users, as a
+// versioned json or yaml document. All roles are exported when role_ids is empty.
+func (p *sysRoleBaseService) ExportPolicy(role_ids []string, with_users bool, format string) ([]byte, error) {
+
+	log.Println("ExportPolicy::Export - Begin", role_ids, with_users, format)
+
+	document, err := exportRolePolicy(p.daoSysRole, sysRoleFields, role_ids, with_users, format)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("ExportPolicy::Export - End ")
+	return document, nil
+}
+
+// ImportPolicy - Compare the policy document with the stored roles and return the difference.
+// The difference is applied in one transaction only when confirm is set.
+func (p *sysRoleBaseService) ImportPolicy(document []byte, format string, confirm bool) (utils.Map, error) {
+
+	log.Println("ImportPolicy::Import - Begin", format, confirm)
+
+	funcode := p.getServiceModuleCode() + "03"
+
+	dataRes, err := importRolePolicy(&p.DatabaseService, p.daoSysRole, sysRoleFields, document, format, confirm, funcode)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("ImportPolicy::Import - End ", dataRes)
+	return dataRes, nil
+}
+
+// validateParents - Normalize the parent role ids in indata and check them for cycles
+func (p *sysRoleBaseService) validateParents(role_id string, indata utils.Map) error {
+	funcode := p.getServiceModuleCode() + "01"
+
+	dataVal, dataOk := indata[sysRoleFields.ParentIds]
+	if !dataOk {
+		return nil
+	}
+
+	parentIds := []string{}
+	for _, parentId := range getStringList(dataVal) {
+		parentIds = append(parentIds, strings.ToLower(parentId))
+	}
+	indata[sysRoleFields.ParentIds] = parentIds
+
+	return validateRoleParents(p.daoSysRole, sysRoleFields, role_id, parentIds, funcode)
+}